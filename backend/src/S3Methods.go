@@ -6,11 +6,13 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 var (
@@ -147,6 +149,26 @@ func uploadBytes(ctx context.Context, client *s3.Client, bucketName string, byte
 	return putObjectOutput, nil
 }
 
+// Copies the object srcObjKey to dstObjKey inside the bucket without downloading it.
+// The objKeys are not escaped, they must only contain URL safe characters like the IDs used for the objKeys.
+func copyFile(ctx context.Context, client *s3.Client, bucketName, srcObjKey, dstObjKey string) (*s3.CopyObjectOutput, error) {
+	if client == nil {
+		return nil, errS3ClientUndefined
+	}
+
+	copyObjectOutput, err := client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(bucketName),
+		CopySource: aws.String(bucketName + "/" + srcObjKey),
+		Key:        aws.String(dstObjKey),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return copyObjectOutput, nil
+}
+
 // Deletes the file with the specified objKey from S3
 func deleteFile(ctx context.Context, client *s3.Client, bucketName, objKey string) (*s3.DeleteObjectOutput, error) {
 	if client == nil {
@@ -163,4 +185,88 @@ func deleteFile(ctx context.Context, client *s3.Client, bucketName, objKey strin
 	}
 
 	return putObjectOutput, nil
-}
\ No newline at end of file
+}
+
+// Calls fn with every object in the bucket, one page at a time
+func listObjects(ctx context.Context, client *s3.Client, bucketName string, fn func(objects []types.Object) error) error {
+	if client == nil {
+		return errS3ClientUndefined
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucketName),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = fn(page.Contents)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Like getFile, but only gets byteRange when it is not empty, e.g. "bytes=0-65535".
+// ifNoneMatch and ifModifiedSince are sent to S3 when they are set. If the object didn't change, S3 answers with a 304 that is returned as an error, see s3StatusCode.
+// ifMatch is sent when it is set. If the object has another ETag, S3 answers with a 412.
+func getFileRange(ctx context.Context, client *s3.Client, bucketName, objKey, byteRange, ifMatch, ifNoneMatch string, ifModifiedSince *time.Time) (*s3.GetObjectOutput, error) {
+	if client == nil {
+		return nil, errS3ClientUndefined
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket:          aws.String(bucketName),
+		Key:             aws.String(objKey),
+		IfModifiedSince: ifModifiedSince,
+	}
+
+	if byteRange != "" {
+		input.Range = aws.String(byteRange)
+	}
+
+	if ifMatch != "" {
+		input.IfMatch = aws.String(ifMatch)
+	}
+
+	if ifNoneMatch != "" {
+		input.IfNoneMatch = aws.String(ifNoneMatch)
+	}
+
+	getObjectOutput, err := client.GetObject(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("getObjectOutput error, %w", err)
+	}
+
+	return getObjectOutput, nil
+}
+
+// Gets the metadata of an object without its content, e.g. its size and ETag
+func getFileInfo(ctx context.Context, client *s3.Client, bucketName, objKey string) (*s3.HeadObjectOutput, error) {
+	if client == nil {
+		return nil, errS3ClientUndefined
+	}
+
+	headObjectOutput, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(objKey),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("headObjectOutput error, %w", err)
+	}
+
+	return headObjectOutput, nil
+}
+
+// Returns the HTTP status code of an error returned by S3, or 0 if the request didn't get a response
+func s3StatusCode(err error) int {
+	var responseError interface{ HTTPStatusCode() int }
+	if errors.As(err, &responseError) {
+		return responseError.HTTPStatusCode()
+	}
+	return 0
+}
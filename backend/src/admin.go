@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// Decodes the AdminRequest, verifies the token and checks that the user is an admin. If it returns false, the response was already sent
+func bindAdminRequest(c *gin.Context, name string) (AdminRequest, bool) {
+	var request AdminRequest
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return request, false
+	}
+
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Errorf("[%s] Failed to decode JSON", name)
+		return request, false
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Errorf("[%s] Failed to verify token", name)
+		return request, false
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return request, false
+	}
+
+	admin, err := isAdmin(c, request.UserID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Errorf("[%s] Failed to get the user's role", name)
+		return request, false
+	}
+
+	if !admin {
+		c.JSON(403, gin.H{"success": false, "error": "Only admins can do this"})
+		return request, false
+	}
+
+	return request, true
+}
+
+// Returns true if the user has the admin role
+func isAdmin(ctx context.Context, userID string) (bool, error) {
+	var roleID string
+	err := db.QueryRowContext(ctx, "SELECT roleID FROM users WHERE userID = ?", userID).Scan(&roleID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return roleID == AdminRoleID, nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+)
+
+func TestIsAdmin(t *testing.T) {
+	useFakeDB(t, fakeResponse{match: "SELECT roleID FROM users", columns: []string{"roleID"}, rows: [][]driver.Value{{"admin"}}})
+	admin, err := isAdmin(context.Background(), "admin")
+	if err != nil || !admin {
+		t.Errorf("isAdmin(admin) = %v, %v", admin, err)
+	}
+
+	useFakeDB(t, fakeResponse{match: "SELECT roleID FROM users", columns: []string{"roleID"}, rows: [][]driver.Value{{"user"}}})
+	admin, err = isAdmin(context.Background(), "testUser")
+	if err != nil || admin {
+		t.Errorf("isAdmin(testUser) = %v, %v", admin, err)
+	}
+
+	// A user that doesn't exist
+	useFakeDB(t)
+	admin, err = isAdmin(context.Background(), "deletedUser")
+	if err != nil || admin {
+		t.Errorf("isAdmin(deletedUser) = %v, %v", admin, err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// The data doesn't start with a valid age header
+	errInvalidAgeHeader error = errors.New("invalid age header")
+	// The uploaded data is not encrypted for the expected recipients
+	errWrongRecipients error = errors.New("the data is not encrypted for the expected recipients")
+)
+
+const (
+	// The first line of every age v1 file
+	AgeVersionLine = "age-encryption.org/v1"
+	// The maximum size of an age header that is parsed, to avoid reading a whole file when it is not age
+	MaxAgeHeaderSize = 1 << 20
+	// The number of base64 characters in a full stanza body line
+	ageColumnsPerLine = 64
+)
+
+// A recipient stanza from an age header. E.g. "-> X25519 <ephemeral share>" followed by the wrapped file key
+type AgeStanza struct {
+	Type string
+	Args []string
+	Body []byte
+}
+
+// Parses the header of an age v1 file and returns its recipient stanzas.
+// Only the header is read, the payload after the MAC line is ignored. The MAC is not verified since that needs the file key.
+// https://github.com/C2SP/C2SP/blob/main/age.md
+func parseAgeHeader(r io.Reader) ([]AgeStanza, error) {
+	reader := bufio.NewReader(io.LimitReader(r, MaxAgeHeaderSize))
+
+	line, err := readAgeHeaderLine(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if line != AgeVersionLine {
+		return nil, fmt.Errorf("%w: unsupported version line", errInvalidAgeHeader)
+	}
+
+	stanzas := []AgeStanza{}
+	line, err = readAgeHeaderLine(reader)
+	for err == nil {
+		if strings.HasPrefix(line, "--- ") {
+			mac, err := base64.RawStdEncoding.Strict().DecodeString(strings.TrimPrefix(line, "--- "))
+			if err != nil || len(mac) != 32 {
+				return nil, fmt.Errorf("%w: invalid MAC", errInvalidAgeHeader)
+			}
+
+			if len(stanzas) == 0 {
+				return nil, fmt.Errorf("%w: no recipient stanzas", errInvalidAgeHeader)
+			}
+			return stanzas, nil
+		}
+
+		if !strings.HasPrefix(line, "-> ") {
+			return nil, fmt.Errorf("%w: unexpected line", errInvalidAgeHeader)
+		}
+
+		fields := strings.Split(strings.TrimPrefix(line, "-> "), " ")
+		for _, field := range fields {
+			if field == "" {
+				return nil, fmt.Errorf("%w: empty stanza argument", errInvalidAgeHeader)
+			}
+		}
+
+		stanza := AgeStanza{Type: fields[0], Args: fields[1:]}
+
+		// The body ends with the first line that is shorter than a full line, which can be empty
+		for {
+			line, err = readAgeHeaderLine(reader)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(line) > ageColumnsPerLine {
+				return nil, fmt.Errorf("%w: stanza body line is too long", errInvalidAgeHeader)
+			}
+
+			body, err := base64.RawStdEncoding.Strict().DecodeString(line)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid stanza body", errInvalidAgeHeader)
+			}
+			stanza.Body = append(stanza.Body, body...)
+
+			if len(line) < ageColumnsPerLine {
+				break
+			}
+		}
+
+		stanzas = append(stanzas, stanza)
+		line, err = readAgeHeaderLine(reader)
+	}
+
+	return nil, err
+}
+
+// Reads a line that ends with '\n' and returns it without the newline
+func readAgeHeaderLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("%w: unexpected end of header", errInvalidAgeHeader)
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+// Returns the number of stanzas of the type, e.g. "X25519"
+func countAgeStanzas(stanzas []AgeStanza, stanzaType string) int {
+	count := 0
+	for _, stanza := range stanzas {
+		if stanza.Type == stanzaType {
+			count++
+		}
+	}
+	return count
+}
+
+// Checks that r starts with a valid age header with one stanza of the right type for each expected public key.
+// This is not a full recipient match: an X25519 stanza only has an ephemeral share, so the server can only count them and can't tell which key each one is for.
+// SSH stanzas start with a tag of their key, so those are matched with the expected keys.
+func checkAgeRecipients(r io.Reader, publicKeys []string) error {
+	stanzas, err := parseAgeHeader(r)
+	if err != nil {
+		return err
+	}
+
+	expected := map[string]int{KeyTypeX25519: 0, KeyTypeSSHEd25519: 0, KeyTypeSSHRSA: 0}
+	expectedTags := []string{}
+	for _, publicKey := range publicKeys {
+		keyType := publicKeyType(publicKey)
+		expected[keyType]++
+
+		if keyType == KeyTypeSSHEd25519 || keyType == KeyTypeSSHRSA {
+			tag, err := sshKeyTag(publicKey)
+			if err != nil {
+				return err
+			}
+			expectedTags = append(expectedTags, keyType+" "+tag)
+		}
+	}
+
+	for stanzaType, count := range expected {
+		if countAgeStanzas(stanzas, stanzaType) != count {
+			return fmt.Errorf("%w: expected %d %s recipients", errWrongRecipients, count, stanzaType)
+		}
+	}
+
+	tags := []string{}
+	for _, stanza := range stanzas {
+		if (stanza.Type == KeyTypeSSHEd25519 || stanza.Type == KeyTypeSSHRSA) && len(stanza.Args) > 0 {
+			tags = append(tags, stanza.Type+" "+stanza.Args[0])
+		}
+	}
+
+	slices.Sort(tags)
+	slices.Sort(expectedTags)
+	if !slices.Equal(tags, expectedTags) {
+		return fmt.Errorf("%w: the ssh recipients don't match", errWrongRecipients)
+	}
+	return nil
+}
+
+// Returns the tag that age puts in the stanzas of an ssh key: the first 4 bytes of the SHA-256 of the key, in base64
+func sshKeyTag(publicKey string) (string, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse ssh key. %w", err)
+	}
+
+	hash := sha256.Sum256(key.Marshal())
+	return base64.RawStdEncoding.EncodeToString(hash[:4]), nil
+}
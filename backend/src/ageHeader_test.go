@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestParseAgeHeader(t *testing.T) {
+	recipients := []age.Recipient{}
+	for i := 0; i < 3; i++ {
+		identity, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		recipients = append(recipients, identity.Recipient())
+	}
+
+	encrypted := &bytes.Buffer{}
+	w, err := age.Encrypt(encrypted, recipients...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write([]byte(strings.Repeat("test data ", 1000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stanzas, err := parseAgeHeader(bytes.NewReader(encrypted.Bytes()))
+	if err != nil {
+		t.Fatalf("parseAgeHeader failed. %v", err)
+	}
+
+	if countAgeStanzas(stanzas, "X25519") != len(recipients) {
+		t.Errorf("parseAgeHeader failed. Expected %d X25519 stanzas got %d", len(recipients), countAgeStanzas(stanzas, "X25519"))
+	}
+
+	for _, stanza := range stanzas {
+		if stanza.Type == "X25519" && (len(stanza.Args) != 1 || len(stanza.Body) != 32) {
+			t.Errorf("parseAgeHeader failed. Invalid X25519 stanza: %+v", stanza)
+		}
+	}
+}
+
+func TestParseAgeHeaderInvalid(t *testing.T) {
+	items := []string{
+		"",
+		"not an age file",
+		"age-encryption.org/v1\n",
+		"age-encryption.org/v1\n--- AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA\n",
+		"age-encryption.org/v1\n-> X25519 abc\n",
+		"age-encryption.org/v1\n-> X25519 abc\n!!!\n--- AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA\n",
+		"age-encryption.org/v1\n-> X25519  abc\n\n--- AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA\n",
+	}
+
+	for _, item := range items {
+		_, err := parseAgeHeader(strings.NewReader(item))
+		if !errors.Is(err, errInvalidAgeHeader) {
+			t.Errorf("parseAgeHeader didn't fail for %q. Got: %v", item, err)
+		}
+	}
+}
+
+func TestCheckAgeRecipients(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sshKey := newTestSSHKey(t)
+	sshRecipient, err := parseRecipient(sshKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted := &bytes.Buffer{}
+	w, err := age.Encrypt(encrypted, identity.Recipient(), identity.Recipient(), sshRecipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey := identity.Recipient().String()
+	err = checkAgeRecipients(bytes.NewReader(encrypted.Bytes()), []string{publicKey, publicKey, sshKey})
+	if err != nil {
+		t.Errorf("checkAgeRecipients failed with the right recipients. %v", err)
+	}
+
+	wrongRecipients := [][]string{
+		{publicKey, publicKey},
+		{publicKey, publicKey, publicKey},
+		{publicKey, sshKey, sshKey},
+		{publicKey, publicKey, sshKey, sshKey},
+		// The same number of ssh stanzas, but for another key
+		{publicKey, publicKey, newTestSSHKey(t)},
+	}
+
+	for _, publicKeys := range wrongRecipients {
+		err = checkAgeRecipients(bytes.NewReader(encrypted.Bytes()), publicKeys)
+		if !errors.Is(err, errWrongRecipients) {
+			t.Errorf("checkAgeRecipients should fail with errWrongRecipients for %d keys. Got: %v", len(publicKeys), err)
+		}
+	}
+}
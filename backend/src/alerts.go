@@ -159,3 +159,10 @@ func removeAlert(ctx context.Context, alertID, userID string) error {
 
 	return nil
 }
+
+// removes the alerts of a type for a userID that have the specified dataSecondary.
+// Used when the thing that the alert is about doesn't exist anymore, e.g. a cancelled friend request.
+func removeAlertsWithData(ctx context.Context, userID, alertType, dataSecondary string) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM activeAlerts WHERE userID = ? AND alertType = ? AND dataSecondary = ?;", userID, alertType, dataSecondary)
+	return err
+}
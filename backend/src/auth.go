@@ -23,6 +23,8 @@ const (
 	MinUserIDLength   int    = 5
 	MaxUserIDLength   int    = 14
 	DefaultRoleID     string = "user"
+	// The role of the users that can run the admin jobs, such as the scrub that verifies the stored files
+	AdminRoleID string = "admin"
 	// The cost that bcrypt uses to hash passwords. This is a good explanation of what the cost is https://stackoverflow.com/a/25586134.
 	// 14 is overkill for most laptops and very basic servers. Use https://github.com/mtzfederico/bcrypt-cost-benchmark to get a good value for the system running this code.
 	BcryptHashCost int = 14
@@ -134,6 +136,12 @@ func handleSignup(c *gin.Context) {
 		return
 	}
 
+	publicKey, keyType, err := parsePublicKey(signupData.PublicKey)
+	if err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid public key"})
+		return
+	}
+
 	isUnique, err := isUserIDUnique(c, signupData.UserID)
 	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
@@ -162,7 +170,7 @@ func handleSignup(c *gin.Context) {
 		log.WithField("error", err).Error("[handleSignup] Failed to generate authToken")
 		return
 	}
-	err = insertPublicKey(c, signupData.UserID, signupData.PublicKey)
+	err = insertPublicKey(c, signupData.UserID, publicKey, keyType)
 	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
 		log.WithField("error", err).Error("[handleSignup] Failed to insert public key")
@@ -430,10 +438,10 @@ func generateBase64ID(size int) (string, error) {
 	return encoded, nil
 }
 
-func insertPublicKey(ctx context.Context, userID string, key string) error {
+func insertPublicKey(ctx context.Context, userID string, key string, keyType string) error {
 	const description string = "Public key"
 	log.Debug("inserting public key")
-	_, err := db.ExecContext(ctx, "INSERT INTO encryptionKeys (publicKey, userID, description, createdDate) VALUES (?, ?, ?,now());", key, userID, description)
+	_, err := db.ExecContext(ctx, "INSERT INTO encryptionKeys (publicKey, keyType, userID, description, createdDate) VALUES (?, ?, ?, ?,now());", key, keyType, userID, description)
 	return err
 }
 
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// A folder can't be moved inside of itself
+	errMoveIntoItself error = errors.New("a folder can't be moved inside of itself")
+	// The names encrypted to a folder key can't be moved to another folder key by the server
+	errMoveEncryptedNames error = errors.New("folders with encrypted names can only be moved to folders that use the same folder key")
+)
+
+const (
+	// The maximum number of operations in one batch request
+	MaxBatchOperations = 500
+	// The reason of the re-encryption tasks created for items moved to other recipients
+	ReencryptionReasonMove = "move"
+
+	BatchOpDelete = "delete"
+	BatchOpMove   = "move"
+	BatchOpRename = "rename"
+	BatchOpShare  = "share"
+	BatchOpCopy   = "copy"
+)
+
+// An item changed by a batch operation
+type batchItem struct {
+	id, parentDir, name, fileType, userID string
+	nameIndex                             sql.NullString
+}
+
+// Runs a list of delete, move, rename, share and copy operations with a single authentication check.
+// The operations run in order and each one has its own result, with the status and the response that its own endpoint would return.
+// Delete, move and share change the DB in one transaction per operation, and copy adds all of its copies in one before copying the objects.
+// The S3 objects of deleted files are released after the commit. With stopOnError, the operations after the first one that fails are not run.
+func handleBatch(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/batch" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","stopOnError": true, "operations": [{"op": "move", "itemID": "01955f82-7409-7cfc-a6ab-af5a70ca5897", "destinationDirID": "0195f78c-2487-75e7-b611-127b303d1e9e"}, {"op": "delete", "itemID": "0195ddc2-dba1-7b94-acbb-b360f88dd9d6"}]}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request BatchRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleBatch] Failed to decode JSON")
+		return
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleBatch] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	if len(request.Operations) == 0 || len(request.Operations) > MaxBatchOperations {
+		c.JSON(400, gin.H{"success": false, "error": fmt.Sprintf("A batch must have between 1 and %d operations", MaxBatchOperations)})
+		return
+	}
+
+	results := []BatchResult{}
+	failed := false
+	for i, operation := range request.Operations {
+		status, response := runBatchOperation(c, request.UserID, operation)
+		results = append(results, BatchResult{Index: i, Op: operation.Op, ItemID: operation.ItemID, Status: status, Response: response})
+
+		if status >= 300 {
+			failed = true
+			if request.StopOnError {
+				break
+			}
+		}
+	}
+
+	// The operations that were not run because of stopOnError don't have a result
+	c.JSON(200, gin.H{"success": !failed, "results": results})
+}
+
+// Runs one operation of a batch for the user, who is already authenticated. Returns the status and the body of the response
+func runBatchOperation(ctx context.Context, userID string, operation BatchOperation) (int, gin.H) {
+	if operation.ItemID == "" {
+		return 400, gin.H{"success": false, "error": "itemID is required"}
+	}
+
+	switch operation.Op {
+	case BatchOpDelete:
+		return deleteItem(ctx, userID, operation.ItemID)
+	case BatchOpMove:
+		return moveItem(ctx, userID, operation)
+	case BatchOpRename:
+		return renameBatchItem(ctx, userID, operation)
+	case BatchOpShare:
+		return shareBatchItem(ctx, userID, operation)
+	case BatchOpCopy:
+		return copyItemToFolder(ctx, CopyItemRequest{UserID: userID, ItemID: operation.ItemID, DestinationDirID: operation.DestinationDirID, NewName: operation.NewName, NameIndex: operation.NameIndex})
+	}
+	return 400, gin.H{"success": false, "error": fmt.Sprintf("Unknown operation %q", operation.Op)}
+}
+
+// Returns the item, or errFileNotFound if it doesn't exist
+func getBatchItem(ctx context.Context, q rowQuerier, itemID string) (batchItem, error) {
+	item := batchItem{id: itemID}
+	err := q.QueryRowContext(ctx, "SELECT parentDir, name, nameIndex, type, userID FROM files WHERE id = ?", itemID).Scan(&item.parentDir, &item.name, &item.nameIndex, &item.fileType, &item.userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return item, errFileNotFound
+	}
+	return item, err
+}
+
+// Deletes a file with removeFile, or a folder with removeDirectory, the same way as their endpoints
+func deleteItem(ctx context.Context, userID, itemID string) (int, gin.H) {
+	if itemID == RootDirectoryID {
+		return 400, gin.H{"success": false, "error": "You cannot delete your home directory"}
+	}
+
+	item, err := getBatchItem(ctx, db, itemID)
+	if err != nil {
+		if errors.Is(err, errFileNotFound) {
+			return 400, gin.H{"success": false, "error": "Item not found"}
+		}
+
+		log.WithField("error", err).Error("[deleteItem] Failed to get the item")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"}
+	}
+
+	if item.fileType == "folder" {
+		return removeDirectory(ctx, GetDirectoryRequest{UserID: userID, DirID: itemID})
+	}
+	return removeFile(ctx, GetFileRequest{UserID: userID, FileID: itemID})
+}
+
+// Moves an item owned by the user to a folder where they have write permission, optionally with a new name.
+// If the items inside of the destination are encrypted to other recipients, the owner's devices re-encrypt the moved files with getReencryptionTasks.
+func moveItem(ctx context.Context, userID string, operation BatchOperation) (int, gin.H) {
+	item, err := getBatchItem(ctx, db, operation.ItemID)
+	if err != nil {
+		if errors.Is(err, errFileNotFound) {
+			return 400, gin.H{"success": false, "error": "Item not found"}
+		}
+
+		log.WithField("error", err).Error("[moveItem] Failed to get the item")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"}
+	}
+
+	if item.userID != userID {
+		return 403, gin.H{"success": false, "error": "Operation not allowed"}
+	}
+
+	permission, err := getFolderPermission(ctx, operation.DestinationDirID, userID, true)
+	if err != nil {
+		if errors.Is(err, errDirNotFound) {
+			return 400, gin.H{"success": false, "error": "Destination folder doesn't exist"}
+		}
+
+		log.WithField("error", err).Error("[moveItem] Failed to get the destination's permission")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"}
+	}
+
+	if permission != WritePermission {
+		return 403, gin.H{"success": false, "error": "No write permission on the destination folder"}
+	}
+
+	if item.fileType == "folder" {
+		err = checkMoveFolder(ctx, item, operation.DestinationDirID)
+		if err != nil {
+			if errors.Is(err, errMoveIntoItself) || errors.Is(err, errMoveEncryptedNames) {
+				return 400, gin.H{"success": false, "error": err.Error()}
+			}
+
+			log.WithField("error", err).Error("[moveItem] Failed to check the folder")
+			return 500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"}
+		}
+	}
+
+	// Without a new name, the name is kept. An encrypted name can only be read with the folder key it was encrypted to
+	name, nameIndex := operation.NewName, operation.NameIndex
+	if name == "" {
+		if item.nameIndex.Valid && item.parentDir != operation.DestinationDirID {
+			same, err := sameNameKey(ctx, item.parentDir, operation.DestinationDirID)
+			if err != nil {
+				log.WithField("error", err).Error("[moveItem] Failed to compare the folder keys")
+				return 500, gin.H{"success": false, "error": "Internal Server Error (5), Please try again later"}
+			}
+
+			if !same {
+				return 400, gin.H{"success": false, "error": "newName and nameIndex are required to move an item with an encrypted name to another folder key"}
+			}
+		}
+		name, nameIndex = item.name, item.nameIndex.String
+	}
+
+	checkedIndex, err := checkItemName(ctx, operation.DestinationDirID, name, nameIndex)
+	if err != nil {
+		if isInvalidNameError(err) {
+			return 400, gin.H{"success": false, "error": err.Error()}
+		}
+
+		log.WithField("error", err).Error("[moveItem] Failed to check the name")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (5), Please try again later"}
+	}
+
+	reencrypt := false
+	if item.parentDir != operation.DestinationDirID {
+		reencrypt, err = recipientsChange(ctx, item.parentDir, operation.DestinationDirID, userID)
+		if err != nil {
+			log.WithField("error", err).Error("[moveItem] Failed to compare the recipients")
+			return 500, gin.H{"success": false, "error": "Internal Server Error (6), Please try again later"}
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.WithField("error", err).Error("[moveItem] Failed to start the transaction")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (7), Please try again later"}
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "UPDATE files SET parentDir = ?, name = ?, nameIndex = ?, lastModified = now() WHERE id = ?", operation.DestinationDirID, name, checkedIndex, item.id)
+	if err != nil {
+		if errors.Is(checkDuplicateName(err), errNameExists) {
+			return 409, gin.H{"success": false, "error": "An item with the same name already exists"}
+		}
+
+		log.WithFields(log.Fields{"error": err, "fileID": item.id}).Error("[moveItem] Failed to move the item")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (8), Please try again later"}
+	}
+
+	if reencrypt {
+		items, err := getOwnedSubtree(ctx, tx, item.id, userID)
+		if err != nil {
+			log.WithField("error", err).Error("[moveItem] Failed to get the items inside")
+			return 500, gin.H{"success": false, "error": "Internal Server Error (9), Please try again later"}
+		}
+
+		err = scheduleSubtreeReencryption(ctx, tx, items, userID, ReencryptionReasonMove)
+		if err != nil {
+			log.WithField("error", err).Error("[moveItem] Failed to schedule re-encryption")
+			return 500, gin.H{"success": false, "error": "Internal Server Error (9), Please try again later"}
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.WithField("error", err).Error("[moveItem] Failed to commit the transaction")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (10), Please try again later"}
+	}
+
+	return 200, gin.H{"success": true, "reencrypt": reencrypt}
+}
+
+// Checks that a folder can be moved to destinationDirID. It can't be moved inside of itself,
+// and if it doesn't have its own folder key, the encrypted names inside of it need the destination to use the same folder key.
+func checkMoveFolder(ctx context.Context, item batchItem, destinationDirID string) error {
+	inside, err := isInsideFolder(ctx, destinationDirID, item.id)
+	if err != nil {
+		return fmt.Errorf("isInsideFolder error. %w", err)
+	}
+
+	if inside {
+		return errMoveIntoItself
+	}
+
+	keyFolderID, err := getFolderKeyFolder(ctx, db, item.id)
+	if err != nil {
+		return fmt.Errorf("getFolderKeyFolder error. %w", err)
+	}
+
+	if keyFolderID == item.id {
+		return nil
+	}
+
+	var encryptedNames int
+	err = db.QueryRowContext(ctx, `
+		WITH RECURSIVE tree (id, depth) AS (
+			SELECT id, 0 FROM files WHERE id = ?
+			UNION ALL
+			SELECT f.id, t.depth + 1 FROM files f INNER JOIN tree t ON f.parentDir = t.id WHERE t.depth < ?
+		)
+		SELECT COUNT(*) FROM files f INNER JOIN tree t ON f.id = t.id WHERE t.depth > 0 AND f.nameIndex IS NOT NULL`, item.id, MaxBreadcrumbDepth).Scan(&encryptedNames)
+	if err != nil {
+		return err
+	}
+
+	if encryptedNames == 0 {
+		return nil
+	}
+
+	destinationKeyFolderID, err := nameKeyFolder(ctx, destinationDirID)
+	if err != nil {
+		return err
+	}
+
+	if destinationKeyFolderID != keyFolderID {
+		return errMoveEncryptedNames
+	}
+	return nil
+}
+
+// Returns the folder whose folder key the names of the items inside of dirID are encrypted to, or "" if there is none
+func nameKeyFolder(ctx context.Context, dirID string) (string, error) {
+	if dirID == RootDirectoryID {
+		return "", nil
+	}
+
+	keyFolderID, err := getFolderKeyFolder(ctx, db, dirID)
+	if err != nil {
+		return "", fmt.Errorf("getFolderKeyFolder error. %w", err)
+	}
+	return keyFolderID, nil
+}
+
+// Returns true if the names of the items inside of both folders are encrypted to the same folder key.
+// A folder without a folder key can't have encrypted names, so it never matches.
+func sameNameKey(ctx context.Context, dirID, destinationDirID string) (bool, error) {
+	keyFolderID, err := nameKeyFolder(ctx, dirID)
+	if err != nil {
+		return false, err
+	}
+
+	destinationKeyFolderID, err := nameKeyFolder(ctx, destinationDirID)
+	if err != nil {
+		return false, err
+	}
+	return keyFolderID != "" && keyFolderID == destinationKeyFolderID, nil
+}
+
+// Returns true if the items inside of dirID and destinationDirID are not encrypted for the same recipients,
+// because they use other folder keys or other users have access to them
+func recipientsChange(ctx context.Context, dirID, destinationDirID, userID string) (bool, error) {
+	recipients, err := folderRecipients(ctx, dirID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	destinationRecipients, err := folderRecipients(ctx, destinationDirID, userID)
+	if err != nil {
+		return false, err
+	}
+	return recipients != destinationRecipients, nil
+}
+
+// Returns a checksum of the public keys that the items inside of the folder are encrypted with and of the users that have access to it
+func folderRecipients(ctx context.Context, dirID, userID string) (string, error) {
+	recipients, err := getPublicKeysForDirectory(ctx, dirID, userID, 0)
+	if err != nil {
+		return "", fmt.Errorf("getPublicKeysForDirectory error. %w", err)
+	}
+
+	if dirID != RootDirectoryID {
+		users, err := getUsersWithFileAccess(ctx, dirID, 0, nil)
+		if err != nil {
+			return "", fmt.Errorf("getUsersWithFileAccess error. %w", err)
+		}
+
+		for _, user := range users {
+			recipients = append(recipients, "user:"+user.UserID)
+		}
+	}
+	return recipientsChecksum(recipients), nil
+}
+
+// Renames an item that the user owns or that is in a folder where they have write permission, in the same way as renameItem
+func renameBatchItem(ctx context.Context, userID string, operation BatchOperation) (int, gin.H) {
+	return renameItem(ctx, RenameItemRequest{UserID: userID, FileID: operation.ItemID, NewName: operation.NewName, NameIndex: operation.NameIndex})
+}
+
+// Shares a file or a folder in the same way as shareFile and shareDir
+func shareBatchItem(ctx context.Context, userID string, operation BatchOperation) (int, gin.H) {
+	item, err := getBatchItem(ctx, db, operation.ItemID)
+	if err != nil {
+		if errors.Is(err, errFileNotFound) {
+			return 400, gin.H{"success": false, "error": "Item not found"}
+		}
+
+		log.WithField("error", err).Error("[shareBatchItem] Failed to get the item")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"}
+	}
+
+	if item.fileType == "folder" {
+		return shareDirectory(ctx, ShareDirectoryRequest{UserID: userID, DirID: item.id, WithUserID: operation.WithUserID, WithGroupID: operation.WithGroupID, ReadOnly: operation.ReadOnly})
+	}
+	return shareFile(ctx, ShareFileRequest{UserID: userID, FileID: item.id, WithUserID: operation.WithUserID, WithGroupID: operation.WithGroupID, ReadOnly: operation.ReadOnly})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestRunBatchOperationInvalid(t *testing.T) {
+	ctx := context.Background()
+
+	// Both are rejected before the DB is used
+	operations := []BatchOperation{
+		{Op: BatchOpDelete},
+		{Op: "chmod", ItemID: "01955f82-7409-7cfc-a6ab-af5a70ca5897"},
+	}
+	for _, operation := range operations {
+		status, response := runBatchOperation(ctx, "testUser", operation)
+		if status != 400 || response["success"] != false {
+			t.Errorf("runBatchOperation(%+v) = %d %v, want 400 and success false", operation, status, response)
+		}
+	}
+
+	status, _ := deleteItem(ctx, "testUser", RootDirectoryID)
+	if status != 400 {
+		t.Errorf("deleteItem(root) = %d, want 400", status)
+	}
+}
+
+var batchItemColumns = []string{"parentDir", "name", "nameIndex", "type", "userID"}
+
+func TestDeleteItemFile(t *testing.T) {
+	fake := useFakeDB(t,
+		fakeResponse{match: "SELECT parentDir, name, nameIndex, type, userID FROM files", columns: batchItemColumns, rows: [][]driver.Value{{"folder", "notes.txt", nil, "text/plain", "testUser"}}},
+		fakeResponse{match: "select userID, IFNULL(objKey, ''), processed from files", columns: []string{"userID", "objKey", "processed"}, rows: [][]driver.Value{{"testUser", "", true}}},
+		fakeResponse{match: "SELECT IFNULL(thumbnailObjKey, '') FROM files", columns: []string{"thumbnailObjKey"}, rows: [][]driver.Value{{""}}},
+	)
+
+	status, response := deleteItem(context.Background(), "testUser", "file")
+	if status != 200 {
+		t.Fatalf("deleteItem() = %d %v, want 200", status, response)
+	}
+
+	calls := fake.callsMatching("DELETE FROM files")
+	if len(calls) != 1 || calls[0].args[0] != "file" || calls[0].args[1] != "testUser" {
+		t.Errorf("got %v, want the file deleted", calls)
+	}
+
+	if fake.commits != 1 {
+		t.Errorf("got %d commits, want 1", fake.commits)
+	}
+}
+
+func TestDeleteItemNotOwner(t *testing.T) {
+	fake := useFakeDB(t,
+		fakeResponse{match: "SELECT parentDir, name, nameIndex, type, userID FROM files", columns: batchItemColumns, rows: [][]driver.Value{{"folder", "notes.txt", nil, "text/plain", "anotherTestUser"}}},
+		fakeResponse{match: "select userID, IFNULL(objKey, ''), processed from files", columns: []string{"userID", "objKey", "processed"}, rows: [][]driver.Value{{"anotherTestUser", "", true}}},
+	)
+
+	status, _ := deleteItem(context.Background(), "testUser", "file")
+	if status != 403 {
+		t.Errorf("deleteItem() of another user's file = %d, want 403", status)
+	}
+
+	if calls := fake.callsMatching("DELETE FROM files"); len(calls) != 0 {
+		t.Errorf("nothing should be deleted, got %v", calls)
+	}
+}
+
+func TestDeleteItemFolder(t *testing.T) {
+	// The folder works like removeDirectory, only the user's own items inside of it are deleted
+	fake := useFakeDB(t,
+		fakeResponse{match: "SELECT parentDir, name, nameIndex, type, userID FROM files", columns: batchItemColumns, rows: [][]driver.Value{{RootDirectoryID, "docs", nil, "folder", "testUser"}}},
+		fakeResponse{match: "select userID from files where id=? AND type='folder'", columns: []string{"userID"}, rows: [][]driver.Value{{"testUser"}}},
+		fakeResponse{match: "select id, objKey, IFNULL(thumbnailObjKey, '') from files where userID=? AND parentDir=?", columns: []string{"id", "objKey", "thumbnailObjKey"}, rows: [][]driver.Value{{"child", "", ""}}},
+	)
+
+	status, response := deleteItem(context.Background(), "testUser", "folder")
+	if status != 200 {
+		t.Fatalf("deleteItem() = %d %v, want 200", status, response)
+	}
+
+	if calls := fake.callsMatching("select id, objKey, IFNULL(thumbnailObjKey, '') from files"); len(calls) != 1 || calls[0].args[0] != "testUser" {
+		t.Errorf("got %v, want only the items of testUser", calls)
+	}
+
+	calls := fake.callsMatching("DELETE FROM files")
+	if len(calls) != 2 || calls[0].args[0] != "child" || calls[1].args[0] != "folder" {
+		t.Errorf("got %v, want the child and the folder deleted", calls)
+	}
+
+	if fake.commits != 1 {
+		t.Errorf("got %d commits, want 1", fake.commits)
+	}
+}
+
+func TestDeleteItemFolderFails(t *testing.T) {
+	// The folder can't be deleted after its child, nothing is committed
+	fake := useFakeDB(t,
+		fakeResponse{match: "SELECT parentDir, name, nameIndex, type, userID FROM files", columns: batchItemColumns, rows: [][]driver.Value{{RootDirectoryID, "docs", nil, "folder", "testUser"}}},
+		fakeResponse{match: "select userID from files where id=? AND type='folder'", columns: []string{"userID"}, rows: [][]driver.Value{{"testUser"}}},
+		fakeResponse{match: "select id, objKey, IFNULL(thumbnailObjKey, '') from files where userID=? AND parentDir=?", columns: []string{"id", "objKey", "thumbnailObjKey"}, rows: [][]driver.Value{{"child", "object", ""}}},
+		fakeResponse{match: "DELETE FROM files", once: true},
+		fakeResponse{match: "DELETE FROM files", err: errors.New("lock wait timeout")},
+	)
+
+	status, _ := deleteItem(context.Background(), "testUser", "folder")
+	if status != 500 {
+		t.Errorf("deleteItem() = %d, want 500", status)
+	}
+
+	if fake.commits != 0 || fake.rollbacks != 1 {
+		t.Errorf("got %d commits and %d rollbacks, want the transaction rolled back", fake.commits, fake.rollbacks)
+	}
+
+	// The objects are only released after the commit
+	if calls := fake.callsMatching("dedupObjects"); len(calls) != 0 {
+		t.Errorf("got %v, want the objects kept", calls)
+	}
+}
+
+// Answers the queries of a move of an item with an encrypted name from keyFolder to destination.
+// destinationKeyFolder is the folder key that the destination uses, or "" if it has none
+func encryptedMoveResponses(t *testing.T, destinationKeyFolder string) ([]fakeResponse, string) {
+	t.Helper()
+	folderKey, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := encryptTestName(t, "notes.txt", folderKey.Recipient())
+	responses := []fakeResponse{
+		{match: "SELECT parentDir, name, nameIndex, type, userID FROM files", columns: batchItemColumns, rows: [][]driver.Value{{"keyFolder", name, strings.Repeat("ab", NameIndexLength/2), "text/plain", "testUser"}}},
+		{match: "select userID from files where id=? AND type='folder'", columns: []string{"userID"}, rows: [][]driver.Value{{"testUser"}}},
+		{match: "INNER JOIN encryptionKeys k ON k.folderID = a.id", columns: []string{"id"}, rows: [][]driver.Value{{"keyFolder"}}, once: true},
+		{match: "SELECT encryptNames FROM files", columns: []string{"encryptNames"}, rows: [][]driver.Value{{true}}},
+		{match: "SELECT publicKey FROM encryptionKeys WHERE folderID", columns: []string{"publicKey"}, rows: [][]driver.Value{{folderKey.Recipient().String()}}},
+		// Both folders are in the root folder and not shared
+		{match: "select parentDir from files where id=?", columns: []string{"parentDir"}, rows: [][]driver.Value{{RootDirectoryID}}},
+	}
+
+	if destinationKeyFolder != "" {
+		responses = append(responses, fakeResponse{match: "INNER JOIN encryptionKeys k ON k.folderID = a.id", columns: []string{"id"}, rows: [][]driver.Value{{destinationKeyFolder}}})
+	}
+	return responses, name
+}
+
+func TestMoveItemEncryptedNameSameFolderKey(t *testing.T) {
+	responses, name := encryptedMoveResponses(t, "keyFolder")
+	fake := useFakeDB(t, responses...)
+
+	status, response := moveItem(context.Background(), "testUser", BatchOperation{Op: BatchOpMove, ItemID: "file", DestinationDirID: "subFolder"})
+	if status != 200 {
+		t.Fatalf("moveItem() = %d %v, want 200", status, response)
+	}
+
+	calls := fake.callsMatching("UPDATE files SET parentDir")
+	if len(calls) != 1 || calls[0].args[0] != "subFolder" || calls[0].args[1] != name || calls[0].args[3] != "file" {
+		t.Errorf("got %v, want the file moved with its name", calls)
+	}
+
+	if fake.commits != 1 {
+		t.Errorf("got %d commits, want 1", fake.commits)
+	}
+}
+
+func TestMoveItemEncryptedNameOtherFolderKey(t *testing.T) {
+	for _, destinationKeyFolder := range []string{"otherKeyFolder", ""} {
+		responses, _ := encryptedMoveResponses(t, destinationKeyFolder)
+		fake := useFakeDB(t, responses...)
+
+		// Without newName, the name would stay encrypted to the folder key of keyFolder
+		status, _ := moveItem(context.Background(), "testUser", BatchOperation{Op: BatchOpMove, ItemID: "file", DestinationDirID: "destination"})
+		if status != 400 {
+			t.Errorf("moveItem() to a folder with the folder key %q = %d, want 400", destinationKeyFolder, status)
+		}
+
+		if calls := fake.callsMatching("UPDATE files SET parentDir"); len(calls) != 0 {
+			t.Errorf("the item should not be moved, got %v", calls)
+		}
+	}
+}
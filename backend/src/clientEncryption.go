@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// Returns the public keys that a file uploaded to parentDir has to be encrypted with when the client encrypts it.
+// It is the folder key of the closest folder that has one, or every active key of the users with access to the location.
+func handleGetUploadRecipients(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/getUploadRecipients" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","parentDir":"root"}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request UploadRecipientsRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleGetUploadRecipients] Failed to decode JSON")
+		return
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleGetUploadRecipients] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	permission, err := getFolderPermission(c, request.ParentDir, request.UserID, true)
+	if err != nil {
+		if errors.Is(err, errDirNotFound) {
+			c.JSON(400, gin.H{"success": false, "error": "Parent Directory doesn't exist"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleGetUploadRecipients] Failed to get parentDir permission")
+		return
+	}
+
+	if permission != WritePermission {
+		c.JSON(403, gin.H{"success": false, "error": "No write permission on Parent Directory"})
+		return
+	}
+
+	publicKeys, err := getUploadRecipients(c, request.ParentDir, request.UserID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+		log.WithField("error", err).Error("[handleGetUploadRecipients] Failed to get public keys")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "publicKeys": publicKeys})
+}
+
+// Validates the MIME type and the plaintext size sent by the client for a client encrypted upload.
+// The type defaults to application/octet-stream and the size to the size of the ciphertext.
+// The plaintext is always smaller than the ciphertext since age adds a header and a tag to every chunk.
+func getClientEncryptedFileInfo(fileType, sizeStr string, encryptedSize int64) (string, int, error) {
+	fileType, err := checkFileType(fileType)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if sizeStr == "" {
+		return fileType, int(encryptedSize), nil
+	}
+
+	size, err := strconv.Atoi(sizeStr)
+	if err != nil || size < 0 || int64(size) > encryptedSize {
+		return "", 0, fmt.Errorf("invalid size")
+	}
+	return fileType, size, nil
+}
+
+// Stores a file that was encrypted by the client. The server never sees the plaintext, so it only checks that it is an age file
+// encrypted for the keys from getFileRecipients and uploads it as is. There is no type check and no thumbnail.
+// If it fails for any reason, the file is removed from the DB since it can't be used without its object.
+func processClientEncryptedFile(ctx context.Context, filePath, fileID, userID string) error {
+	defer deleteLocalFile(filePath)
+
+	err := storeClientEncryptedFile(ctx, filePath, fileID)
+	if err != nil {
+		removeErr := removeFileFromDB(ctx, db, fileID, userID)
+		if removeErr != nil {
+			log.WithFields(log.Fields{"error": removeErr, "fileID": fileID}).Error("[processClientEncryptedFile] Failed to remove the file from the DB")
+		}
+	}
+	return err
+}
+
+// Checks and uploads the file for processClientEncryptedFile
+func storeClientEncryptedFile(ctx context.Context, filePath, fileID string) error {
+	publicKeys, err := getFileRecipients(ctx, fileID)
+	if err != nil {
+		return fmt.Errorf("getFileRecipients error. %w", err)
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open the file. %w", err)
+	}
+	defer file.Close()
+
+	err = checkAgeRecipients(file, publicKeys)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to seek the file. %w", err)
+	}
+
+	// The server can't see the plaintext, so only the checksum of the ciphertext is known
+	checksum, err := hashFile(file)
+	if err != nil {
+		return err
+	}
+
+	objKey, err := getNewID()
+	if err != nil {
+		return fmt.Errorf("getNewID failed. %w", err)
+	}
+
+	_, err = uploadFile(ctx, s3Client, serverConfig.S3BucketName, file, objKey.String())
+	if err != nil {
+		return fmt.Errorf("failed to upload the file. %w", err)
+	}
+
+	err = recordObjectRecipients(ctx, objKey.String(), publicKeys)
+	if err != nil {
+		deleteFileObject(ctx, objKey.String())
+		return fmt.Errorf("recordObjectRecipients error. %w", err)
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE files SET objKey = ?, ciphertextSHA256 = ?, processed = true, lastModified = now() WHERE id = ?", objKey.String(), checksum, fileID)
+	if err != nil {
+		// Don't keep the object for a file that is removed
+		deleteFileObject(ctx, objKey.String())
+		return fmt.Errorf("failed to update DB. %w", err)
+	}
+	return nil
+}
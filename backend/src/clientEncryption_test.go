@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetClientEncryptedFileInfo(t *testing.T) {
+	fileType, size, err := getClientEncryptedFileInfo("", "", 500)
+	if err != nil || fileType != "application/octet-stream" || size != 500 {
+		t.Errorf("getClientEncryptedFileInfo defaults failed. Got %q %d %v", fileType, size, err)
+	}
+
+	fileType, size, err = getClientEncryptedFileInfo("image/png", "300", 500)
+	if err != nil || fileType != "image/png" || size != 300 {
+		t.Errorf("getClientEncryptedFileInfo failed. Got %q %d %v", fileType, size, err)
+	}
+
+	invalid := [][2]string{
+		{"image/png", "-1"},
+		{"image/png", "501"},
+		{"image/png", "abc"},
+		{"application/" + string(make([]byte, MaxFileTypeLength)), "1"},
+		{"folder", "1"},
+		{"not a type", "1"},
+		{"text/", "1"},
+	}
+
+	for _, item := range invalid {
+		_, _, err := getClientEncryptedFileInfo(item[0], item[1], 500)
+		if err == nil {
+			t.Errorf("getClientEncryptedFileInfo(%q, %q) didn't fail", item[0], item[1])
+		}
+	}
+}
+
+func TestCheckFileType(t *testing.T) {
+	valid := map[string]string{"": "application/octet-stream", "image/png": "image/png", "text/plain; charset=utf-8": "text/plain; charset=utf-8", "Image/PNG;\n": "image/png"}
+	for fileType, expected := range valid {
+		result, err := checkFileType(fileType)
+		if err != nil || result != expected {
+			t.Errorf("checkFileType(%q) = %q %v, want %q", fileType, result, err, expected)
+		}
+	}
+
+	for _, fileType := range []string{"folder", "image", "<script>", "image/png; charset"} {
+		_, err := checkFileType(fileType)
+		if !errors.Is(err, errInvalidFileType) {
+			t.Errorf("checkFileType(%q) returned %v, want errInvalidFileType", fileType, err)
+		}
+	}
+}
+
+func TestProcessClientEncryptedFileRemovesRow(t *testing.T) {
+	ctx := context.Background()
+	fileID := "0196b0c1-2d3e-7f40-8a5b-6c7d8e9f0a1b"
+	publicKey := newTestPublicKey(t)
+
+	newUpload := func() string {
+		filePath := filepath.Join(t.TempDir(), fileID)
+		err := os.WriteFile(filePath, []byte("not an age file"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return filePath
+	}
+
+	// A file of testUser in their root directory
+	uploadedFile := fakeResponse{match: "SELECT parentDir, userID FROM files", columns: []string{"parentDir", "userID"}, rows: [][]driver.Value{{RootDirectoryID, "testUser"}}}
+	parentDir := fakeResponse{match: "select parentDir from files", columns: []string{"parentDir"}, rows: [][]driver.Value{{RootDirectoryID}}}
+
+	// The upload is not an age file
+	fake := useFakeDB(t, uploadedFile, parentDir, fakeResponse{match: "SELECT publicKey FROM encryptionKeys WHERE userID", columns: []string{"publicKey"}, rows: [][]driver.Value{{publicKey}}})
+	err := processClientEncryptedFile(ctx, newUpload(), fileID, "testUser")
+	if !errors.Is(err, errInvalidAgeHeader) {
+		t.Errorf("processClientEncryptedFile() returned %v, want errInvalidAgeHeader", err)
+	}
+	if calls := fake.callsMatching("DELETE FROM files"); len(calls) != 1 || calls[0].args[0] != fileID {
+		t.Errorf("got deletes %v, want the invalid file to be removed", calls)
+	}
+
+	// The keys can't be read, which is not the client's fault
+	fake = useFakeDB(t, uploadedFile, parentDir, fakeResponse{match: "SELECT publicKey FROM encryptionKeys WHERE userID", err: errors.New("connection lost")})
+	err = processClientEncryptedFile(ctx, newUpload(), fileID, "testUser")
+	if err == nil || errors.Is(err, errInvalidAgeHeader) {
+		t.Errorf("processClientEncryptedFile() returned %v, want the DB error", err)
+	}
+	if calls := fake.callsMatching("DELETE FROM files"); len(calls) != 1 || calls[0].args[0] != fileID {
+		t.Errorf("got deletes %v, want the unprocessed file to be removed", calls)
+	}
+}
@@ -36,6 +36,13 @@ type Config struct {
 	// Set the mode for the http library Gin to "release" or "debug".
 	// More info in https://github.com/gin-gonic/gin/issues/2984
 	GINRelease bool `yaml:"GINMode" binding:"required"`
+	// Who users can share items with. Options: "anyone", "friends", "organization". Defaults to "anyone".
+	// Users can make it stricter for the items shared with them with their own sharingPolicy setting
+	SharingPolicy string `yaml:"SharingPolicy"`
+	// How often the garbage collector removes orphaned S3 objects and tmp files. 0 disables it, admins can still run it with runGarbageCollector
+	GCIntervalHours int `yaml:"GCIntervalHours"`
+	// How old orphaned S3 objects and tmp files have to be to be deleted. Defaults to 24
+	GCGracePeriodHours int `yaml:"GCGracePeriodHours"`
 }
 
 // Reads the yaml file specified in the path
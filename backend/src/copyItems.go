@@ -0,0 +1,634 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// A folder can't be copied inside of itself
+	errCopyIntoItself error = errors.New("a folder can't be copied inside of itself")
+	// The names encrypted to a folder key can't be moved to another folder key by the server
+	errCopyEncryptedNames error = errors.New("folders with encrypted names can't be copied")
+	// The item has more than MaxCopyItems items inside
+	errTooManyCopyItems error = errors.New("too many items to copy")
+)
+
+const (
+	// The maximum number of items copied by one copyItem request
+	MaxCopyItems = 10000
+	// Copies with at least this number of files are done in the background, the client can follow them with getCopyJob
+	CopyJobMinFiles = 20
+	// The reason of the re-encryption tasks created for copies to other recipients
+	ReencryptionReasonCopy = "copy"
+
+	CopyJobRunning = "running"
+	CopyJobDone    = "done"
+	CopyJobFailed  = "failed"
+)
+
+// An item in the tree that is copied, with the ID of its copy
+type copyItem struct {
+	id, newID, parentDir, name, fileType string
+	objKey, thumbnailObjKey              string
+	plaintextSHA256, ciphertextSHA256    string
+	size                                 int
+	nameEncrypted, encryptNames          bool
+	processed                            bool
+}
+
+// Copies a file, or a folder and everything inside of it, into a folder where the user has write permission. The copies are owned by the user.
+// The S3 objects are copied without downloading them. When the destination needs other recipients, the copy keeps the original recipients
+// and a re-encryption task is created for the user's devices.
+func handleCopyItem(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/copyItem" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","itemID": "01955f82-7409-7cfc-a6ab-af5a70ca5897", "destinationDirID": "root"}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request CopyItemRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleCopyItem] Failed to decode JSON")
+		return
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleCopyItem] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	c.JSON(copyItemToFolder(c, request))
+}
+
+// Copies the item of the request. Returns the status and the body of the response, so that it can also be used by batch
+func copyItemToFolder(ctx context.Context, request CopyItemRequest) (int, gin.H) {
+	// The whole tree is read in one query, the item is the first one
+	items, err := getCopyTree(ctx, request.ItemID)
+	if err != nil {
+		if errors.Is(err, errTooManyCopyItems) {
+			return 400, gin.H{"success": false, "error": fmt.Sprintf("Only up to %d items can be copied at once", MaxCopyItems)}
+		}
+
+		if errors.Is(err, errFolderTooDeep) {
+			return 400, gin.H{"success": false, "error": fmt.Sprintf("The folder has items more than %d levels deep", MaxBreadcrumbDepth)}
+		}
+
+		log.WithField("error", err).Error("[copyItemToFolder] Failed to get the items to copy")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"}
+	}
+
+	if len(items) == 0 {
+		return 400, gin.H{"success": false, "error": "File not found"}
+	}
+
+	status, message, err := checkCopyAccess(ctx, request, items[0])
+	if err != nil {
+		log.WithField("error", err).Error("[copyItemToFolder] Failed to check the permissions")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"}
+	}
+
+	if status != 0 {
+		return status, gin.H{"success": false, "error": message}
+	}
+
+	// Only the name of the copied item changes folder, so it is the only one that can be encrypted
+	name := request.NewName
+	if name == "" {
+		if items[0].nameEncrypted {
+			return 400, gin.H{"success": false, "error": "newName is required to copy an item with an encrypted name"}
+		}
+		name = items[0].name
+	}
+
+	nameIndex, err := checkItemName(ctx, request.DestinationDirID, name, request.NameIndex)
+	if err != nil {
+		if isInvalidNameError(err) {
+			return 400, gin.H{"success": false, "error": err.Error()}
+		}
+
+		log.WithField("error", err).Error("[copyItemToFolder] Failed to check the name")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"}
+	}
+
+	err = checkCopyTree(ctx, items, request.DestinationDirID)
+	if err != nil {
+		if errors.Is(err, errCopyIntoItself) || errors.Is(err, errCopyEncryptedNames) {
+			return 400, gin.H{"success": false, "error": err.Error()}
+		}
+
+		log.WithField("error", err).Error("[copyItemToFolder] Failed to check the items")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (5), Please try again later"}
+	}
+
+	files, err := addCopiesToDB(ctx, items, request.DestinationDirID, name, nameIndex, request.UserID)
+	if err != nil {
+		if errors.Is(err, errNameExists) {
+			return 409, gin.H{"success": false, "error": "An item with the same name already exists"}
+		}
+
+		log.WithField("error", err).Error("[copyItemToFolder] Failed to add the copies to the DB")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (6), Please try again later"}
+	}
+
+	newItemID := items[0].newID
+	if len(files) < CopyJobMinFiles {
+		err = copyObjects(ctx, files, request.UserID)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "itemID": request.ItemID}).Error("[copyItemToFolder] Failed to copy the objects")
+			return 500, gin.H{"success": false, "error": "Internal Server Error (7), Please try again later"}
+		}
+
+		return 200, gin.H{"success": true, "itemID": newItemID}
+	}
+
+	jobID, err := startCopyJob(ctx, files, newItemID, request.UserID)
+	if err != nil {
+		log.WithField("error", err).Error("[copyItemToFolder] Failed to start the copy job")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (8), Please try again later"}
+	}
+
+	// The copies are in the DB already, the files show as processing until the job copies them
+	return 202, gin.H{"success": true, "itemID": newItemID, "jobID": jobID}
+}
+
+// Returns the progress of a copy done in the background
+func handleGetCopyJob(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/getCopyJob" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","jobID": "0195ddc2-dba1-7b94-acbb-b360f88dd9d6"}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request GetCopyJobRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleGetCopyJob] Failed to decode JSON")
+		return
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleGetCopyJob] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	var job CopyJob
+	var jobError sql.NullString
+	err = db.QueryRowContext(c, "SELECT id, itemID, status, totalFiles, copiedFiles, error, createdDate, finishedDate FROM copyJobs WHERE id = ? AND userID = ?", request.JobID, request.UserID).
+		Scan(&job.ID, &job.ItemID, &job.Status, &job.TotalFiles, &job.CopiedFiles, &jobError, &job.CreatedDate, &job.FinishedDate)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(400, gin.H{"success": false, "error": "Copy job not found"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleGetCopyJob] Failed to get the job")
+		return
+	}
+	job.Error = jobError.String
+
+	c.JSON(200, gin.H{"success": true, "job": job})
+}
+
+// Checks that the user can read the item and write to the destination.
+// If it returns a status code other than 0, the copy is not allowed and message says why.
+func checkCopyAccess(ctx context.Context, request CopyItemRequest, item copyItem) (int, string, error) {
+	if item.fileType == "folder" {
+		permission, err := getFolderPermission(ctx, item.id, request.UserID, true)
+		if err != nil {
+			return 0, "", fmt.Errorf("getFolderPermission error. %w", err)
+		}
+
+		if permission == "" {
+			return 403, "You don't have access to this item", nil
+		}
+
+		pending, err := hasPendingShare(ctx, item.id, request.UserID)
+		if err != nil {
+			return 0, "", fmt.Errorf("hasPendingShare error. %w", err)
+		}
+
+		if pending {
+			return 400, "File is being processed, try again later", nil
+		}
+	} else {
+		_, err := getObjectKey(ctx, item.id, request.UserID, true)
+		if err != nil {
+			if errors.Is(err, errUserAccessNotAllowed) {
+				return 403, "You don't have access to this item", nil
+			}
+
+			if errors.Is(err, errFileProcessing) {
+				return 400, "File is being processed, try again later", nil
+			}
+			return 0, "", fmt.Errorf("getObjectKey error. %w", err)
+		}
+	}
+
+	permission, err := getFolderPermission(ctx, request.DestinationDirID, request.UserID, true)
+	if err != nil {
+		if errors.Is(err, errDirNotFound) {
+			return 400, "Destination folder doesn't exist", nil
+		}
+		return 0, "", fmt.Errorf("getFolderPermission error. %w", err)
+	}
+
+	if permission != WritePermission {
+		return 403, "No write permission on the destination folder", nil
+	}
+	return 0, "", nil
+}
+
+// Returns the item and everything inside of it, the folders before their items. It is empty if the item doesn't exist.
+// It returns errFolderTooDeep if there are items more than MaxBreadcrumbDepth levels below the item.
+func getCopyTree(ctx context.Context, itemID string) ([]copyItem, error) {
+	// The recursion goes one level further than the limit, to find out if there is anything below it
+	rows, err := db.QueryContext(ctx, `
+		WITH RECURSIVE tree (id, depth) AS (
+			SELECT id, 0 FROM files WHERE id = ?
+			UNION ALL
+			SELECT f.id, t.depth + 1 FROM files f INNER JOIN tree t ON f.parentDir = t.id WHERE t.depth <= ?
+		)
+		SELECT t.depth, f.id, f.parentDir, f.name, f.nameIndex IS NOT NULL, f.encryptNames, f.type, f.size, f.objKey, IFNULL(f.thumbnailObjKey, ''),
+			f.processed, IFNULL(f.plaintextSHA256, ''), IFNULL(f.ciphertextSHA256, '')
+		FROM files f INNER JOIN tree t ON f.id = t.id ORDER BY t.depth, f.id LIMIT ?`, itemID, MaxBreadcrumbDepth, MaxCopyItems+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []copyItem{}
+	for rows.Next() {
+		var item copyItem
+		var depth int
+		err := rows.Scan(&depth, &item.id, &item.parentDir, &item.name, &item.nameEncrypted, &item.encryptNames, &item.fileType, &item.size, &item.objKey, &item.thumbnailObjKey,
+			&item.processed, &item.plaintextSHA256, &item.ciphertextSHA256)
+		if err != nil {
+			return nil, err
+		}
+
+		if depth > MaxBreadcrumbDepth {
+			return nil, errFolderTooDeep
+		}
+		items = append(items, item)
+	}
+
+	if len(items) > MaxCopyItems {
+		return nil, errTooManyCopyItems
+	}
+	return items, rows.Err()
+}
+
+// Checks that a folder is not copied inside of itself and that it doesn't have encrypted names.
+// The copies don't have folder keys, so the names encrypted to the folder keys of the original folders couldn't be read.
+func checkCopyTree(ctx context.Context, items []copyItem, destinationDirID string) error {
+	if items[0].fileType != "folder" {
+		return nil
+	}
+
+	for _, item := range items {
+		if item.encryptNames || (item.nameEncrypted && item.id != items[0].id) {
+			return errCopyEncryptedNames
+		}
+	}
+
+	encrypted, err := hasEncryptedNames(ctx, destinationDirID)
+	if err != nil {
+		return err
+	}
+
+	if encrypted {
+		return fmt.Errorf("%w into a folder with encrypted names", errCopyEncryptedNames)
+	}
+
+	inside, err := isInsideFolder(ctx, destinationDirID, items[0].id)
+	if err != nil {
+		return fmt.Errorf("isInsideFolder error. %w", err)
+	}
+
+	if inside {
+		return errCopyIntoItself
+	}
+	return nil
+}
+
+// Returns true if dirID is folderID or is inside of it
+func isInsideFolder(ctx context.Context, dirID, folderID string) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx, `
+		WITH RECURSIVE ancestors (id, parentDir) AS (
+			SELECT id, parentDir FROM files WHERE id = ?
+			UNION ALL
+			SELECT f.id, f.parentDir FROM files f INNER JOIN ancestors a ON f.id = a.parentDir
+		)
+		SELECT COUNT(*) FROM ancestors WHERE id = ?`, dirID, folderID).Scan(&count)
+	return count > 0, err
+}
+
+// Inserts the copies of the items and returns the files whose objects have to be copied.
+// The folders are ready right away, the files are not processed until their objects are copied.
+// The files that were still being uploaded are not copied.
+func addCopiesToDB(ctx context.Context, items []copyItem, destinationDirID, name string, nameIndex sql.NullString, userID string) ([]copyItem, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// The ID of the copy of each folder
+	newFolderIDs := map[string]string{}
+	files := []copyItem{}
+
+	for i, item := range items {
+		if item.fileType != "folder" && (!item.processed || item.objKey == "") {
+			continue
+		}
+
+		newID, err := getNewID()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get a new ID. %w", err)
+		}
+		items[i].newID = newID.String()
+		item.newID = newID.String()
+
+		parentDir, itemName, itemNameIndex := newFolderIDs[item.parentDir], item.name, sql.NullString{}
+		if i == 0 {
+			parentDir, itemName, itemNameIndex = destinationDirID, name, nameIndex
+		} else if parentDir == "" {
+			// The folder above it wasn't copied
+			continue
+		}
+
+		if item.fileType == "folder" {
+			newFolderIDs[item.id] = item.newID
+			_, err = tx.ExecContext(ctx, "INSERT INTO files (id, parentDir, name, nameIndex, type, size, userID, processed, createdDate) VALUES (?, ?, ?, ?, 'folder', 0, ?, true, now())", item.newID, parentDir, itemName, itemNameIndex, userID)
+		} else {
+			files = append(files, item)
+			_, err = tx.ExecContext(ctx, "INSERT INTO files (id, parentDir, name, nameIndex, type, size, userID, processed, plaintextSHA256, ciphertextSHA256, createdDate) VALUES (?, ?, ?, ?, ?, ?, ?, false, NULLIF(?, ''), NULLIF(?, ''), now())",
+				item.newID, parentDir, itemName, itemNameIndex, item.fileType, item.size, userID, item.plaintextSHA256, item.ciphertextSHA256)
+		}
+		if err != nil {
+			return nil, checkDuplicateName(err)
+		}
+	}
+
+	return files, tx.Commit()
+}
+
+// Copies the objects of the files one at a time. If one fails, the copies that were not made are removed from the DB
+func copyObjects(ctx context.Context, files []copyItem, userID string) error {
+	for i, file := range files {
+		err := copyFileObjects(ctx, file, userID)
+		if err != nil {
+			removeFailedCopies(ctx, files[i:], userID)
+			return fmt.Errorf("failed to copy %s. %w", file.id, err)
+		}
+	}
+	return nil
+}
+
+// Copies the object and the thumbnail of the file to new objKeys and marks the copy as processed.
+// If the copy's folder needs other recipients, a re-encryption task is created for the user, who could read the original,
+// and the copy stays processing until the task is done.
+func copyFileObjects(ctx context.Context, file copyItem, userID string) error {
+	sourceRecipients, err := getObjectRecipients(ctx, file.objKey)
+	if err != nil {
+		return fmt.Errorf("getObjectRecipients error. %w", err)
+	}
+
+	recipients, err := getFileRecipients(ctx, file.newID)
+	if err != nil {
+		return fmt.Errorf("getFileRecipients error. %w", err)
+	}
+
+	objKey, err := copyObject(ctx, file.objKey, sourceRecipients)
+	if err != nil {
+		return err
+	}
+
+	var thumbnailObjKey sql.NullString
+	if file.thumbnailObjKey != "" {
+		key, err := copyObject(ctx, file.thumbnailObjKey, sourceRecipients)
+		if err != nil {
+			return fmt.Errorf("failed to copy the thumbnail. %w", err)
+		}
+		thumbnailObjKey = sql.NullString{String: key, Valid: true}
+	}
+
+	reencrypt := recipientsChecksum(sourceRecipients) != recipientsChecksum(recipients)
+	return recordCopiedObjects(ctx, file.newID, objKey, thumbnailObjKey, userID, reencrypt)
+}
+
+// Sets the objKeys of a copy. With reencrypt, the copy is still encrypted to the original's recipients,
+// so it is not processed until finishReencryptionTasks has the new version
+func recordCopiedObjects(ctx context.Context, fileID, objKey string, thumbnailObjKey sql.NullString, userID string, reencrypt bool) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "UPDATE files SET objKey = ?, thumbnailObjKey = ?, processed = ? WHERE id = ?", objKey, thumbnailObjKey, !reencrypt, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to update the copy. %w", err)
+	}
+
+	if reencrypt {
+		err = insertReencryptionTask(ctx, tx, fileID, userID, ReencryptionTaskFile, ReencryptionReasonCopy, sql.NullString{}, sql.NullString{})
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Copies the object to a new objKey inside of the bucket and records its recipients, which are the same as the original's
+func copyObject(ctx context.Context, srcObjKey string, recipients []string) (string, error) {
+	objKey, err := getNewID()
+	if err != nil {
+		return "", fmt.Errorf("failed to get a new objKey. %w", err)
+	}
+
+	_, err = copyFile(ctx, s3Client, serverConfig.S3BucketName, srcObjKey, objKey.String())
+	if err != nil {
+		return "", fmt.Errorf("failed to copy the object. %w", err)
+	}
+
+	err = recordObjectRecipients(ctx, objKey.String(), recipients)
+	if err != nil {
+		return "", fmt.Errorf("recordObjectRecipients error. %w", err)
+	}
+	return objKey.String(), nil
+}
+
+// Removes the copies of the files that couldn't be copied so that they don't stay as processing forever
+func removeFailedCopies(ctx context.Context, files []copyItem, userID string) {
+	for _, file := range files {
+		err := removeFileFromDB(ctx, db, file.newID, userID)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "fileID": file.newID}).Error("[removeFailedCopies] Failed to remove the copy")
+		}
+	}
+}
+
+// Saves the job and copies the objects in a goroutine. Returns the jobID
+func startCopyJob(ctx context.Context, files []copyItem, itemID, userID string) (string, error) {
+	jobID, err := getNewID()
+	if err != nil {
+		return "", fmt.Errorf("failed to get a new ID. %w", err)
+	}
+
+	_, err = db.ExecContext(ctx, "INSERT INTO copyJobs (id, userID, itemID, status, totalFiles, copiedFiles, createdDate) VALUES (?, ?, ?, ?, ?, 0, now())", jobID.String(), userID, itemID, CopyJobRunning, len(files))
+	if err != nil {
+		return "", err
+	}
+
+	go runCopyJob(context.Background(), jobID.String(), files, userID)
+	return jobID.String(), nil
+}
+
+func runCopyJob(ctx context.Context, jobID string, files []copyItem, userID string) {
+	for i, file := range files {
+		err := copyFileObjects(ctx, file, userID)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "jobID": jobID, "fileID": file.id}).Error("[runCopyJob] Failed to copy the file")
+			removeFailedCopies(ctx, files[i:], userID)
+
+			_, err = db.ExecContext(ctx, "UPDATE copyJobs SET status = ?, error = ?, finishedDate = now() WHERE id = ?", CopyJobFailed, "Failed to copy "+file.name, jobID)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err, "jobID": jobID}).Error("[runCopyJob] Failed to update the job")
+			}
+			return
+		}
+
+		_, err = db.ExecContext(ctx, "UPDATE copyJobs SET copiedFiles = ? WHERE id = ?", i+1, jobID)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "jobID": jobID}).Error("[runCopyJob] Failed to update the progress")
+		}
+	}
+
+	_, err := db.ExecContext(ctx, "UPDATE copyJobs SET status = ?, finishedDate = now() WHERE id = ?", CopyJobDone, jobID)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "jobID": jobID}).Error("[runCopyJob] Failed to update the job")
+	}
+}
+
+// Marks the copy jobs that were running when the server stopped as failed, and removes the copies of the files that weren't copied.
+// The jobs run in goroutines, so nothing else would finish them. It is called before the server starts.
+func failStaleCopyJobs(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, "SELECT id, userID, itemID FROM copyJobs WHERE status = ?", CopyJobRunning)
+	if err != nil {
+		return err
+	}
+
+	type copyJobRef struct {
+		id, userID, itemID string
+	}
+
+	jobs := []copyJobRef{}
+	for rows.Next() {
+		var job copyJobRef
+		err := rows.Scan(&job.id, &job.userID, &job.itemID)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		jobs = append(jobs, job)
+	}
+	rows.Close()
+
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		err := failCopyJob(ctx, job.id, job.userID, job.itemID)
+		if err != nil {
+			return fmt.Errorf("failed to clean up the copy job %s. %w", job.id, err)
+		}
+		log.WithField("jobID", job.id).Warn("[failStaleCopyJobs] Copy job interrupted by a restart")
+	}
+	return nil
+}
+
+// Removes the copies that are still processing below itemID and marks the job as failed. The copies waiting for a re-encryption task are kept.
+// The objects that were copied without updating the DB are left for the garbage collector.
+func failCopyJob(ctx context.Context, jobID, userID, itemID string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		WITH RECURSIVE tree (id, depth) AS (
+			SELECT id, 0 FROM files WHERE id = ?
+			UNION ALL
+			SELECT f.id, t.depth + 1 FROM files f INNER JOIN tree t ON f.parentDir = t.id WHERE t.depth < ?
+		)
+		SELECT f.id FROM files f INNER JOIN tree t ON f.id = t.id WHERE f.userID = ? AND f.type != 'folder' AND f.processed = false
+			AND NOT EXISTS (SELECT 1 FROM reencryptionTasks r WHERE r.fileID = f.id) FOR UPDATE`, itemID, MaxBreadcrumbDepth, userID)
+	if err != nil {
+		return err
+	}
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		err := rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		_, err = tx.ExecContext(ctx, "DELETE FROM files WHERE id = ?", id)
+		if err != nil {
+			return fmt.Errorf("failed to remove the copy %s. %w", id, err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE copyJobs SET status = ?, error = ?, finishedDate = now() WHERE id = ?", CopyJobFailed, "The server restarted before the copy finished", jobID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
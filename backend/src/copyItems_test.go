@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCheckCopyTreeEncryptedNames(t *testing.T) {
+	ctx := context.Background()
+
+	// A file can be copied with its encrypted name, newName replaces it
+	file := []copyItem{{id: "file", fileType: "text/plain", nameEncrypted: true}}
+	if err := checkCopyTree(ctx, file, "root"); err != nil {
+		t.Errorf("checkCopyTree(file) = %v, want nil", err)
+	}
+
+	folderWithEncryptedNames := []copyItem{{id: "folder", fileType: "folder", encryptNames: true}}
+	if err := checkCopyTree(ctx, folderWithEncryptedNames, "root"); !errors.Is(err, errCopyEncryptedNames) {
+		t.Errorf("checkCopyTree(folder with encryptNames) = %v, want errCopyEncryptedNames", err)
+	}
+
+	encryptedChild := []copyItem{{id: "folder", fileType: "folder"}, {id: "child", parentDir: "folder", fileType: "text/plain", nameEncrypted: true}}
+	if err := checkCopyTree(ctx, encryptedChild, "root"); !errors.Is(err, errCopyEncryptedNames) {
+		t.Errorf("checkCopyTree(folder with an encrypted name inside) = %v, want errCopyEncryptedNames", err)
+	}
+}
+
+var copyTreeColumns = []string{"depth", "id", "parentDir", "name", "nameEncrypted", "encryptNames", "type", "size", "objKey", "thumbnailObjKey", "processed", "plaintextSHA256", "ciphertextSHA256"}
+
+func TestGetCopyTree(t *testing.T) {
+	useFakeDB(t, fakeResponse{match: "SELECT t.depth, f.id, f.parentDir", columns: copyTreeColumns, rows: [][]driver.Value{
+		{0, "folder", "root", "docs", false, false, "folder", 0, "", "", true, "", ""},
+		{1, "file", "folder", "notes.txt", false, false, "text/plain", 5, "object", "", true, "", ""},
+	}})
+
+	items, err := getCopyTree(context.Background(), "folder")
+	if err != nil {
+		t.Fatalf("getCopyTree() returned %v", err)
+	}
+
+	if len(items) != 2 || items[0].id != "folder" || items[1].objKey != "object" {
+		t.Errorf("getCopyTree() = %+v, want the folder and its file", items)
+	}
+}
+
+func TestGetCopyTreeTooDeep(t *testing.T) {
+	// The recursion returns an item one level below the limit
+	rows := [][]driver.Value{{0, "folder0", "root", "folder0", false, false, "folder", 0, "", "", true, "", ""}}
+	for depth := 1; depth <= MaxBreadcrumbDepth+1; depth++ {
+		rows = append(rows, []driver.Value{depth, fmt.Sprintf("folder%d", depth), fmt.Sprintf("folder%d", depth-1), "folder", false, false, "folder", 0, "", "", true, "", ""})
+	}
+	useFakeDB(t, fakeResponse{match: "SELECT t.depth, f.id, f.parentDir", columns: copyTreeColumns, rows: rows})
+
+	_, err := getCopyTree(context.Background(), "folder0")
+	if !errors.Is(err, errFolderTooDeep) {
+		t.Errorf("getCopyTree() = %v, want errFolderTooDeep", err)
+	}
+}
+
+func TestFailStaleCopyJobs(t *testing.T) {
+	fake := useFakeDB(t,
+		fakeResponse{match: "SELECT id, userID, itemID FROM copyJobs", columns: []string{"id", "userID", "itemID"}, rows: [][]driver.Value{{"job", "testUser", "copiedFolder"}}},
+		fakeResponse{match: "WHERE r.fileID = f.id) FOR UPDATE", columns: []string{"id"}, rows: [][]driver.Value{{"copy1"}, {"copy2"}}},
+	)
+
+	err := failStaleCopyJobs(context.Background())
+	if err != nil {
+		t.Fatalf("failStaleCopyJobs() returned %v", err)
+	}
+
+	if calls := fake.callsMatching("WHERE r.fileID = f.id) FOR UPDATE"); len(calls) != 1 || calls[0].args[0] != "copiedFolder" || calls[0].args[2] != "testUser" {
+		t.Errorf("got %v, want the unprocessed copies of testUser below copiedFolder", calls)
+	}
+
+	deletes := fake.callsMatching("DELETE FROM files")
+	if len(deletes) != 2 || deletes[0].args[0] != "copy1" || deletes[1].args[0] != "copy2" {
+		t.Errorf("got deletes %v, want copy1 and copy2", deletes)
+	}
+
+	updates := fake.callsMatching("UPDATE copyJobs SET status")
+	if len(updates) != 1 || updates[0].args[0] != CopyJobFailed || updates[0].args[2] != "job" {
+		t.Errorf("got updates %v, want the job marked as failed", updates)
+	}
+
+	if fake.commits != 1 {
+		t.Errorf("got %d commits, want 1", fake.commits)
+	}
+}
+
+func TestRecordCopiedObjects(t *testing.T) {
+	ctx := context.Background()
+
+	// The same recipients, the copy can be read right away
+	fake := useFakeDB(t)
+	if err := recordCopiedObjects(ctx, "copy", "object", sql.NullString{}, "testUser", false); err != nil {
+		t.Fatalf("recordCopiedObjects() returned %v", err)
+	}
+
+	if calls := fake.callsMatching("UPDATE files SET objKey"); len(calls) != 1 || calls[0].args[2] != true {
+		t.Errorf("got %v, want the copy processed", calls)
+	}
+	if calls := fake.callsMatching("INSERT INTO reencryptionTasks"); len(calls) != 0 {
+		t.Errorf("got tasks %v, want none", calls)
+	}
+
+	// Other recipients, the copy is still encrypted to the original's and waits for the task
+	fake = useFakeDB(t)
+	if err := recordCopiedObjects(ctx, "copy", "object", sql.NullString{}, "testUser", true); err != nil {
+		t.Fatalf("recordCopiedObjects() returned %v", err)
+	}
+
+	if calls := fake.callsMatching("UPDATE files SET objKey"); len(calls) != 1 || calls[0].args[2] != false {
+		t.Errorf("got %v, want the copy still processing", calls)
+	}
+	calls := fake.callsMatching("INSERT INTO reencryptionTasks")
+	if len(calls) != 1 || calls[0].args[1] != "copy" || calls[0].args[2] != "testUser" || calls[0].args[4] != ReencryptionReasonCopy {
+		t.Errorf("got tasks %v, want a copy task for testUser", calls)
+	}
+	if fake.commits != 1 {
+		t.Errorf("got %d commits, want 1", fake.commits)
+	}
+}
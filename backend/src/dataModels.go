@@ -42,6 +42,12 @@ type CreateFolderRequest struct {
 	// For the root/home it is 'root', otherwise it is the parentDir's ID
 	ParentDir string   `json:"parentDir"`
 	ShareWith []string `json:"shareWith"`
+	// Groups that the user is a member of
+	ShareWithGroupID []string `json:"shareWithGroupID" binding:"omitempty"`
+	// When true, the names of the items inside of the folder are encrypted to its folder key. Folders inside of it inherit it
+	EncryptNames bool `json:"encryptNames" binding:"omitempty"`
+	// The blind index of the name. Required when the parentDir has encrypted names, dirName is then the encrypted name in base64
+	NameIndex string `json:"nameIndex" binding:"omitempty"`
 }
 
 type GetDirectoryRequest struct {
@@ -57,7 +63,9 @@ type ShareDirectoryRequest struct {
 	// For the root/home it is 'root', otherwise it is the parentDir's ID
 	DirID      string   `json:"dirID"`
 	WithUserID []string `json:"withUserID"`
-	ReadOnly   bool     `json:"isReadOnly"`
+	// Groups that the user is a member of
+	WithGroupID []string `json:"withGroupID" binding:"omitempty"`
+	ReadOnly    bool     `json:"isReadOnly"`
 }
 
 type GetFileRequest struct {
@@ -71,6 +79,8 @@ type GetProfilePictureRequest struct {
 	UserID    string `json:"userID"`
 	AuthToken string `json:"authToken"`
 	ForUserID string `json:"forUserID"`
+	// The width and height in pixels. The closest size available is returned. Optional
+	Size int `json:"size" binding:"omitempty"`
 }
 
 type ShareFileRequest struct {
@@ -79,7 +89,9 @@ type ShareFileRequest struct {
 	// The fileID in the DB, NOT the S3 objKey
 	FileID     string   `json:"fileID"`
 	WithUserID []string `json:"withUserID"`
-	ReadOnly   bool     `json:"isReadOnly"`
+	// Groups that the user is a member of
+	WithGroupID []string `json:"withGroupID" binding:"omitempty"`
+	ReadOnly    bool     `json:"isReadOnly"`
 }
 
 type GetDirectoryResponse struct {
@@ -96,6 +108,14 @@ type GetDirectoryResponseItems struct {
 	ID       string `json:"id"`
 	FileType string `json:"type"`
 	Size     int    `json:"size" binding:"omitempty"`
+	// True when a thumbnail can be downloaded with getThumbnail
+	HasThumbnail bool `json:"hasThumbnail"`
+	// True when the name is encrypted to the folder key, as base64
+	NameEncrypted bool `json:"nameEncrypted"`
+	// The SHA-256 of the plaintext in hex. Empty for folders and for files encrypted by the client
+	SHA256 string `json:"sha256"`
+	// The SHA-256 of the stored age file in hex. Empty for folders
+	CiphertextSHA256 string `json:"ciphertextSHA256"`
 }
 
 // Used to form a list with users that have access to a file and the permission that they have
@@ -128,6 +148,8 @@ type Folder struct {
 	//	   // NULL value
 	//	}
 	LastModified sql.NullTime `json:"lastModified"`
+	// True when the name is encrypted to the folder key, as base64
+	NameEncrypted bool `json:"nameEncrypted"`
 }
 
 type Alert struct {
@@ -171,4 +193,436 @@ type RenameItemRequest struct {
 	// The fileID in the DB, NOT the S3 objKey
 	FileID string `json:"dirID"`
 	NewName string `json:"newName"`
+	// The blind index of the new name. Required when the parentDir has encrypted names, newName is then the encrypted name in base64
+	NameIndex string `json:"nameIndex" binding:"omitempty"`
+}
+
+type SearchFilesRequest struct {
+	UserID    string `json:"userID"`
+	AuthToken string `json:"authToken"`
+	// The text to look for in the item's name. The search is case-insensitive
+	Query string `json:"query"`
+	// When true, only names that start with the query are returned. Otherwise the query can be anywhere in the name
+	PrefixOnly bool `json:"prefixOnly"`
+	// Optional MIME type filter. A value ending in '/' such as "image/" matches every subtype
+	MIMEType string `json:"type" binding:"omitempty"`
+	// Optional size range in bytes. MaxSize is ignored when it is 0
+	MinSize int `json:"minSize" binding:"omitempty"`
+	MaxSize int `json:"maxSize" binding:"omitempty"`
+	// Optional date range compared against the last modified date, or the created date if it was never modified
+	ModifiedAfter  time.Time `json:"modifiedAfter" binding:"omitempty"`
+	ModifiedBefore time.Time `json:"modifiedBefore" binding:"omitempty"`
+	// The page to return, starting at 0
+	Page int `json:"page"`
+	// The number of results per page. Defaults to DefaultSearchPageSize
+	PageSize int `json:"pageSize" binding:"omitempty"`
+}
+
+type SearchFilesResult struct {
+	ID        string `json:"id"`
+	ParentDir string `json:"parentDir"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Size      int    `json:"size"`
+	// The owner of the item
+	UserID       string       `json:"userID"`
+	CreatedDate  time.Time    `json:"createdDate"`
+	LastModified sql.NullTime `json:"lastModified"`
+	// The folders leading to the item, starting from the top-most folder that the user can see
+	Path []PathItem `json:"path"`
+	// The SHA-256 of the plaintext in hex. Empty for folders and for files encrypted by the client
+	SHA256 string `json:"sha256"`
+	// The SHA-256 of the stored age file in hex. Empty for folders
+	CiphertextSHA256 string `json:"ciphertextSHA256"`
+}
+
+// A single folder in a breadcrumb path
+type PathItem struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// True when the name is encrypted to the folder key, as base64
+	NameEncrypted bool `json:"nameEncrypted"`
+}
+
+// The user's preferences
+type UserSettings struct {
+	// Remove the EXIF/XMP/IPTC data from the photos that the user uploads
+	StripPhotoMetadata bool `json:"stripPhotoMetadata"`
+	// Who can see the user's profile picture. "everyone", "friends" or "nobody"
+	ProfilePictureVisibility string `json:"profilePictureVisibility"`
+	// The name shown to other users. Empty if the user didn't set one
+	DisplayName string `json:"displayName"`
+	// When false, the user only shows up in searchUsers for users that they have a friendship or request with
+	Discoverable bool `json:"discoverable"`
+	// Who can share items with the user. "anyone", "friends" or "organization"
+	SharingPolicy string `json:"sharingPolicy"`
+}
+
+// Used to change the user's settings. Only the fields that are set are changed
+type UpdateSettingsRequest struct {
+	UserID             string `json:"userID"`
+	AuthToken          string `json:"authToken"`
+	StripPhotoMetadata *bool  `json:"stripPhotoMetadata" binding:"omitempty"`
+	// "everyone", "friends" or "nobody"
+	ProfilePictureVisibility string `json:"profilePictureVisibility" binding:"omitempty"`
+	// A pointer so that the display name can be removed by sending an empty string
+	DisplayName  *string `json:"displayName" binding:"omitempty"`
+	Discoverable *bool   `json:"discoverable" binding:"omitempty"`
+	// "anyone", "friends" or "organization"
+	SharingPolicy string `json:"sharingPolicy" binding:"omitempty"`
+}
+
+type SearchUsersRequest struct {
+	UserID    string `json:"userID"`
+	AuthToken string `json:"authToken"`
+	// Matched against the start of the userID or of any word in the display name. The search is case-insensitive
+	Query string `json:"query"`
+	// The page to return, starting at 0
+	Page int `json:"page"`
+	// The number of results per page. Defaults to DefaultSearchPageSize
+	PageSize int `json:"pageSize" binding:"omitempty"`
+}
+
+type SearchUsersResult struct {
+	UserID      string `json:"userID"`
+	DisplayName string `json:"displayName"`
+	// "none", "pending", "friends" or "blocked"
+	Friendship string `json:"friendship"`
+}
+
+type CreateGroupRequest struct {
+	UserID    string `json:"userID"`
+	AuthToken string `json:"authToken"`
+	Name      string `json:"name"`
+	// The owner is added automatically
+	Members []string `json:"members" binding:"omitempty"`
+}
+
+// Used to add or remove members and to delete a group. Members is ignored when deleting
+type GroupMembersRequest struct {
+	UserID    string   `json:"userID"`
+	AuthToken string   `json:"authToken"`
+	GroupID   string   `json:"groupID"`
+	Members   []string `json:"members" binding:"omitempty"`
+}
+
+type Group struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	OwnerUserID string   `json:"ownerUserID"`
+	Members     []string `json:"members"`
+}
+
+// A user that a folder key has to be encrypted for
+type FolderKeyRecipient struct {
+	UserID    string `json:"userID"`
+	PublicKey string `json:"publicKey"`
+}
+
+type OfferOwnershipRequest struct {
+	UserID    string `json:"userID"`
+	AuthToken string `json:"authToken"`
+	// The file or folder to transfer
+	FileID   string `json:"fileID"`
+	ToUserID string `json:"toUserID"`
+}
+
+// Used to accept or cancel an ownership transfer
+type OwnershipTransferRequest struct {
+	UserID     string `json:"userID"`
+	AuthToken  string `json:"authToken"`
+	TransferID string `json:"transferID"`
+}
+
+type OwnershipTransfer struct {
+	ID          string    `json:"id"`
+	FileID      string    `json:"fileID"`
+	FromUserID  string    `json:"fromUserID"`
+	ToUserID    string    `json:"toUserID"`
+	CreatedDate time.Time `json:"createdDate"`
+}
+
+// Used by the endpoints that register, label, list and revoke the user's device keys. The fields that are not needed are ignored
+type PublicKeyRequest struct {
+	UserID    string `json:"userID"`
+	AuthToken string `json:"authToken"`
+	// The age public key. "age1..."
+	PublicKey   string `json:"publicKey" binding:"omitempty"`
+	Description string `json:"description" binding:"omitempty"`
+}
+
+// A public key of one of the user's devices
+type DeviceKey struct {
+	PublicKey string `json:"publicKey"`
+	// "X25519", "ssh-ed25519" or "ssh-rsa"
+	KeyType     string    `json:"keyType"`
+	Description string    `json:"description"`
+	CreatedDate time.Time `json:"createdDate"`
+	// nil if the key is active
+	RevokedDate *time.Time `json:"revokedDate"`
+	// Set while the key is being replaced in a key rotation
+	RetiringDate *time.Time `json:"retiringDate"`
+}
+
+type StartKeyRotationRequest struct {
+	UserID       string `json:"userID"`
+	AuthToken    string `json:"authToken"`
+	OldPublicKey string `json:"oldPublicKey"`
+	NewPublicKey string `json:"newPublicKey"`
+	// The description of the new key
+	Description string `json:"description"`
+}
+
+// Used to list the items of a key rotation and to complete it. PublicKey is the retiring key
+type KeyRotationRequest struct {
+	UserID    string `json:"userID"`
+	AuthToken string `json:"authToken"`
+	PublicKey string `json:"publicKey"`
+	// The maximum number of items to return, up to MaxRotationItems
+	Limit int `json:"limit" binding:"omitempty"`
+}
+
+// A file, thumbnail or folder key that is still encrypted with the retiring key
+type RotationItem struct {
+	FileID string `json:"fileID"`
+	// "file", "thumbnail" or "folderKey"
+	Type   string `json:"type"`
+	ObjKey string `json:"objKey"`
+	// The public keys that it has to be encrypted with
+	Recipients []string `json:"recipients"`
+}
+
+type KeyBackupRequest struct {
+	UserID    string `json:"userID"`
+	AuthToken string `json:"authToken"`
+	// The age identity encrypted with a passphrase. It is base64 in the JSON
+	Backup []byte `json:"backup"`
+}
+
+type RecoveryCodesRequest struct {
+	UserID    string `json:"userID"`
+	AuthToken string `json:"authToken"`
+	Password  string `json:"password"`
+}
+
+type RecoverAccountRequest struct {
+	UserID       string `json:"userID"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+// Used to list and restore the previous folder keys. VersionID is only needed to restore one
+type FolderKeyVersionRequest struct {
+	UserID    string `json:"userID"`
+	AuthToken string `json:"authToken"`
+	FolderID  string `json:"folderID"`
+	VersionID string `json:"versionID" binding:"omitempty"`
+}
+
+// A previous folder key of a folder
+type FolderKeyVersion struct {
+	ID string `json:"id"`
+	// The user that replaced it with a newer folder key
+	ReplacedBy  string    `json:"replacedBy"`
+	CreatedDate time.Time `json:"createdDate"`
+}
+
+type UploadRecipientsRequest struct {
+	UserID    string `json:"userID"`
+	AuthToken string `json:"authToken"`
+	// For the root/home it is 'root', otherwise it is the parentDir's ID
+	ParentDir string `json:"parentDir"`
+}
+
+type GetReencryptionTasksRequest struct {
+	UserID    string `json:"userID"`
+	AuthToken string `json:"authToken"`
+	// The maximum number of tasks to return, up to MaxReencryptionTasks
+	Limit int `json:"limit" binding:"omitempty"`
+}
+
+// A file or folder key that the user's devices have to encrypt again
+type ReencryptionTask struct {
+	ID     string `json:"id"`
+	FileID string `json:"fileID"`
+	// "file" or "folderKey"
+	TaskType string `json:"type"`
+	// What created the task. "share", "ownershipTransfer", "move" or "copy"
+	Reason string `json:"reason"`
+	// The object to download, decrypt and encrypt again. For folder keys it is folderkeys/<fileID>
+	ObjKey string `json:"objKey"`
+	// Empty if there is no thumbnail. Otherwise it has to be encrypted again and uploaded with the file
+	ThumbnailObjKey string `json:"thumbnailObjKey"`
+	// The public keys that it has to be encrypted with
+	Recipients []string `json:"recipients"`
+}
+
+// Used by the admin jobs
+type AdminRequest struct {
+	UserID    string `json:"userID"`
+	AuthToken string `json:"authToken"`
+	// The maximum number of files to check, up to MaxScrubItems. Only used by startScrub
+	Limit int `json:"limit" binding:"omitempty"`
+	// Only report what would be deleted. Only used by runGarbageCollector
+	DryRun bool `json:"dryRun" binding:"omitempty"`
+	// The user whose organization is set. Only used by setUserOrganization
+	TargetUserID string `json:"targetUserID" binding:"omitempty"`
+	// Empty to remove the user from their organization. Only used by setUserOrganization
+	OrganizationID string `json:"organizationID" binding:"omitempty"`
+}
+
+// The progress of a scrub
+type ScrubStatus struct {
+	Running     bool      `json:"running"`
+	StartedDate time.Time `json:"startedDate"`
+	// nil while it is running
+	FinishedDate *time.Time `json:"finishedDate"`
+	// The number of files checked
+	Checked int `json:"checked"`
+	// The number of files that didn't match their checksum
+	Mismatches int `json:"mismatches"`
+	// The number of files that couldn't be read from S3
+	Errors int `json:"errors"`
+	// Set if the scrub stopped because of an error
+	Error string `json:"error"`
+}
+
+// A file whose stored object didn't match its checksum
+type CorruptedFile struct {
+	ID     string `json:"id"`
+	ObjKey string `json:"objKey"`
+	// The owner of the file
+	UserID       string    `json:"userID"`
+	VerifiedDate time.Time `json:"verifiedDate"`
+}
+
+// What the garbage collector deleted, or would delete in a dry run
+type GCReport struct {
+	DryRun      bool      `json:"dryRun"`
+	StartedDate time.Time `json:"startedDate"`
+	// Items left in the DB after a folder above them was deleted
+	OrphanedFileCount int      `json:"orphanedFileCount"`
+	OrphanedFiles     []string `json:"orphanedFiles"`
+	// The number of objects in the bucket
+	ObjectsChecked int `json:"objectsChecked"`
+	// S3 objects that are not used by anything in the DB
+	OrphanedObjectCount int      `json:"orphanedObjectCount"`
+	OrphanedObjectBytes int64    `json:"orphanedObjectBytes"`
+	OrphanedObjects     []string `json:"orphanedObjects"`
+	// Files left in TMPStorageDir
+	TmpFileCount int      `json:"tmpFileCount"`
+	TmpFileBytes int64    `json:"tmpFileBytes"`
+	TmpFiles     []string `json:"tmpFiles"`
+	// The number of items that couldn't be deleted
+	Errors int `json:"errors"`
+}
+
+type DownloadFolderRequest struct {
+	UserID    string `json:"userID"`
+	AuthToken string `json:"authToken"`
+	// 'root' downloads the user's home
+	FolderID string `json:"folderID"`
+}
+
+// manifest.json in the ZIP file of a folder download
+type FolderArchiveManifest struct {
+	FolderID    string    `json:"folderID"`
+	CreatedDate time.Time `json:"createdDate"`
+	// The folders come before the items inside of them
+	Items []FolderArchiveItem `json:"items"`
+	// The folder keys that the items are encrypted to
+	FolderKeys []FolderArchiveKey `json:"folderKeys"`
+}
+
+type FolderArchiveItem struct {
+	ID        string `json:"id"`
+	ParentDir string `json:"parentDir"`
+	// The path in the ZIP file. Files have the .age extension. It is empty for files that are still being uploaded, they are not in the ZIP file
+	Path string `json:"path"`
+	// The name as it is stored. Encrypted names are base64 of an age file, their path uses the ID instead
+	Name             string `json:"name"`
+	NameEncrypted    bool   `json:"nameEncrypted"`
+	Type             string `json:"type"`
+	Size             int    `json:"size"`
+	SHA256           string `json:"sha256"`
+	CiphertextSHA256 string `json:"ciphertextSHA256"`
+	// The folder whose folder key the content and the encrypted name are encrypted to. Empty if they are encrypted to the devices of the users
+	FolderKeyID string `json:"folderKeyID"`
+}
+
+type FolderArchiveKey struct {
+	FolderID string `json:"folderID"`
+	// The path of the encrypted folder key in the ZIP file
+	Path string `json:"path"`
+}
+
+type CopyItemRequest struct {
+	UserID    string `json:"userID"`
+	AuthToken string `json:"authToken"`
+	// The file or folder to copy
+	ItemID string `json:"itemID"`
+	// The folder where the copy is created, 'root' for the user's home
+	DestinationDirID string `json:"destinationDirID"`
+	// The name of the copy. Defaults to the name of the item, it is required when the name is encrypted
+	NewName string `json:"newName" binding:"omitempty"`
+	// The blind index of newName. Required when the destination has encrypted names
+	NameIndex string `json:"nameIndex" binding:"omitempty"`
+}
+
+type GetCopyJobRequest struct {
+	UserID    string `json:"userID"`
+	AuthToken string `json:"authToken"`
+	JobID     string `json:"jobID"`
+}
+
+// A copy that is done in the background
+type CopyJob struct {
+	ID string `json:"id"`
+	// The copy of the item
+	ItemID string `json:"itemID"`
+	// "running", "done" or "failed"
+	Status       string       `json:"status"`
+	TotalFiles   int          `json:"totalFiles"`
+	CopiedFiles  int          `json:"copiedFiles"`
+	Error        string       `json:"error"`
+	CreatedDate  time.Time    `json:"createdDate"`
+	FinishedDate sql.NullTime `json:"finishedDate"`
+}
+
+type BatchRequest struct {
+	UserID    string `json:"userID"`
+	AuthToken string `json:"authToken"`
+	// Run in order, up to MaxBatchOperations
+	Operations []BatchOperation `json:"operations"`
+	// Don't run the operations after the first one that fails
+	StopOnError bool `json:"stopOnError" binding:"omitempty"`
+}
+
+// An operation of a batch request. Only the fields used by the operation are needed
+type BatchOperation struct {
+	// "delete", "move", "rename", "share" or "copy"
+	Op string `json:"op"`
+	// The file or folder
+	ItemID string `json:"itemID"`
+	// The folder where the item is moved or copied to
+	DestinationDirID string `json:"destinationDirID" binding:"omitempty"`
+	// The new name for rename. For move and copy it defaults to the name of the item
+	NewName string `json:"newName" binding:"omitempty"`
+	// The blind index of newName. Required when the folder has encrypted names
+	NameIndex string `json:"nameIndex" binding:"omitempty"`
+	// The users and groups to share with
+	WithUserID  []string `json:"withUserID" binding:"omitempty"`
+	WithGroupID []string `json:"withGroupID" binding:"omitempty"`
+	ReadOnly    bool     `json:"isReadOnly" binding:"omitempty"`
+}
+
+// The result of an operation of a batch request
+type BatchResult struct {
+	// The position of the operation in the request
+	Index  int    `json:"index"`
+	Op     string `json:"op"`
+	ItemID string `json:"itemID"`
+	// The status code that the operation's own endpoint would return
+	Status int `json:"status"`
+	// The body that the operation's own endpoint would return
+	Response map[string]any `json:"response"`
 }
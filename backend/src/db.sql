@@ -17,14 +17,24 @@ INSERT INTO roles (roleID, canModifyOtherUser, createdDate) VALUES
 ("admin", true, now());
 
 -- profilePicture is the S3 objKey for the user's profile picture
+-- stripPhotoMetadata is a setting to remove the EXIF/XMP/IPTC data from the photos that the user uploads
+-- profilePictureVisibility is who can see the user's profile picture. The rest get the default avatar
+-- displayName is the name shown to other users. discoverable is if the user shows up when other users search for them
+-- sharingPolicy is who can share items with the user, on top of the server's SharingPolicy. organizationID is used by the 'organization' policy and is set by admins with setUserOrganization
 CREATE TABLE IF NOT EXISTS users (
-  userID            VARCHAR(50)     PRIMARY KEY,
-  email             VARCHAR(50)     NOT NULL,
-  password          BINARY(60)      NOT NULL,
-  roleID            VARCHAR(50)     NOT NULL,
-  profilePictureID  VARCHAR(50)     DEFAULT NULL,
-  createdDate       DATETIME        NOT NULL,
-  lastModified      DATETIME        DEFAULT NULL,
+  userID                    VARCHAR(50)     PRIMARY KEY,
+  email                     VARCHAR(50)     NOT NULL,
+  password                  BINARY(60)      NOT NULL,
+  roleID                    VARCHAR(50)     NOT NULL,
+  profilePictureID          VARCHAR(50)     DEFAULT NULL,
+  displayName               VARCHAR(50)     DEFAULT NULL,
+  discoverable              BOOL            NOT NULL  DEFAULT true,
+  sharingPolicy             ENUM('anyone', 'friends', 'organization')  NOT NULL  DEFAULT 'anyone',
+  organizationID            VARCHAR(50)     DEFAULT NULL,
+  stripPhotoMetadata        BOOL            NOT NULL  DEFAULT false,
+  profilePictureVisibility  ENUM('everyone', 'friends', 'nobody')  NOT NULL  DEFAULT 'everyone',
+  createdDate               DATETIME        NOT NULL,
+  lastModified              DATETIME        DEFAULT NULL,
   CONSTRAINT users_roleID_fk FOREIGN KEY (roleID) REFERENCES roles(roleID) ON DELETE RESTRICT
 );
 
@@ -50,28 +60,46 @@ INSERT INTO authTokens (tokenID, userID, loginDate) VALUES ('K1xS9ehuxeC5tw==',
 -- If it is a folder, then type is 'folder' and size is 0
 -- Processed is to indicate whether the file has been checked/inspected or not. true means that it is ready to be accessed.
 -- objKey is the S3 object key. it is null on folders
+-- thumbnailObjKey is the S3 object key of the file's thumbnail, encrypted with the same key as the file. It is null when there is no thumbnail
+-- nameIndex is only set when the name is encrypted. The name is then an age file encrypted to the folder key, in base64, and nameIndex is a blind index of it made by the client. It keeps the names unique in the folder
+-- encryptNames is set on folders where the names of the items inside are encrypted. Search skips the items with encrypted names
+-- plaintextSHA256 and ciphertextSHA256 are the hex SHA-256 of the content and of the age file in S3. plaintextSHA256 is null for files encrypted by the client
+-- checksumVerifiedDate is the last time that the scrub read the object, and checksumMismatch is true if it didn't match ciphertextSHA256
 CREATE TABLE IF NOT EXISTS files (
-  id            VARCHAR(36)   PRIMARY KEY,
-  objKey        VARCHAR(36)   NOT NULL   DEFAULT "",
-  parentDir     VARCHAR(50)   NOT NULL,
-  name          VARCHAR(265)  NOT NULL,
-  type          VARCHAR(50)   NOT NULL,
-  size          INT           NOT NULL,
-  userID        VARCHAR(50)   NOT NULL,
-  processed     BOOL          NOT NULL  DEFAULT false,
-  createdDate   DATETIME      NOT NULL,
-  lastModified  DATETIME      DEFAULT NULL,
+  id               VARCHAR(36)   PRIMARY KEY,
+  objKey           VARCHAR(36)   NOT NULL   DEFAULT "",
+  thumbnailObjKey  VARCHAR(36)   DEFAULT NULL,
+  parentDir        VARCHAR(50)   NOT NULL,
+  name             VARCHAR(1024) NOT NULL,
+  nameIndex        CHAR(64)      DEFAULT NULL,
+  encryptNames     BOOL          NOT NULL  DEFAULT false,
+  type             VARCHAR(50)   NOT NULL,
+  size             INT           NOT NULL,
+  userID           VARCHAR(50)   NOT NULL,
+  processed        BOOL          NOT NULL  DEFAULT false,
+  createdDate      DATETIME      NOT NULL,
+  lastModified     DATETIME      DEFAULT NULL,
+  plaintextSHA256      CHAR(64)  CHARACTER SET ascii  DEFAULT NULL,
+  ciphertextSHA256     CHAR(64)  CHARACTER SET ascii  DEFAULT NULL,
+  checksumVerifiedDate DATETIME  DEFAULT NULL,
+  checksumMismatch     BOOL      NOT NULL  DEFAULT false,
+  UNIQUE KEY files_nameIndex_uq (parentDir, nameIndex),
   CONSTRAINT files_userID_fk FOREIGN KEY (userID) REFERENCES users(userID) ON DELETE CASCADE
 );
 
 -- The user's age public keys. The description is some sort of text to identify the key if the user has multiple public keys
+-- keyType is X25519 for age1... keys, ssh-ed25519 or ssh-rsa for SSH keys, which are stored without the comment
 -- folderID is optional and only there if the public key is for a folder. When it is for a folder then the userID is the folders owner.
+-- A user has one public key for each of their devices. Everything is encrypted with all of the keys that don't have a revokedDate
 CREATE TABLE IF NOT EXISTS encryptionKeys (
-  publicKey    VARCHAR(65)     PRIMARY KEY,
+  publicKey    VARCHAR(750)    CHARACTER SET ascii PRIMARY KEY,
+  keyType      VARCHAR(20)     NOT NULL DEFAULT 'X25519',
   userID       VARCHAR(50)     NOT NULL,
   description  VARCHAR(50)     NOT NULL,
   createdDate  DATETIME        NOT NULL,
   folderID     VARCHAR(36)     DEFAULT null,
+  revokedDate  DATETIME        DEFAULT NULL,
+  retiringDate DATETIME        DEFAULT NULL,
   CONSTRAINT encryptionKeys_userID_fk FOREIGN KEY (userID) REFERENCES users(userID) ON DELETE CASCADE,
   CONSTRAINT encryptionKeys_folder_fk FOREIGN KEY (folderid) REFERENCES files(id) ON DELETE CASCADE
 );
@@ -96,6 +124,137 @@ CREATE TABLE IF NOT EXISTS sharedFiles (
   UNIQUE KEY unique_ids (fileID, userID, fileOwner)
 );
 
+-- Groups of users that items can be shared with. The owner is also in userGroupMembers
+CREATE TABLE IF NOT EXISTS userGroups (
+  id            VARCHAR(36)   PRIMARY KEY,
+  name          VARCHAR(50)   NOT NULL,
+  ownerUserID   VARCHAR(50)   NOT NULL,
+  createdDate   DATETIME      NOT NULL,
+  lastModified  DATETIME      DEFAULT NULL,
+  CONSTRAINT userGroups_ownerUserID_fk FOREIGN KEY (ownerUserID) REFERENCES users(userID) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS userGroupMembers (
+  groupID       VARCHAR(36)   NOT NULL,
+  userID        VARCHAR(50)   NOT NULL,
+  createdDate   DATETIME      NOT NULL,
+  PRIMARY KEY (groupID, userID),
+  CONSTRAINT userGroupMembers_groupID_fk FOREIGN KEY (groupID) REFERENCES userGroups(id) ON DELETE CASCADE,
+  CONSTRAINT userGroupMembers_userID_fk FOREIGN KEY (userID) REFERENCES users(userID) ON DELETE CASCADE
+);
+
+-- items shared with a group. Every member of the group gets the permission
+-- processed works the same way as in sharedFiles
+CREATE TABLE IF NOT EXISTS sharedFilesGroups (
+  id            VARCHAR(36)   PRIMARY KEY,
+  fileID        VARCHAR(36)   NOT NULL,
+  groupID       VARCHAR(36)   NOT NULL,
+  fileOwner     VARCHAR(50)   NOT NULL,
+  isReadOnly    BOOL          NOT NULL  DEFAULT true,
+  processed     BOOL          NOT NULL  DEFAULT false,
+  createdDate   DATETIME      NOT NULL,
+  lastModified  DATETIME      DEFAULT NULL,
+  CONSTRAINT sharedFilesGroups_fileID_fk FOREIGN KEY (fileID) REFERENCES files(id) ON DELETE CASCADE,
+  CONSTRAINT sharedFilesGroups_groupID_fk FOREIGN KEY (groupID) REFERENCES userGroups(id) ON DELETE CASCADE,
+  CONSTRAINT sharedFilesGroups_fileOwner_fk FOREIGN KEY (fileOwner) REFERENCES users(userID) ON DELETE CASCADE,
+  UNIQUE KEY unique_ids (fileID, groupID)
+);
+
+-- Pending offers to transfer the ownership of a file or folder. There is only one per item
+CREATE TABLE IF NOT EXISTS ownershipTransfers (
+  id            VARCHAR(36)   PRIMARY KEY,
+  fileID        VARCHAR(36)   NOT NULL,
+  fromUserID    VARCHAR(50)   NOT NULL,
+  toUserID      VARCHAR(50)   NOT NULL,
+  createdDate   DATETIME      NOT NULL,
+  CONSTRAINT ownershipTransfers_fileID_fk FOREIGN KEY (fileID) REFERENCES files(id) ON DELETE CASCADE,
+  CONSTRAINT ownershipTransfers_fromUserID_fk FOREIGN KEY (fromUserID) REFERENCES users(userID) ON DELETE CASCADE,
+  CONSTRAINT ownershipTransfers_toUserID_fk FOREIGN KEY (toUserID) REFERENCES users(userID) ON DELETE CASCADE,
+  UNIQUE KEY unique_fileID (fileID)
+);
+
+-- Files and folder keys that have to be encrypted again by a client. userID is the user whose devices can decrypt them.
+-- taskType is 'file' to re-upload the file or 'folderKey' to re-wrap the folder key. reason is what created the task, 'share', 'ownershipTransfer', 'copy' or 'move'
+-- sharedFileID or sharedFileGroupID is the share that is waiting for the task. The share is marked as processed when all of its tasks are done
+CREATE TABLE IF NOT EXISTS reencryptionTasks (
+  id            VARCHAR(36)   PRIMARY KEY,
+  fileID        VARCHAR(36)   NOT NULL,
+  userID        VARCHAR(50)   NOT NULL,
+  taskType      ENUM('file', 'folderKey')  NOT NULL,
+  reason        VARCHAR(50)   NOT NULL,
+  sharedFileID  VARCHAR(36)   DEFAULT NULL,
+  sharedFileGroupID  VARCHAR(36)  DEFAULT NULL,
+  createdDate   DATETIME      NOT NULL,
+  CONSTRAINT reencryptionTasks_fileID_fk FOREIGN KEY (fileID) REFERENCES files(id) ON DELETE CASCADE,
+  CONSTRAINT reencryptionTasks_userID_fk FOREIGN KEY (userID) REFERENCES users(userID) ON DELETE CASCADE,
+  CONSTRAINT reencryptionTasks_sharedFileID_fk FOREIGN KEY (sharedFileID) REFERENCES sharedFiles(id) ON DELETE CASCADE,
+  CONSTRAINT reencryptionTasks_sharedFileGroupID_fk FOREIGN KEY (sharedFileGroupID) REFERENCES sharedFilesGroups(id) ON DELETE CASCADE
+);
+
+-- The user's age identity encrypted by the client with a passphrase (age scrypt recipient). The server can't decrypt it.
+-- lastAccessed is the last time that it was fetched
+CREATE TABLE IF NOT EXISTS keyBackups (
+  userID        VARCHAR(50)   PRIMARY KEY,
+  backup        BLOB          NOT NULL,
+  createdDate   DATETIME      NOT NULL,
+  lastAccessed  DATETIME      DEFAULT NULL,
+  CONSTRAINT keyBackups_userID_fk FOREIGN KEY (userID) REFERENCES users(userID) ON DELETE CASCADE
+);
+
+-- One-time codes to sign in without the password. codeHash is the hex SHA-256 of the code. usedDate is set once the code is used
+CREATE TABLE IF NOT EXISTS recoveryCodes (
+  codeHash      CHAR(64)      PRIMARY KEY,
+  userID        VARCHAR(50)   NOT NULL,
+  createdDate   DATETIME      NOT NULL,
+  usedDate      DATETIME      DEFAULT NULL,
+  CONSTRAINT recoveryCodes_userID_fk FOREIGN KEY (userID) REFERENCES users(userID) ON DELETE CASCADE
+);
+
+-- Previous folder keys, kept so that a bad folder key update can be rolled back. The S3 object key is folderkeyversions/<id>
+-- replacedBy is the user that uploaded the folder key that replaced it. createdDate is when it was replaced
+CREATE TABLE IF NOT EXISTS folderKeyVersions (
+  id            VARCHAR(36)   PRIMARY KEY,
+  folderID      VARCHAR(36)   NOT NULL,
+  replacedBy    VARCHAR(50)   NOT NULL,
+  createdDate   DATETIME      NOT NULL,
+  CONSTRAINT folderKeyVersions_folderID_fk FOREIGN KEY (folderID) REFERENCES files(id) ON DELETE CASCADE
+);
+
+-- The device public keys that each S3 object is encrypted with. Used to find what still has to be re-encrypted during a key rotation.
+-- objKey is the file, thumbnail or folderkeys/<folderID> object key
+CREATE TABLE IF NOT EXISTS objectRecipients (
+  objKey        VARCHAR(80)   NOT NULL,
+  publicKey     VARCHAR(750)  CHARACTER SET ascii NOT NULL,
+  PRIMARY KEY (objKey, publicKey),
+  CONSTRAINT objectRecipients_publicKey_fk FOREIGN KEY (publicKey) REFERENCES encryptionKeys(publicKey) ON DELETE CASCADE
+);
+
+-- The objects uploaded by processFile, to reuse them when the user uploads the same content again. Files encrypted by the client are not included.
+-- recipientsSHA256 is the hex SHA-256 of the sorted public keys in objectRecipients. refCount is the number of files that use the object, it is deleted from S3 when it reaches 0
+CREATE TABLE IF NOT EXISTS dedupObjects (
+  objKey            VARCHAR(36)   PRIMARY KEY,
+  userID            VARCHAR(50)   NOT NULL,
+  plaintextSHA256   CHAR(64)      CHARACTER SET ascii NOT NULL,
+  recipientsSHA256  CHAR(64)      CHARACTER SET ascii NOT NULL,
+  refCount          INT           NOT NULL  DEFAULT 1,
+  KEY dedupObjects_lookup_idx (userID, plaintextSHA256, recipientsSHA256),
+  CONSTRAINT dedupObjects_userID_fk FOREIGN KEY (userID) REFERENCES users(userID) ON DELETE CASCADE
+);
+
+-- Copies of folders that are done in the background. itemID is the copy of the folder. totalFiles is the number of objects to copy
+CREATE TABLE IF NOT EXISTS copyJobs (
+  id            VARCHAR(36)   PRIMARY KEY,
+  userID        VARCHAR(50)   NOT NULL,
+  itemID        VARCHAR(36)   NOT NULL,
+  status        ENUM('running', 'done', 'failed')  NOT NULL,
+  totalFiles    INT           NOT NULL,
+  copiedFiles   INT           NOT NULL  DEFAULT 0,
+  error         VARCHAR(300)  DEFAULT NULL,
+  createdDate   DATETIME      NOT NULL,
+  finishedDate  DATETIME      DEFAULT NULL,
+  CONSTRAINT copyJobs_userID_fk FOREIGN KEY (userID) REFERENCES users(userID) ON DELETE CASCADE
+);
+
 -- A table with all the alerts/notifications that are active
 -- fileID and fileOwner are optinal and only used if the alert involves a file and or another user
 -- processed is used to know if it has been sent. Once the user dismisses it, we could delete it.
@@ -114,7 +273,7 @@ CREATE TABLE IF NOT EXISTS user_friends (
   friendshipID     VARCHAR(36)  PRIMARY KEY,
   userID1          VARCHAR(50)  NOT NULL,
   userID2          VARCHAR(50)  NOT NULL,
-  request_status            ENUM('pending', 'accepted', 'declined') DEFAULT 'pending',
+  request_status            ENUM('pending', 'accepted', 'declined', 'blocked') DEFAULT 'pending', -- for 'blocked', userID1 blocked userID2
   createdDate      DATETIME     NOT NULL,
   CONSTRAINT user_friends_userID1_fk FOREIGN KEY (userID1) REFERENCES users(userID) ON DELETE CASCADE,
   CONSTRAINT user_friends_userID2_fk FOREIGN KEY (userID2) REFERENCES users(userID) ON DELETE CASCADE,
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Returns the SHA-256 of the set of public keys in hex. The order and duplicates don't change it
+func recipientsChecksum(publicKeys []string) string {
+	keys := slices.Clone(publicKeys)
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+	return sha256Hex([]byte(strings.Join(keys, "\n")))
+}
+
+// Looks for an object of the user with the same plaintext that is encrypted to the same recipients and adds a reference to it.
+// Returns the objKey and the checksum of its ciphertext, or an empty objKey if there is none.
+// The reference has to be released with releaseObject if the file doesn't end up using it.
+func reuseObject(ctx context.Context, userID, plaintextChecksum, recipients string) (string, string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	// Lock the row so that it can't be deleted by releaseObject before the reference is added
+	var objKey string
+	err = tx.QueryRowContext(ctx, "SELECT objKey FROM dedupObjects WHERE userID = ? AND plaintextSHA256 = ? AND recipientsSHA256 = ? AND refCount > 0 LIMIT 1 FOR UPDATE", userID, plaintextChecksum, recipients).Scan(&objKey)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE dedupObjects SET refCount = refCount + 1 WHERE objKey = ?", objKey)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to add the reference. %w", err)
+	}
+
+	var ciphertextChecksum string
+	err = tx.QueryRowContext(ctx, "SELECT IFNULL(MAX(ciphertextSHA256), '') FROM files WHERE objKey = ?", objKey).Scan(&ciphertextChecksum)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get the ciphertext checksum. %w", err)
+	}
+
+	return objKey, ciphertextChecksum, tx.Commit()
+}
+
+// Registers a new object so that the next uploads of the same content can reuse it. It starts with one reference
+func addDedupObject(ctx context.Context, objKey, userID, plaintextChecksum, recipients string) error {
+	_, err := db.ExecContext(ctx, "INSERT INTO dedupObjects (objKey, userID, plaintextSHA256, recipientsSHA256, refCount) VALUES (?, ?, ?, ?, 1)", objKey, userID, plaintextChecksum, recipients)
+	return err
+}
+
+// Removes a reference to the object. It returns true when it was the last one and the S3 object can be deleted.
+// Objects that are not deduplicated, e.g. the ones uploaded by clients that encrypt the files, only have one reference.
+func releaseObject(ctx context.Context, objKey string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var refCount int
+	err = tx.QueryRowContext(ctx, "SELECT refCount FROM dedupObjects WHERE objKey = ? FOR UPDATE", objKey).Scan(&refCount)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	if refCount > 1 {
+		_, err = tx.ExecContext(ctx, "UPDATE dedupObjects SET refCount = refCount - 1 WHERE objKey = ?", objKey)
+	} else {
+		_, err = tx.ExecContext(ctx, "DELETE FROM dedupObjects WHERE objKey = ?", objKey)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to remove the reference. %w", err)
+	}
+
+	return refCount <= 1, tx.Commit()
+}
+
+// Prepares an object to be replaced by one of the files that use it. Returns true if other files use it too, the file then needs a new object.
+// Otherwise the object stops being reused, since it won't be encrypted to the recipients that it was registered with anymore.
+func detachDedupObject(ctx context.Context, objKey string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Lock the row so that reuseObject can't add a reference while it is replaced
+	var refCount int
+	err = tx.QueryRowContext(ctx, "SELECT refCount FROM dedupObjects WHERE objKey = ? FOR UPDATE", objKey).Scan(&refCount)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if refCount > 1 {
+		return true, nil
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM dedupObjects WHERE objKey = ?", objKey)
+	if err != nil {
+		return false, fmt.Errorf("failed to remove the object. %w", err)
+	}
+	return false, tx.Commit()
+}
+
+// Removes the file's reference to the object and deletes it from S3 if no other file uses it
+func deleteFileObject(ctx context.Context, objKey string) error {
+	if objKey == "" {
+		return nil
+	}
+
+	last, err := releaseObject(ctx, objKey)
+	if err != nil {
+		return fmt.Errorf("releaseObject error. %w", err)
+	}
+
+	if !last {
+		return nil
+	}
+
+	_, err = deleteFile(ctx, s3Client, serverConfig.S3BucketName, objKey)
+	return err
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+)
+
+func TestRecipientsChecksum(t *testing.T) {
+	a := recipientsChecksum([]string{"age1b", "age1a", "age1c"})
+	b := recipientsChecksum([]string{"age1c", "age1a", "age1b", "age1a"})
+	if a != b {
+		t.Errorf("the order or duplicates changed the checksum: %s != %s", a, b)
+	}
+
+	c := recipientsChecksum([]string{"age1a", "age1b"})
+	if a == c {
+		t.Error("different recipients have the same checksum")
+	}
+}
+
+func TestDetachDedupObject(t *testing.T) {
+	ctx := context.Background()
+
+	// Other files use it, it stays as it is and the file needs a new object
+	fake := useFakeDB(t, fakeResponse{match: "SELECT refCount FROM dedupObjects", columns: []string{"refCount"}, rows: [][]driver.Value{{2}}})
+	shared, err := detachDedupObject(ctx, "object")
+	if err != nil || !shared {
+		t.Errorf("detachDedupObject() with 2 references = %v %v, want true", shared, err)
+	}
+	if calls := fake.callsMatching("DELETE FROM dedupObjects"); len(calls) != 0 {
+		t.Errorf("got %v, want the object kept", calls)
+	}
+
+	// Only this file uses it, it is replaced in place and can't be reused anymore
+	fake = useFakeDB(t, fakeResponse{match: "SELECT refCount FROM dedupObjects", columns: []string{"refCount"}, rows: [][]driver.Value{{1}}})
+	shared, err = detachDedupObject(ctx, "object")
+	if err != nil || shared {
+		t.Errorf("detachDedupObject() with 1 reference = %v %v, want false", shared, err)
+	}
+	if calls := fake.callsMatching("DELETE FROM dedupObjects"); len(calls) != 1 || calls[0].args[0] != "object" {
+		t.Errorf("got %v, want the object removed from dedupObjects", calls)
+	}
+
+	// Objects that are not deduplicated only have one file
+	useFakeDB(t)
+	shared, err = detachDedupObject(ctx, "object")
+	if err != nil || shared {
+		t.Errorf("detachDedupObject() of an object that is not deduplicated = %v %v, want false", shared, err)
+	}
+}
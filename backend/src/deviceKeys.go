@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Public key not found for the user, or already revoked, error
+	errPublicKeyNotFound error = errors.New("public key not found")
+	// Error returned when revoking the only active key of a user
+	errLastPublicKey error = errors.New("the last active public key can't be revoked")
+)
+
+const (
+	// The maximum length of a public key description, the size of the column in encryptionKeys
+	MaxKeyDescriptionLength = 50
+)
+
+// Registers the public key of a new device for the user.
+// It can be an age X25519 recipient or an ssh-ed25519 or ssh-rsa public key
+func handleRegisterPublicKey(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/registerPublicKey" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","publicKey": "age1...", "description": "Laptop"}'
+	*/
+	request, ok := bindPublicKeyRequest(c, "handleRegisterPublicKey")
+	if !ok {
+		return
+	}
+
+	publicKey, keyType, err := parsePublicKey(request.PublicKey)
+	if err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid public key"})
+		return
+	}
+
+	description, err := validateKeyDescription(request.Description)
+	if err != nil {
+		c.JSON(400, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	var count int
+	err = db.QueryRowContext(c, "SELECT COUNT(*) FROM encryptionKeys WHERE publicKey = ?", publicKey).Scan(&count)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleRegisterPublicKey] Failed to check if the key exists")
+		return
+	}
+
+	if count > 0 {
+		c.JSON(400, gin.H{"success": false, "error": "Public key already registered"})
+		return
+	}
+
+	_, err = db.ExecContext(c, "INSERT INTO encryptionKeys (publicKey, keyType, userID, description, createdDate) VALUES (?, ?, ?, ?, now())", publicKey, keyType, request.UserID, description)
+	if isDuplicateEntry(err) {
+		// Registered by another request after the check
+		c.JSON(400, gin.H{"success": false, "error": "Public key already registered"})
+		return
+	}
+
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+		log.WithField("error", err).Error("[handleRegisterPublicKey] Failed to insert key")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// Changes the description of one of the user's public keys
+func handleLabelPublicKey(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/labelPublicKey" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","publicKey": "age1...", "description": "Work laptop"}'
+	*/
+	request, ok := bindPublicKeyRequest(c, "handleLabelPublicKey")
+	if !ok {
+		return
+	}
+
+	description, err := validateKeyDescription(request.Description)
+	if err != nil {
+		c.JSON(400, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	// RowsAffected is 0 when the description doesn't change, so check that the key exists first
+	var count int
+	err = db.QueryRowContext(c, "SELECT COUNT(*) FROM encryptionKeys WHERE publicKey = ? AND userID = ? AND folderID IS NULL", request.PublicKey, request.UserID).Scan(&count)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleLabelPublicKey] Failed to check if the key exists")
+		return
+	}
+
+	if count == 0 {
+		c.JSON(404, gin.H{"success": false, "error": "Public key not found"})
+		return
+	}
+
+	_, err = db.ExecContext(c, "UPDATE encryptionKeys SET description = ? WHERE publicKey = ? AND userID = ? AND folderID IS NULL", description, request.PublicKey, request.UserID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+		log.WithField("error", err).Error("[handleLabelPublicKey] Failed to update key")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// Returns the user's device public keys, including the revoked ones
+func handleGetPublicKeys(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/getPublicKeys" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw=="}'
+	*/
+	request, ok := bindPublicKeyRequest(c, "handleGetPublicKeys")
+	if !ok {
+		return
+	}
+
+	keys, err := getDeviceKeys(c, request.UserID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleGetPublicKeys] Failed to get keys")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "keys": keys})
+}
+
+// Revokes a device's public key. New files and folder keys are not encrypted with it anymore.
+// The data that was already encrypted with it is not changed, use a key rotation for that.
+func handleRevokePublicKey(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/revokePublicKey" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","publicKey": "age1..."}'
+	*/
+	request, ok := bindPublicKeyRequest(c, "handleRevokePublicKey")
+	if !ok {
+		return
+	}
+
+	err := revokePublicKey(c, request.UserID, request.PublicKey)
+	if err != nil {
+		if errors.Is(err, errPublicKeyNotFound) {
+			c.JSON(404, gin.H{"success": false, "error": "Public key not found"})
+			return
+		}
+
+		if errors.Is(err, errLastPublicKey) {
+			c.JSON(400, gin.H{"success": false, "error": "You can't revoke your only active public key"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleRevokePublicKey] Failed to revoke key")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// Decodes the PublicKeyRequest and verifies the token. If it returns false, the response was already sent
+func bindPublicKeyRequest(c *gin.Context, name string) (PublicKeyRequest, bool) {
+	var request PublicKeyRequest
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return request, false
+	}
+
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Errorf("[%s] Failed to decode JSON", name)
+		return request, false
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Errorf("[%s] Failed to verify token", name)
+		return request, false
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return request, false
+	}
+
+	return request, true
+}
+
+// Returns the trimmed description or an error if it is empty or too long
+func validateKeyDescription(description string) (string, error) {
+	description = strings.TrimSpace(description)
+	if description == "" || utf8.RuneCountInString(description) > MaxKeyDescriptionLength {
+		return "", fmt.Errorf("the description must be between 1 and %d characters", MaxKeyDescriptionLength)
+	}
+	return description, nil
+}
+
+// Returns every device key of the user, oldest first. Folder keys are not included
+func getDeviceKeys(ctx context.Context, userID string) ([]DeviceKey, error) {
+	rows, err := db.QueryContext(ctx, "SELECT publicKey, keyType, description, createdDate, revokedDate, retiringDate FROM encryptionKeys WHERE userID = ? AND folderID IS NULL ORDER BY createdDate", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Initialize an empty array so that the json returns an empty array instead of null.
+	keys := []DeviceKey{}
+	for rows.Next() {
+		var key DeviceKey
+		var revokedDate, retiringDate sql.NullTime
+		if err := rows.Scan(&key.PublicKey, &key.KeyType, &key.Description, &key.CreatedDate, &revokedDate, &retiringDate); err != nil {
+			return nil, err
+		}
+
+		if revokedDate.Valid {
+			key.RevokedDate = &revokedDate.Time
+		}
+		if retiringDate.Valid {
+			key.RetiringDate = &retiringDate.Time
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Marks the key as revoked. It fails with errLastPublicKey if it is the user's only active key,
+// since nothing could be encrypted for the user without it. Retiring keys can always be revoked.
+func revokePublicKey(ctx context.Context, userID, publicKey string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var isActive bool
+	err = tx.QueryRowContext(ctx, "SELECT retiringDate IS NULL FROM encryptionKeys WHERE publicKey = ? AND userID = ? AND folderID IS NULL AND revokedDate IS NULL FOR UPDATE", publicKey, userID).Scan(&isActive)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return errPublicKeyNotFound
+		}
+		return fmt.Errorf("failed to get the key. %w", err)
+	}
+
+	if isActive {
+		var active int
+		err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM encryptionKeys WHERE userID = ? AND folderID IS NULL AND revokedDate IS NULL AND retiringDate IS NULL FOR UPDATE", userID).Scan(&active)
+		if err != nil {
+			return fmt.Errorf("failed to count active keys. %w", err)
+		}
+
+		if active <= 1 {
+			return errLastPublicKey
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE encryptionKeys SET revokedDate = now() WHERE publicKey = ? AND userID = ? AND folderID IS NULL AND revokedDate IS NULL", publicKey, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke key. %w", err)
+	}
+
+	return tx.Commit()
+}
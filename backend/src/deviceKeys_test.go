@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/go-sql-driver/mysql"
+)
+
+// The answer to the check for an existing key when the key is not registered
+var noRegisteredKey = fakeResponse{match: "SELECT COUNT(*) FROM encryptionKeys", columns: []string{"count"}, rows: [][]driver.Value{{0}}}
+
+func newTestPublicKey(t *testing.T) string {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity.Recipient().String()
+}
+
+func TestRegisterPublicKey(t *testing.T) {
+	publicKey := newTestPublicKey(t)
+	request := PublicKeyRequest{UserID: "testUser", AuthToken: "K1xS9ehuxeC5tw==", PublicKey: publicKey, Description: " Laptop "}
+
+	fake := useFakeDB(t, validTokenResponse, noRegisteredKey)
+	status, response := postJSON(t, handleRegisterPublicKey, request)
+	if status != 200 {
+		t.Fatalf("handleRegisterPublicKey() = %d %v, want 200", status, response)
+	}
+
+	calls := fake.callsMatching("INSERT INTO encryptionKeys")
+	if len(calls) != 1 || calls[0].args[0] != publicKey || calls[0].args[1] != "X25519" || calls[0].args[3] != "Laptop" {
+		t.Errorf("got inserts %v, want the key with the trimmed description", calls)
+	}
+
+	invalid := request
+	invalid.PublicKey = "age1notakey"
+	status, _ = postJSON(t, handleRegisterPublicKey, invalid)
+	if status != 400 {
+		t.Errorf("handleRegisterPublicKey(invalid key) = %d, want 400", status)
+	}
+
+	noDescription := request
+	noDescription.Description = " "
+	status, _ = postJSON(t, handleRegisterPublicKey, noDescription)
+	if status != 400 {
+		t.Errorf("handleRegisterPublicKey(no description) = %d, want 400", status)
+	}
+}
+
+func TestRegisterPublicKeyDuplicate(t *testing.T) {
+	request := PublicKeyRequest{UserID: "testUser", AuthToken: "K1xS9ehuxeC5tw==", PublicKey: newTestPublicKey(t), Description: "Laptop"}
+
+	useFakeDB(t, validTokenResponse, fakeResponse{match: "SELECT COUNT(*) FROM encryptionKeys", columns: []string{"count"}, rows: [][]driver.Value{{1}}})
+	status, response := postJSON(t, handleRegisterPublicKey, request)
+	if status != 400 {
+		t.Errorf("handleRegisterPublicKey(registered key) = %d %v, want 400", status, response)
+	}
+
+	// Another request inserted the key between the check and the insert
+	duplicate := &mysql.MySQLError{Number: mysqlDuplicateEntry, Message: "Duplicate entry"}
+	useFakeDB(t, validTokenResponse, noRegisteredKey, fakeResponse{match: "INSERT INTO encryptionKeys", err: duplicate})
+	status, response = postJSON(t, handleRegisterPublicKey, request)
+	if status != 400 {
+		t.Errorf("handleRegisterPublicKey(concurrent duplicate) = %d %v, want 400", status, response)
+	}
+}
+
+func TestLabelPublicKey(t *testing.T) {
+	request := PublicKeyRequest{UserID: "testUser", AuthToken: "K1xS9ehuxeC5tw==", PublicKey: newTestPublicKey(t), Description: "Work laptop"}
+
+	// No key with that publicKey for the user
+	fake := useFakeDB(t, validTokenResponse, fakeResponse{match: "SELECT COUNT(*) FROM encryptionKeys", columns: []string{"count"}, rows: [][]driver.Value{{0}}})
+	status, _ := postJSON(t, handleLabelPublicKey, request)
+	if status != 404 {
+		t.Errorf("handleLabelPublicKey(unknown key) = %d, want 404", status)
+	}
+	if calls := fake.callsMatching("UPDATE encryptionKeys"); len(calls) != 0 {
+		t.Errorf("an unknown key was updated: %v", calls)
+	}
+
+	fake = useFakeDB(t, validTokenResponse, fakeResponse{match: "SELECT COUNT(*) FROM encryptionKeys", columns: []string{"count"}, rows: [][]driver.Value{{1}}})
+	status, response := postJSON(t, handleLabelPublicKey, request)
+	if status != 200 {
+		t.Fatalf("handleLabelPublicKey() = %d %v, want 200", status, response)
+	}
+	calls := fake.callsMatching("UPDATE encryptionKeys SET description")
+	if len(calls) != 1 || calls[0].args[0] != "Work laptop" {
+		t.Errorf("got updates %v, want the new description", calls)
+	}
+}
+
+func TestGetPublicKeys(t *testing.T) {
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	revoked := created.Add(time.Hour)
+	useFakeDB(t, validTokenResponse, fakeResponse{
+		match:   "SELECT publicKey, keyType, description, createdDate, revokedDate, retiringDate FROM encryptionKeys",
+		columns: []string{"publicKey", "keyType", "description", "createdDate", "revokedDate", "retiringDate"},
+		rows:    [][]driver.Value{{"age1first", "X25519", "Laptop", created, nil, nil}, {"age1second", "X25519", "Phone", created, revoked, nil}},
+	})
+
+	status, response := postJSON(t, handleGetPublicKeys, PublicKeyRequest{UserID: "testUser", AuthToken: "K1xS9ehuxeC5tw=="})
+	if status != 200 {
+		t.Fatalf("handleGetPublicKeys() = %d %v, want 200", status, response)
+	}
+
+	keys, ok := response["keys"].([]any)
+	if !ok || len(keys) != 2 {
+		t.Fatalf("got keys %v, want 2", response["keys"])
+	}
+	if keys[0].(map[string]any)["revokedDate"] != nil || keys[1].(map[string]any)["revokedDate"] == nil {
+		t.Errorf("got keys %v, want only the second one to be revoked", keys)
+	}
+}
+
+func TestRevokePublicKey(t *testing.T) {
+	request := PublicKeyRequest{UserID: "testUser", AuthToken: "K1xS9ehuxeC5tw==", PublicKey: newTestPublicKey(t)}
+	activeKeys := func(count int) fakeResponse {
+		return fakeResponse{match: "SELECT COUNT(*) FROM encryptionKeys", columns: []string{"count"}, rows: [][]driver.Value{{count}}}
+	}
+	keyIsActive := func(active bool) fakeResponse {
+		return fakeResponse{match: "SELECT retiringDate IS NULL FROM encryptionKeys", columns: []string{"isActive"}, rows: [][]driver.Value{{active}}}
+	}
+
+	fake := useFakeDB(t, validTokenResponse, keyIsActive(true), activeKeys(1))
+	status, _ := postJSON(t, handleRevokePublicKey, request)
+	if status != 400 {
+		t.Errorf("handleRevokePublicKey(only key) = %d, want 400", status)
+	}
+	if fake.commits != 0 {
+		t.Errorf("the only active key was revoked")
+	}
+
+	fake = useFakeDB(t, validTokenResponse, keyIsActive(true), activeKeys(2))
+	status, response := postJSON(t, handleRevokePublicKey, request)
+	if status != 200 {
+		t.Fatalf("handleRevokePublicKey() = %d %v, want 200", status, response)
+	}
+	if fake.commits != 1 {
+		t.Errorf("got %d commits, want 1", fake.commits)
+	}
+
+	// A retiring key doesn't count as active, revoking it leaves the only active key
+	fake = useFakeDB(t, validTokenResponse, keyIsActive(false), activeKeys(1))
+	status, response = postJSON(t, handleRevokePublicKey, request)
+	if status != 200 {
+		t.Fatalf("handleRevokePublicKey(retiring key) = %d %v, want 200", status, response)
+	}
+	if calls := fake.callsMatching("UPDATE encryptionKeys SET revokedDate"); len(calls) != 1 || fake.commits != 1 {
+		t.Errorf("got %d revokes and %d commits, want the retiring key revoked", len(calls), fake.commits)
+	}
+
+	// Already revoked or another user's key
+	useFakeDB(t, validTokenResponse)
+	status, _ = postJSON(t, handleRevokePublicKey, request)
+	if status != 404 {
+		t.Errorf("handleRevokePublicKey(unknown key) = %d, want 404", status)
+	}
+}
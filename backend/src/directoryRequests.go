@@ -2,10 +2,11 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
+	"slices"
 
-	"filippo.io/age"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 )
@@ -105,89 +106,92 @@ func handleRemoveDirectory(c *gin.Context) {
 		return
 	}
 
+	c.JSON(removeDirectory(c, request))
+}
+
+// Removes the folder and the user's items directly inside of it. Returns the status and the body of the response, so that it can also be used by batch.
+// The rows are deleted in one transaction, then the S3 objects are released. The items further down are left to the garbage collector.
+func removeDirectory(ctx context.Context, request GetDirectoryRequest) (int, gin.H) {
 	if request.DirID == RootDirectoryID {
-		c.JSON(400, gin.H{"success": false, "error": "You cannot delete your home directory"})
-		return
+		return 400, gin.H{"success": false, "error": "You cannot delete your home directory"}
 	}
 
-	fmt.Println("request dirID is here ", request.DirID)
 	// check that user owns the directory
-	perm, err := getFolderPermission(c, request.DirID, request.UserID, false)
+	perm, err := getFolderPermission(ctx, request.DirID, request.UserID, false)
 	if err != nil {
 		if errors.Is(err, errDirNotFound) {
-			c.JSON(400, gin.H{"success": false, "error": "Parent Directory doesn't exist"})
-			return
+			return 400, gin.H{"success": false, "error": "Parent Directory doesn't exist"}
 		}
 
-		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
-		log.WithField("Error", err).Error("[handleRemoveDirectory] Error getting dir permission")
-		return
+		if errors.Is(err, errUserAccessNotAllowed) {
+			return 403, gin.H{"success": false, "error": "You don't have permission to delete this folder"}
+		}
+
+		log.WithField("Error", err).Error("[removeDirectory] Error getting dir permission")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"}
 	}
 
 	if perm != WritePermission {
-		c.JSON(403, gin.H{"success": false, "error": "You don't have permission to delete this folder"})
-		return
+		return 403, gin.H{"success": false, "error": "You don't have permission to delete this folder"}
 	}
 
-	// Get the items in the DB and delete them.
-	rows, err := db.QueryContext(c, "select id, objKey from files where userID=? AND parentDir=?", request.UserID, request.DirID)
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
-		log.WithField("error", err).Error("[handleRemoveDirectory] Failed to get items in directory")
-		return
+		log.WithField("error", err).Error("[removeDirectory] Failed to start the transaction")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"}
 	}
+	defer tx.Rollback()
 
-	defer rows.Close()
-
-	var ids []string = []string{}
+	// Get the items in the DB and delete them.
+	rows, err := tx.QueryContext(ctx, "select id, objKey, IFNULL(thumbnailObjKey, '') from files where userID=? AND parentDir=? FOR UPDATE", request.UserID, request.DirID)
+	if err != nil {
+		log.WithField("error", err).Error("[removeDirectory] Failed to get items in directory")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"}
+	}
 
+	ids := []string{}
+	objKeys := []string{}
+	thumbnailObjKeys := []string{}
 	for rows.Next() {
-		var id, objKey string
-		err := rows.Scan(&id, &objKey)
+		var id, objKey, thumbnailObjKey string
+		err := rows.Scan(&id, &objKey, &thumbnailObjKey)
 		if err != nil {
-			c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
-			idsLen := len(ids)
-			log.WithFields(log.Fields{"error": err, "dirID": request.DirID, "idsCount": idsLen}).Error("[handleRemoveDirectory] Failed to scan item")
-			if idsLen > 0 {
-				fmt.Printf("IDs Deleted: %v\n", ids)
-			}
-			return
+			rows.Close()
+			log.WithFields(log.Fields{"error": err, "dirID": request.DirID}).Error("[removeDirectory] Failed to scan item")
+			return 500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"}
 		}
 
-		// delete the file from S3
-		_, err = deleteFile(c, s3Client, serverConfig.S3BucketName, objKey)
-		if err != nil {
-			// handle the error
-			c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
-			log.WithFields(log.Fields{"error": err, "objKey": objKey}).Error("[handleRemoveDirectory] Failed to delete file from S3")
-			return
-		}
+		ids = append(ids, id)
+		objKeys = append(objKeys, objKey)
+		thumbnailObjKeys = append(thumbnailObjKeys, thumbnailObjKey)
+	}
+	rows.Close()
 
-		// remove from DB
-		err = removeFileFromDB(c, id, request.UserID)
+	err = rows.Err()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "dirID": request.DirID}).Error("[removeDirectory] Failed to get items in directory")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"}
+	}
+
+	// remove from DB, the folder last
+	for _, id := range append(ids, request.DirID) {
+		err = removeFileFromDB(ctx, tx, id, request.UserID)
 		if err != nil {
-			// handle the error
-			c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"})
-			log.WithFields(log.Fields{"error": err, "fileID": id, "objKey": objKey, "userID": request.UserID}).Error("[handleRemoveFile] Failed to delete file from DB")
-			return
+			log.WithFields(log.Fields{"error": err, "fileID": id, "userID": request.UserID}).Error("[removeDirectory] Failed to delete file from DB")
+			return 500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"}
 		}
-
-		// log.WithFields(log.Fields{"userID": userID, "fileOwnerUserID": fileOwnerUserID, "fileID": fileID}).Trace("[isAuthTokenValid]")
-
-		// append id deleted
-		ids = append(ids, id)
 	}
-	err = removeFileFromDB(c, request.DirID, request.UserID)
+
+	err = tx.Commit()
 	if err != nil {
-		// handle the error
-		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"})
-		log.WithFields(log.Fields{"error": err, "fileID": request.DirID, "userID": request.UserID}).Error("[handleRemoveFile] Failed to delete file from DB")
-		return
+		log.WithField("error", err).Error("[removeDirectory] Failed to commit the transaction")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"}
 	}
 
 	// the loop might take too long on big directories, this should probably be done in the background
+	deleteRemovedObjects(ctx, objKeys, thumbnailObjKeys)
 
-	c.JSON(200, gin.H{"success": true})
+	return 200, gin.H{"success": true}
 }
 
 // When a whole directory is shared
@@ -221,109 +225,138 @@ func handleShareDirectory(c *gin.Context) {
 		return
 	}
 
+	c.JSON(shareDirectory(c, request))
+}
+
+// Shares the folder with the users and groups of the request. Returns the status and the body of the response, so that it can also be used by batch
+func shareDirectory(ctx context.Context, request ShareDirectoryRequest) (int, gin.H) {
 	if request.DirID == RootDirectoryID {
-		c.JSON(400, gin.H{"success": false, "error": "You cannot share your home directory"})
-		return
+		return 400, gin.H{"success": false, "error": "You cannot share your home directory"}
 	}
 
 	// check that user can actually share the directory
-	perm, err := getFolderPermission(c, request.DirID, request.UserID, false)
+	perm, err := getFolderPermission(ctx, request.DirID, request.UserID, false)
 	if err != nil {
 		if errors.Is(err, errDirNotFound) {
-			c.JSON(400, gin.H{"success": false, "error": "Parent Directory doesn't exist"})
-			return
+			return 400, gin.H{"success": false, "error": "Parent Directory doesn't exist"}
 		}
 
-		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
-		log.WithField("Error", err).Error("[handleShareDirectory] Error getting dir permission")
-		return
+		log.WithField("Error", err).Error("[shareDirectory] Error getting dir permission")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"}
 	}
 
 	if perm != WritePermission {
-		c.JSON(403, gin.H{"success": false, "error": "You don't have permission to share this folder"})
-		return
+		return 403, gin.H{"success": false, "error": "You don't have permission to share this folder"}
+	}
+
+	// check that the sharing policies allow sharing with every recipient
+	refused, err := checkShareRecipients(ctx, request.UserID, request.WithUserID)
+	if err != nil {
+		log.WithField("error", err).Error("[shareDirectory] Failed to check the recipients")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"}
+	}
+
+	if len(refused) > 0 {
+		return 403, gin.H{"success": false, "error": "Sharing is not allowed with some of the users", "refused": refused}
+	}
+
+	// check that the user can share with the groups and that the policies allow sharing with their members
+	refused, err = checkShareGroups(ctx, request.UserID, request.WithGroupID)
+	if err != nil {
+		log.WithField("error", err).Error("[shareDirectory] Failed to check the groups")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (3b), Please try again later"}
+	}
+
+	if len(refused) > 0 {
+		return 403, gin.H{"success": false, "error": "Sharing is not allowed with some of the users", "refused": refused}
 	}
 
 	// check that the directory is not already shared
 	// This doesn't check if it is inside of a parentDir that is already shared
-	// Loop over each user to share with using a basic for loop
-	for i := 0; i < len(request.WithUserID); i++ {
-		withUserID := request.WithUserID[i]
-
-		sharedFilesID, perm, err := querySharedFilesTable(c, request.DirID, withUserID)
+	// Everything is checked before anything is written, so that a refused request doesn't leave the folder shared with the groups.
+	// The users that get a new share and the shares whose permission changes
+	newUserIDs := []string{}
+	changedShares := map[string]string{}
+	for _, withUserID := range request.WithUserID {
+		sharedFilesID, perm, err := querySharedFilesTable(ctx, request.DirID, withUserID)
 		if err != nil {
-			log.WithFields(log.Fields{"error": err, "withUserID": withUserID}).Error("[handleShareDirectory] querySharedFilesTable")
-			continue
+			log.WithFields(log.Fields{"error": err, "withUserID": withUserID}).Error("[shareDirectory] querySharedFilesTable")
+			return 500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"}
 		}
 
 		// TODO: test this
-		if perm != "" {
-			switch perm {
-			case WritePermission:
-				// already has write permission
-				if request.ReadOnly {
-					// change the folder's permission to read only
-					err := changeFilePermission(c, sharedFilesID, request.DirID, ReadOnlyPermission)
-					if err != nil {
-						c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4a), Please try again later"})
-						log.WithField("error", err).Error("[handleShareDirectory] Failed to change permission")
-						return
-					}
-					c.JSON(200, gin.H{"success": true})
-					return
-				} else {
-					// do nothing, user already has write permission
-					c.JSON(400, gin.H{"success": false, "error": "User already has write permission for that directory"})
-					log.Trace("[handleShareDirectory] Dir already has write permission")
-					return
-				}
-			case ReadOnlyPermission:
-				// already has read permission
-				if !request.ReadOnly {
-					// change the folder's permission to write
-					err := changeFilePermission(c, sharedFilesID, request.DirID, WritePermission)
-					if err != nil {
-						c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4b), Please try again later"})
-						log.WithField("error", err).Error("[handleShareDirectory] Failed to change permission")
-						return
-					}
-					c.JSON(200, gin.H{"success": true})
-					return
-				} else {
-					// do nothing, user already has read permission
-					c.JSON(400, gin.H{"success": false, "error": "User already has read permission for that directory"})
-					log.Trace("[handleShareDirectory] Dir already has read permission")
-					return
-				}
-			default:
-				// unkown permission value
-				c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4c), Please try again later"})
-				log.WithFields(log.Fields{"perm": perm}).Error("[handleShareDirectory] File has unkown permission")
-				return
+		switch perm {
+		case "":
+			// directory is not already shared
+			newUserIDs = append(newUserIDs, withUserID)
+		case WritePermission:
+			// already has write permission
+			if !request.ReadOnly {
+				// do nothing, user already has write permission
+				log.Trace("[shareDirectory] Dir already has write permission")
+				return 400, gin.H{"success": false, "error": "User already has write permission for that directory"}
+			}
+			// change the folder's permission to read only
+			changedShares[sharedFilesID] = ReadOnlyPermission
+		case ReadOnlyPermission:
+			// already has read permission
+			if request.ReadOnly {
+				// do nothing, user already has read permission
+				log.Trace("[shareDirectory] Dir already has read permission")
+				return 400, gin.H{"success": false, "error": "User already has read permission for that directory"}
 			}
+			// change the folder's permission to write
+			changedShares[sharedFilesID] = WritePermission
+		default:
+			// unkown permission value
+			log.WithFields(log.Fields{"perm": perm}).Error("[shareDirectory] File has unkown permission")
+			return 500, gin.H{"success": false, "error": "Internal Server Error (4c), Please try again later"}
 		}
+	}
 
-		// directory is not already shared
+	// The group and user shares are added together
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.WithField("error", err).Error("[shareDirectory] Failed to start the transaction")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (5)"}
+	}
+	defer tx.Rollback()
 
-		id, err := getNewID()
-		if err != nil {
-			c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (5)"})
-			log.WithField("error", err).Error("[handleShareDirectory] Failed to get new fileID")
-			return
-		}
+	sharedFileGroupIDs, err := addGroupFilePermission(ctx, tx, request.DirID, request.WithGroupID, request.UserID, request.ReadOnly)
+	if err != nil {
+		log.WithField("error", err).Error("[shareDirectory] Failed to share with the groups")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (5a)"}
+	}
 
-		_, err = db.ExecContext(c, "INSERT INTO sharedFiles (id, fileID, userID, fileOwner, isReadOnly, createdDate) VALUES (?, ?, ?, ?, ?, now());", id, request.DirID, request.WithUserID, request.UserID, request.ReadOnly)
+	for sharedFilesID, permission := range changedShares {
+		err = changeFilePermission(ctx, tx, sharedFilesID, request.DirID, permission)
 		if err != nil {
-			c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (6)"})
-			log.WithField("error", err).Error("[handleShareDirectory] Failed to add share to DB")
-			return
+			log.WithField("error", err).Error("[shareDirectory] Failed to change permission")
+			return 500, gin.H{"success": false, "error": "Internal Server Error (5b)"}
 		}
 	}
-	// The DB part is the same as with a file, but all of the files inside of the directory have to be reencrypted
 
-	// TODO: get the client to encrypt the files with all recipients, upload it, and set processed to true on the db
+	sharedFileIDs, err := addFilePermission(ctx, tx, request.DirID, newUserIDs, request.UserID, request.ReadOnly)
+	if err != nil {
+		log.WithField("error", err).Error("[shareDirectory] Failed to add share to DB")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (6)"}
+	}
 
-	c.JSON(200, gin.H{"success": true})
+	// The DB part is the same as with a file, but all of the files inside of the directory have to be reencrypted.
+	// The owner's devices do it with getReencryptionTasks and the shares are processed once they are done
+	err = scheduleShareReencryption(ctx, tx, request.DirID, request.UserID, sharedFileIDs, sharedFileGroupIDs)
+	if err != nil {
+		log.WithField("error", err).Error("[shareDirectory] Failed to schedule re-encryption")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (7)"}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.WithField("error", err).Error("[shareDirectory] Failed to commit the transaction")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (8)"}
+	}
+
+	return 200, gin.H{"success": true}
 }
 
 // Returns the user's that have access to a file/folder
@@ -441,6 +474,48 @@ func handleCreateDirectory(c *gin.Context) {
 		return
 	}
 
+	// In folders with encrypted names, the name is encrypted to the folder key and nameIndex is its blind index
+	nameIndex, err := checkItemName(c, request.ParentDir, request.DirName, request.NameIndex)
+	if err != nil {
+		if isInvalidNameError(err) {
+			c.JSON(400, gin.H{"success": false, "error": err.Error()})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2a), Please try again later"})
+		log.WithField("error", err).Error("[handleCreateDirectory] Failed to check the name")
+		return
+	}
+
+	// Folders inside of a folder with encrypted names always have encrypted names too
+	encryptNames := request.EncryptNames || nameIndex.Valid
+
+	// check that the sharing policies allow sharing with every recipient
+	refused, err := checkShareRecipients(c, request.UserID, request.ShareWith)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2b), Please try again later"})
+		log.WithField("error", err).Error("[handleCreateDirectory] Failed to check the recipients")
+		return
+	}
+
+	if len(refused) > 0 {
+		c.JSON(403, gin.H{"success": false, "error": "Sharing is not allowed with some of the users", "refused": refused})
+		return
+	}
+
+	// check that the user can share with the groups and that the policies allow sharing with their members
+	refused, err = checkShareGroups(c, request.UserID, request.ShareWithGroupID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2c), Please try again later"})
+		log.WithField("error", err).Error("[handleCreateDirectory] Failed to check the groups")
+		return
+	}
+
+	if len(refused) > 0 {
+		c.JSON(403, gin.H{"success": false, "error": "Sharing is not allowed with some of the users", "refused": refused})
+		return
+	}
+
 	dirID, err := getNewID()
 	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3)"})
@@ -448,16 +523,21 @@ func handleCreateDirectory(c *gin.Context) {
 		return
 	}
 
-	err = addDirectoryToDB(c, dirID.String(), request.ParentDir, request.DirName, request.UserID)
+	err = addDirectoryToDB(c, dirID.String(), request.ParentDir, request.DirName, request.UserID, nameIndex, encryptNames)
 	if err != nil {
+		if errors.Is(err, errNameExists) {
+			c.JSON(409, gin.H{"success": false, "error": "An item with the same name already exists"})
+			return
+		}
+
 		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4)"})
 		log.WithField("error", err).Error("[handleCreateDirectory] Failed to create a directory")
 		return
 	}
 
-	// only generate a folderKey if the folder is shared
-	shareWithLen := len(request.ShareWith)
-	if shareWithLen > 0 {
+	// only generate a folderKey if the folder is shared, or if the names inside of it are encrypted and there is no folder key above it to use
+	shareWithLen := len(request.ShareWith) + len(request.ShareWithGroupID)
+	if shareWithLen > 0 || (encryptNames && !nameIndex.Valid) {
 		log.WithFields(log.Fields{"shareWithLen": shareWithLen}).Trace("[handleCreateDirectory] Directory is shared")
 
 		//  Generate the folder key
@@ -475,28 +555,42 @@ func handleCreateDirectory(c *gin.Context) {
 			}).Error("[handleCreateDirectory] Failed to insert public key into encryptionKeys table")
 		}
 
-		// Fetch public keys for all users including the creator
+		// Fetch public keys for all users including the creator and the members of the groups
 		shareWith := append(request.ShareWith, request.UserID)
+		groupMembers, err := getMembersOfGroups(c, request.ShareWithGroupID)
+		if err != nil {
+			log.WithError(err).Error("[handleCreateDirectory] Failed to get group members")
+			c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (5)"})
+			return
+		}
 
-		publicKeys := []age.Recipient{}
-		for _, userID := range shareWith {
-			pubKey, err := getPublicKeyForUser(c, userID)
-			if err != nil {
-				log.WithField("userID", userID).WithError(err).Error("[handleCreateDirectory] Failed to fetch user's public key")
-				continue
+		for _, member := range groupMembers {
+			if !slices.Contains(shareWith, member) {
+				shareWith = append(shareWith, member)
 			}
+		}
 
-			recipient, err := age.ParseX25519Recipient(pubKey)
+		publicKeys := []string{}
+		for _, userID := range shareWith {
+			// every device of the user gets access to the folder key
+			userKeys, err := getActivePublicKeysForUser(c, userID)
 			if err != nil {
-				log.WithFields(log.Fields{"pubKey": pubKey, "shareWith": shareWith}).WithError(err).Error("[handleCreateDirectory] Invalid public key")
+				log.WithFields(log.Fields{"userID": userID, "shareWith": shareWith}).WithError(err).Error("[handleCreateDirectory] Failed to fetch user's public keys")
 				// TODO: maybe return an error here
 				continue
 			}
-			publicKeys = append(publicKeys, recipient)
+			publicKeys = append(publicKeys, userKeys...)
+		}
+
+		recipients, err := parseRecipients(publicKeys)
+		if err != nil {
+			log.WithError(err).Error("[handleCreateDirectory] Failed to parse public keys")
+			c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (5)"})
+			return
 		}
 
 		// Encrypt the folder key for all recipients at once
-		encryptedKey, err := encryptFolderKeyForUsers([]byte(privateKey.String()), publicKeys)
+		encryptedKey, err := encryptFolderKeyForUsers([]byte(privateKey.String()), recipients)
 		if err != nil {
 			log.WithError(err).Error("[handleCreateDirectory] Failed to encrypt folder key")
 			c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (5)"})
@@ -511,14 +605,35 @@ func handleCreateDirectory(c *gin.Context) {
 			return
 		}
 
+		err = recordObjectRecipients(c, folderKeyObjKey(dirID.String()), publicKeys)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "dirID": dirID}).Error("[handleCreateDirectory] Failed to record the folder key recipients")
+		}
+
 		// Share the newly created directory with the specified users
 		// Grant write permission by default when creating and sharing
-		err = addFilePermission(c, dirID.String(), request.ShareWith, request.UserID, false) // isReadOnly = false for write permission
+		sharedFileIDs, err := addFilePermission(c, db, dirID.String(), request.ShareWith, request.UserID, false) // isReadOnly = false for write permission
 		if err != nil {
 			log.WithFields(log.Fields{"error": err, "dirID": dirID}).Error("[handleCreateDirectory] Failed to share directory")
 			// Consider whether to rollback the directory creation or continue with errors
 		}
 
+		// The folder key was already encrypted for every user, so there is nothing to re-encrypt
+		err = markSharesProcessed(c, db, sharedFileIDs)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "dirID": dirID}).Error("[handleCreateDirectory] Failed to mark the shares as processed")
+		}
+
+		sharedFileGroupIDs, err := addGroupFilePermission(c, db, dirID.String(), request.ShareWithGroupID, request.UserID, false)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "dirID": dirID}).Error("[handleCreateDirectory] Failed to share directory with the groups")
+		}
+
+		err = markGroupSharesProcessed(c, db, sharedFileGroupIDs)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "dirID": dirID}).Error("[handleCreateDirectory] Failed to mark the group shares as processed")
+		}
+
 		// https://gobyexample.com/goroutines
 		go func() {
 			for _, userID := range shareWith {
@@ -538,15 +653,17 @@ func handleCreateDirectory(c *gin.Context) {
 	c.JSON(200, gin.H{"success": true, "dirID": dirID})
 }
 
-func addDirectoryToDB(ctx context.Context, dirID, parentDir, name, userID string) error {
-	_, err := db.ExecContext(ctx, "INSERT INTO files (id, parentDir, name, type, size, userID, processed, createdDate) VALUES (?, ?, ?, 'folder', 0, ?, true, now());", dirID, parentDir, name, userID)
-	return err
+// nameIndex is only valid when the name is encrypted. encryptNames is true when the names of the items inside of the folder are encrypted.
+// It returns errNameExists if the folder already has an item with the same blind index
+func addDirectoryToDB(ctx context.Context, dirID, parentDir, name, userID string, nameIndex sql.NullString, encryptNames bool) error {
+	_, err := db.ExecContext(ctx, "INSERT INTO files (id, parentDir, name, nameIndex, encryptNames, type, size, userID, processed, createdDate) VALUES (?, ?, ?, ?, ?, 'folder', 0, ?, true, now());", dirID, parentDir, name, nameIndex, encryptNames, userID)
+	return checkDuplicateName(err)
 }
 
 func getItemsInDir(ctx context.Context, userID, dirID string) ([]GetDirectoryResponseItems, error) {
 	var items []GetDirectoryResponseItems
 
-	rows, err := db.QueryContext(ctx, "select id, name, type, size from files where userID=? AND parentDir=?", userID, dirID)
+	rows, err := db.QueryContext(ctx, "select id, name, nameIndex IS NOT NULL, type, size, thumbnailObjKey IS NOT NULL, IFNULL(plaintextSHA256, ''), IFNULL(ciphertextSHA256, '') from files where userID=? AND parentDir=?", userID, dirID)
 	if err != nil {
 		return nil, err
 	}
@@ -555,7 +672,7 @@ func getItemsInDir(ctx context.Context, userID, dirID string) ([]GetDirectoryRes
 
 	for rows.Next() {
 		var item GetDirectoryResponseItems
-		err := rows.Scan(&item.ID, &item.Name, &item.FileType, &item.Size)
+		err := rows.Scan(&item.ID, &item.Name, &item.NameEncrypted, &item.FileType, &item.Size, &item.HasThumbnail, &item.SHA256, &item.CiphertextSHA256)
 		if err != nil {
 			/*
 				if err == sql.ErrNoRows {
@@ -702,6 +819,13 @@ func getUsersWithFileAccess(ctx context.Context, fileID string, callNumber int,
 		}
 	}
 
+	// Expand the groups that the item is shared with into their members
+	groupPermissions, err := getGroupMembersWithFileAccess(ctx, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("getGroupMembersWithFileAccess Error. callNumber: %d. %w", callNumber, err)
+	}
+	userPermissions = append(userPermissions, groupPermissions...)
+
 	parentDir, err := getParentDirID(ctx, fileID)
 	if err != nil {
 		return userPermissions, fmt.Errorf("getParentDirID Error. callNumber: %d. %w", callNumber, err)
@@ -806,7 +930,7 @@ func handleSync(c *gin.Context) {
 
 func getFolders(ctx context.Context, userID string) ([]Folder, error) {
 	// It needs to consider the cases when a file is inside of a shared folder and when the file is inside a folder that is inside the shared folder
-	rows, err := db.QueryContext(ctx, "SELECT id, parentDir, name, type, size, userID, lastModified FROM files WHERE userID = ?", userID)
+	rows, err := db.QueryContext(ctx, "SELECT id, parentDir, name, nameIndex IS NOT NULL, type, size, userID, lastModified FROM files WHERE userID = ?", userID)
 	if err != nil {
 		return nil, err
 	}
@@ -817,7 +941,7 @@ func getFolders(ctx context.Context, userID string) ([]Folder, error) {
 	var folders []Folder = []Folder{}
 	for rows.Next() {
 		var folder Folder
-		if err := rows.Scan(&folder.ID, &folder.ParentDir, &folder.Name, &folder.Type, &folder.FileSize, &folder.UserID, &folder.LastModified); err != nil {
+		if err := rows.Scan(&folder.ID, &folder.ParentDir, &folder.Name, &folder.NameEncrypted, &folder.Type, &folder.FileSize, &folder.UserID, &folder.LastModified); err != nil {
 			return nil, err
 		}
 		folders = append(folders, folder)
@@ -833,10 +957,16 @@ func getSharedFolders(ctx context.Context, userID string) ([]Folder, error) {
 	// find folders from the files table that are shared with the given user
 	// only select folders that are listed in the 'sharedFiles' table
 	rows, err := db.QueryContext(ctx, `
-		SELECT f.id, f.parentDir, f.name, f.type, f.size, f.userID, f.lastModified
+		SELECT f.id, f.parentDir, f.name, f.nameIndex IS NOT NULL, f.type, f.size, f.userID, f.lastModified
 		FROM files f
 		INNER JOIN sharedFiles s ON f.id = s.fileID
-		WHERE s.userID = ?`, userID)
+		WHERE s.userID = ?
+		UNION
+		SELECT f.id, f.parentDir, f.name, f.nameIndex IS NOT NULL, f.type, f.size, f.userID, f.lastModified
+		FROM files f
+		INNER JOIN sharedFilesGroups s ON f.id = s.fileID
+		INNER JOIN userGroupMembers m ON s.groupID = m.groupID
+		WHERE m.userID = ?`, userID, userID)
 	// if error executing the query, return the error
 	if err != nil {
 		return nil, err
@@ -852,7 +982,7 @@ func getSharedFolders(ctx context.Context, userID string) ([]Folder, error) {
 		var folder Folder
 
 		// read the data from the current row into the folder struct
-		err := rows.Scan(&folder.ID, &folder.ParentDir, &folder.Name, &folder.Type, &folder.FileSize, &folder.UserID, &folder.LastModified)
+		err := rows.Scan(&folder.ID, &folder.ParentDir, &folder.Name, &folder.NameEncrypted, &folder.Type, &folder.FileSize, &folder.UserID, &folder.LastModified)
 		if err != nil {
 			//fail to read a row, return the error
 			return nil, err
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// A single byte range, the only kind supported by S3. "bytes=0-65535", "bytes=65536-" or "bytes=-1024"
+var byteRangeRegex = regexp.MustCompile(`^bytes=(\d+-\d*|-\d+)$`)
+
+// Handles GET requests to download a file, for the clients that need to stream it.
+// The credentials are sent in the X-User-ID header and as a bearer token in the Authorization header, so that they don't end up in the logs with the URL.
+// Range, If-Range, If-None-Match and If-Modified-Since work the same way as in getFile.
+func handleDownloadFile(c *gin.Context) {
+	/*
+		curl "localhost:9090/files/01955f82-7409-7cfc-a6ab-af5a70ca5897" -H 'X-User-ID: testUser' -H 'Authorization: Bearer K1xS9ehuxeC5tw==' -H 'Range: bytes=0-65535'
+	*/
+	userID := c.GetHeader("X-User-ID")
+	authToken, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+
+	valid, err := isAuthTokenValid(c, userID, authToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleDownloadFile] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	sendFile(c, "handleDownloadFile", userID, c.Param("fileID"))
+}
+
+// Checks that the user can access the file and streams it from S3.
+// It honours a single byte range in the Range header and answers with a 304 when If-None-Match or If-Modified-Since match the object.
+// With If-Range, the range is only sent if the object didn't change, otherwise the whole file is.
+// The age payload is split in 64 KiB chunks, so the clients can seek by asking for the header and the chunks they need.
+func sendFile(c *gin.Context, name, userID, fileID string) {
+	// check that file exists, and the user has access to it, and get the s3 objKey
+	objKey, err := getObjectKey(c, fileID, userID, true)
+	if err != nil {
+		if errors.Is(err, errFileNotFound) {
+			c.JSON(400, gin.H{"success": false, "error": "File not found"})
+			log.WithFields(log.Fields{"error": err, "fileID": fileID}).Debugf("[%s] No file with that fileID found", name)
+			return
+		}
+
+		if errors.Is(err, errFileProcessing) {
+			c.JSON(400, gin.H{"success": false, "error": "File is being processed, try again later"})
+			log.WithFields(log.Fields{"error": err, "fileID": fileID}).Tracef("[%s] File is still being processed", name)
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Errorf("[%s] Failed to get object key", name)
+		return
+	}
+
+	if objKey == "" {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("fileID", fileID).Errorf("[%s] Object key is empty", name)
+		return
+	}
+
+	plaintextChecksum, ciphertextChecksum, err := getFileChecksums(c, fileID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"})
+		log.WithField("error", err).Errorf("[%s] Failed to get the checksums", name)
+		return
+	}
+
+	// An invalid or multipart range is ignored and the whole file is sent
+	byteRange := c.GetHeader("Range")
+	if !byteRangeRegex.MatchString(byteRange) {
+		byteRange = ""
+	}
+
+	// If-Modified-Since is ignored when there is an If-None-Match (RFC 9110 13.1.3)
+	var ifModifiedSince *time.Time
+	ifNoneMatch := c.GetHeader("If-None-Match")
+	if ifNoneMatch == "" {
+		if date, err := http.ParseTime(c.GetHeader("If-Modified-Since")); err == nil {
+			ifModifiedSince = &date
+		}
+	}
+
+	// Objects are replaced in place when they are encrypted again, a resumed download would mix the bytes of both versions (RFC 9110 13.1.5)
+	ifMatch := ""
+	ifRange := c.GetHeader("If-Range")
+	if byteRange != "" && ifRange != "" {
+		info, err := getFileInfo(c, s3Client, serverConfig.S3BucketName, objKey)
+		if err != nil {
+			c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (5), Please try again later"})
+			log.WithField("error", err).Errorf("[%s] Failed to get the ETag of the file", name)
+			return
+		}
+
+		byteRange = checkIfRange(byteRange, ifRange, info.ETag, info.LastModified)
+		if byteRange != "" && info.ETag != nil {
+			// In case it is replaced before the range is read
+			ifMatch = *info.ETag
+		}
+	}
+
+	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Reference/Headers/Cache-Control
+	extraHeaders := map[string]string{"Cache-Control": "private", "Accept-Ranges": "bytes"}
+
+	file, err := getFileRange(c, s3Client, serverConfig.S3BucketName, objKey, byteRange, ifMatch, ifNoneMatch, ifModifiedSince)
+	if err != nil && ifMatch != "" && s3StatusCode(err) == http.StatusPreconditionFailed {
+		// It was replaced after checking If-Range, the new version is sent whole
+		file, err = getFileRange(c, s3Client, serverConfig.S3BucketName, objKey, "", "", ifNoneMatch, ifModifiedSince)
+	}
+	if err != nil {
+		switch s3StatusCode(err) {
+		case http.StatusNotModified:
+			// A 304 has to repeat the validators of the 200 it replaces (RFC 9110 15.4.5), S3 doesn't return them with the error
+			info, err := getFileInfo(c, s3Client, serverConfig.S3BucketName, objKey)
+			if err != nil {
+				log.WithField("error", err).Warnf("[%s] Failed to get the ETag of a file that was not modified", name)
+			} else {
+				setObjectHeaders(extraHeaders, info.ETag, info.LastModified)
+			}
+
+			for key, value := range extraHeaders {
+				c.Header(key, value)
+			}
+			c.Status(http.StatusNotModified)
+			return
+		case http.StatusRequestedRangeNotSatisfiable:
+			// The client needs the size of the file to ask for a valid range (RFC 9110 15.5.17)
+			info, err := getFileInfo(c, s3Client, serverConfig.S3BucketName, objKey)
+			if err != nil {
+				log.WithField("error", err).Warnf("[%s] Failed to get the size of the file", name)
+			} else if info.ContentLength != nil {
+				c.Header("Content-Range", fmt.Sprintf("bytes */%d", *info.ContentLength))
+			}
+
+			c.JSON(http.StatusRequestedRangeNotSatisfiable, gin.H{"success": false, "error": "Invalid range"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3)"})
+		log.WithField("error", err).Errorf("[%s] Failed to get file", name)
+		return
+	}
+
+	setObjectHeaders(extraHeaders, file.ETag, file.LastModified)
+
+	// The checksums are of the whole file, they would not match the content of a 206
+	status := http.StatusOK
+	if file.ContentRange != nil {
+		status = http.StatusPartialContent
+		extraHeaders["Content-Range"] = *file.ContentRange
+	} else {
+		setChecksumHeaders(extraHeaders, plaintextChecksum, ciphertextChecksum)
+	}
+
+	// https://www.iana.org/assignments/media-types/application/vnd.age
+	// asumming that all files returned are encrypted with age
+	c.DataFromReader(status, *file.ContentLength, "application/vnd.age", file.Body, extraHeaders)
+}
+
+// Sets the ETag and Last-Modified headers of a file download, when S3 returned them
+func setObjectHeaders(headers map[string]string, etag *string, lastModified *time.Time) {
+	if etag != nil {
+		headers["ETag"] = *etag
+	}
+
+	if lastModified != nil {
+		headers["Last-Modified"] = lastModified.UTC().Format(http.TimeFormat)
+	}
+}
+
+// Returns byteRange if the If-Range validator matches the current ETag or Last-Modified date of the object, otherwise an empty range.
+// ETags are compared with the strong comparison, so a weak ETag never matches.
+func checkIfRange(byteRange, ifRange string, etag *string, lastModified *time.Time) string {
+	if strings.HasPrefix(ifRange, `"`) {
+		if etag != nil && *etag == ifRange {
+			return byteRange
+		}
+		return ""
+	}
+
+	date, err := http.ParseTime(ifRange)
+	if err != nil || lastModified == nil || !lastModified.Truncate(time.Second).Equal(date) {
+		return ""
+	}
+	return byteRange
+}
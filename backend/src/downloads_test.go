@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+func TestByteRangeRegex(t *testing.T) {
+	valid := []string{"bytes=0-65535", "bytes=65536-", "bytes=-1024"}
+	for _, byteRange := range valid {
+		if !byteRangeRegex.MatchString(byteRange) {
+			t.Errorf("%q should be valid", byteRange)
+		}
+	}
+
+	// S3 only supports a single range
+	invalid := []string{"", "bytes=-", "bytes=0-10,20-30", "items=0-10", "bytes=a-b"}
+	for _, byteRange := range invalid {
+		if byteRangeRegex.MatchString(byteRange) {
+			t.Errorf("%q should be invalid", byteRange)
+		}
+	}
+}
+
+func TestS3StatusCode(t *testing.T) {
+	responseError := &smithyhttp.ResponseError{
+		Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusNotModified}},
+		Err:      errors.New("not modified"),
+	}
+
+	err := fmt.Errorf("getObjectOutput error, %w", responseError)
+	if code := s3StatusCode(err); code != http.StatusNotModified {
+		t.Errorf("s3StatusCode() = %d, want %d", code, http.StatusNotModified)
+	}
+
+	if code := s3StatusCode(errors.New("connection refused")); code != 0 {
+		t.Errorf("s3StatusCode() = %d, want 0", code)
+	}
+}
+
+func TestSetObjectHeaders(t *testing.T) {
+	headers := map[string]string{}
+	setObjectHeaders(headers, nil, nil)
+	if len(headers) != 0 {
+		t.Errorf("setObjectHeaders() without an ETag set %v", headers)
+	}
+
+	etag := `"5d41402abc4b2a76b9719d911017c592"`
+	lastModified := time.Date(2025, 3, 4, 10, 30, 0, 0, time.FixedZone("CET", 3600))
+	setObjectHeaders(headers, &etag, &lastModified)
+	if headers["ETag"] != etag {
+		t.Errorf("ETag = %q, want %q", headers["ETag"], etag)
+	}
+	if headers["Last-Modified"] != "Tue, 04 Mar 2025 09:30:00 GMT" {
+		t.Errorf("Last-Modified = %q, want the date in GMT", headers["Last-Modified"])
+	}
+}
+
+func TestCheckIfRange(t *testing.T) {
+	byteRange := "bytes=65536-"
+	etag := `"5d41402abc4b2a76b9719d911017c592"`
+	lastModified := time.Date(2025, 3, 4, 9, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		ifRange string
+		want    string
+	}{
+		{etag, byteRange},
+		{"Tue, 04 Mar 2025 09:30:00 GMT", byteRange},
+		// The object was replaced since the client got the first part
+		{`"7d793037a0760186574b0282f2f435e7"`, ""},
+		{"Mon, 03 Mar 2025 09:30:00 GMT", ""},
+		// Weak ETags don't match with the strong comparison
+		{"W/" + etag, ""},
+		{"yesterday", ""},
+	}
+
+	for _, test := range tests {
+		if got := checkIfRange(byteRange, test.ifRange, &etag, &lastModified); got != test.want {
+			t.Errorf("checkIfRange(%q) = %q, want %q", test.ifRange, got, test.want)
+		}
+	}
+
+	if got := checkIfRange(byteRange, etag, nil, nil); got != "" {
+		t.Errorf("checkIfRange() without an ETag = %q, want no range", got)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var (
+	// The name is empty or too long
+	errInvalidName error = errors.New("invalid name")
+	// The encrypted name is not base64 of an age file encrypted to the folder key
+	errInvalidEncryptedName error = errors.New("invalid encrypted name")
+	// The blind index is missing or is not a hex encoded HMAC-SHA256, or it was sent for a folder without encrypted names
+	errInvalidNameIndex error = errors.New("invalid name index")
+	// Another item in the folder has the same blind index
+	errNameExists error = errors.New("an item with the same name already exists")
+)
+
+const (
+	// The maximum length of a base64 encrypted name, the size of the name column in files.
+	// It fits a MaxFileNameLength name encrypted to one X25519 recipient
+	MaxEncryptedNameLength = 1024
+	// The length of a blind index, a hex encoded HMAC-SHA256 of the normalized name
+	NameIndexLength = 64
+	// The MySQL error number for duplicate entries in a unique index
+	mysqlDuplicateEntry = 1062
+)
+
+// Returns true if the names of the items inside of the folder are encrypted.
+// The root directory never has encrypted names since there is no folder key for it.
+func hasEncryptedNames(ctx context.Context, dirID string) (bool, error) {
+	if dirID == RootDirectoryID {
+		return false, nil
+	}
+
+	var encryptNames bool
+	err := db.QueryRowContext(ctx, "SELECT encryptNames FROM files WHERE id = ?", dirID).Scan(&encryptNames)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, errDirNotFound
+		}
+		return false, err
+	}
+	return encryptNames, nil
+}
+
+// Returns true if the name of the item is encrypted
+func isNameEncrypted(ctx context.Context, fileID string) (bool, error) {
+	var nameEncrypted bool
+	err := db.QueryRowContext(ctx, "SELECT nameIndex IS NOT NULL FROM files WHERE id = ?", fileID).Scan(&nameEncrypted)
+	return nameEncrypted, err
+}
+
+// Checks the name of a new or renamed item in parentDir and returns the blind index to store with it.
+// In folders with encrypted names, the name has to be base64 of an age file encrypted to the folder key and nameIndex is required.
+// In other folders, nameIndex has to be empty and the returned index is NULL.
+func checkItemName(ctx context.Context, parentDir, name, nameIndex string) (sql.NullString, error) {
+	encrypted, err := hasEncryptedNames(ctx, parentDir)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+
+	if !encrypted {
+		if nameIndex != "" {
+			return sql.NullString{}, errInvalidNameIndex
+		}
+
+		if name == "" || len(name) > MaxFileNameLength {
+			return sql.NullString{}, fmt.Errorf("%w: it must be between 1 and %d characters", errInvalidName, MaxFileNameLength)
+		}
+		return sql.NullString{}, nil
+	}
+
+	err = validateEncryptedName(ctx, parentDir, name)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+
+	decoded, err := hex.DecodeString(nameIndex)
+	if err != nil || len(decoded) != NameIndexLength/2 {
+		return sql.NullString{}, errInvalidNameIndex
+	}
+	// Always store it in lowercase so that the unique index works
+	return sql.NullString{String: hex.EncodeToString(decoded), Valid: true}, nil
+}
+
+// Checks that the name is base64 of an age file encrypted only to the folder key used by dirID
+func validateEncryptedName(ctx context.Context, dirID, name string) error {
+	if name == "" || len(name) > MaxEncryptedNameLength {
+		return fmt.Errorf("%w: it must be between 1 and %d characters", errInvalidEncryptedName, MaxEncryptedNameLength)
+	}
+
+	encrypted, err := base64.StdEncoding.DecodeString(name)
+	if err != nil {
+		return fmt.Errorf("%w: it is not base64", errInvalidEncryptedName)
+	}
+
+	publicKey, err := getNameKey(ctx, dirID)
+	if err != nil {
+		return err
+	}
+
+	err = checkAgeRecipients(bytes.NewReader(encrypted), []string{publicKey})
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidEncryptedName, err)
+	}
+	return nil
+}
+
+// Returns the public key that the names inside of dirID are encrypted to.
+// It is the folder key of dirID or of the closest folder above it that has one.
+func getNameKey(ctx context.Context, dirID string) (string, error) {
+	folderID, err := getFolderKeyFolder(ctx, db, dirID)
+	if err != nil {
+		return "", fmt.Errorf("getFolderKeyFolder error. %w", err)
+	}
+
+	if folderID == "" {
+		return "", fmt.Errorf("no folder key found for folder %s", dirID)
+	}
+
+	var publicKey string
+	err = db.QueryRowContext(ctx, "SELECT publicKey FROM encryptionKeys WHERE folderID = ? LIMIT 1", folderID).Scan(&publicKey)
+	return publicKey, err
+}
+
+// Returns true for the errors returned by checkItemName when the name sent by the client is not valid
+func isInvalidNameError(err error) bool {
+	return errors.Is(err, errInvalidName) || errors.Is(err, errInvalidEncryptedName) || errors.Is(err, errInvalidNameIndex)
+}
+
+// Returns errNameExists if err is a duplicate entry error, which happens when the blind index is already used in the folder.
+// Other errors are returned as they are.
+func checkDuplicateName(err error) error {
+	if isDuplicateEntry(err) {
+		return errNameExists
+	}
+	return err
+}
+
+// Returns true if err is a MySQL duplicate entry error
+func isDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry
+}
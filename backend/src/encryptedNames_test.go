@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestCheckDuplicateName(t *testing.T) {
+	duplicate := &mysql.MySQLError{Number: mysqlDuplicateEntry, Message: "Duplicate entry"}
+	if !errors.Is(checkDuplicateName(duplicate), errNameExists) {
+		t.Errorf("checkDuplicateName should return errNameExists for a duplicate entry")
+	}
+
+	if !errors.Is(checkDuplicateName(fmt.Errorf("wrapped. %w", duplicate)), errNameExists) {
+		t.Errorf("checkDuplicateName should return errNameExists for a wrapped duplicate entry")
+	}
+
+	other := &mysql.MySQLError{Number: 1452, Message: "Foreign key constraint fails"}
+	if checkDuplicateName(other) != other {
+		t.Errorf("checkDuplicateName should return other errors as they are")
+	}
+
+	if checkDuplicateName(nil) != nil {
+		t.Errorf("checkDuplicateName should return nil when there is no error")
+	}
+}
+
+func TestIsInvalidNameError(t *testing.T) {
+	items := map[error]bool{
+		errInvalidName: true,
+		fmt.Errorf("%w: not base64", errInvalidEncryptedName): true,
+		errInvalidNameIndex: true,
+		errNameExists:       false,
+		errDirNotFound:      false,
+	}
+
+	for err, expected := range items {
+		if isInvalidNameError(err) != expected {
+			t.Errorf("isInvalidNameError failed for %v. Expected: %t", err, expected)
+		}
+	}
+}
+
+// Returns the name encrypted for the recipients, in base64 like the clients send it
+func encryptTestName(t *testing.T, name string, recipients ...age.Recipient) string {
+	t.Helper()
+	encrypted := &bytes.Buffer{}
+	w, err := age.Encrypt(encrypted, recipients...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write([]byte(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(encrypted.Bytes())
+}
+
+func TestCheckItemNamePlain(t *testing.T) {
+	ctx := context.Background()
+	useFakeDB(t)
+
+	nameIndex, err := checkItemName(ctx, RootDirectoryID, "notes.txt", "")
+	if err != nil || nameIndex.Valid {
+		t.Errorf("checkItemName(notes.txt) = %v %v, want no index", nameIndex, err)
+	}
+
+	invalid := map[[2]string]error{
+		{"", ""}: errInvalidName,
+		{strings.Repeat("a", MaxFileNameLength+1), ""}:      errInvalidName,
+		{"notes.txt", strings.Repeat("a", NameIndexLength)}: errInvalidNameIndex,
+	}
+	for item, expected := range invalid {
+		_, err := checkItemName(ctx, RootDirectoryID, item[0], item[1])
+		if !errors.Is(err, expected) {
+			t.Errorf("checkItemName(%q, %q) returned %v, want %v", item[0], item[1], err, expected)
+		}
+	}
+}
+
+func TestCheckItemNameEncrypted(t *testing.T) {
+	ctx := context.Background()
+	folderKey, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherKey, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	useFakeDB(t,
+		fakeResponse{match: "SELECT encryptNames FROM files", columns: []string{"encryptNames"}, rows: [][]driver.Value{{true}}},
+		fakeResponse{match: "INNER JOIN encryptionKeys k ON k.folderID = a.id", columns: []string{"id"}, rows: [][]driver.Value{{"folder"}}},
+		fakeResponse{match: "SELECT publicKey FROM encryptionKeys WHERE folderID", columns: []string{"publicKey"}, rows: [][]driver.Value{{folderKey.Recipient().String()}}},
+	)
+
+	name := encryptTestName(t, "notes.txt", folderKey.Recipient())
+	index := strings.Repeat("AB", NameIndexLength/2)
+	nameIndex, err := checkItemName(ctx, "folder", name, index)
+	if err != nil || nameIndex.String != strings.ToLower(index) {
+		t.Errorf("checkItemName() = %v %v, want the index in lowercase", nameIndex, err)
+	}
+
+	invalid := map[[2]string]error{
+		{"notes.txt", index}: errInvalidEncryptedName,
+		// Only the number of X25519 recipients can be checked
+		{encryptTestName(t, "notes.txt", folderKey.Recipient(), otherKey.Recipient()), index}: errInvalidEncryptedName,
+		{name, ""}:                        errInvalidNameIndex,
+		{name, "not hex"}:                 errInvalidNameIndex,
+		{name, index[:NameIndexLength-2]}: errInvalidNameIndex,
+	}
+	for item, expected := range invalid {
+		_, err := checkItemName(ctx, "folder", item[0], item[1])
+		if !errors.Is(err, expected) {
+			t.Errorf("checkItemName(%.20q, %q) returned %v, want %v", item[0], item[1], err, expected)
+		}
+	}
+}
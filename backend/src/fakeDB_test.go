@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The answer to isAuthTokenValid for a valid token
+var validTokenResponse = fakeResponse{match: "from authTokens", columns: []string{"count"}, rows: [][]driver.Value{{1}}}
+
+// A canned answer to the queries that contain match
+type fakeResponse struct {
+	match   string
+	columns []string
+	rows    [][]driver.Value
+	err     error
+	// Only used for the first matching query, the next ones use the following responses
+	once bool
+}
+
+// A statement run against the fake DB
+type fakeCall struct {
+	query string
+	args  []driver.Value
+}
+
+// A database/sql driver that answers with fakeResponses, so that the functions that use the global db can be tested without MySQL.
+// Queries without a response return no rows, and Exec calls affect one row.
+type fakeDB struct {
+	mu        sync.Mutex
+	responses []fakeResponse
+	calls     []fakeCall
+	commits   int
+	rollbacks int
+}
+
+// Replaces the global db with a fakeDB for the duration of the test
+func useFakeDB(t *testing.T, responses ...fakeResponse) *fakeDB {
+	t.Helper()
+	fake := &fakeDB{responses: responses}
+	previous := db
+	db = sql.OpenDB(fake)
+	t.Cleanup(func() {
+		db.Close()
+		db = previous
+	})
+	return fake
+}
+
+// Sends the body as JSON to the handler. Returns the status and the decoded response
+func postJSON(t *testing.T, handler gin.HandlerFunc, body any) (int, map[string]any) {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("failed to encode the request. %v", err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest("POST", "/", bytes.NewReader(data))
+	c.Request.Header.Set("Content-Type", "application/json")
+	handler(c)
+
+	response := map[string]any{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatalf("failed to decode the response %q. %v", recorder.Body.String(), err)
+	}
+	return recorder.Code, response
+}
+
+// Returns the statements that contain match
+func (f *fakeDB) callsMatching(match string) []fakeCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := []fakeCall{}
+	for _, call := range f.calls {
+		if strings.Contains(call.query, match) {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+func (f *fakeDB) respond(query string, args []driver.NamedValue) (fakeResponse, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	call := fakeCall{query: query}
+	for _, arg := range args {
+		call.args = append(call.args, arg.Value)
+	}
+	f.calls = append(f.calls, call)
+
+	for i, response := range f.responses {
+		if strings.Contains(query, response.match) {
+			if response.once {
+				f.responses = append(f.responses[:i:i], f.responses[i+1:]...)
+			}
+			return response, true
+		}
+	}
+	return fakeResponse{}, false
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return &fakeConn{f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) { return &fakeStmt{c.db, query}, nil }
+func (c *fakeConn) Close() error                              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)                 { return &fakeTx{c.db}, nil }
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	response, _ := c.db.respond(query, args)
+	if response.err != nil {
+		return nil, response.err
+	}
+	return &fakeRows{columns: response.columns, rows: response.rows}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	response, _ := c.db.respond(query, args)
+	if response.err != nil {
+		return nil, response.err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+type fakeTx struct{ db *fakeDB }
+
+func (t *fakeTx) Commit() error {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	t.db.commits++
+	return nil
+}
+
+func (t *fakeTx) Rollback() error {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	t.db.rollbacks++
+	return nil
+}
+
+// Only used if the driver doesn't go through QueryContext and ExecContext
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return (&fakeConn{s.db}).ExecContext(context.Background(), s.query, namedValues(args))
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return (&fakeConn{s.db}).QueryContext(context.Background(), s.query, namedValues(args))
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return named
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+	next    int
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
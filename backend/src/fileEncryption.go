@@ -3,104 +3,100 @@ package main
 import (
 	"bytes"
 	"context"
-	"database/sql"
 	"fmt"
 	"io"
 	"os"
+	"slices"
 
 	"filippo.io/age"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 )
 
 // Encrpts the file at the specified path and uploads it to S3 with the specified object key
 // Missing way of specifing the publicKeys
-func encryptAndUploadFile(ctx context.Context, filePath, s3ObjKey, parentDir, userID string) (*s3.PutObjectOutput, error) {
+// Returns the SHA-256 of the uploaded ciphertext in hex
+func encryptAndUploadFile(ctx context.Context, filePath, s3ObjKey string, publicKeys []string) (string, error) {
 	// get file
 	fileIn, err := os.Open(filePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file %q. %w", filePath, err)
+		return "", fmt.Errorf("failed to open file %q. %w", filePath, err)
 	}
 	defer fileIn.Close()
 
-	// Get the public key associated with the parent directory
-	publicKey, err := getPublicKeyForDirectory(ctx, parentDir, userID, 0)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get public key for folder %s: %w", parentDir, err)
-	}
+	return encryptAndUploadReader(ctx, fileIn, s3ObjKey, publicKeys)
+}
 
-	// Parse the public key into an age recipient
-	recipient, err := age.ParseX25519Recipient(publicKey)
+// Encrypts everything read from fileIn for the public keys and uploads it to S3 with the specified object key.
+// It is used for the files uploaded and for the data generated from them, such as thumbnails. The keys come from getFileRecipients.
+// Returns the SHA-256 of the uploaded ciphertext in hex
+func encryptAndUploadReader(ctx context.Context, fileIn io.Reader, s3ObjKey string, publicKeys []string) (string, error) {
+	// Parse the public keys into age recipients
+	recipients, err := parseRecipients(publicKeys)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse public key: %w", err)
+		return "", fmt.Errorf("failed to parse public keys: %w", err)
 	}
 
 	// encrypt
 	encryptedData := &bytes.Buffer{}
-	ageWriter, err := age.Encrypt(encryptedData, recipient)
+	ageWriter, err := age.Encrypt(encryptedData, recipients...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to start encrypting the file: %w", err)
+		return "", fmt.Errorf("failed to start encrypting the file: %w", err)
 	}
 
 	n, err := io.Copy(ageWriter, fileIn)
 	if err != nil {
-		return nil, fmt.Errorf("failed to encrypt the file : %w", err)
+		return "", fmt.Errorf("failed to encrypt the file : %w", err)
 	}
 	err = ageWriter.Close()
 	if err != nil {
-		return nil, fmt.Errorf("failed to close the ageWriter: %w", err)
+		return "", fmt.Errorf("failed to close the ageWriter: %w", err)
 	}
 
 	log.WithField("bytesEncrypted", n).Trace("[encryptFile] Encrypted file")
+	checksum := sha256Hex(encryptedData.Bytes())
 
 	// age --decrypt -i "/Users/FedeMtz/Downloads/testing-age-key copy.txt" testImage-0.png.age > out-testImage-0.png
 	// upload file
-	res, err := uploadBytes(ctx, s3Client, serverConfig.S3BucketName, encryptedData, int64(encryptedData.Len()), s3ObjKey)
+	_, err = uploadBytes(ctx, s3Client, serverConfig.S3BucketName, encryptedData, int64(encryptedData.Len()), s3ObjKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to upload the file: %w", err)
+		return "", fmt.Errorf("failed to upload the file: %w", err)
 	}
 
-	return res, err
-	// Example Usage:
-	/*
-		filePath := "tmp/testImage-0.png"
-		parts := strings.Split(filePath, "/tmp/")
-		newFilename := parts[len(parts)-1] + ".age"
-		res, err = encryptAndUploadFile(filePath, newFilename)
-		if err != nil {
-			fmt.Printf("[main] encryptFile error: ")
-			fmt.Println(err)
-		}
-		fmt.Print("result: ")
-		fmt.Println(res)
-	*/
+	err = recordObjectRecipients(ctx, s3ObjKey, publicKeys)
+	if err != nil {
+		return "", fmt.Errorf("recordObjectRecipients error: %w", err)
+	}
+
+	return checksum, nil
 }
 
+// Returns the public keys that the items inside of the directory are encrypted with.
+// It is the folder key of the closest folder that has one, or every active key of the user when the root is reached.
 // folderID is the parentDir
 // callNumber is increased in recursive calls, set it to zero.
-func getPublicKeyForDirectory(ctx context.Context, dirID, userID string, callNumber int) (string, error) {
+func getPublicKeysForDirectory(ctx context.Context, dirID, userID string, callNumber int) ([]string, error) {
 	// 10 might break folders inside folders inside folders
 	if callNumber > 10 {
-		return "", fmt.Errorf("called 10 times")
+		return nil, fmt.Errorf("called 10 times")
 	}
 
 	if dirID == "" {
-		return "", fmt.Errorf("dirID is empty")
+		return nil, fmt.Errorf("dirID is empty")
 	}
 
 	if dirID == RootDirectoryID {
-		userKey, err := getPublicKeyForUser(ctx, userID)
+		userKeys, err := getActivePublicKeysForUser(ctx, userID)
 		if err != nil {
-			return "", nil
+			return nil, fmt.Errorf("getActivePublicKeysForUser error. %w", err)
 		}
-		return userKey, nil
+		return userKeys, nil
 	}
 
 	// Query to get the public key for the folder from the encryptionKeys table
 	rows, err := db.QueryContext(ctx, "SELECT publicKey FROM encryptionKeys WHERE folderID = ? LIMIT 1", dirID)
 	if err != nil {
-		return "", fmt.Errorf("db query error. %w", err)
+		return nil, fmt.Errorf("db query error. %w", err)
 	}
 
 	defer rows.Close()
@@ -109,13 +105,13 @@ func getPublicKeyForDirectory(ctx context.Context, dirID, userID string, callNum
 		var publicKey string
 		err := rows.Scan(&publicKey)
 		if err != nil {
-			return "", fmt.Errorf("failed to scan profilePictureID. %w", err)
+			return nil, fmt.Errorf("failed to scan profilePictureID. %w", err)
 		}
-		return publicKey, nil
+		return []string{publicKey}, nil
 	} else {
 		err = rows.Err()
 		if err != nil {
-			return "", fmt.Errorf("failed to get publicKey. %w", err)
+			return nil, fmt.Errorf("failed to get publicKey. %w", err)
 		}
 
 		// dir not found in the encryptionKeys db
@@ -123,9 +119,9 @@ func getPublicKeyForDirectory(ctx context.Context, dirID, userID string, callNum
 		callNumber++
 		parentDirID, err := getParentDirID(ctx, dirID)
 		if err != nil {
-			return "", fmt.Errorf("failed to get parentDirID. callNumber: %d. %w", callNumber, err)
+			return nil, fmt.Errorf("failed to get parentDirID. callNumber: %d. %w", callNumber, err)
 		}
-		return getPublicKeyForDirectory(ctx, parentDirID, userID, callNumber)
+		return getPublicKeysForDirectory(ctx, parentDirID, userID, callNumber)
 	}
 
 	/*
@@ -185,18 +181,74 @@ func getUserIDFromFileID(ctx context.Context, fileID string) (string, error) {
 	return userID, nil
 }*/
 
-func getPublicKeyForUser(ctx context.Context, userID string) (string, error) {
-	var publicKey string
+// Returns every active public key of the user, one for each of their devices. Folder keys, revoked keys and keys that are being rotated out are not included.
+// If the user doesn't have any, it returns an error.
+func getActivePublicKeysForUser(ctx context.Context, userID string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT publicKey FROM encryptionKeys WHERE userID = ? AND folderID IS NULL AND revokedDate IS NULL AND retiringDate IS NULL ORDER BY createdDate", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	err := db.QueryRowContext(ctx, "SELECT publicKey FROM encryptionKeys WHERE userID = ? LIMIT 1", userID).Scan(&publicKey)
+	publicKeys := []string{}
+	for rows.Next() {
+		var publicKey string
+		if err := rows.Scan(&publicKey); err != nil {
+			return nil, err
+		}
+		publicKeys = append(publicKeys, publicKey)
+	}
+
+	err = rows.Err()
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return "", fmt.Errorf("no public key found for userID %s", userID)
+		return nil, err
+	}
+
+	if len(publicKeys) == 0 {
+		return nil, fmt.Errorf("no public key found for userID %s", userID)
+	}
+
+	return publicKeys, nil
+}
+
+// Returns the age recipients for every active public key of the user
+func getRecipientsForUser(ctx context.Context, userID string) ([]age.Recipient, error) {
+	publicKeys, err := getActivePublicKeysForUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseRecipients(publicKeys)
+}
+
+// Saves the public keys that the S3 object is encrypted with, replacing the ones saved before.
+// It is used to find the objects that still need to be encrypted again during a key rotation.
+func recordObjectRecipients(ctx context.Context, objKey string, publicKeys []string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM objectRecipients WHERE objKey = ?", objKey)
+	if err != nil {
+		return fmt.Errorf("failed to remove old recipients. %w", err)
+	}
+
+	for _, publicKey := range publicKeys {
+		_, err = tx.ExecContext(ctx, "INSERT IGNORE INTO objectRecipients (objKey, publicKey) VALUES (?, ?)", objKey, publicKey)
+		if err != nil {
+			return fmt.Errorf("failed to insert recipient %s. %w", publicKey, err)
 		}
-		return "", err
 	}
 
-	return publicKey, nil
+	// Deduplicated objects are only reused for uploads to the same recipients
+	_, err = tx.ExecContext(ctx, "UPDATE dedupObjects SET recipientsSHA256 = ? WHERE objKey = ?", recipientsChecksum(publicKeys), objKey)
+	if err != nil {
+		return fmt.Errorf("failed to update the deduplicated object. %w", err)
+	}
+
+	return tx.Commit()
 }
 
 func generateFolderKey(ctx context.Context) (*age.X25519Identity, *age.X25519Recipient, error) {
@@ -242,9 +294,56 @@ func encryptFolderKeyForUsers(folderKey []byte, recipients []age.Recipient) ([]b
 	return encryptedData.Bytes(), nil
 }
 
+// Returns the active public keys of the folder's owner and of every user with access to it, without duplicates.
+// It is the set of keys that the folder key has to be encrypted with.
+func getFolderKeyPublicKeys(ctx context.Context, folderID string) ([]string, error) {
+	userIDs, err := getFolderKeyRecipients(ctx, folderID)
+	if err != nil {
+		return nil, fmt.Errorf("getFolderKeyRecipients error. %w", err)
+	}
+
+	publicKeys := []string{}
+	for _, userID := range userIDs {
+		userKeys, err := getActivePublicKeysForUser(ctx, userID)
+		if err != nil {
+			return nil, fmt.Errorf("getActivePublicKeysForUser error. %w", err)
+		}
+
+		for _, publicKey := range userKeys {
+			if !slices.Contains(publicKeys, publicKey) {
+				publicKeys = append(publicKeys, publicKey)
+			}
+		}
+	}
+	return publicKeys, nil
+}
+
+// Returns the public keys that the S3 object was encrypted with, from objectRecipients
+func getObjectRecipients(ctx context.Context, objKey string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT publicKey FROM objectRecipients WHERE objKey = ?", objKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	publicKeys := []string{}
+	for rows.Next() {
+		var publicKey string
+		if err := rows.Scan(&publicKey); err != nil {
+			return nil, err
+		}
+		publicKeys = append(publicKeys, publicKey)
+	}
+	return publicKeys, rows.Err()
+}
+
+// Returns the S3 object key of the folder's encrypted folder key
+func folderKeyObjKey(folderID string) string {
+	return fmt.Sprintf("folderkeys/%s", folderID)
+}
+
 func uploadEncryptedFolderKey(ctx context.Context, encryptedKey []byte, folderID string) error {
-	// S3 object key format (customize as needed)
-	objKey := fmt.Sprintf("folderkeys/%s", folderID)
+	objKey := folderKeyObjKey(folderID)
 
 	// Wrap encryptedKey []byte in a reader
 	reader := bytes.NewReader(encryptedKey)
@@ -284,7 +383,7 @@ func handleGetFolderKey(c *gin.Context) {
 		return
 	}
 	// the S3 object key for this folder
-	objKey := fmt.Sprintf("folderkeys/%s", request.FolderID)
+	objKey := folderKeyObjKey(request.FolderID)
 
 	file, err := getFile(c, s3Client, serverConfig.S3BucketName, objKey)
 	if err != nil {
@@ -306,19 +405,13 @@ func getPublicKeysForUsers(ctx context.Context, shareWith []string, userID strin
 
 	publicKeys := []age.Recipient{}
 	for _, userID := range shareWith {
-		pubKey, err := getPublicKeyForUser(ctx, userID)
-		if err != nil {
-			log.WithField("userID", userID).WithError(err).Error("[getPublicKeysForUsers] Failed to fetch user's public key")
-			continue
-		}
-
-		recipient, err := age.ParseX25519Recipient(pubKey)
+		recipients, err := getRecipientsForUser(ctx, userID)
 		if err != nil {
-			log.WithFields(log.Fields{"pubKey": pubKey, "shareWith": shareWith}).WithError(err).Error("[getPublicKeysForUsers] Invalid public key")
+			log.WithFields(log.Fields{"userID": userID, "shareWith": shareWith}).WithError(err).Error("[getPublicKeysForUsers] Failed to fetch user's public keys")
 			// TODO: maybe return an error here
 			continue
 		}
-		publicKeys = append(publicKeys, recipient)
+		publicKeys = append(publicKeys, recipients...)
 	}
 	return publicKeys, nil
 }
@@ -328,19 +421,13 @@ func getPublicKeysForUsersWithFolderAccess(ctx context.Context, shareWith []stri
 
 	publicKeys := []age.Recipient{}
 	for _, userID := range shareWith {
-		pubKey, err := getPublicKeyForUser(ctx, userID)
-		if err != nil {
-			log.WithField("userID", userID).WithError(err).Error("[getPublicKeysForUsers] Failed to fetch user's public key")
-			continue
-		}
-
-		recipient, err := age.ParseX25519Recipient(pubKey)
+		recipients, err := getRecipientsForUser(ctx, userID)
 		if err != nil {
-			log.WithFields(log.Fields{"pubKey": pubKey, "shareWith": shareWith}).WithError(err).Error("[getPublicKeysForUsers] Invalid public key")
+			log.WithFields(log.Fields{"userID": userID, "shareWith": shareWith}).WithError(err).Error("[getPublicKeysForUsers] Failed to fetch user's public keys")
 			// TODO: maybe return an error here
 			continue
 		}
-		publicKeys = append(publicKeys, recipient)
+		publicKeys = append(publicKeys, recipients...)
 	}
 	return publicKeys, nil
 }
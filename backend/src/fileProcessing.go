@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"os"
@@ -18,13 +20,13 @@ var (
 	errFileIsNotAnImg error = errors.New("the file is not an image")
 	// Error for unsuported image file type
 	errUnsuportedImgType error = errors.New("the image file format is not supported")
-	// A list of the suported image types for a profile picture
-	supportedImageTypes = []string{"jpeg", "jp2", "png", "gif"}
+	// A list of the suported image types for a profile picture. They have to be types that image.Decode() can read
+	supportedImageTypes = []string{"jpeg", "png", "gif", "webp"}
 	// A list of the file types that the filetype library can't recognize that are ok to be assumed to be safe.
 	excemptedFileTypes = []string{"text/plain", "application/xml", "text/xml"}
 )
 
-func processFile(ctx context.Context, filePath, fileID, expectedMIMEType string, parentDir, userID string) error {
+func processFile(ctx context.Context, filePath, fileID, expectedMIMEType string, userID string) error {
 	buf, err := os.ReadFile(filePath)
 	if err != nil {
 		return fmt.Errorf("failed to open the file: %w", err)
@@ -60,23 +62,83 @@ func processFile(ctx context.Context, filePath, fileID, expectedMIMEType string,
 		}
 	}
 
-	objKey, err := getNewID()
+	// Remove the photo's metadata if the user enabled it
+	if kind != filetype.Unknown && slices.Contains(metadataSanitizerTypes, kind.MIME.Value) {
+		settings, err := getUserSettings(ctx, userID)
+		if err != nil {
+			return fmt.Errorf("failed to get the user's settings: %w", err)
+		}
+
+		if settings.StripPhotoMetadata {
+			buf, err = stripImageMetadata(buf, kind.MIME.Value)
+			if err != nil {
+				return fmt.Errorf("failed to remove the metadata: %w", err)
+			}
+
+			err = os.WriteFile(filePath, buf, 0644)
+			if err != nil {
+				return fmt.Errorf("failed to save the file without metadata: %w", err)
+			}
+			log.WithField("fileID", fileID).Trace("[processFile] Removed metadata")
+		}
+	}
+
+	// The checksum of the plaintext that is stored, after removing the metadata
+	plaintextChecksum := sha256Hex(buf)
+
+	// Everyone with access to the file has to be able to decrypt it, including the users that the folder is shared with
+	publicKeys, err := getFileRecipients(ctx, fileID)
 	if err != nil {
-		return fmt.Errorf("getNewFileID failed: %w", err)
+		return fmt.Errorf("failed to get the recipients: %w", err)
 	}
+	recipients := recipientsChecksum(publicKeys)
 
-	// encrypt and upload
-	res, err := encryptAndUploadFile(ctx, filePath, objKey.String(), parentDir, userID)
+	// If the user already uploaded the same content for the same recipients, the object is reused instead of uploading it again
+	objKey, ciphertextChecksum, err := reuseObject(ctx, userID, plaintextChecksum, recipients)
 	if err != nil {
-		return fmt.Errorf("encryptAndUploadFile failed: %w", err)
+		return fmt.Errorf("reuseObject failed: %w", err)
+	}
+
+	if objKey != "" {
+		log.WithFields(log.Fields{"fileID": fileID, "objKey": objKey}).Trace("[processFile] Reused an identical object")
+	} else {
+		newObjKey, err := getNewID()
+		if err != nil {
+			return fmt.Errorf("getNewFileID failed: %w", err)
+		}
+		objKey = newObjKey.String()
+
+		// encrypt and upload
+		ciphertextChecksum, err = encryptAndUploadFile(ctx, filePath, objKey, publicKeys)
+		if err != nil {
+			return fmt.Errorf("encryptAndUploadFile failed: %w", err)
+		}
+
+		err = addDedupObject(ctx, objKey, userID, plaintextChecksum, recipients)
+		if err != nil {
+			return fmt.Errorf("addDedupObject failed: %w", err)
+		}
 	}
 
-	fmt.Printf("[processFile] Result: ")
-	fmt.Println(res)
+	// The thumbnail is optional, the file is still usable without it.
+	var thumbnailObjKey sql.NullString
+	if kind != filetype.Unknown {
+		key, err := createThumbnail(ctx, buf, kind.MIME.Value, publicKeys)
+		if err != nil {
+			if !errors.Is(err, errThumbnailNotSupported) {
+				log.WithFields(log.Fields{"err": err, "fileID": fileID}).Warning("[processFile] Failed to create thumbnail")
+			}
+		} else {
+			thumbnailObjKey = sql.NullString{String: key, Valid: true}
+		}
+	}
 
 	// set objKey
-	_, err = db.ExecContext(ctx, "update files set objKey=?, processed=true, lastModified=now() where id=?;", objKey, fileID)
+	// The size changes if the metadata was removed
+	_, err = db.ExecContext(ctx, "update files set objKey=?, thumbnailObjKey=?, size=?, plaintextSHA256=?, ciphertextSHA256=?, processed=true, lastModified=now() where id=?;", objKey, thumbnailObjKey, len(buf), plaintextChecksum, ciphertextChecksum, fileID)
 	if err != nil {
+		// Don't keep the object alive for a file that doesn't use it
+		deleteFileObject(ctx, objKey)
 		return fmt.Errorf("failed to update DB: %w", err)
 	}
 
@@ -115,32 +177,32 @@ func processProfilePicture(ctx context.Context, filePath, profilePictureID, user
 
 	fmt.Printf("File type: %s. MIME: %s\n", kind.Extension, kind.MIME.Value)
 
-	// TODO: remove exif data
-
-	// the fileID is the objKey that is going to be used in S3.
-	// It is <the ID from the db>.<mime subtype>.
-	fileID := fmt.Sprintf("%s.%s", profilePictureID, kind.MIME.Subtype)
-
-	// open the file to upload it
-	file, err := os.Open(filePath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	info, err := file.Stat()
+	buf, err := os.ReadFile(filePath)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to open the file: %w", err)
 	}
 
-	fileSize := info.Size()
-	if fileSize == 0 {
+	if len(buf) == 0 {
 		return errFileIsEmpty
 	}
 
-	res, err := uploadBytes(ctx, s3Client, serverConfig.S3BucketName, file, fileSize, fileID)
+	// Profile pictures can be seen by other users. Decoding and encoding the image again removes all of the metadata,
+	// the orientation is applied to the pixels before that.
+	sizes, err := resizeProfilePicture(buf, kind.MIME.Value)
 	if err != nil {
-		return fmt.Errorf("failed to upload the file to S3: %w. Res: %v", err, res)
+		return fmt.Errorf("failed to resize the profile picture: %w", err)
+	}
+
+	// the fileID is the profilePictureID stored in the DB.
+	// It is <the ID from the db>.<format>. Each size is uploaded to S3 with the objKey from profilePictureObjKey().
+	fileID := fmt.Sprintf("%s.%s", profilePictureID, ProfilePictureFormat)
+
+	for size, image := range sizes {
+		objKey := profilePictureObjKey(fileID, size)
+		res, err := uploadBytes(ctx, s3Client, serverConfig.S3BucketName, bytes.NewReader(image), int64(len(image)), objKey)
+		if err != nil {
+			return fmt.Errorf("failed to upload the file to S3: %w. Res: %v", err, res)
+		}
 	}
 
 	// update user to add profilePictureID
@@ -5,7 +5,8 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"net/http"
+	"mime"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -19,11 +20,15 @@ var (
 	errFileNotFound error = errors.New("file not found")
 	// Error returned when trying to get the objKey of a file that is still being processed
 	errFileProcessing error = errors.New("file is still processing")
+	// The type of an uploaded file is not a valid MIME type
+	errInvalidFileType error = errors.New("invalid file type")
 )
 
 const (
 	// The maximum file name length in the files table on the db
 	MaxFileNameLength = 265
+	// The maximum length of the type column in the files table
+	MaxFileTypeLength = 50
 )
 
 // Handles the requests to uplooad files to the server
@@ -35,6 +40,8 @@ func handleFileUpload(c *gin.Context) {
 			curl -F "userID=testUser" -F "authToken=K1xS9ehuxeC5tw==" -F "parentDir=root" -F "file=@testFile.txt" localhost:9090/uploadFile
 
 			curl -F "userID=testUser" -F "authToken=K1xS9ehuxeC5tw==" -F "parentDir=root" -F "file=@testImage-0.png" localhost:9090/uploadFile
+		Upload a file encrypted by the client for the keys from getUploadRecipients. type and size are the plaintext's MIME type and size:
+			curl -F "userID=testUser" -F "authToken=K1xS9ehuxeC5tw==" -F "parentDir=root" -F "clientEncrypted=true" -F "type=image/png" -F "size=1024" -F "file=@testImage-0.png.age" localhost:9090/uploadFile
 	*/
 
 	if c.Request.Body == nil {
@@ -46,6 +53,8 @@ func handleFileUpload(c *gin.Context) {
 	authToken := c.PostForm("authToken")
 	// parentDir is a UUID for an actual folder. If it is the root/home folder, then it is 'root'
 	parentDir := c.PostForm("parentDir")
+	// When it is true the file was encrypted by the client and the server only stores it
+	clientEncrypted := c.PostForm("clientEncrypted") == "true"
 
 	if userID == "" || authToken == "" {
 		c.JSON(400, gin.H{"success": false, "error": "Authentication Missing"})
@@ -112,6 +121,40 @@ func handleFileUpload(c *gin.Context) {
 		return
 	}
 
+	// In folders with encrypted names, the multipart filename can't hold the base64 name, so it is sent with its blind index in encryptedName
+	fileName := file.Filename
+	if c.PostForm("encryptedName") != "" {
+		fileName = c.PostForm("encryptedName")
+	}
+
+	nameIndex, err := checkItemName(c, parentDir, fileName, c.PostForm("nameIndex"))
+	if err != nil {
+		if isInvalidNameError(err) {
+			c.JSON(400, gin.H{"success": false, "error": err.Error()})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1b), Please try again later"})
+		log.WithField("error", err).Error("[handleFileUpload] Failed to check the name")
+		return
+	}
+
+	size := int(file.Size)
+	if clientEncrypted {
+		// The server can't see the content, so the client sends the type and size of the plaintext
+		contentType, size, err = getClientEncryptedFileInfo(c.PostForm("type"), c.PostForm("size"), file.Size)
+		if err != nil {
+			c.JSON(400, gin.H{"success": false, "error": err.Error()})
+			return
+		}
+	} else {
+		contentType, err = checkFileType(contentType)
+		if err != nil {
+			c.JSON(400, gin.H{"success": false, "error": err.Error()})
+			return
+		}
+	}
+
 	// filePath := fmt.Sprintf("%s%s", serverConfig.TMPStorageDir, file.Filename)
 	filePath := fmt.Sprintf("%s%s", serverConfig.TMPStorageDir, fileID)
 	fmt.Printf("Filepath: %s\n", filePath)
@@ -124,16 +167,39 @@ func handleFileUpload(c *gin.Context) {
 
 	// add file to db with fileName as the name, contentType as type, and processed = false
 	fmt.Printf("Content Type: %s\n", contentType)
-	err = saveFileToDB(c, fileID.String(), parentDir, file.Filename, userID, contentType, int(file.Size))
+	err = saveFileToDB(c, fileID.String(), parentDir, fileName, nameIndex, userID, contentType, size)
 	if err != nil {
+		if errors.Is(err, errNameExists) {
+			deleteLocalFile(filePath)
+			c.JSON(409, gin.H{"success": false, "error": "An item with the same name already exists"})
+			return
+		}
+
 		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
 		log.WithFields(log.Fields{"error": err, "filename": file.Filename, "size": file.Size, "header": file.Header, "filePath": filePath}).Error("[handleFileUpload] Error adding uploaded file to DB")
 		return
 	}
 
+	if clientEncrypted {
+		err = processClientEncryptedFile(c, filePath, fileID.String(), userID)
+		if err != nil {
+			if errors.Is(err, errInvalidAgeHeader) || errors.Is(err, errWrongRecipients) {
+				c.JSON(400, gin.H{"success": false, "error": err.Error()})
+				return
+			}
+
+			c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"})
+			log.WithFields(log.Fields{"error": err, "fileID": fileID}).Error("[handleFileUpload] Error storing client encrypted file")
+			return
+		}
+
+		c.JSON(200, gin.H{"success": true, "fileName": file.Filename, "bytesUploaded": file.Size, "fileID": fileID})
+		return
+	}
+
 	// Start processing the file here
 	expectedMIMEType := file.Header.Get("Content-Type")
-	err = processFile(context.Background(), filePath, fileID.String(), expectedMIMEType, parentDir, userID)
+	err = processFile(context.Background(), filePath, fileID.String(), expectedMIMEType, userID)
 	if err != nil {
 		log.WithField("err", err).Error("[handleFileUpload] Error processing file")
 	}
@@ -173,45 +239,7 @@ func handleGetFile(c *gin.Context) {
 		return
 	}
 
-	// check that file exists, and the user has access to it, and get the s3 objKey
-	objKey, err := getObjectKey(c, request.FileID, request.UserID, true)
-	if err != nil {
-		if errors.Is(err, errFileNotFound) {
-			c.JSON(400, gin.H{"success": false, "error": "File not found"})
-			log.WithFields(log.Fields{"error": err, "fileID": request.FileID}).Debug("[handleGetFile] No file with that fileID found")
-			return
-		}
-
-		if errors.Is(err, errFileProcessing) {
-			c.JSON(400, gin.H{"success": false, "error": "File is being processed, try again later"})
-			log.WithFields(log.Fields{"error": err, "fileID": request.FileID}).Trace("[handleGetFile] File is still being processed")
-			return
-		}
-
-		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
-		log.WithField("error", err).Error("[handleGetFile] Failed to get object key")
-		return
-	}
-
-	if objKey == "" {
-		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
-		log.WithField("fileID", request.FileID).Error("[handleGetFile] Object key is empty")
-		return
-	}
-
-	file, err := getFile(c, s3Client, serverConfig.S3BucketName, objKey)
-	if err != nil {
-		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3)"})
-		log.WithField("error", err).Error("[handleGetFile] Failed to get file")
-		return
-	}
-
-	// https://www.iana.org/assignments/media-types/application/vnd.age
-	// asumming that all files returned are encrypted with age
-
-	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Reference/Headers/Cache-Control
-	extraHeaders := map[string]string{"Cache-Control": "private"}
-	c.DataFromReader(http.StatusOK, int64(*file.ContentLength), "application/vnd.age", file.Body, extraHeaders)
+	sendFile(c, "handleGetFile", request.UserID, request.FileID)
 }
 
 func handleRemoveFile(c *gin.Context) {
@@ -241,41 +269,88 @@ func handleRemoveFile(c *gin.Context) {
 		return
 	}
 
+	c.JSON(removeFile(c, request))
+}
+
+// Removes a file that the user owns. Returns the status and the body of the response, so that it can also be used by batch.
+// The row is deleted in a transaction, then the S3 objects are released. The ones that fail to be deleted are left to the garbage collector.
+func removeFile(ctx context.Context, request GetFileRequest) (int, gin.H) {
 	// Query DB
-	objKey, err := getObjectKey(c, request.FileID, request.UserID, false)
+	objKey, err := getObjectKey(ctx, request.FileID, request.UserID, false)
 	if err != nil {
 		if errors.Is(err, errUserAccessNotAllowed) {
 			// User is not the owner and can't delete it
-			c.JSON(403, gin.H{"success": false, "error": "Operation not allowed"})
-			log.WithFields(log.Fields{"error": err, "fileID": request.FileID}).Debug("[handleRemoveFile] User tried to delete file without proper permission")
-			return
+			log.WithFields(log.Fields{"error": err, "fileID": request.FileID}).Debug("[removeFile] User tried to delete file without proper permission")
+			return 403, gin.H{"success": false, "error": "Operation not allowed"}
 		}
-		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
-		log.WithFields(log.Fields{"error": err, "fileID": request.FileID}).Error("[handleRemoveFile] Failed to verify token")
-		return
+
+		if errors.Is(err, errFileNotFound) {
+			return 400, gin.H{"success": false, "error": "File not found"}
+		}
+
+		log.WithFields(log.Fields{"error": err, "fileID": request.FileID}).Error("[removeFile] Failed to get object key")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"}
 	}
 
-	_, err = deleteFile(c, s3Client, serverConfig.S3BucketName, objKey)
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		// handle the error
-		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
-		log.WithField("error", err).Error("[handleRemoveFile] Failed to verify token")
-		return
+		log.WithField("error", err).Error("[removeFile] Failed to start the transaction")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"}
+	}
+	defer tx.Rollback()
+
+	var thumbnailObjKey string
+	err = tx.QueryRowContext(ctx, "SELECT IFNULL(thumbnailObjKey, '') FROM files WHERE id = ? FOR UPDATE", request.FileID).Scan(&thumbnailObjKey)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 400, gin.H{"success": false, "error": "File not found"}
+		}
+
+		log.WithField("error", err).Error("[removeFile] Failed to get the thumbnail")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"}
 	}
 
 	// remove from DB
-	err = removeFileFromDB(c, request.FileID, request.UserID)
+	err = removeFileFromDB(ctx, tx, request.FileID, request.UserID)
 	if err != nil {
-		// handle the error
-		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"})
-		log.WithField("error", err).Error("[handleRemoveFile] Failed to delete file from DB")
-		return
+		log.WithField("error", err).Error("[removeFile] Failed to delete file from DB")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"}
 	}
 
-	c.JSON(200, gin.H{"success": true, "fileID": request.FileID})
+	err = tx.Commit()
+	if err != nil {
+		log.WithField("error", err).Error("[removeFile] Failed to commit the transaction")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"}
+	}
+
+	deleteRemovedObjects(ctx, []string{objKey}, []string{thumbnailObjKey})
+
+	return 200, gin.H{"success": true, "fileID": request.FileID}
 }
 
-func handleRenameItem(c *gin.Context){ 
+// Deletes the S3 objects of files that were removed from the DB. The file objects are only deleted when no other file uses them.
+// The failures are only logged, the garbage collector removes what is left.
+func deleteRemovedObjects(ctx context.Context, objKeys, thumbnailObjKeys []string) {
+	for _, objKey := range objKeys {
+		err := deleteFileObject(ctx, objKey)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "objKey": objKey}).Error("[deleteRemovedObjects] Failed to delete file from S3")
+		}
+	}
+
+	for _, thumbnailObjKey := range thumbnailObjKeys {
+		if thumbnailObjKey == "" {
+			continue
+		}
+
+		_, err := deleteFile(ctx, s3Client, serverConfig.S3BucketName, thumbnailObjKey)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "thumbnailObjKey": thumbnailObjKey}).Error("[deleteRemovedObjects] Failed to delete thumbnail from S3")
+		}
+	}
+}
+
+func handleRenameItem(c *gin.Context) {
 	if c.Request.Body == nil {
 		c.JSON(400, gin.H{"success": false, "error": "No data received"})
 		return
@@ -301,19 +376,60 @@ func handleRenameItem(c *gin.Context){
 		c.JSON(401, gin.H{"success": false, "error": "Invalid Credentials"})
 		return
 	}
-	
-	err = renameFile(db, request.FileID, request.NewName)
+
+	c.JSON(renameItem(c, request))
+}
+
+// Renames the item of the request if the user owns it or has write permission on its folder.
+// Returns the status and the body of the response, so that it can also be used by batch
+func renameItem(ctx context.Context, request RenameItemRequest) (int, gin.H) {
+	item, err := getBatchItem(ctx, db, request.FileID)
 	if err != nil {
-		c.JSON(500, gin.H{"success": false, "error": "Failed to rename file"})
+		if errors.Is(err, errFileNotFound) {
+			return 400, gin.H{"success": false, "error": "File not found"}
+		}
+
+		log.WithField("error", err).Error("[renameItem] Failed to get the item")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"}
+	}
+
+	if item.userID != request.UserID {
+		permission, err := getFolderPermission(ctx, item.parentDir, request.UserID, true)
+		if err != nil && !errors.Is(err, errDirNotFound) {
+			log.WithField("error", err).Error("[renameItem] Failed to get the folder's permission")
+			return 500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"}
+		}
+
+		if permission != WritePermission {
+			return 403, gin.H{"success": false, "error": "Operation not allowed"}
+		}
+	}
+
+	// In folders with encrypted names, newName is encrypted to the folder key and nameIndex is its blind index
+	nameIndex, err := checkItemName(ctx, item.parentDir, request.NewName, request.NameIndex)
+	if err != nil {
+		if isInvalidNameError(err) {
+			return 400, gin.H{"success": false, "error": err.Error()}
+		}
+
+		log.WithField("error", err).Error("[renameItem] Failed to check the name")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"}
+	}
+
+	err = renameFile(db, request.FileID, request.NewName, nameIndex)
+	if err != nil {
+		if errors.Is(err, errNameExists) {
+			return 409, gin.H{"success": false, "error": "An item with the same name already exists"}
+		}
+
 		log.WithFields(log.Fields{
 			"error":  err,
 			"fileID": request.FileID,
-		}).Error("[handleRenameItem] Failed to rename file")
-		return
+		}).Error("[renameItem] Failed to rename file")
+		return 500, gin.H{"success": false, "error": "Failed to rename file"}
 	}
 
-	c.JSON(200, gin.H{"success": true})
-
+	return 200, gin.H{"success": true}
 }
 
 // ---------------------------------------------------------------------------
@@ -358,11 +474,27 @@ func getObjectKey(ctx context.Context, fileID string, userID string, allowShared
 			if permission == "" {
 				return "", errUserAccessNotAllowed
 			}
+
+			// The owner's devices haven't encrypted it for the user yet
+			pending, err := hasPendingShare(ctx, fileID, userID)
+			if err != nil {
+				return "", fmt.Errorf("hasPendingShare error. %w", err)
+			}
+			if pending {
+				return "", errFileProcessing
+			}
 		}
 		// The user has access to this item
 
 		if !processed {
-			return "", errFileProcessing
+			// A copy that is waiting to be encrypted again can be downloaded by the devices that do it
+			task, err := hasFileReencryptionTask(ctx, fileID, userID)
+			if err != nil {
+				return "", fmt.Errorf("hasFileReencryptionTask error. %w", err)
+			}
+			if !task || objKey == "" {
+				return "", errFileProcessing
+			}
 		}
 		return objKey, nil
 	} else {
@@ -376,13 +508,32 @@ func getObjectKey(ctx context.Context, fileID string, userID string, allowShared
 	return "", errFileNotFound
 }
 
-func saveFileToDB(ctx context.Context, fileID, parentDir, fileName, ownerUserID, fileType string, size int) error {
-	_, err := db.ExecContext(ctx, "INSERT INTO files (id, parentDir, name, type, size, userID, processed, createdDate) VALUES (?, ?, ?, ?, ?, ?, false, now());", fileID, parentDir, fileName, fileType, size, ownerUserID)
-	return err
+// Returns the type that is stored for an uploaded file, in its canonical form, or application/octet-stream if it is empty.
+// It has to be a valid MIME type that fits in the DB, which also keeps files from using the "folder" type.
+func checkFileType(fileType string) (string, error) {
+	if fileType == "" {
+		return "application/octet-stream", nil
+	}
+
+	if len(fileType) > MaxFileTypeLength {
+		return "", fmt.Errorf("%w: the type is too long", errInvalidFileType)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(fileType)
+	if err != nil || !strings.Contains(mediaType, "/") {
+		return "", errInvalidFileType
+	}
+	return mime.FormatMediaType(mediaType, params), nil
+}
+
+// nameIndex is only valid when the name is encrypted. It returns errNameExists if the folder already has an item with the same blind index
+func saveFileToDB(ctx context.Context, fileID, parentDir, fileName string, nameIndex sql.NullString, ownerUserID, fileType string, size int) error {
+	_, err := db.ExecContext(ctx, "INSERT INTO files (id, parentDir, name, nameIndex, type, size, userID, processed, createdDate) VALUES (?, ?, ?, ?, ?, ?, ?, false, now());", fileID, parentDir, fileName, nameIndex, fileType, size, ownerUserID)
+	return checkDuplicateName(err)
 }
 
-func removeFileFromDB(ctx context.Context, fileID, userID string) error {
-	_, err := db.ExecContext(ctx, "DELETE FROM files WHERE id = ? AND userID = ?;", fileID, userID)
+func removeFileFromDB(ctx context.Context, e execer, fileID, userID string) error {
+	_, err := e.ExecContext(ctx, "DELETE FROM files WHERE id = ? AND userID = ?;", fileID, userID)
 	return err
 }
 
@@ -421,14 +572,15 @@ func getMIMEType(extension string) string {
 */
 
 // This is the renameFile functiion where it updates the file name for a given file ID
-func renameFile(db *sql.DB, fileID, newName string) error {
+// nameIndex is the blind index of the new name, only valid when the name is encrypted
+func renameFile(db *sql.DB, fileID, newName string, nameIndex sql.NullString) error {
 	query := `
 		UPDATE files 
-		SET name = ?, lastModified = CURRENT_TIMESTAMP 
+		SET name = ?, nameIndex = ?, lastModified = CURRENT_TIMESTAMP 
 		WHERE id = ?`
-	result, err := db.Exec(query, newName, fileID)
+	result, err := db.Exec(query, newName, nameIndex, fileID)
 	if err != nil {
-		return fmt.Errorf("failed to rename file: %w", err)
+		return fmt.Errorf("failed to rename file: %w", checkDuplicateName(err))
 	}
 
 	rowsAffected, err := result.RowsAffected()
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"database/sql/driver"
+	"testing"
+)
+
+func TestRenameItemNotAllowed(t *testing.T) {
+	request := RenameItemRequest{UserID: "testUser", AuthToken: "K1xS9ehuxeC5tw==", FileID: "file", NewName: "notes.txt"}
+	item := fakeResponse{match: "SELECT parentDir, name, nameIndex, type, userID FROM files", columns: batchItemColumns, rows: [][]driver.Value{{"folder", "old.txt", nil, "text/plain", "anotherTestUser"}}}
+
+	// The folder of another user is shared read only
+	fake := useFakeDB(t, validTokenResponse, item,
+		fakeResponse{match: "select userID from files where id=? AND type='folder'", columns: []string{"userID"}, rows: [][]driver.Value{{"anotherTestUser"}}},
+		fakeResponse{match: "select userID, isReadOnly from sharedFiles", columns: []string{"userID", "isReadOnly"}, rows: [][]driver.Value{{"testUser", true}}},
+		fakeResponse{match: "SELECT MIN(s.isReadOnly)", columns: []string{"isReadOnly"}, rows: [][]driver.Value{{nil}}},
+	)
+
+	status, response := postJSON(t, handleRenameItem, request)
+	if status != 403 {
+		t.Errorf("handleRenameItem() of another user's file = %d %v, want 403", status, response)
+	}
+
+	if calls := fake.callsMatching("SET name = ?, nameIndex = ?"); len(calls) != 0 {
+		t.Errorf("the item should not be renamed, got %v", calls)
+	}
+
+	// The owner can rename it
+	request.UserID = "anotherTestUser"
+	fake = useFakeDB(t, validTokenResponse, item, fakeResponse{match: "SELECT encryptNames FROM files", columns: []string{"encryptNames"}, rows: [][]driver.Value{{false}}})
+	status, response = postJSON(t, handleRenameItem, request)
+	if status != 200 {
+		t.Errorf("handleRenameItem() by the owner = %d %v, want 200", status, response)
+	}
+
+	if calls := fake.callsMatching("SET name = ?, nameIndex = ?"); len(calls) != 1 || calls[0].args[0] != "notes.txt" {
+		t.Errorf("got %v, want the item renamed", calls)
+	}
+}
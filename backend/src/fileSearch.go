@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// The number of results returned by searchFiles when the client doesn't specify a pageSize
+	DefaultSearchPageSize = 50
+	// The maximum number of results that searchFiles returns in a single page
+	MaxSearchPageSize = 200
+	// The maximum number of folders walked up when building a breadcrumb path
+	MaxBreadcrumbDepth = 50
+)
+
+func handleSearchFiles(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/searchFiles" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","query": "test", "type": "image/"}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request SearchFilesRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleSearchFiles] Failed to decode JSON")
+		return
+	}
+
+	// verify that the token is valid
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleSearchFiles] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	if strings.TrimSpace(request.Query) == "" {
+		c.JSON(400, gin.H{"success": false, "error": "Query Missing"})
+		return
+	}
+
+	if request.Page < 0 || request.PageSize < 0 || request.MinSize < 0 || request.MaxSize < 0 {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid search parameters"})
+		return
+	}
+
+	if request.PageSize == 0 {
+		request.PageSize = DefaultSearchPageSize
+	}
+
+	if request.PageSize > MaxSearchPageSize {
+		request.PageSize = MaxSearchPageSize
+	}
+
+	results, hasMore, err := searchFiles(c, request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleSearchFiles] Failed to search files")
+		return
+	}
+
+	for i := range results {
+		path, err := getBreadcrumbPath(c, results[i].ID, request.UserID)
+		if err != nil {
+			c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+			log.WithFields(log.Fields{"error": err, "fileID": results[i].ID}).Error("[handleSearchFiles] Failed to get breadcrumb path")
+			return
+		}
+		results[i].Path = path
+	}
+
+	c.JSON(200, gin.H{"success": true, "results": results, "page": request.Page, "pageSize": request.PageSize, "hasMore": hasMore})
+}
+
+// Searches the names of every item that the user owns or that is shared with them, either directly or through a shared parent directory.
+// It returns one page of results and true if there are more pages after it.
+// The Path of each result is not set, use getBreadcrumbPath() for that.
+func searchFiles(ctx context.Context, request SearchFilesRequest) ([]SearchFilesResult, bool, error) {
+	// sharedTree is every item shared with the user or their groups plus everything inside of the shared folders.
+	// Shares that are waiting for re-encryption tasks are left out like in hasPendingShare, the user can't decrypt those items yet.
+	// Items with encrypted names are never returned, the server can't read their names
+	query := `
+		WITH RECURSIVE sharedTree (id) AS (
+			SELECT s.fileID FROM sharedFiles s
+			WHERE s.userID = ? AND (s.processed = true OR NOT EXISTS (SELECT 1 FROM reencryptionTasks t WHERE t.sharedFileID = s.id))
+			UNION
+			SELECT s.fileID FROM sharedFilesGroups s INNER JOIN userGroupMembers m ON s.groupID = m.groupID
+			WHERE m.userID = ? AND (s.processed = true OR NOT EXISTS (SELECT 1 FROM reencryptionTasks t WHERE t.sharedFileGroupID = s.id))
+			UNION
+			SELECT f.id FROM files f INNER JOIN sharedTree t ON f.parentDir = t.id
+		)
+		SELECT id, parentDir, name, type, size, userID, createdDate, lastModified, IFNULL(plaintextSHA256, ''), IFNULL(ciphertextSHA256, '')
+		FROM files
+		WHERE (userID = ? OR id IN (SELECT id FROM sharedTree)) AND nameIndex IS NULL AND LOWER(name) LIKE ? ESCAPE '\\'`
+	args := []any{request.UserID, request.UserID, request.UserID, searchPattern(request.Query, request.PrefixOnly)}
+
+	if request.MIMEType != "" {
+		if strings.HasSuffix(request.MIMEType, "/") {
+			query += " AND type LIKE ? ESCAPE '\\\\'"
+			args = append(args, escapeLikePattern(request.MIMEType)+"%")
+		} else {
+			query += " AND type = ?"
+			args = append(args, request.MIMEType)
+		}
+	}
+
+	if request.MinSize > 0 {
+		query += " AND size >= ?"
+		args = append(args, request.MinSize)
+	}
+
+	if request.MaxSize > 0 {
+		query += " AND size <= ?"
+		args = append(args, request.MaxSize)
+	}
+
+	if !request.ModifiedAfter.IsZero() {
+		query += " AND IFNULL(lastModified, createdDate) >= ?"
+		args = append(args, request.ModifiedAfter)
+	}
+
+	if !request.ModifiedBefore.IsZero() {
+		query += " AND IFNULL(lastModified, createdDate) <= ?"
+		args = append(args, request.ModifiedBefore)
+	}
+
+	// Get one extra row to know if there is another page
+	query += " ORDER BY name, id LIMIT ? OFFSET ?"
+	args = append(args, request.PageSize+1, request.Page*request.PageSize)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, false, fmt.Errorf("db query error. %w", err)
+	}
+
+	defer rows.Close()
+
+	// Initialize an empty array so that the json returns an empty array instead of null.
+	var results []SearchFilesResult = []SearchFilesResult{}
+	for rows.Next() {
+		var result SearchFilesResult
+		err := rows.Scan(&result.ID, &result.ParentDir, &result.Name, &result.Type, &result.Size, &result.UserID, &result.CreatedDate, &result.LastModified, &result.SHA256, &result.CiphertextSHA256)
+		if err != nil {
+			return nil, false, fmt.Errorf("rows.Scan error. %w", err)
+		}
+		results = append(results, result)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, false, fmt.Errorf("rows error. %w", err)
+	}
+
+	if len(results) > request.PageSize {
+		return results[:request.PageSize], true, nil
+	}
+
+	return results, false, nil
+}
+
+// Returns the folders that lead to the fileID as seen by the userID, starting at the top.
+// For the user's own items it goes up to their root directory.
+// For shared items it stops at the item that was shared with the user since the folders above it belong to the owner.
+// Shares that are waiting for re-encryption tasks are not counted, the same as in searchFiles.
+// Every folder above the item is read with a single query.
+func getBreadcrumbPath(ctx context.Context, fileID, userID string) ([]PathItem, error) {
+	rows, err := db.QueryContext(ctx, `
+		WITH RECURSIVE ancestors (id, parentDir, depth) AS (
+			SELECT id, parentDir, 0 FROM files WHERE id = ?
+			UNION ALL
+			SELECT f.id, f.parentDir, a.depth + 1 FROM files f INNER JOIN ancestors a ON f.id = a.parentDir WHERE a.depth < ?
+		)
+		SELECT a.id, a.parentDir, f.name, f.nameIndex IS NOT NULL, f.userID,
+			EXISTS (SELECT 1 FROM sharedFiles s WHERE s.fileID = a.id AND s.userID = ?
+				AND (s.processed = true OR NOT EXISTS (SELECT 1 FROM reencryptionTasks t WHERE t.sharedFileID = s.id)))
+			OR EXISTS (SELECT 1 FROM sharedFilesGroups s INNER JOIN userGroupMembers m ON s.groupID = m.groupID WHERE s.fileID = a.id AND m.userID = ?
+				AND (s.processed = true OR NOT EXISTS (SELECT 1 FROM reencryptionTasks t WHERE t.sharedFileGroupID = s.id)))
+		FROM ancestors a INNER JOIN files f ON f.id = a.id ORDER BY a.depth`, fileID, MaxBreadcrumbDepth, userID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("db query error. %w", err)
+	}
+	defer rows.Close()
+
+	type ancestor struct {
+		item                   PathItem
+		parentDir, ownerUserID string
+		sharedWithUser         bool
+	}
+
+	// The item itself first, then each folder above it
+	ancestors := []ancestor{}
+	for rows.Next() {
+		var a ancestor
+		err := rows.Scan(&a.item.ID, &a.parentDir, &a.item.Name, &a.item.NameEncrypted, &a.ownerUserID, &a.sharedWithUser)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan error. %w", err)
+		}
+		ancestors = append(ancestors, a)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("rows error. %w", err)
+	}
+
+	if len(ancestors) == 0 {
+		return nil, fmt.Errorf("failed to get item %s. %w", fileID, sql.ErrNoRows)
+	}
+
+	path := []PathItem{}
+	for i, current := range ancestors {
+		if current.ownerUserID != userID && current.sharedWithUser {
+			// This is the item that was shared with the user, they can't see its parentDir
+			return path, nil
+		}
+
+		if current.parentDir == RootDirectoryID || current.parentDir == "" {
+			return path, nil
+		}
+
+		if i+1 == len(ancestors) {
+			break
+		}
+
+		// prepend the parent
+		path = append([]PathItem{ancestors[i+1].item}, path...)
+	}
+
+	if len(ancestors) <= MaxBreadcrumbDepth {
+		return nil, fmt.Errorf("failed to get folder %s. %w", ancestors[len(ancestors)-1].parentDir, sql.ErrNoRows)
+	}
+
+	log.WithFields(log.Fields{"fileID": fileID, "userID": userID}).Warn("[getBreadcrumbPath] Reached MaxBreadcrumbDepth")
+	return path, nil
+}
+
+// Returns the LIKE pattern used to search for the query in lowercase.
+func searchPattern(query string, prefixOnly bool) string {
+	pattern := escapeLikePattern(strings.ToLower(strings.TrimSpace(query))) + "%"
+	if prefixOnly {
+		return pattern
+	}
+	return "%" + pattern
+}
+
+// Escapes the characters that have a special meaning in a LIKE pattern so that they are matched literally.
+func escapeLikePattern(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return replacer.Replace(s)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSearchPattern(t *testing.T) {
+	items := map[string]string{"photo": "%photo%", "Photo": "%photo%", "  report ": "%report%", "100%": "%100\\%%", "my_file": "%my\\_file%", "back\\slash": "%back\\\\slash%"}
+
+	for key, value := range items {
+		result := searchPattern(key, false)
+		if result != value {
+			t.Errorf("searchPattern failed for value '%s'. Expected: '%s' got: '%s'", key, value, result)
+		}
+	}
+
+	prefixItems := map[string]string{"photo": "photo%", "IMG_": "img\\_%"}
+
+	for key, value := range prefixItems {
+		result := searchPattern(key, true)
+		if result != value {
+			t.Errorf("searchPattern with prefixOnly failed for value '%s'. Expected: '%s' got: '%s'", key, value, result)
+		}
+	}
+}
+
+func TestGetBreadcrumbPath(t *testing.T) {
+	columns := []string{"id", "parentDir", "name", "nameEncrypted", "userID", "shared"}
+
+	// testUser's photo inside of root/Documents/Photos
+	useFakeDB(t, fakeResponse{match: "WITH RECURSIVE ancestors", columns: columns, rows: [][]driver.Value{
+		{"photo", "photos", "photo.jpg", false, "testUser", false},
+		{"photos", "documents", "Photos", false, "testUser", false},
+		{"documents", RootDirectoryID, "Documents", false, "testUser", false},
+	}})
+
+	path, err := getBreadcrumbPath(context.Background(), "photo", "testUser")
+	if err != nil {
+		t.Fatalf("getBreadcrumbPath() error: %v", err)
+	}
+
+	if len(path) != 2 || path[0].ID != "documents" || path[1].ID != "photos" {
+		t.Errorf("getBreadcrumbPath() = %+v, want documents then photos", path)
+	}
+}
+
+func TestGetBreadcrumbPathShared(t *testing.T) {
+	columns := []string{"id", "parentDir", "name", "nameEncrypted", "userID", "shared"}
+
+	// The Photos folder was shared with anotherTestUser, they can't see the folders above it
+	useFakeDB(t, fakeResponse{match: "WITH RECURSIVE ancestors", columns: columns, rows: [][]driver.Value{
+		{"photo", "photos", "photo.jpg", false, "testUser", false},
+		{"photos", "documents", "Photos", false, "testUser", true},
+		{"documents", RootDirectoryID, "Documents", false, "testUser", false},
+	}})
+
+	path, err := getBreadcrumbPath(context.Background(), "photo", "anotherTestUser")
+	if err != nil {
+		t.Fatalf("getBreadcrumbPath() error: %v", err)
+	}
+
+	if len(path) != 1 || path[0].ID != "photos" {
+		t.Errorf("getBreadcrumbPath() = %+v, want only photos", path)
+	}
+}
+
+func TestGetBreadcrumbPathNotFound(t *testing.T) {
+	useFakeDB(t)
+
+	_, err := getBreadcrumbPath(context.Background(), "missing", "testUser")
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("getBreadcrumbPath() error = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestPendingSharesNotSearched(t *testing.T) {
+	// Both kinds of share are left out while they wait for their re-encryption tasks
+	pendingTests := []string{"t.sharedFileID = s.id", "t.sharedFileGroupID = s.id"}
+
+	fake := useFakeDB(t)
+	_, _, err := searchFiles(context.Background(), SearchFilesRequest{UserID: "anotherTestUser", Query: "photo", PageSize: DefaultSearchPageSize})
+	if err != nil {
+		t.Fatalf("searchFiles() error: %v", err)
+	}
+
+	calls := fake.callsMatching("WITH RECURSIVE sharedTree")
+	for _, pending := range pendingTests {
+		if len(calls) != 1 || !strings.Contains(calls[0].query, pending) {
+			t.Errorf("searchFiles() doesn't check %q", pending)
+		}
+	}
+
+	fake = useFakeDB(t)
+	getBreadcrumbPath(context.Background(), "photo", "anotherTestUser")
+
+	calls = fake.callsMatching("WITH RECURSIVE ancestors")
+	for _, pending := range pendingTests {
+		if len(calls) != 1 || !strings.Contains(calls[0].query, pending) {
+			t.Errorf("getBreadcrumbPath() doesn't check %q", pending)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// The folder has more than MaxFolderArchiveItems items
+	errTooManyItems error = errors.New("too many items")
+	// The folder has items nested more than MaxBreadcrumbDepth levels below it
+	errFolderTooDeep error = errors.New("folder too deep")
+)
+
+const (
+	// The maximum number of items in a folder download
+	MaxFolderArchiveItems = 10000
+	// The name of the manifest in the ZIP file
+	FolderArchiveManifestName = "manifest.json"
+	// The ZIP folder with the encrypted folder keys
+	FolderArchiveKeysDir = ".folderkeys"
+)
+
+// Streams a ZIP file with everything inside of the folder that the user can read.
+// The entries are the age files as they are stored, the server never decrypts them. manifest.json describes every item and the folder key
+// that it is encrypted to, and the folder keys encrypted to the user's devices are in .folderkeys/<folderID>.age
+func handleDownloadFolder(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/downloadFolder" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","folderID": "01955efc-ca5b-7b65-849e-ab9f1351de23"}' -o folder.zip
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request DownloadFolderRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleDownloadFolder] Failed to decode JSON")
+		return
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleDownloadFolder] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	// Sharing a folder shares everything inside of it, so the whole subtree can be read if the folder can
+	permission, err := getFolderPermission(c, request.FolderID, request.UserID, true)
+	if err != nil {
+		if errors.Is(err, errDirNotFound) {
+			c.JSON(400, gin.H{"success": false, "error": "Folder not found"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleDownloadFolder] Failed to get folder permission")
+		return
+	}
+
+	if permission == "" {
+		c.JSON(403, gin.H{"success": false, "error": "You don't have access to this folder"})
+		return
+	}
+
+	if request.FolderID != RootDirectoryID {
+		pending, err := hasPendingShare(c, request.FolderID, request.UserID)
+		if err != nil {
+			c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+			log.WithField("error", err).Error("[handleDownloadFolder] Failed to check the pending shares")
+			return
+		}
+
+		if pending {
+			c.JSON(400, gin.H{"success": false, "error": "Folder is being processed, try again later"})
+			return
+		}
+	}
+
+	manifest, objKeys, err := getFolderArchiveManifest(c, request.FolderID, request.UserID)
+	if err != nil {
+		if errors.Is(err, errTooManyItems) {
+			c.JSON(400, gin.H{"success": false, "error": fmt.Sprintf("The folder has more than %d items", MaxFolderArchiveItems)})
+			return
+		}
+
+		if errors.Is(err, errFolderTooDeep) {
+			c.JSON(400, gin.H{"success": false, "error": fmt.Sprintf("The folder has items more than %d levels deep", MaxBreadcrumbDepth)})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"})
+		log.WithField("error", err).Error("[handleDownloadFolder] Failed to get the items in the folder")
+		return
+	}
+
+	// Nothing can be reported with JSON after the ZIP starts, a failure leaves it truncated
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", request.FolderID))
+	c.Header("Cache-Control", "private")
+	c.Status(200)
+
+	err = writeFolderArchive(c, c.Writer, manifest, objKeys)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "folderID": request.FolderID}).Error("[handleDownloadFolder] Failed to stream the ZIP file")
+	}
+}
+
+// Returns the manifest of the folder's subtree and the S3 objKey of every file in it, by fileID.
+// The items are sorted so that the folders come before the items inside of them.
+// It returns errFolderTooDeep instead of leaving out the items more than MaxBreadcrumbDepth levels below the folder.
+func getFolderArchiveManifest(ctx context.Context, folderID, userID string) (FolderArchiveManifest, map[string]string, error) {
+	manifest := FolderArchiveManifest{FolderID: folderID, CreatedDate: time.Now(), Items: []FolderArchiveItem{}, FolderKeys: []FolderArchiveKey{}}
+	objKeys := map[string]string{}
+
+	// The root folder has the items of every user, only the user's own items are in their home
+	topLevel := "SELECT id, 1 FROM files WHERE parentDir = ?"
+	args := []any{folderID}
+	if folderID == RootDirectoryID {
+		topLevel += " AND userID = ?"
+		args = append(args, userID)
+	}
+	args = append(args, MaxBreadcrumbDepth, MaxFolderArchiveItems+1)
+
+	rows, err := db.QueryContext(ctx, `
+		WITH RECURSIVE tree (id, depth) AS (
+			`+topLevel+`
+			UNION ALL
+			SELECT f.id, t.depth + 1 FROM files f INNER JOIN tree t ON f.parentDir = t.id WHERE t.depth <= ?
+		)
+		SELECT t.depth, f.id, f.parentDir, f.name, f.nameIndex IS NOT NULL, f.type, f.size, f.objKey, f.processed,
+			IFNULL(f.plaintextSHA256, ''), IFNULL(f.ciphertextSHA256, ''), EXISTS (SELECT 1 FROM encryptionKeys k WHERE k.folderID = f.id)
+		FROM files f INNER JOIN tree t ON f.id = t.id ORDER BY t.depth, f.id LIMIT ?`, args...)
+	if err != nil {
+		return manifest, nil, err
+	}
+	defer rows.Close()
+
+	// The folder key that the items inside of the folder are encrypted to, by folderID
+	keyFolders := map[string]string{}
+	// The path of each folder in the ZIP file
+	folderPaths := map[string]string{folderID: ""}
+	// The paths already used in the ZIP file
+	usedPaths := map[string]bool{FolderArchiveManifestName: true, strings.ToLower(FolderArchiveKeysDir): true}
+
+	if folderID != RootDirectoryID {
+		keyFolders[folderID], err = getFolderKeyFolder(ctx, db, folderID)
+		if err != nil {
+			return manifest, nil, fmt.Errorf("getFolderKeyFolder error. %w", err)
+		}
+	}
+
+	for rows.Next() {
+		var item FolderArchiveItem
+		var objKey string
+		var depth int
+		var processed, hasKey bool
+		err := rows.Scan(&depth, &item.ID, &item.ParentDir, &item.Name, &item.NameEncrypted, &item.Type, &item.Size, &objKey, &processed, &item.SHA256, &item.CiphertextSHA256, &hasKey)
+		if err != nil {
+			return manifest, nil, err
+		}
+
+		if len(manifest.Items) == MaxFolderArchiveItems {
+			return manifest, nil, errTooManyItems
+		}
+
+		// The recursion goes one level further than the limit, to find out if there is anything below it
+		if depth > MaxBreadcrumbDepth {
+			return manifest, nil, errFolderTooDeep
+		}
+
+		parentPath, ok := folderPaths[item.ParentDir]
+		if !ok {
+			return manifest, nil, fmt.Errorf("the parent of %s is not in the manifest", item.ID)
+		}
+
+		item.FolderKeyID = keyFolders[item.ParentDir]
+		itemPath := path.Join(parentPath, archiveName(item))
+
+		if item.Type == "folder" {
+			item.Path = uniqueArchivePath(usedPaths, itemPath, "")
+			folderPaths[item.ID] = item.Path
+			keyFolders[item.ID] = item.FolderKeyID
+			if hasKey {
+				keyFolders[item.ID] = item.ID
+			}
+		} else if processed && objKey != "" {
+			item.Path = uniqueArchivePath(usedPaths, itemPath, ".age")
+			objKeys[item.ID] = objKey
+		}
+		// Files that are still being uploaded are listed without a path or content
+
+		manifest.Items = append(manifest.Items, item)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return manifest, nil, err
+	}
+
+	// Every folder key used by the items, including the one of a folder above the downloaded folder
+	keyFolderIDs := []string{}
+	for _, keyFolderID := range keyFolders {
+		if keyFolderID != "" {
+			keyFolderIDs = append(keyFolderIDs, keyFolderID)
+		}
+	}
+	slices.Sort(keyFolderIDs)
+
+	for _, keyFolderID := range slices.Compact(keyFolderIDs) {
+		manifest.FolderKeys = append(manifest.FolderKeys, FolderArchiveKey{FolderID: keyFolderID, Path: path.Join(FolderArchiveKeysDir, keyFolderID+".age")})
+	}
+
+	return manifest, objKeys, nil
+}
+
+// Returns the name used for the item in the ZIP file. Encrypted names and names that are not valid in a path are replaced by the item's ID
+func archiveName(item FolderArchiveItem) string {
+	name := strings.NewReplacer("/", "_", "\\", "_").Replace(item.Name)
+	if item.NameEncrypted || name == "" || name == "." || name == ".." {
+		return item.ID
+	}
+	return name
+}
+
+// Returns itemPath+extension, with a number before the extension if another item already uses it, and marks it as used.
+// The paths are compared ignoring the case since most file systems do.
+func uniqueArchivePath(usedPaths map[string]bool, itemPath, extension string) string {
+	candidate := itemPath + extension
+	for i := 2; usedPaths[strings.ToLower(candidate)]; i++ {
+		candidate = fmt.Sprintf("%s (%d)%s", itemPath, i, extension)
+	}
+	usedPaths[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// Writes the manifest, the folder keys and the files to w as a ZIP file. The files are copied from S3 one at a time without staging them on disk
+func writeFolderArchive(ctx context.Context, w io.Writer, manifest FolderArchiveManifest, objKeys map[string]string) error {
+	archive := zip.NewWriter(w)
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode the manifest. %w", err)
+	}
+
+	entry, err := archive.CreateHeader(&zip.FileHeader{Name: FolderArchiveManifestName, Method: zip.Deflate, Modified: manifest.CreatedDate})
+	if err != nil {
+		return err
+	}
+	_, err = entry.Write(manifestJSON)
+	if err != nil {
+		return err
+	}
+
+	for _, folderKey := range manifest.FolderKeys {
+		err = copyObjectToArchive(ctx, archive, folderKeyObjKey(folderKey.FolderID), folderKey.Path, manifest.CreatedDate)
+		if err != nil {
+			return fmt.Errorf("failed to add the folder key of %s. %w", folderKey.FolderID, err)
+		}
+	}
+
+	for _, item := range manifest.Items {
+		objKey, ok := objKeys[item.ID]
+		if !ok {
+			continue
+		}
+
+		err = copyObjectToArchive(ctx, archive, objKey, item.Path, manifest.CreatedDate)
+		if err != nil {
+			return fmt.Errorf("failed to add %s. %w", item.ID, err)
+		}
+	}
+
+	return archive.Close()
+}
+
+// Adds the S3 object to the ZIP file. age files don't compress, so they are stored as they are
+func copyObjectToArchive(ctx context.Context, archive *zip.Writer, objKey, name string, modified time.Time) error {
+	object, err := getFile(ctx, s3Client, serverConfig.S3BucketName, objKey)
+	if err != nil {
+		return err
+	}
+	defer object.Body.Close()
+
+	entry, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: modified})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(entry, object.Body)
+	return err
+}
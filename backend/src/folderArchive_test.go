@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestArchiveName(t *testing.T) {
+	tests := []struct {
+		item FolderArchiveItem
+		want string
+	}{
+		{FolderArchiveItem{ID: "id1", Name: "photo.jpg"}, "photo.jpg"},
+		{FolderArchiveItem{ID: "id2", Name: "a/b\\c"}, "a_b_c"},
+		{FolderArchiveItem{ID: "id3", Name: ".."}, "id3"},
+		{FolderArchiveItem{ID: "id4", Name: "YWdlLWVuY3J5cHRpb24=", NameEncrypted: true}, "id4"},
+		{FolderArchiveItem{ID: "id5", Name: ".config"}, ".config"},
+	}
+
+	for _, test := range tests {
+		if got := archiveName(test.item); got != test.want {
+			t.Errorf("archiveName(%q) = %q, want %q", test.item.Name, got, test.want)
+		}
+	}
+}
+
+func TestUniqueArchivePath(t *testing.T) {
+	used := map[string]bool{FolderArchiveManifestName: true}
+
+	paths := []string{
+		uniqueArchivePath(used, "docs/report", ".age"),
+		uniqueArchivePath(used, "docs/Report", ".age"),
+		uniqueArchivePath(used, "docs/report", ".age"),
+		uniqueArchivePath(used, "manifest.json", ""),
+	}
+	want := []string{"docs/report.age", "docs/Report (2).age", "docs/report (3).age", "manifest.json (2)"}
+
+	for i := range want {
+		if paths[i] != want[i] {
+			t.Errorf("path %d = %q, want %q", i, paths[i], want[i])
+		}
+	}
+}
+
+func TestWriteFolderArchiveManifest(t *testing.T) {
+	manifest := FolderArchiveManifest{
+		FolderID:    "folder",
+		CreatedDate: time.Now(),
+		// A file that is still being uploaded has no content
+		Items:      []FolderArchiveItem{{ID: "file", ParentDir: "folder", Name: "notes.txt", Type: "text/plain"}},
+		FolderKeys: []FolderArchiveKey{},
+	}
+
+	var buf bytes.Buffer
+	if err := writeFolderArchive(context.Background(), &buf, manifest, map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(archive.File) != 1 || archive.File[0].Name != FolderArchiveManifestName {
+		t.Fatalf("unexpected entries in the ZIP file: %v", archive.File)
+	}
+
+	entry, err := archive.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer entry.Close()
+
+	data, err := io.ReadAll(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got FolderArchiveManifest
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.FolderID != "folder" || len(got.Items) != 1 || got.Items[0].Name != "notes.txt" {
+		t.Errorf("unexpected manifest: %+v", got)
+	}
+}
+
+var folderArchiveColumns = []string{"depth", "id", "parentDir", "name", "nameEncrypted", "type", "size", "objKey", "processed", "sha256", "ciphertextSHA256", "hasKey"}
+
+func TestGetFolderArchiveManifest(t *testing.T) {
+	useFakeDB(t, fakeResponse{match: "SELECT t.depth, f.id, f.parentDir", columns: folderArchiveColumns, rows: [][]driver.Value{
+		{1, "docs", "folder", "docs", false, "folder", 0, "", true, "", "", true},
+		{2, "file", "docs", "notes.txt", false, "text/plain", 5, "object", true, "", "", false},
+	}})
+
+	manifest, objKeys, err := getFolderArchiveManifest(context.Background(), "folder", "testUser")
+	if err != nil {
+		t.Fatalf("getFolderArchiveManifest() returned %v", err)
+	}
+
+	if len(manifest.Items) != 2 || manifest.Items[1].Path != "docs/notes.txt.age" || manifest.Items[1].FolderKeyID != "docs" {
+		t.Errorf("unexpected items: %+v", manifest.Items)
+	}
+	if objKeys["file"] != "object" {
+		t.Errorf("objKeys = %v, want the object of the file", objKeys)
+	}
+}
+
+func TestGetFolderArchiveManifestTooDeep(t *testing.T) {
+	// The recursion returns an item one level below the limit
+	rows := [][]driver.Value{}
+	parentDir := "folder"
+	for depth := 1; depth <= MaxBreadcrumbDepth+1; depth++ {
+		id := fmt.Sprintf("folder%d", depth)
+		rows = append(rows, []driver.Value{depth, id, parentDir, id, false, "folder", 0, "", true, "", "", false})
+		parentDir = id
+	}
+	useFakeDB(t, fakeResponse{match: "SELECT t.depth, f.id, f.parentDir", columns: folderArchiveColumns, rows: rows})
+
+	_, _, err := getFolderArchiveManifest(context.Background(), "folder", "testUser")
+	if !errors.Is(err, errFolderTooDeep) {
+		t.Errorf("getFolderArchiveManifest() = %v, want errFolderTooDeep", err)
+	}
+}
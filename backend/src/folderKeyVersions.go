@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// The folder key version doesn't exist for the folder
+	errFolderKeyVersionNotFound error = errors.New("folder key version not found")
+)
+
+const (
+	// The number of previous folder keys kept for each folder. The oldest ones are deleted
+	MaxFolderKeyVersions = 5
+)
+
+// Returns the previous folder keys of a folder that can be restored, newest first
+func handleGetFolderKeyVersions(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/getFolderKeyVersions" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","folderID":"0195ddc2-dba1-7b94-acbb-b360f88dd9d6"}'
+	*/
+	request, ok := bindFolderKeyVersionRequest(c, "handleGetFolderKeyVersions")
+	if !ok {
+		return
+	}
+
+	permission, err := getFolderPermission(c, request.FolderID, request.UserID, true)
+	if err != nil {
+		if errors.Is(err, errDirNotFound) {
+			c.JSON(400, gin.H{"success": false, "error": "Directory doesn't exist"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleGetFolderKeyVersions] Failed to get folder permission")
+		return
+	}
+
+	if permission != WritePermission {
+		c.JSON(403, gin.H{"success": false, "error": "No write permission on directory"})
+		return
+	}
+
+	versions, err := getFolderKeyVersions(c, request.FolderID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+		log.WithField("error", err).Error("[handleGetFolderKeyVersions] Failed to get versions")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "versions": versions})
+}
+
+// Restores a previous folder key, for example after a client uploaded a broken one. Only the owner of the folder can do it.
+// The current folder key is kept as a version, so the rollback can be undone.
+func handleRollbackFolderKey(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/rollbackFolderKey" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","folderID":"0195ddc2-dba1-7b94-acbb-b360f88dd9d6","versionID":"0195ddc2-dba1-7b94-acbb-b360f88dd9d7"}'
+	*/
+	request, ok := bindFolderKeyVersionRequest(c, "handleRollbackFolderKey")
+	if !ok {
+		return
+	}
+
+	_, err := getFolderPermission(c, request.FolderID, request.UserID, false)
+	if err != nil {
+		if errors.Is(err, errDirNotFound) {
+			c.JSON(400, gin.H{"success": false, "error": "Directory doesn't exist"})
+			return
+		}
+
+		if errors.Is(err, errUserAccessNotAllowed) {
+			c.JSON(403, gin.H{"success": false, "error": "Only the owner can restore a folder key"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleRollbackFolderKey] Failed to get folder permission")
+		return
+	}
+
+	err = rollbackFolderKey(c, request.FolderID, request.VersionID, request.UserID)
+	if err != nil {
+		if errors.Is(err, errFolderKeyVersionNotFound) {
+			c.JSON(404, gin.H{"success": false, "error": "Version not found"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+		log.WithFields(log.Fields{"error": err, "folderID": request.FolderID, "versionID": request.VersionID}).Error("[handleRollbackFolderKey] Failed to restore folder key")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// Decodes the FolderKeyVersionRequest and verifies the token. If it returns false, the response was already sent
+func bindFolderKeyVersionRequest(c *gin.Context, name string) (FolderKeyVersionRequest, bool) {
+	var request FolderKeyVersionRequest
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return request, false
+	}
+
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Errorf("[%s] Failed to decode JSON", name)
+		return request, false
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Errorf("[%s] Failed to verify token", name)
+		return request, false
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return request, false
+	}
+
+	return request, true
+}
+
+// Returns true if the folder has its own folder key
+func hasFolderKey(ctx context.Context, folderID string) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM encryptionKeys WHERE folderID = ?", folderID).Scan(&count)
+	return count > 0, err
+}
+
+// Checks that the age file at filePath is encrypted for every user with access to the folder and replaces the folder key with it.
+// The previous folder key is kept as a version. userID is the user that uploaded it.
+func updateFolderKey(ctx context.Context, folderID, userID, filePath string) error {
+	publicKeys, err := getFolderKeyPublicKeys(ctx, folderID)
+	if err != nil {
+		return fmt.Errorf("getFolderKeyPublicKeys error. %w", err)
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open the file. %w", err)
+	}
+	defer file.Close()
+
+	err = checkAgeRecipients(file, publicKeys)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to seek the file. %w", err)
+	}
+
+	err = archiveFolderKey(ctx, folderID, userID)
+	if err != nil {
+		return fmt.Errorf("archiveFolderKey error. %w", err)
+	}
+
+	objKey := folderKeyObjKey(folderID)
+	_, err = uploadFile(ctx, s3Client, serverConfig.S3BucketName, file, objKey)
+	if err != nil {
+		return fmt.Errorf("failed to upload the folder key. %w", err)
+	}
+
+	err = recordObjectRecipients(ctx, objKey, publicKeys)
+	if err != nil {
+		return fmt.Errorf("recordObjectRecipients error. %w", err)
+	}
+
+	pruneFolderKeyVersions(ctx, folderID)
+	return nil
+}
+
+// Restores the folder key version. The current folder key is archived first and the restored version is removed from the list.
+func rollbackFolderKey(ctx context.Context, folderID, versionID, userID string) error {
+	var count int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM folderKeyVersions WHERE id = ? AND folderID = ?", versionID, folderID).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to get the version. %w", err)
+	}
+
+	if count == 0 {
+		return errFolderKeyVersionNotFound
+	}
+
+	versionObjKey := folderKeyVersionObjKey(versionID)
+	publicKeys, err := getObjectRecipients(ctx, versionObjKey)
+	if err != nil {
+		return fmt.Errorf("getObjectRecipients error. %w", err)
+	}
+
+	err = archiveFolderKey(ctx, folderID, userID)
+	if err != nil {
+		return fmt.Errorf("archiveFolderKey error. %w", err)
+	}
+
+	objKey := folderKeyObjKey(folderID)
+	_, err = copyFile(ctx, s3Client, serverConfig.S3BucketName, versionObjKey, objKey)
+	if err != nil {
+		return fmt.Errorf("failed to restore the folder key. %w", err)
+	}
+
+	err = recordObjectRecipients(ctx, objKey, publicKeys)
+	if err != nil {
+		return fmt.Errorf("recordObjectRecipients error. %w", err)
+	}
+
+	deleteFolderKeyVersion(ctx, versionID)
+	pruneFolderKeyVersions(ctx, folderID)
+	return nil
+}
+
+// Copies the current folder key to a new version. The recipients are copied too so that they are known if it is restored.
+// replacedBy is the user that is replacing the folder key.
+func archiveFolderKey(ctx context.Context, folderID, replacedBy string) error {
+	versionID, err := getNewID()
+	if err != nil {
+		return fmt.Errorf("failed to get a new ID. %w", err)
+	}
+
+	objKey := folderKeyObjKey(folderID)
+	versionObjKey := folderKeyVersionObjKey(versionID.String())
+	_, err = copyFile(ctx, s3Client, serverConfig.S3BucketName, objKey, versionObjKey)
+	if err != nil {
+		return fmt.Errorf("failed to copy the folder key. %w", err)
+	}
+
+	publicKeys, err := getObjectRecipients(ctx, objKey)
+	if err != nil {
+		return fmt.Errorf("getObjectRecipients error. %w", err)
+	}
+
+	err = recordObjectRecipients(ctx, versionObjKey, publicKeys)
+	if err != nil {
+		return fmt.Errorf("recordObjectRecipients error. %w", err)
+	}
+
+	_, err = db.ExecContext(ctx, "INSERT INTO folderKeyVersions (id, folderID, replacedBy, createdDate) VALUES (?, ?, ?, now())", versionID.String(), folderID, replacedBy)
+	return err
+}
+
+// Returns the folder key versions of the folder, newest first
+func getFolderKeyVersions(ctx context.Context, folderID string) ([]FolderKeyVersion, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, replacedBy, createdDate FROM folderKeyVersions WHERE folderID = ? ORDER BY createdDate DESC, id DESC", folderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Initialize an empty array so that the json returns an empty array instead of null.
+	versions := []FolderKeyVersion{}
+	for rows.Next() {
+		var version FolderKeyVersion
+		if err := rows.Scan(&version.ID, &version.ReplacedBy, &version.CreatedDate); err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// Deletes the versions after the newest MaxFolderKeyVersions. Errors are only logged since the folder key was already updated.
+func pruneFolderKeyVersions(ctx context.Context, folderID string) {
+	versions, err := getFolderKeyVersions(ctx, folderID)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "folderID": folderID}).Error("[pruneFolderKeyVersions] Failed to get versions")
+		return
+	}
+
+	if len(versions) <= MaxFolderKeyVersions {
+		return
+	}
+
+	for _, version := range versions[MaxFolderKeyVersions:] {
+		deleteFolderKeyVersion(ctx, version.ID)
+	}
+}
+
+// Deletes the version from S3 and from the DB. Errors are only logged
+func deleteFolderKeyVersion(ctx context.Context, versionID string) {
+	objKey := folderKeyVersionObjKey(versionID)
+	_, err := deleteFile(ctx, s3Client, serverConfig.S3BucketName, objKey)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "versionID": versionID}).Error("[deleteFolderKeyVersion] Failed to delete the version from S3")
+		return
+	}
+
+	_, err = db.ExecContext(ctx, "DELETE FROM objectRecipients WHERE objKey = ?", objKey)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "versionID": versionID}).Error("[deleteFolderKeyVersion] Failed to delete the recipients")
+	}
+
+	_, err = db.ExecContext(ctx, "DELETE FROM folderKeyVersions WHERE id = ?", versionID)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "versionID": versionID}).Error("[deleteFolderKeyVersion] Failed to delete the version")
+	}
+}
+
+// Returns the S3 object key of a previous folder key
+func folderKeyVersionObjKey(versionID string) string {
+	return fmt.Sprintf("folderkeyversions/%s", versionID)
+}
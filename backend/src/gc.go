@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// The garbage collector can't run twice at the same time
+	errGCRunning error = errors.New("the garbage collector is already running")
+)
+
+const (
+	// How old an unreferenced object or tmp file has to be before it is deleted, when GCGracePeriodHours is not set.
+	// Objects are uploaded before the DB is updated, so new objects are not referenced for a short time
+	DefaultGCGracePeriod = 24 * time.Hour
+	// The maximum number of objKeys, file IDs and tmp files listed in a GCReport. The counts include all of them
+	MaxGCReportItems = 1000
+)
+
+// Held while the garbage collector runs
+var gcLock sync.Mutex
+
+// Looks for the debris left by failed uploads and deletions and removes it. With dryRun, nothing is deleted and the report lists what would be.
+func handleRunGarbageCollector(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/runGarbageCollector" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","dryRun": true}'
+	*/
+	request, ok := bindAdminRequest(c, "handleRunGarbageCollector")
+	if !ok {
+		return
+	}
+
+	report, err := runGarbageCollector(c, request.DryRun)
+	if err != nil {
+		if errors.Is(err, errGCRunning) {
+			c.JSON(409, gin.H{"success": false, "error": "The garbage collector is already running"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+		log.WithField("error", err).Error("[handleRunGarbageCollector] Garbage collector failed")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "report": report})
+}
+
+// Runs the garbage collector every GCIntervalHours. It does nothing if it is not set
+func startGarbageCollector() {
+	if serverConfig.GCIntervalHours <= 0 {
+		return
+	}
+
+	interval := time.Duration(serverConfig.GCIntervalHours) * time.Hour
+	log.WithField("interval", interval).Info("[startGarbageCollector] Garbage collector enabled")
+
+	go func() {
+		for range time.Tick(interval) {
+			report, err := runGarbageCollector(context.Background(), false)
+			if err != nil {
+				log.WithField("error", err).Error("[startGarbageCollector: Goroutine] Garbage collector failed")
+				continue
+			}
+
+			log.WithFields(log.Fields{"orphanedFiles": report.OrphanedFileCount, "orphanedObjects": report.OrphanedObjectCount, "tmpFiles": report.TmpFileCount, "errors": report.Errors}).Info("[startGarbageCollector: Goroutine] Garbage collector finished")
+		}
+	}()
+}
+
+// Returns how old the debris has to be to be deleted
+func gcGracePeriod() time.Duration {
+	if serverConfig.GCGracePeriodHours > 0 {
+		return time.Duration(serverConfig.GCGracePeriodHours) * time.Hour
+	}
+	return DefaultGCGracePeriod
+}
+
+// Removes, in this order:
+//   - The files left in the DB when a folder above them was deleted, handleRemoveDirectory only deletes the items directly inside of the folder.
+//   - The S3 objects that are older than the grace period and are not used by files, profile pictures or folder keys.
+//   - The files in TMPStorageDir older than the grace period.
+func runGarbageCollector(ctx context.Context, dryRun bool) (GCReport, error) {
+	report := GCReport{DryRun: dryRun, StartedDate: time.Now(), OrphanedFiles: []string{}, OrphanedObjects: []string{}, TmpFiles: []string{}}
+	if !gcLock.TryLock() {
+		return report, errGCRunning
+	}
+	defer gcLock.Unlock()
+
+	cutoff := report.StartedDate.Add(-gcGracePeriod())
+
+	err := collectOrphanedFiles(ctx, dryRun, &report)
+	if err != nil {
+		return report, fmt.Errorf("collectOrphanedFiles error. %w", err)
+	}
+
+	err = collectOrphanedObjects(ctx, dryRun, cutoff, &report)
+	if err != nil {
+		return report, fmt.Errorf("collectOrphanedObjects error. %w", err)
+	}
+
+	err = collectTmpFiles(dryRun, cutoff, &report)
+	if err != nil {
+		return report, fmt.Errorf("collectTmpFiles error. %w", err)
+	}
+
+	return report, nil
+}
+
+// Deletes the items whose parent folder doesn't exist anymore, and everything inside of them
+func collectOrphanedFiles(ctx context.Context, dryRun bool, report *GCReport) error {
+	rows, err := db.QueryContext(ctx, `
+		WITH RECURSIVE orphans (id) AS (
+			SELECT f.id FROM files f LEFT JOIN files p ON f.parentDir = p.id WHERE f.parentDir != ? AND p.id IS NULL
+			UNION
+			SELECT f.id FROM files f INNER JOIN orphans o ON f.parentDir = o.id
+		)
+		SELECT id, objKey, IFNULL(thumbnailObjKey, '') FROM files WHERE id IN (SELECT id FROM orphans)`, RootDirectoryID)
+	if err != nil {
+		return err
+	}
+
+	type orphanedFile struct {
+		id, objKey, thumbnailObjKey string
+	}
+
+	files := []orphanedFile{}
+	for rows.Next() {
+		var file orphanedFile
+		err := rows.Scan(&file.id, &file.objKey, &file.thumbnailObjKey)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		files = append(files, file)
+	}
+	rows.Close()
+
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		report.OrphanedFileCount++
+		if len(report.OrphanedFiles) < MaxGCReportItems {
+			report.OrphanedFiles = append(report.OrphanedFiles, file.id)
+		}
+
+		if dryRun {
+			continue
+		}
+
+		// Remove the row first so that the objects are never referenced by a file that is being deleted
+		_, err = db.ExecContext(ctx, "DELETE FROM files WHERE id = ?", file.id)
+		if err != nil {
+			return fmt.Errorf("failed to delete %s. %w", file.id, err)
+		}
+
+		err = deleteFileObject(ctx, file.objKey)
+		if err != nil {
+			report.Errors++
+			log.WithFields(log.Fields{"error": err, "fileID": file.id, "objKey": file.objKey}).Error("[collectOrphanedFiles] Failed to delete the object")
+		}
+
+		if file.thumbnailObjKey != "" {
+			_, err = deleteFile(ctx, s3Client, serverConfig.S3BucketName, file.thumbnailObjKey)
+			if err != nil {
+				report.Errors++
+				log.WithFields(log.Fields{"error": err, "fileID": file.id, "thumbnailObjKey": file.thumbnailObjKey}).Error("[collectOrphanedFiles] Failed to delete the thumbnail")
+			}
+		}
+	}
+	return nil
+}
+
+// Lists the bucket and deletes the objects that are not referenced in the DB and were last modified before cutoff
+func collectOrphanedObjects(ctx context.Context, dryRun bool, cutoff time.Time, report *GCReport) error {
+	// The objects are listed after getting the references, so the objects uploaded in between are protected by the grace period
+	referenced, err := getReferencedObjKeys(ctx)
+	if err != nil {
+		return fmt.Errorf("getReferencedObjKeys error. %w", err)
+	}
+
+	return listObjects(ctx, s3Client, serverConfig.S3BucketName, func(objects []types.Object) error {
+		for _, object := range objects {
+			report.ObjectsChecked++
+			objKey := *object.Key
+			if referenced[objKey] || object.LastModified == nil || object.LastModified.After(cutoff) {
+				continue
+			}
+
+			report.OrphanedObjectCount++
+			if object.Size != nil {
+				report.OrphanedObjectBytes += *object.Size
+			}
+			if len(report.OrphanedObjects) < MaxGCReportItems {
+				report.OrphanedObjects = append(report.OrphanedObjects, objKey)
+			}
+
+			if dryRun {
+				continue
+			}
+
+			_, err := deleteFile(ctx, s3Client, serverConfig.S3BucketName, objKey)
+			if err != nil {
+				report.Errors++
+				log.WithFields(log.Fields{"error": err, "objKey": objKey}).Error("[collectOrphanedObjects] Failed to delete the object")
+				continue
+			}
+
+			_, err = db.ExecContext(ctx, "DELETE FROM objectRecipients WHERE objKey = ?", objKey)
+			if err != nil {
+				return fmt.Errorf("failed to delete the recipients of %s. %w", objKey, err)
+			}
+
+			_, err = db.ExecContext(ctx, "DELETE FROM dedupObjects WHERE objKey = ?", objKey)
+			if err != nil {
+				return fmt.Errorf("failed to delete the deduplicated object %s. %w", objKey, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Returns every objKey that is used by a file, thumbnail, profile picture, folder key or previous folder key
+func getReferencedObjKeys(ctx context.Context) (map[string]bool, error) {
+	referenced := map[string]bool{}
+
+	queries := []string{
+		"SELECT objKey FROM files WHERE objKey != ''",
+		"SELECT thumbnailObjKey FROM files WHERE thumbnailObjKey IS NOT NULL",
+		"SELECT CONCAT('folderkeys/', id) FROM files WHERE type = 'folder'",
+		"SELECT CONCAT('folderkeyversions/', id) FROM folderKeyVersions",
+	}
+	for _, query := range queries {
+		err := addQueryResults(ctx, referenced, query)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	profilePictures := map[string]bool{}
+	err := addQueryResults(ctx, profilePictures, "SELECT profilePictureID FROM users WHERE profilePictureID IS NOT NULL AND profilePictureID != 'default'")
+	if err != nil {
+		return nil, err
+	}
+
+	// Old profile pictures use the profilePictureID as the objKey, the resized ones have one object per size
+	for profilePictureID := range profilePictures {
+		referenced[profilePictureID] = true
+		for _, size := range profilePictureSizes {
+			referenced[profilePictureObjKey(profilePictureID, size)] = true
+		}
+	}
+	return referenced, nil
+}
+
+// Adds the values of the first column returned by the query to set
+func addQueryResults(ctx context.Context, set map[string]bool, query string) error {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return err
+		}
+		set[value] = true
+	}
+	return rows.Err()
+}
+
+// Deletes the files in TMPStorageDir that were last modified before cutoff.
+// They are left there when processing an upload fails.
+func collectTmpFiles(dryRun bool, cutoff time.Time, report *GCReport) error {
+	entries, err := os.ReadDir(serverConfig.TMPStorageDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			// It was deleted after listing the directory
+			continue
+		}
+
+		if info.ModTime().After(cutoff) {
+			continue
+		}
+
+		report.TmpFileCount++
+		report.TmpFileBytes += info.Size()
+		if len(report.TmpFiles) < MaxGCReportItems {
+			report.TmpFiles = append(report.TmpFiles, entry.Name())
+		}
+
+		if dryRun {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(serverConfig.TMPStorageDir, entry.Name()))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			report.Errors++
+			log.WithFields(log.Fields{"error": err, "file": entry.Name()}).Error("[collectTmpFiles] Failed to delete the tmp file")
+		}
+	}
+	return nil
+}
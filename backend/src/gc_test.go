@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCollectTmpFiles(t *testing.T) {
+	previous := serverConfig.TMPStorageDir
+	defer func() { serverConfig.TMPStorageDir = previous }()
+	serverConfig.TMPStorageDir = t.TempDir() + "/"
+
+	now := time.Now()
+	oldFile := filepath.Join(serverConfig.TMPStorageDir, "old")
+	newFile := filepath.Join(serverConfig.TMPStorageDir, "new")
+	for _, path := range []string{oldFile, newFile} {
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(oldFile, now.Add(-48*time.Hour), now.Add(-48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	cutoff := now.Add(-24 * time.Hour)
+
+	// A dry run only reports the stale files
+	report := GCReport{TmpFiles: []string{}}
+	if err := collectTmpFiles(true, cutoff, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.TmpFileCount != 1 || report.TmpFiles[0] != "old" || report.TmpFileBytes != 4 {
+		t.Errorf("unexpected dry run report: %+v", report)
+	}
+	if _, err := os.Stat(oldFile); err != nil {
+		t.Errorf("dry run deleted the file: %v", err)
+	}
+
+	report = GCReport{TmpFiles: []string{}}
+	if err := collectTmpFiles(false, cutoff, &report); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(oldFile); !os.IsNotExist(err) {
+		t.Errorf("stale tmp file was not deleted: %v", err)
+	}
+	if _, err := os.Stat(newFile); err != nil {
+		t.Errorf("recent tmp file was deleted: %v", err)
+	}
+}
@@ -0,0 +1,767 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+var (
+	// Error returned when the metadata can't be removed from the file type
+	errUnsupportedMetadataFormat error = errors.New("removing metadata is not supported for this file type")
+	// Error returned when the image can't be parsed
+	errInvalidImageData error = errors.New("invalid image data")
+	// The MIME types that stripImageMetadata() supports
+	metadataSanitizerTypes = []string{"image/jpeg", "image/png", "image/gif", "image/jp2", "image/heif", "image/heic"}
+)
+
+const (
+	// The EXIF tag for the orientation of the image
+	exifOrientationTag = 0x0112
+)
+
+// Removes the EXIF, XMP, IPTC and comment metadata from the image and returns the new image.
+// The orientation is kept so that the image is still displayed the right way.
+// If the mimeType is not in metadataSanitizerTypes it returns errUnsupportedMetadataFormat.
+func stripImageMetadata(buf []byte, mimeType string) ([]byte, error) {
+	switch mimeType {
+	case "image/jpeg":
+		return stripJPEGMetadata(buf)
+	case "image/png":
+		return stripPNGMetadata(buf)
+	case "image/gif":
+		return stripGIFMetadata(buf)
+	case "image/jp2":
+		return stripJP2Metadata(buf)
+	case "image/heif", "image/heic":
+		return stripHEIFMetadata(buf)
+	default:
+		return nil, errUnsupportedMetadataFormat
+	}
+}
+
+// Removes every APPn segment except JFIF (APP0), ICC profiles (APP2) and Adobe (APP14), and the comments.
+// If the EXIF data had an orientation, a new EXIF segment with only the orientation is added.
+// Everything after the End Of Image is removed, e.g. the second image with its own EXIF that phones add for MPF (the other APP2 segments).
+func stripJPEGMetadata(buf []byte) ([]byte, error) {
+	if len(buf) < 4 || buf[0] != 0xFF || buf[1] != 0xD8 {
+		return nil, errInvalidImageData
+	}
+
+	orientation := 0
+	segments := [][]byte{}
+	// The image data from the Start Of Scan segment to the End Of Image
+	var scanData []byte
+
+	i := 2
+	for scanData == nil {
+		if i+1 >= len(buf) || buf[i] != 0xFF {
+			return nil, errInvalidImageData
+		}
+
+		marker := buf[i+1]
+		switch {
+		case marker == 0xFF:
+			// fill byte
+			i++
+			continue
+		case marker == 0xD9:
+			// End Of Image without a scan
+			scanData = buf[i : i+2]
+			continue
+		case marker == 0xDA:
+			// Start Of Scan. The metadata segments are always before it
+			end, err := jpegImageEnd(buf, i)
+			if err != nil {
+				return nil, err
+			}
+			scanData = buf[i:end]
+			continue
+		case marker >= 0xD0 && marker <= 0xD7, marker == 0x01:
+			// markers without a length
+			segments = append(segments, buf[i:i+2])
+			i += 2
+			continue
+		}
+
+		if i+4 > len(buf) {
+			return nil, errInvalidImageData
+		}
+
+		length := int(binary.BigEndian.Uint16(buf[i+2:]))
+		if length < 2 || i+2+length > len(buf) {
+			return nil, errInvalidImageData
+		}
+
+		segment := buf[i : i+2+length]
+		payload := segment[4:]
+		i += 2 + length
+
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")):
+			orientation = readTIFFOrientation(payload[6:])
+		case marker == 0xE2 && bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00")):
+			segments = append(segments, segment)
+		case marker == 0xE0, marker == 0xEE:
+			segments = append(segments, segment)
+		case marker >= 0xE1 && marker <= 0xEF, marker == 0xFE:
+			// XMP, IPTC, other application data and comments
+		default:
+			segments = append(segments, segment)
+		}
+	}
+
+	out := &bytes.Buffer{}
+	out.Write(buf[:2])
+
+	// JFIF requires APP0 to be right after the Start Of Image
+	if len(segments) > 0 && segments[0][1] == 0xE0 {
+		out.Write(segments[0])
+		segments = segments[1:]
+	}
+
+	if orientation > 1 {
+		tiff := orientationTIFF(orientation)
+		out.Write([]byte{0xFF, 0xE1})
+		binary.Write(out, binary.BigEndian, uint16(2+6+len(tiff)))
+		out.WriteString("Exif\x00\x00")
+		out.Write(tiff)
+	}
+
+	for _, segment := range segments {
+		out.Write(segment)
+	}
+	out.Write(scanData)
+
+	return out.Bytes(), nil
+}
+
+// Returns the position after the End Of Image marker, starting at the first Start Of Scan segment at i.
+// The entropy-coded data can't have a marker, 0xFF is followed by 0x00 or a restart marker. Progressive images have more segments between the scans.
+// If the End Of Image is missing, it returns the end of buf.
+func jpegImageEnd(buf []byte, i int) (int, error) {
+	for i+1 < len(buf) {
+		if buf[i] != 0xFF {
+			i++
+			continue
+		}
+
+		marker := buf[i+1]
+		switch {
+		case marker == 0x00, marker >= 0xD0 && marker <= 0xD7, marker == 0xFF:
+			// stuffed byte, restart marker or fill byte
+			i++
+			continue
+		case marker == 0xD9:
+			return i + 2, nil
+		}
+
+		// A segment: Start Of Scan, Huffman tables, etc.
+		if i+4 > len(buf) {
+			return 0, errInvalidImageData
+		}
+
+		length := int(binary.BigEndian.Uint16(buf[i+2:]))
+		if length < 2 || i+2+length > len(buf) {
+			return 0, errInvalidImageData
+		}
+		i += 2 + length
+	}
+	return len(buf), nil
+}
+
+// Removes the text, time and EXIF chunks.
+// If the EXIF data had an orientation, a new eXIf chunk with only the orientation is added.
+func stripPNGMetadata(buf []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(buf, []byte(signature)) {
+		return nil, errInvalidImageData
+	}
+
+	type pngChunk struct {
+		chunkType string
+		raw       []byte
+	}
+
+	orientation := 0
+	chunks := []pngChunk{}
+
+	i := len(signature)
+	for i < len(buf) {
+		if i+12 > len(buf) {
+			return nil, errInvalidImageData
+		}
+
+		length := int(binary.BigEndian.Uint32(buf[i:]))
+		if length < 0 || i+12+length > len(buf) {
+			return nil, errInvalidImageData
+		}
+
+		chunkType := string(buf[i+4 : i+8])
+		data := buf[i+8 : i+8+length]
+		raw := buf[i : i+12+length]
+		i += 12 + length
+
+		switch chunkType {
+		case "eXIf":
+			orientation = readTIFFOrientation(data)
+		case "tEXt", "zTXt", "iTXt", "tIME":
+			// text chunks contain XMP and other metadata
+		default:
+			chunks = append(chunks, pngChunk{chunkType, raw})
+		}
+
+		if chunkType == "IEND" {
+			break
+		}
+	}
+
+	out := &bytes.Buffer{}
+	out.WriteString(signature)
+
+	for _, chunk := range chunks {
+		// eXIf has to be before the image data
+		if chunk.chunkType == "IDAT" && orientation > 1 {
+			writePNGChunk(out, "eXIf", orientationTIFF(orientation))
+			orientation = 0
+		}
+		out.Write(chunk.raw)
+	}
+
+	return out.Bytes(), nil
+}
+
+func writePNGChunk(out *bytes.Buffer, chunkType string, data []byte) {
+	binary.Write(out, binary.BigEndian, uint32(len(data)))
+	out.WriteString(chunkType)
+	out.Write(data)
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))
+	crc.Write(data)
+	binary.Write(out, binary.BigEndian, crc.Sum32())
+}
+
+// Removes the comment extensions and the application extensions except the ones used for animations.
+func stripGIFMetadata(buf []byte) ([]byte, error) {
+	if len(buf) < 13 || !(bytes.HasPrefix(buf, []byte("GIF87a")) || bytes.HasPrefix(buf, []byte("GIF89a"))) {
+		return nil, errInvalidImageData
+	}
+
+	// Header and Logical Screen Descriptor
+	i := 13
+	if buf[10]&0x80 != 0 {
+		// Global Color Table
+		i += 3 << ((buf[10] & 0x07) + 1)
+	}
+
+	if i > len(buf) {
+		return nil, errInvalidImageData
+	}
+
+	out := &bytes.Buffer{}
+	out.Write(buf[:i])
+
+	for {
+		if i >= len(buf) {
+			return nil, errInvalidImageData
+		}
+
+		switch buf[i] {
+		case 0x3B:
+			// Trailer
+			out.WriteByte(0x3B)
+			return out.Bytes(), nil
+		case 0x21:
+			// Extension
+			if i+2 > len(buf) {
+				return nil, errInvalidImageData
+			}
+
+			label := buf[i+1]
+			end, err := skipGIFSubBlocks(buf, i+2)
+			if err != nil {
+				return nil, err
+			}
+
+			keep := true
+			if label == 0xFE {
+				keep = false
+			}
+
+			if label == 0xFF {
+				// The application identifier is in the first sub-block
+				appID := buf[i+3 : min(i+3+11, end)]
+				keep = bytes.Equal(appID, []byte("NETSCAPE2.0")) || bytes.Equal(appID, []byte("ANIMEXTS1.0"))
+			}
+
+			if keep {
+				out.Write(buf[i:end])
+			}
+			i = end
+		case 0x2C:
+			// Image Descriptor
+			if i+11 > len(buf) {
+				return nil, errInvalidImageData
+			}
+
+			start := i
+			i += 10
+			if buf[start+9]&0x80 != 0 {
+				// Local Color Table
+				i += 3 << ((buf[start+9] & 0x07) + 1)
+			}
+
+			// LZW minimum code size
+			i++
+			end, err := skipGIFSubBlocks(buf, i)
+			if err != nil {
+				return nil, err
+			}
+
+			out.Write(buf[start:end])
+			i = end
+		default:
+			return nil, errInvalidImageData
+		}
+	}
+}
+
+// Returns the index after the block terminator of the sub-blocks starting at i
+func skipGIFSubBlocks(buf []byte, i int) (int, error) {
+	for {
+		if i >= len(buf) {
+			return 0, errInvalidImageData
+		}
+
+		size := int(buf[i])
+		i += 1 + size
+		if size == 0 {
+			return i, nil
+		}
+	}
+}
+
+// Removes the uuid boxes (used for EXIF and XMP) and the XML boxes from a JPEG 2000 file.
+// The orientation is not stored in the metadata in JPEG 2000.
+func stripJP2Metadata(buf []byte) ([]byte, error) {
+	boxes, err := readISOBoxes(buf, 0, len(buf))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(boxes) == 0 || boxes[0].boxType != "jP  " {
+		return nil, errInvalidImageData
+	}
+
+	out := &bytes.Buffer{}
+	for _, box := range boxes {
+		if box.boxType == "uuid" || box.boxType == "xml " {
+			continue
+		}
+		out.Write(buf[box.start:box.end])
+	}
+
+	return out.Bytes(), nil
+}
+
+// Overwrites the EXIF and XMP items of a HEIF/HEIC image with zeros.
+// The items are not removed since that would require rewriting every offset in the file.
+// HEIF stores the orientation in the irot and imir properties, not in EXIF, so it is not affected.
+func stripHEIFMetadata(buf []byte) ([]byte, error) {
+	out := bytes.Clone(buf)
+
+	boxes, err := readISOBoxes(out, 0, len(out))
+	if err != nil {
+		return nil, err
+	}
+
+	meta, found := findISOBox(boxes, "meta")
+	if !found {
+		return nil, errInvalidImageData
+	}
+
+	// meta is a FullBox, the children start after the version and flags
+	children, err := readISOBoxes(out, meta.dataStart+4, meta.end)
+	if err != nil {
+		return nil, err
+	}
+
+	iinf, found := findISOBox(children, "iinf")
+	if !found {
+		// There are no items, so there is no metadata
+		return out, nil
+	}
+
+	metadataItems, err := readHEIFMetadataItems(out, iinf)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(metadataItems) == 0 {
+		return out, nil
+	}
+
+	iloc, found := findISOBox(children, "iloc")
+	if !found {
+		return nil, errInvalidImageData
+	}
+
+	// idat is only needed for items stored inside of the meta box
+	idatStart, idatEnd := -1, -1
+	if idat, found := findISOBox(children, "idat"); found {
+		idatStart, idatEnd = idat.dataStart, idat.end
+	}
+
+	r := &byteReader{buf: out, pos: iloc.dataStart, end: iloc.end}
+	version := r.uint(1)
+	r.uint(3) // flags
+	sizes := r.uint(1)
+	offsetSize, lengthSize := int(sizes>>4), int(sizes&0x0F)
+	sizes = r.uint(1)
+	baseOffsetSize, indexSize := int(sizes>>4), int(sizes&0x0F)
+	if version != 1 && version != 2 {
+		indexSize = 0
+	}
+
+	itemCount := r.uint(2)
+	if version == 2 {
+		itemCount = r.uint(4)
+	}
+
+	for n := uint64(0); n < itemCount && r.err == nil; n++ {
+		var itemID uint64
+		if version < 2 {
+			itemID = r.uint(2)
+		} else {
+			itemID = r.uint(4)
+		}
+
+		constructionMethod := uint64(0)
+		if version == 1 || version == 2 {
+			constructionMethod = r.uint(2) & 0x0F
+		}
+
+		r.uint(2) // data_reference_index
+		baseOffset := r.uint(baseOffsetSize)
+		extentCount := r.uint(2)
+
+		for e := uint64(0); e < extentCount && r.err == nil; e++ {
+			r.uint(indexSize)
+			extentOffset := r.uint(offsetSize)
+			extentLength := r.uint(lengthSize)
+
+			if !metadataItems[itemID] {
+				continue
+			}
+
+			start, end := 0, len(out)
+			switch constructionMethod {
+			case 0:
+				// file offset
+			case 1:
+				// offset inside of the idat box
+				if idatStart < 0 {
+					return nil, errInvalidImageData
+				}
+				start, end = idatStart, idatEnd
+			default:
+				return nil, errUnsupportedMetadataFormat
+			}
+
+			from := uint64(start) + baseOffset + extentOffset
+			to := from + extentLength
+			if extentLength == 0 || to > uint64(end) || from > to {
+				return nil, errInvalidImageData
+			}
+
+			clear(out[from:to])
+		}
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return out, nil
+}
+
+// Returns the IDs of the EXIF and XMP items in the iinf box
+func readHEIFMetadataItems(buf []byte, iinf isoBox) (map[uint64]bool, error) {
+	r := &byteReader{buf: buf, pos: iinf.dataStart, end: iinf.end}
+	version := r.uint(1)
+	r.uint(3) // flags
+	if version == 0 {
+		r.uint(2)
+	} else {
+		r.uint(4)
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	entries, err := readISOBoxes(buf, r.pos, iinf.end)
+	if err != nil {
+		return nil, err
+	}
+
+	items := map[uint64]bool{}
+	for _, entry := range entries {
+		if entry.boxType != "infe" {
+			continue
+		}
+
+		r := &byteReader{buf: buf, pos: entry.dataStart, end: entry.end}
+		version := r.uint(1)
+		r.uint(3) // flags
+		if version < 2 {
+			// Older versions don't have an item type
+			continue
+		}
+
+		var itemID uint64
+		if version == 2 {
+			itemID = r.uint(2)
+		} else {
+			itemID = r.uint(4)
+		}
+
+		r.uint(2) // item_protection_index
+		itemType := string(r.bytes(4))
+		r.cString() // item_name
+
+		switch itemType {
+		case "Exif":
+			items[itemID] = true
+		case "mime":
+			if r.cString() == "application/rdf+xml" {
+				items[itemID] = true
+			}
+		}
+
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+
+	return items, nil
+}
+
+// An ISO Base Media File Format box. Used by HEIF and JPEG 2000.
+type isoBox struct {
+	boxType string
+	// The index of the box's header
+	start int
+	// The index of the box's contents
+	dataStart int
+	// The index after the box's contents
+	end int
+}
+
+// Reads the boxes in buf from start to end. It doesn't read the boxes inside of them
+func readISOBoxes(buf []byte, start, end int) ([]isoBox, error) {
+	boxes := []isoBox{}
+
+	i := start
+	for i < end {
+		if i+8 > end {
+			return nil, errInvalidImageData
+		}
+
+		size := uint64(binary.BigEndian.Uint32(buf[i:]))
+		boxType := string(buf[i+4 : i+8])
+		dataStart := i + 8
+
+		switch size {
+		case 0:
+			// the box goes to the end
+			size = uint64(end - i)
+		case 1:
+			// 64 bit size
+			if i+16 > end {
+				return nil, errInvalidImageData
+			}
+			size = binary.BigEndian.Uint64(buf[i+8:])
+			dataStart = i + 16
+		}
+
+		if size < uint64(dataStart-i) || size > uint64(end-i) {
+			return nil, errInvalidImageData
+		}
+
+		boxes = append(boxes, isoBox{boxType, i, dataStart, i + int(size)})
+		i += int(size)
+	}
+
+	return boxes, nil
+}
+
+func findISOBox(boxes []isoBox, boxType string) (isoBox, bool) {
+	for _, box := range boxes {
+		if box.boxType == boxType {
+			return box, true
+		}
+	}
+	return isoBox{}, false
+}
+
+// Reads big endian values from a buffer. Once there is an error, every read returns zero values and err is set.
+type byteReader struct {
+	buf []byte
+	pos int
+	end int
+	err error
+}
+
+// Reads an unsigned integer that is n bytes long. n can be 0 which returns 0
+func (r *byteReader) uint(n int) uint64 {
+	b := r.bytes(n)
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func (r *byteReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if n < 0 || r.pos+n > r.end {
+		r.err = errInvalidImageData
+		return nil
+	}
+
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+// Reads a null terminated string
+func (r *byteReader) cString() string {
+	if r.err != nil {
+		return ""
+	}
+
+	n := bytes.IndexByte(r.buf[r.pos:r.end], 0)
+	if n < 0 {
+		r.err = errInvalidImageData
+		return ""
+	}
+
+	s := string(r.buf[r.pos : r.pos+n])
+	r.pos += n + 1
+	return s
+}
+
+// Returns the EXIF orientation of a JPEG or PNG image, or 0 if it doesn't have one.
+func readImageOrientation(buf []byte, mimeType string) int {
+	switch mimeType {
+	case "image/jpeg":
+		i := 2
+		for i+4 <= len(buf) && buf[i] == 0xFF {
+			marker := buf[i+1]
+			if marker == 0xDA || marker == 0xD9 {
+				// The metadata is always before the Start Of Scan
+				return 0
+			}
+
+			length := int(binary.BigEndian.Uint16(buf[i+2:]))
+			if length < 2 || i+2+length > len(buf) {
+				return 0
+			}
+
+			payload := buf[i+4 : i+2+length]
+			if marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+				return readTIFFOrientation(payload[6:])
+			}
+			i += 2 + length
+		}
+	case "image/png":
+		i := 8
+		for i+12 <= len(buf) {
+			length := int(binary.BigEndian.Uint32(buf[i:]))
+			if length < 0 || i+12+length > len(buf) {
+				return 0
+			}
+
+			if string(buf[i+4:i+8]) == "eXIf" {
+				return readTIFFOrientation(buf[i+8 : i+8+length])
+			}
+			i += 12 + length
+		}
+	}
+
+	return 0
+}
+
+// Returns the orientation in the TIFF data of an EXIF block, or 0 if there is none.
+func readTIFFOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	if order.Uint16(tiff[2:]) != 42 {
+		return 0
+	}
+
+	ifd := uint64(order.Uint32(tiff[4:]))
+	if ifd+2 > uint64(len(tiff)) {
+		return 0
+	}
+
+	count := uint64(order.Uint16(tiff[ifd:]))
+	for n := uint64(0); n < count; n++ {
+		entry := ifd + 2 + 12*n
+		if entry+12 > uint64(len(tiff)) {
+			return 0
+		}
+
+		if order.Uint16(tiff[entry:]) != exifOrientationTag {
+			continue
+		}
+
+		// The orientation is a SHORT
+		if order.Uint16(tiff[entry+2:]) != 3 {
+			return 0
+		}
+
+		orientation := int(order.Uint16(tiff[entry+8:]))
+		if orientation < 1 || orientation > 8 {
+			return 0
+		}
+		return orientation
+	}
+
+	return 0
+}
+
+// Returns the TIFF data for an EXIF block that only has the orientation
+func orientationTIFF(orientation int) []byte {
+	out := &bytes.Buffer{}
+	// Big endian header, the first IFD is right after it
+	out.WriteString("MM\x00\x2A")
+	binary.Write(out, binary.BigEndian, uint32(8))
+	// One entry: orientation, SHORT, count 1, value padded to 4 bytes
+	binary.Write(out, binary.BigEndian, uint16(1))
+	binary.Write(out, binary.BigEndian, uint16(exifOrientationTag))
+	binary.Write(out, binary.BigEndian, uint16(3))
+	binary.Write(out, binary.BigEndian, uint32(1))
+	binary.Write(out, binary.BigEndian, uint16(orientation))
+	binary.Write(out, binary.BigEndian, uint16(0))
+	// No next IFD
+	binary.Write(out, binary.BigEndian, uint32(0))
+	return out.Bytes()
+}
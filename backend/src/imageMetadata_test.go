@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func testImage() image.Image {
+	return image.NewPaletted(image.Rect(0, 0, 16, 8), []color.Color{color.Black, color.White})
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := jpeg.Encode(buf, testImage(), nil)
+	if err != nil {
+		t.Fatalf("failed to encode test image: %v", err)
+	}
+
+	exif := append([]byte("Exif\x00\x00"), orientationTIFF(6)...)
+	xmp := []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>secret location</x:xmpmeta>")
+	comment := []byte("secret comment")
+
+	original := buf.Bytes()
+	withMetadata := append([]byte{}, original[:2]...)
+	withMetadata = append(withMetadata, jpegSegment(0xE1, exif)...)
+	withMetadata = append(withMetadata, jpegSegment(0xE1, xmp)...)
+	withMetadata = append(withMetadata, jpegSegment(0xFE, comment)...)
+	withMetadata = append(withMetadata, original[2:]...)
+
+	result, err := stripImageMetadata(withMetadata, "image/jpeg")
+	if err != nil {
+		t.Fatalf("stripImageMetadata failed: %v", err)
+	}
+
+	if bytes.Contains(result, []byte("secret")) {
+		t.Error("the metadata was not removed")
+	}
+
+	_, err = jpeg.Decode(bytes.NewReader(result))
+	if err != nil {
+		t.Errorf("the result is not a valid JPEG: %v", err)
+	}
+
+	i := bytes.Index(result, []byte("Exif\x00\x00"))
+	if i < 0 {
+		t.Fatal("the orientation was removed")
+	}
+
+	orientation := readTIFFOrientation(result[i+6:])
+	if orientation != 6 {
+		t.Errorf("wrong orientation. Expected: 6 got: %d", orientation)
+	}
+}
+
+func TestStripJPEGMetadataMPF(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := jpeg.Encode(buf, testImage(), &jpeg.Options{Quality: 90})
+	if err != nil {
+		t.Fatalf("failed to encode test image: %v", err)
+	}
+	original := buf.Bytes()
+
+	icc := []byte("ICC_PROFILE\x00\x01\x01profile data")
+	mpf := []byte("MPF\x00secret index of the second image")
+	// Phones append a second image with its own EXIF after the End Of Image
+	exif := append([]byte("Exif\x00\x00"), []byte("secret GPS")...)
+	secondImage := append([]byte{0xFF, 0xD8}, jpegSegment(0xE1, exif)...)
+	secondImage = append(secondImage, original[2:]...)
+
+	withMetadata := append([]byte{}, original[:2]...)
+	withMetadata = append(withMetadata, jpegSegment(0xE2, icc)...)
+	withMetadata = append(withMetadata, jpegSegment(0xE2, mpf)...)
+	withMetadata = append(withMetadata, original[2:]...)
+	withMetadata = append(withMetadata, secondImage...)
+
+	result, err := stripImageMetadata(withMetadata, "image/jpeg")
+	if err != nil {
+		t.Fatalf("stripImageMetadata failed: %v", err)
+	}
+
+	if bytes.Contains(result, []byte("secret")) {
+		t.Error("the MPF segment or the second image was not removed")
+	}
+
+	if !bytes.Contains(result, icc) {
+		t.Error("the ICC profile was removed")
+	}
+
+	if !bytes.HasSuffix(result, []byte{0xFF, 0xD9}) {
+		t.Error("the result doesn't end at the End Of Image")
+	}
+
+	_, err = jpeg.Decode(bytes.NewReader(result))
+	if err != nil {
+		t.Errorf("the result is not a valid JPEG: %v", err)
+	}
+}
+
+func TestJPEGImageEnd(t *testing.T) {
+	sos := jpegSegment(0xDA, []byte{0x01, 0x01, 0x00, 0x00, 0x3F, 0x00})
+	// Entropy-coded data with a stuffed 0xFF and a restart marker, then the End Of Image and something after it
+	scan := append(append([]byte{}, sos...), 0x12, 0xFF, 0x00, 0x34, 0xFF, 0xD0, 0x56, 0xFF, 0xD9)
+	buf := append(append([]byte{}, scan...), 0xFF, 0xD8, 0xFF, 0xD9)
+
+	end, err := jpegImageEnd(buf, 0)
+	if err != nil || end != len(scan) {
+		t.Errorf("jpegImageEnd() = %d %v, want %d", end, err, len(scan))
+	}
+
+	// Truncated after the scan, nothing is cut
+	end, err = jpegImageEnd(scan[:len(scan)-2], 0)
+	if err != nil || end != len(scan)-2 {
+		t.Errorf("jpegImageEnd() without End Of Image = %d %v, want %d", end, err, len(scan)-2)
+	}
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xFF, marker}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := png.Encode(buf, testImage())
+	if err != nil {
+		t.Fatalf("failed to encode test image: %v", err)
+	}
+
+	// Add a text chunk after the IHDR chunk. signature (8) + IHDR (12 + 13)
+	original := buf.Bytes()
+	text := &bytes.Buffer{}
+	writePNGChunk(text, "tEXt", []byte("Comment\x00secret location"))
+	withMetadata := append([]byte{}, original[:33]...)
+	withMetadata = append(withMetadata, text.Bytes()...)
+	withMetadata = append(withMetadata, original[33:]...)
+
+	result, err := stripImageMetadata(withMetadata, "image/png")
+	if err != nil {
+		t.Fatalf("stripImageMetadata failed: %v", err)
+	}
+
+	if bytes.Contains(result, []byte("secret")) {
+		t.Error("the metadata was not removed")
+	}
+
+	_, err = png.Decode(bytes.NewReader(result))
+	if err != nil {
+		t.Errorf("the result is not a valid PNG: %v", err)
+	}
+}
+
+func TestStripGIFMetadata(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := gif.Encode(buf, testImage(), nil)
+	if err != nil {
+		t.Fatalf("failed to encode test image: %v", err)
+	}
+
+	// Add a comment extension before the trailer
+	original := buf.Bytes()
+	comment := []byte("secret comment")
+	withMetadata := append([]byte{}, original[:len(original)-1]...)
+	withMetadata = append(withMetadata, 0x21, 0xFE, byte(len(comment)))
+	withMetadata = append(withMetadata, comment...)
+	withMetadata = append(withMetadata, 0x00, 0x3B)
+
+	result, err := stripImageMetadata(withMetadata, "image/gif")
+	if err != nil {
+		t.Fatalf("stripImageMetadata failed: %v", err)
+	}
+
+	if bytes.Contains(result, []byte("secret")) {
+		t.Error("the metadata was not removed")
+	}
+
+	_, err = gif.Decode(bytes.NewReader(result))
+	if err != nil {
+		t.Errorf("the result is not a valid GIF: %v", err)
+	}
+}
+
+func TestStripHEIFMetadata(t *testing.T) {
+	exif := []byte("secret location")
+
+	// infe version 2: item_ID 1, protection index 0, type Exif, empty name
+	infe := isoTestBox("infe", append([]byte{2, 0, 0, 0, 0, 1, 0, 0}, []byte("Exif\x00")...))
+	iinf := isoTestBox("iinf", append([]byte{0, 0, 0, 0, 0, 1}, infe...))
+
+	ftyp := isoTestBox("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	// The size of the meta box doesn't depend on the offset value
+	metaSize := len(isoTestBox("meta", append(append([]byte{0, 0, 0, 0}, iinf...), heifTestIloc(0, 0)...)))
+	offset := len(ftyp) + metaSize + 8
+
+	iloc := heifTestIloc(uint32(offset), uint32(len(exif)))
+	meta := isoTestBox("meta", append(append([]byte{0, 0, 0, 0}, iinf...), iloc...))
+	mdat := isoTestBox("mdat", exif)
+
+	file := append(append(ftyp, meta...), mdat...)
+
+	result, err := stripImageMetadata(file, "image/heif")
+	if err != nil {
+		t.Fatalf("stripImageMetadata failed: %v", err)
+	}
+
+	if bytes.Contains(result, []byte("secret")) {
+		t.Error("the metadata was not removed")
+	}
+
+	if len(result) != len(file) {
+		t.Errorf("the file size changed. Expected: %d got: %d", len(file), len(result))
+	}
+}
+
+func isoTestBox(boxType string, data []byte) []byte {
+	box := binary.BigEndian.AppendUint32(nil, uint32(len(data)+8))
+	box = append(box, boxType...)
+	return append(box, data...)
+}
+
+// iloc version 0 with 4 byte offsets and lengths and one item with ID 1
+func heifTestIloc(offset, length uint32) []byte {
+	data := []byte{0, 0, 0, 0, 0x44, 0x00, 0, 1, 0, 1, 0, 0, 0, 1}
+	data = binary.BigEndian.AppendUint32(data, offset)
+	data = binary.BigEndian.AppendUint32(data, length)
+	return isoTestBox("iloc", data)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// A scrub can't be started while another one is running
+	errScrubRunning error = errors.New("a scrub is already running")
+)
+
+const (
+	// The number of files checked by a scrub when the request doesn't set a limit
+	DefaultScrubItems = 100
+	// The maximum number of files checked by one scrub
+	MaxScrubItems = 10000
+	// The maximum number of corrupted files returned by getScrubStatus
+	MaxCorruptedFiles = 100
+)
+
+// The state of the last scrub. Only one scrub runs at a time
+var scrubState struct {
+	sync.Mutex
+	status ScrubStatus
+}
+
+// Starts a scrub in the background. It downloads the stored objects, oldest verified first, and checks them against the SHA-256 recorded on upload.
+// The server can only check the ciphertext, the clients check the plaintext checksum after decrypting.
+func handleStartScrub(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/startScrub" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","limit": 500}'
+	*/
+	request, ok := bindAdminRequest(c, "handleStartScrub")
+	if !ok {
+		return
+	}
+
+	limit := request.Limit
+	if limit <= 0 {
+		limit = DefaultScrubItems
+	}
+	if limit > MaxScrubItems {
+		limit = MaxScrubItems
+	}
+
+	err := startScrub(limit)
+	if err != nil {
+		if errors.Is(err, errScrubRunning) {
+			c.JSON(409, gin.H{"success": false, "error": "A scrub is already running"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+		log.WithField("error", err).Error("[handleStartScrub] Failed to start the scrub")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// Returns the progress of the current or last scrub and the files whose stored object doesn't match its checksum
+func handleGetScrubStatus(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/getScrubStatus" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw=="}'
+	*/
+	_, ok := bindAdminRequest(c, "handleGetScrubStatus")
+	if !ok {
+		return
+	}
+
+	corrupted, err := getCorruptedFiles(c, MaxCorruptedFiles)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+		log.WithField("error", err).Error("[handleGetScrubStatus] Failed to get the corrupted files")
+		return
+	}
+
+	scrubState.Lock()
+	status := scrubState.status
+	scrubState.Unlock()
+
+	c.JSON(200, gin.H{"success": true, "status": status, "corrupted": corrupted})
+}
+
+// Returns the SHA-256 of the data in hex, the format stored in the files table
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the SHA-256 of everything read from r in hex
+func hashReader(r io.Reader) (string, error) {
+	hash := sha256.New()
+	_, err := io.Copy(hash, r)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Returns the SHA-256 of the file in hex and moves back to the start of the file so that it can be uploaded
+func hashFile(file *os.File) (string, error) {
+	checksum, err := hashReader(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the file. %w", err)
+	}
+
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to seek the file. %w", err)
+	}
+	return checksum, nil
+}
+
+// Saves the checksum of the ciphertext uploaded to objKey for the file that uses it, after the object was replaced.
+// The plaintext doesn't change when a file is encrypted again, so its checksum is kept.
+func setCiphertextChecksum(ctx context.Context, objKey, checksum string) error {
+	_, err := db.ExecContext(ctx, "UPDATE files SET ciphertextSHA256 = ?, checksumVerifiedDate = NULL, checksumMismatch = false WHERE objKey = ?", checksum, objKey)
+	return err
+}
+
+// Returns the checksums of the file in hex. They are empty when they are not known, e.g. the plaintext of a client encrypted file
+func getFileChecksums(ctx context.Context, fileID string) (string, string, error) {
+	var plaintext, ciphertext string
+	err := db.QueryRowContext(ctx, "SELECT IFNULL(plaintextSHA256, ''), IFNULL(ciphertextSHA256, '') FROM files WHERE id = ?", fileID).Scan(&plaintext, &ciphertext)
+	return plaintext, ciphertext, err
+}
+
+// Sets the checksum headers of a file download.
+// Repr-Digest is the checksum of the age file that is sent (RFC 9530), X-Plaintext-SHA256 is the checksum of the decrypted content.
+func setChecksumHeaders(headers map[string]string, plaintextChecksum, ciphertextChecksum string) {
+	if ciphertextChecksum != "" {
+		sum, err := hex.DecodeString(ciphertextChecksum)
+		if err == nil {
+			headers["Repr-Digest"] = fmt.Sprintf("sha-256=:%s:", base64.StdEncoding.EncodeToString(sum))
+		}
+	}
+
+	if plaintextChecksum != "" {
+		headers["X-Plaintext-SHA256"] = plaintextChecksum
+	}
+}
+
+// Starts a scrub of up to limit files in a goroutine. It returns errScrubRunning if one is already running
+func startScrub(limit int) error {
+	scrubState.Lock()
+	defer scrubState.Unlock()
+
+	if scrubState.status.Running {
+		return errScrubRunning
+	}
+
+	scrubState.status = ScrubStatus{Running: true, StartedDate: time.Now()}
+	go func() {
+		err := runScrub(context.Background(), limit)
+		if err != nil {
+			log.WithField("error", err).Error("[startScrub: Goroutine] Scrub failed")
+		}
+
+		scrubState.Lock()
+		defer scrubState.Unlock()
+		scrubState.status.Running = false
+		finished := time.Now()
+		scrubState.status.FinishedDate = &finished
+		if err != nil {
+			scrubState.status.Error = err.Error()
+		}
+	}()
+	return nil
+}
+
+// Checks the files that haven't been verified for the longest time.
+// The owner gets an alert the first time that a file is found to be corrupted.
+func runScrub(ctx context.Context, limit int) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, objKey, ciphertextSHA256, checksumMismatch, userID FROM files
+		WHERE processed = true AND objKey != '' AND ciphertextSHA256 IS NOT NULL
+		ORDER BY checksumVerifiedDate IS NOT NULL, checksumVerifiedDate, id LIMIT ?`, limit)
+	if err != nil {
+		return fmt.Errorf("failed to get the files. %w", err)
+	}
+
+	type scrubItem struct {
+		id, objKey, checksum, userID string
+		mismatch                     bool
+	}
+
+	items := []scrubItem{}
+	for rows.Next() {
+		var item scrubItem
+		err := rows.Scan(&item.id, &item.objKey, &item.checksum, &item.mismatch, &item.userID)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		items = append(items, item)
+	}
+	rows.Close()
+
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		checksum, err := hashObject(ctx, item.objKey)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "fileID": item.id}).Error("[runScrub] Failed to read the object")
+			updateScrubStatus(func(status *ScrubStatus) { status.Errors++ })
+			continue
+		}
+
+		mismatch := checksum != item.checksum
+		_, err = db.ExecContext(ctx, "UPDATE files SET checksumVerifiedDate = now(), checksumMismatch = ? WHERE id = ? AND objKey = ?", mismatch, item.id, item.objKey)
+		if err != nil {
+			return fmt.Errorf("failed to save the result of %s. %w", item.id, err)
+		}
+
+		if mismatch {
+			log.WithFields(log.Fields{"fileID": item.id, "objKey": item.objKey, "expected": item.checksum, "got": checksum}).Error("[runScrub] Checksum mismatch")
+			if !item.mismatch {
+				err = addAlert(ctx, item.userID, "fileCorrupted", item.objKey, item.id)
+				if err != nil {
+					log.WithFields(log.Fields{"error": err, "fileID": item.id}).Error("[runScrub] Failed to alert the owner")
+				}
+			}
+		}
+
+		updateScrubStatus(func(status *ScrubStatus) {
+			status.Checked++
+			if mismatch {
+				status.Mismatches++
+			}
+		})
+	}
+	return nil
+}
+
+// Downloads the object and returns its SHA-256 in hex
+func hashObject(ctx context.Context, objKey string) (string, error) {
+	object, err := getFile(ctx, s3Client, serverConfig.S3BucketName, objKey)
+	if err != nil {
+		return "", err
+	}
+	defer object.Body.Close()
+
+	return hashReader(object.Body)
+}
+
+func updateScrubStatus(update func(status *ScrubStatus)) {
+	scrubState.Lock()
+	defer scrubState.Unlock()
+	update(&scrubState.status)
+}
+
+// Returns the files whose stored object didn't match its checksum the last time it was checked
+func getCorruptedFiles(ctx context.Context, limit int) ([]CorruptedFile, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, objKey, userID, checksumVerifiedDate FROM files WHERE checksumMismatch = true ORDER BY checksumVerifiedDate DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Initialize an empty array so that the json returns an empty array instead of null.
+	files := []CorruptedFile{}
+	for rows.Next() {
+		var file CorruptedFile
+		var verifiedDate sql.NullTime
+		if err := rows.Scan(&file.ID, &file.ObjKey, &file.UserID, &verifiedDate); err != nil {
+			return nil, err
+		}
+		file.VerifiedDate = verifiedDate.Time
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
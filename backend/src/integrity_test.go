@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSha256Hex(t *testing.T) {
+	got := sha256Hex([]byte("abc"))
+	want := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	if got != want {
+		t.Errorf("sha256Hex(abc) = %s, want %s", got, want)
+	}
+}
+
+func TestHashFile(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	data := []byte("some content to upload")
+	if _, err := file.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	checksum, err := hashFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checksum != sha256Hex(data) {
+		t.Errorf("hashFile() = %s, want %s", checksum, sha256Hex(data))
+	}
+
+	// The file has to be ready to be uploaded after hashing it
+	buf := make([]byte, len(data))
+	n, err := file.Read(buf)
+	if err != nil || n != len(data) {
+		t.Errorf("file was not rewound: read %d bytes, err %v", n, err)
+	}
+}
+
+func TestSetChecksumHeaders(t *testing.T) {
+	checksum := sha256Hex([]byte("abc"))
+
+	headers := map[string]string{}
+	setChecksumHeaders(headers, checksum, checksum)
+	if headers["Repr-Digest"] != "sha-256=:ungWv48Bz+pBQUDeXa4iI7ADYaOWF3qctBD/YfIAFa0=:" {
+		t.Errorf("Repr-Digest = %q", headers["Repr-Digest"])
+	}
+	if headers["X-Plaintext-SHA256"] != checksum {
+		t.Errorf("X-Plaintext-SHA256 = %q", headers["X-Plaintext-SHA256"])
+	}
+
+	// Client encrypted files don't have a plaintext checksum
+	headers = map[string]string{}
+	setChecksumHeaders(headers, "", checksum)
+	if _, ok := headers["X-Plaintext-SHA256"]; ok {
+		t.Error("X-Plaintext-SHA256 set without a plaintext checksum")
+	}
+	if _, ok := headers["Repr-Digest"]; !ok {
+		t.Error("Repr-Digest not set")
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// The user doesn't have a key backup
+	errKeyBackupNotFound error = errors.New("key backup not found")
+	// The key backup is not an age file encrypted with a passphrase
+	errInvalidKeyBackup error = errors.New("the key backup must be an age file encrypted with a passphrase")
+	// The recovery code doesn't exist or was already used
+	errInvalidRecoveryCode error = errors.New("invalid recovery code")
+)
+
+const (
+	// The maximum size of a key backup. An age identity wrapped with a passphrase is around 250 bytes
+	MaxKeyBackupSize = 16 * 1024
+	// The number of recovery codes generated each time
+	RecoveryCodeCount = 10
+	// The number of random bytes in a recovery code. 10 bytes are 16 base32 characters
+	recoveryCodeBytes = 10
+)
+
+// Saves the user's age identity, encrypted by the client with an age scrypt (passphrase) recipient.
+// The server can't decrypt it, it is stored as is. It replaces the previous backup.
+func handleUploadKeyBackup(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/uploadKeyBackup" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","backup": "<base64 age file>"}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request KeyBackupRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleUploadKeyBackup] Failed to decode JSON")
+		return
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleUploadKeyBackup] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	err = validateKeyBackup(request.Backup)
+	if err != nil {
+		c.JSON(400, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	_, err = db.ExecContext(c, "INSERT INTO keyBackups (userID, backup, createdDate) VALUES (?, ?, now()) ON DUPLICATE KEY UPDATE backup = VALUES(backup), createdDate = now(), lastAccessed = NULL", request.UserID, request.Backup)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleUploadKeyBackup] Failed to save backup")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// Returns the user's encrypted key backup. An alert is added every time that it is fetched so that the user can see if somebody else did it.
+func handleGetKeyBackup(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/getKeyBackup" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw=="}'
+	*/
+	request, ok := bindBasicRequest(c, "handleGetKeyBackup")
+	if !ok {
+		return
+	}
+
+	backup, err := getKeyBackup(c, request.UserID, "session", c.ClientIP())
+	if err != nil {
+		if errors.Is(err, errKeyBackupNotFound) {
+			c.JSON(404, gin.H{"success": false, "error": "No key backup found"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleGetKeyBackup] Failed to get backup")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "backup": backup})
+}
+
+// Deletes the user's key backup
+func handleDeleteKeyBackup(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/deleteKeyBackup" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw=="}'
+	*/
+	request, ok := bindBasicRequest(c, "handleDeleteKeyBackup")
+	if !ok {
+		return
+	}
+
+	_, err := db.ExecContext(c, "DELETE FROM keyBackups WHERE userID = ?", request.UserID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleDeleteKeyBackup] Failed to delete backup")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// Replaces the user's recovery codes with new ones. The codes are only returned in this response, the server only stores their hashes.
+// The password is required since the codes can be used to sign in.
+func handleGenerateRecoveryCodes(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/generateRecoveryCodes" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","password":"password"}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request RecoveryCodesRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleGenerateRecoveryCodes] Failed to decode JSON")
+		return
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleGenerateRecoveryCodes] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	correct, err := isPasswordCorrect(c, request.UserID, request.Password)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleGenerateRecoveryCodes] Failed to verify password")
+		return
+	}
+
+	if !correct {
+		c.JSON(400, gin.H{"success": false, "error": "Password is wrong"})
+		return
+	}
+
+	codes, err := generateRecoveryCodes(c, request.UserID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+		log.WithField("error", err).Error("[handleGenerateRecoveryCodes] Failed to generate codes")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "recoveryCodes": codes})
+}
+
+// Signs in with a one-time recovery code when the user lost their device.
+// It returns a new authToken and the key backup if there is one. The code can't be used again.
+func handleRecoverAccount(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/recoverAccount" -H 'Content-Type: application/json' -d '{"userID":"testUser","recoveryCode":"ABCD-EFGH-IJKL-MNOP"}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request RecoverAccountRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleRecoverAccount] Failed to decode JSON")
+		return
+	}
+
+	remaining, err := useRecoveryCode(c, request.UserID, request.RecoveryCode)
+	if err != nil {
+		if errors.Is(err, errInvalidRecoveryCode) {
+			c.JSON(400, gin.H{"success": false, "error": "UserID and/or recovery code is wrong"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleRecoverAccount] Failed to verify recovery code")
+		return
+	}
+
+	token, err := generateAuthToken(c, request.UserID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleRecoverAccount] Failed to generate authToken")
+		return
+	}
+
+	backup, err := getKeyBackup(c, request.UserID, "recoveryCode", c.ClientIP())
+	if err != nil && !errors.Is(err, errKeyBackupNotFound) {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+		log.WithField("error", err).Error("[handleRecoverAccount] Failed to get backup")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "userID": request.UserID, "authToken": token, "backup": backup, "recoveryCodesLeft": remaining})
+}
+
+// Decodes the BasicRequest and verifies the token. If it returns false, the response was already sent
+func bindBasicRequest(c *gin.Context, name string) (BasicRequest, bool) {
+	var request BasicRequest
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return request, false
+	}
+
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Errorf("[%s] Failed to decode JSON", name)
+		return request, false
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Errorf("[%s] Failed to verify token", name)
+		return request, false
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return request, false
+	}
+
+	return request, true
+}
+
+// Checks that the backup is an age file with a single scrypt stanza, which is how age encrypts with a passphrase.
+// It makes sure that the client didn't upload the identity encrypted with one of its own keys, which would be useless after losing the device.
+func validateKeyBackup(backup []byte) error {
+	if len(backup) == 0 || len(backup) > MaxKeyBackupSize {
+		return fmt.Errorf("%w: it must be between 1 and %d bytes", errInvalidKeyBackup, MaxKeyBackupSize)
+	}
+
+	stanzas, err := parseAgeHeader(bytes.NewReader(backup))
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidKeyBackup, err)
+	}
+
+	if len(stanzas) != 1 || stanzas[0].Type != "scrypt" {
+		return errInvalidKeyBackup
+	}
+	return nil
+}
+
+// Returns the user's key backup and adds a "keyBackupAccessed" alert.
+// method is how the user authenticated, "session" or "recoveryCode", and ip is the client's address.
+func getKeyBackup(ctx context.Context, userID, method, ip string) ([]byte, error) {
+	var backup []byte
+	err := db.QueryRowContext(ctx, "SELECT backup FROM keyBackups WHERE userID = ?", userID).Scan(&backup)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errKeyBackupNotFound
+		}
+		return nil, err
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE keyBackups SET lastAccessed = now() WHERE userID = ?", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update lastAccessed. %w", err)
+	}
+
+	// The backup is not returned if the access can't be recorded
+	err = addAlert(ctx, userID, "keyBackupAccessed", method, ip)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add alert. %w", err)
+	}
+
+	return backup, nil
+}
+
+// Deletes the user's recovery codes and creates RecoveryCodeCount new ones. Returns the codes in plaintext
+func generateRecoveryCodes(ctx context.Context, userID string) ([]string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM recoveryCodes WHERE userID = ?", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete old codes. %w", err)
+	}
+
+	codes := []string{}
+	for range RecoveryCodeCount {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.ExecContext(ctx, "INSERT INTO recoveryCodes (codeHash, userID, createdDate) VALUES (?, ?, now())", hashRecoveryCode(code), userID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert code. %w", err)
+		}
+		codes = append(codes, code)
+	}
+
+	return codes, tx.Commit()
+}
+
+// Marks the recovery code as used. Returns the number of unused codes left, or errInvalidRecoveryCode
+func useRecoveryCode(ctx context.Context, userID, code string) (int, error) {
+	if userID == "" || code == "" {
+		return 0, errInvalidRecoveryCode
+	}
+
+	res, err := db.ExecContext(ctx, "UPDATE recoveryCodes SET usedDate = now() WHERE codeHash = ? AND userID = ? AND usedDate IS NULL", hashRecoveryCode(code), userID)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if n == 0 {
+		return 0, errInvalidRecoveryCode
+	}
+
+	var remaining int
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM recoveryCodes WHERE userID = ? AND usedDate IS NULL", userID).Scan(&remaining)
+	return remaining, err
+}
+
+// Returns a random code formatted as "ABCD-EFGH-IJKL-MNOP"
+func newRecoveryCode() (string, error) {
+	b := make([]byte, recoveryCodeBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+	groups := []string{}
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:min(i+4, len(encoded))])
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+// Returns the hex SHA-256 of the code without dashes, spaces or lowercase letters.
+// The codes are random so a fast hash is enough, unlike passwords.
+func hashRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
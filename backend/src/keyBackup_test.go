@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestValidateKeyBackup(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scryptRecipient, err := age.NewScryptRecipient("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keep the test fast, the work factor doesn't change the header format
+	scryptRecipient.SetWorkFactor(10)
+
+	encrypt := func(recipient age.Recipient) []byte {
+		encrypted := &bytes.Buffer{}
+		w, err := age.Encrypt(encrypted, recipient)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = w.Write([]byte(identity.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encrypted.Bytes()
+	}
+
+	err = validateKeyBackup(encrypt(scryptRecipient))
+	if err != nil {
+		t.Errorf("validateKeyBackup failed with a passphrase backup. %v", err)
+	}
+
+	tests := map[string][]byte{
+		"X25519 recipient": encrypt(identity.Recipient()),
+		"empty":            {},
+		"not age":          []byte(identity.String()),
+		"too big":          bytes.Repeat([]byte("a"), MaxKeyBackupSize+1),
+	}
+
+	for name, backup := range tests {
+		err := validateKeyBackup(backup)
+		if !errors.Is(err, errInvalidKeyBackup) {
+			t.Errorf("%s: expected errInvalidKeyBackup, got %v", name, err)
+		}
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	code, err := newRecoveryCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(code) != 19 || strings.Count(code, "-") != 3 {
+		t.Errorf("unexpected recovery code format %q", code)
+	}
+
+	other, err := newRecoveryCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code == other {
+		t.Errorf("two recovery codes are the same %q", code)
+	}
+
+	// The user might type it without dashes or in lowercase
+	typed := strings.ToLower(strings.ReplaceAll(code, "-", " "))
+	if hashRecoveryCode(typed) != hashRecoveryCode(code) {
+		t.Errorf("hashRecoveryCode(%q) doesn't match hashRecoveryCode(%q)", typed, code)
+	}
+
+	if hashRecoveryCode(code) == hashRecoveryCode(other) {
+		t.Errorf("different codes have the same hash")
+	}
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// The objKey is not a file, thumbnail or folder key that is still encrypted with the retiring key
+	errRotationItemNotFound error = errors.New("rotation item not found")
+	// The new public key is already in encryptionKeys
+	errPublicKeyExists error = errors.New("public key already registered")
+	// The public key is not being rotated out for the user
+	errKeyRotationNotFound error = errors.New("key rotation not found")
+)
+
+const (
+	// The maximum number of items returned by getKeyRotationItems in one call
+	MaxRotationItems = 100
+
+	RotationItemFile      = "file"
+	RotationItemThumbnail = "thumbnail"
+	RotationItemFolderKey = "folderKey"
+)
+
+// Every object that is still encrypted with the public key.
+// Objects that were uploaded before the recipients were recorded in objectRecipients are included if the user owns them,
+// since there is no way to know which keys they use.
+// The args are the publicKey and the userID, repeated for each of the 3 queries.
+const rotationItemsQuery = `
+SELECT f.id, 'file' AS itemType, f.objKey FROM files f
+WHERE f.type != 'folder' AND f.objKey != '' AND (
+  f.objKey IN (SELECT objKey FROM objectRecipients WHERE publicKey = ?)
+  OR (f.userID = ? AND NOT EXISTS (SELECT 1 FROM objectRecipients r WHERE r.objKey = f.objKey)))
+UNION ALL
+SELECT f.id, 'thumbnail', f.thumbnailObjKey FROM files f
+WHERE f.thumbnailObjKey IS NOT NULL AND (
+  f.thumbnailObjKey IN (SELECT objKey FROM objectRecipients WHERE publicKey = ?)
+  OR (f.userID = ? AND NOT EXISTS (SELECT 1 FROM objectRecipients r WHERE r.objKey = f.thumbnailObjKey)))
+UNION ALL
+SELECT f.id, 'folderKey', CONCAT('folderkeys/', f.id) FROM files f
+WHERE f.type = 'folder' AND EXISTS (SELECT 1 FROM encryptionKeys k WHERE k.folderID = f.id) AND (
+  CONCAT('folderkeys/', f.id) IN (SELECT objKey FROM objectRecipients WHERE publicKey = ?)
+  OR (f.userID = ? AND NOT EXISTS (SELECT 1 FROM objectRecipients r WHERE r.objKey = CONCAT('folderkeys/', f.id))))`
+
+// Starts replacing one of the user's keys. The new key is registered and the old one is marked as retiring,
+// so that new files and folder keys are only encrypted with the new key. The old key keeps working until completeKeyRotation.
+func handleStartKeyRotation(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/startKeyRotation" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","oldPublicKey": "age1...", "newPublicKey": "age1...", "description": "Laptop"}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request StartKeyRotationRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleStartKeyRotation] Failed to decode JSON")
+		return
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleStartKeyRotation] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	newPublicKey, keyType, err := parsePublicKey(request.NewPublicKey)
+	if err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid public key"})
+		return
+	}
+
+	description, err := validateKeyDescription(request.Description)
+	if err != nil {
+		c.JSON(400, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	err = startKeyRotation(c, request.UserID, request.OldPublicKey, newPublicKey, keyType, description)
+	if err != nil {
+		if errors.Is(err, errPublicKeyNotFound) {
+			c.JSON(404, gin.H{"success": false, "error": "Public key not found"})
+			return
+		}
+
+		if errors.Is(err, errPublicKeyExists) {
+			c.JSON(400, gin.H{"success": false, "error": "Public key already registered"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleStartKeyRotation] Failed to start key rotation")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// Returns a batch of the files, thumbnails and folder keys that are still encrypted with the retiring key.
+// Each item has the public keys that it has to be encrypted with again. remaining is the total number of items left.
+func handleGetKeyRotationItems(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/getKeyRotationItems" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","publicKey": "age1...", "limit": 50}'
+	*/
+	request, ok := bindKeyRotationRequest(c, "handleGetKeyRotationItems")
+	if !ok {
+		return
+	}
+
+	limit := request.Limit
+	if limit <= 0 || limit > MaxRotationItems {
+		limit = MaxRotationItems
+	}
+
+	items, err := getRotationItems(c, request.UserID, request.PublicKey, limit)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleGetKeyRotationItems] Failed to get items")
+		return
+	}
+
+	remaining, err := countRotationItems(c, db, request.UserID, request.PublicKey)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+		log.WithField("error", err).Error("[handleGetKeyRotationItems] Failed to count items")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "items": items, "remaining": remaining})
+}
+
+// Replaces a file, thumbnail or folder key with the same data encrypted again by the client.
+// The age header is checked to make sure that it is encrypted for every expected recipient, so that nobody loses access.
+func handleUploadRewrappedItem(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/uploadRewrappedItem" -F "userID=testUser" -F "authToken=K1xS9ehuxeC5tw==" -F "publicKey=age1..." -F "objKey=folderkeys/0190..." -F "file=@item.age"
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	userID := c.PostForm("userID")
+	authToken := c.PostForm("authToken")
+	publicKey := c.PostForm("publicKey")
+	objKey := c.PostForm("objKey")
+	if userID == "" || authToken == "" {
+		c.JSON(400, gin.H{"success": false, "error": "Authentication Missing"})
+		return
+	}
+
+	valid, err := isAuthTokenValid(c, userID, authToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleUploadRewrappedItem] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	retiring, err := isRetiringKey(c, userID, publicKey)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleUploadRewrappedItem] Failed to check the key")
+		return
+	}
+
+	if !retiring {
+		c.JSON(404, gin.H{"success": false, "error": "No key rotation found for the public key"})
+		return
+	}
+
+	item, err := getRotationItem(c, userID, publicKey, objKey)
+	if err != nil {
+		if errors.Is(err, errRotationItemNotFound) {
+			c.JSON(404, gin.H{"success": false, "error": "Item not found"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleUploadRewrappedItem] Failed to get item")
+		return
+	}
+
+	// Folder keys only need access to the folder, it doesn't change the content. Files can only be replaced with write access
+	var permission string
+	if item.Type == RotationItemFolderKey {
+		permission, err = getFolderPermission(c, item.FileID, userID, true)
+	} else {
+		permission, err = getItemPermission(c, item.FileID, userID)
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleUploadRewrappedItem] Failed to get permission")
+		return
+	}
+
+	if permission == "" || (item.Type != RotationItemFolderKey && permission != WritePermission) {
+		c.JSON(403, gin.H{"success": false, "error": "You don't have permission to change this item"})
+		return
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "No file received"})
+		return
+	}
+
+	filePath := fmt.Sprintf("%s%s_rewrap", serverConfig.TMPStorageDir, item.FileID)
+	err = c.SaveUploadedFile(file, filePath)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+		log.WithFields(log.Fields{"error": err, "filePath": filePath}).Error("[handleUploadRewrappedItem] Error saving uploaded file")
+		return
+	}
+	defer deleteLocalFile(filePath)
+
+	err = replaceRotationItem(c, item, filePath)
+	if err != nil {
+		if errors.Is(err, errInvalidAgeHeader) || errors.Is(err, errWrongRecipients) {
+			c.JSON(400, gin.H{"success": false, "error": err.Error()})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"})
+		log.WithFields(log.Fields{"error": err, "objKey": item.ObjKey}).Error("[handleUploadRewrappedItem] Failed to replace item")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// Deletes the retiring key once nothing is encrypted with it anymore
+func handleCompleteKeyRotation(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/completeKeyRotation" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","publicKey": "age1..."}'
+	*/
+	request, ok := bindKeyRotationRequest(c, "handleCompleteKeyRotation")
+	if !ok {
+		return
+	}
+
+	remaining, err := completeKeyRotation(c, request.UserID, request.PublicKey)
+	if err != nil {
+		if errors.Is(err, errKeyRotationNotFound) {
+			c.JSON(404, gin.H{"success": false, "error": "No key rotation found for the public key"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleCompleteKeyRotation] Failed to delete key")
+		return
+	}
+
+	if remaining > 0 {
+		c.JSON(409, gin.H{"success": false, "error": "Some items are still encrypted with the old key", "remaining": remaining})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// Deletes the retiring key if nothing is encrypted with it anymore. The key is locked while the items are counted and it is deleted in the same transaction,
+// so that a rewrapped item that is replaced in between is not lost. Returns the number of items that still use the key, it is only deleted if there are none.
+func completeKeyRotation(ctx context.Context, userID, publicKey string) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var count int
+	err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM encryptionKeys WHERE publicKey = ? AND userID = ? AND folderID IS NULL AND retiringDate IS NOT NULL FOR UPDATE", publicKey, userID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to lock the key. %w", err)
+	}
+
+	if count == 0 {
+		return 0, errKeyRotationNotFound
+	}
+
+	remaining, err := countRotationItems(ctx, tx, userID, publicKey)
+	if err != nil {
+		return 0, fmt.Errorf("countRotationItems error. %w", err)
+	}
+
+	if remaining > 0 {
+		return remaining, nil
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM encryptionKeys WHERE publicKey = ? AND userID = ? AND folderID IS NULL AND retiringDate IS NOT NULL", publicKey, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete the key. %w", err)
+	}
+
+	return 0, tx.Commit()
+}
+
+// Decodes the KeyRotationRequest and verifies the token. If it returns false, the response was already sent
+func bindKeyRotationRequest(c *gin.Context, name string) (KeyRotationRequest, bool) {
+	var request KeyRotationRequest
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return request, false
+	}
+
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Errorf("[%s] Failed to decode JSON", name)
+		return request, false
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Errorf("[%s] Failed to verify token", name)
+		return request, false
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return request, false
+	}
+
+	retiring, err := isRetiringKey(c, request.UserID, request.PublicKey)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Errorf("[%s] Failed to check the key", name)
+		return request, false
+	}
+
+	if !retiring {
+		c.JSON(404, gin.H{"success": false, "error": "No key rotation found for the public key"})
+		return request, false
+	}
+
+	return request, true
+}
+
+// Registers the new key and marks the old one as retiring in a single transaction.
+// The old key has to be an active device key of the user.
+func startKeyRotation(ctx context.Context, userID, oldPublicKey, newPublicKey, keyType, description string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "UPDATE encryptionKeys SET retiringDate = now() WHERE publicKey = ? AND userID = ? AND folderID IS NULL AND revokedDate IS NULL AND retiringDate IS NULL", oldPublicKey, userID)
+	if err != nil {
+		return fmt.Errorf("failed to mark the key as retiring. %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return errPublicKeyNotFound
+	}
+
+	var count int
+	err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM encryptionKeys WHERE publicKey = ?", newPublicKey).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to check if the key exists. %w", err)
+	}
+
+	if count > 0 {
+		return errPublicKeyExists
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO encryptionKeys (publicKey, keyType, userID, description, createdDate) VALUES (?, ?, ?, ?, now())", newPublicKey, keyType, userID, description)
+	if isDuplicateEntry(err) {
+		return errPublicKeyExists
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to insert the new key. %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// Returns true if the public key is one of the user's keys that is being rotated out
+func isRetiringKey(ctx context.Context, userID, publicKey string) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM encryptionKeys WHERE publicKey = ? AND userID = ? AND folderID IS NULL AND retiringDate IS NOT NULL", publicKey, userID).Scan(&count)
+	return count > 0, err
+}
+
+// Returns up to limit items that are still encrypted with the public key, with the keys that each one has to be encrypted with
+func getRotationItems(ctx context.Context, userID, publicKey string, limit int) ([]RotationItem, error) {
+	rows, err := db.QueryContext(ctx, rotationItemsQuery+" ORDER BY id LIMIT ?", publicKey, userID, publicKey, userID, publicKey, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Initialize an empty array so that the json returns an empty array instead of null.
+	items := []RotationItem{}
+	for rows.Next() {
+		var item RotationItem
+		if err := rows.Scan(&item.FileID, &item.Type, &item.ObjKey); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range items {
+		items[i].Recipients, err = getRotationItemRecipients(ctx, items[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the recipients of %s. %w", items[i].ObjKey, err)
+		}
+	}
+	return items, nil
+}
+
+// Returns the number of items that are still encrypted with the public key
+func countRotationItems(ctx context.Context, q rowQuerier, userID, publicKey string) (int, error) {
+	var count int
+	err := q.QueryRowContext(ctx, "SELECT COUNT(*) FROM ("+rotationItemsQuery+") AS items", publicKey, userID, publicKey, userID, publicKey, userID).Scan(&count)
+	return count, err
+}
+
+// Returns the item with the objKey if it is still encrypted with the public key, otherwise errRotationItemNotFound
+func getRotationItem(ctx context.Context, userID, publicKey, objKey string) (RotationItem, error) {
+	var item RotationItem
+	err := db.QueryRowContext(ctx, "SELECT id, itemType, objKey FROM ("+rotationItemsQuery+") AS items WHERE objKey = ? LIMIT 1", publicKey, userID, publicKey, userID, publicKey, userID, objKey).Scan(&item.FileID, &item.Type, &item.ObjKey)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return item, errRotationItemNotFound
+		}
+		return item, err
+	}
+
+	item.Recipients, err = getRotationItemRecipients(ctx, item)
+	return item, err
+}
+
+// Returns the public keys that the item should be encrypted with.
+// Files and thumbnails use the keys of their folder. Folder keys are encrypted for every device of the owner and of the users with access.
+func getRotationItemRecipients(ctx context.Context, item RotationItem) ([]string, error) {
+	if item.Type != RotationItemFolderKey {
+		return getFileRecipients(ctx, item.FileID)
+	}
+
+	return getFolderKeyPublicKeys(ctx, item.FileID)
+}
+
+// Returns the permission that the user has on a file: "write", "read" or "" for no permission
+func getItemPermission(ctx context.Context, fileID, userID string) (string, error) {
+	owner, err := getItemOwner(ctx, fileID)
+	if err != nil {
+		return "", err
+	}
+
+	if owner == userID {
+		return WritePermission, nil
+	}
+	return hasSharedFilePermission(ctx, fileID, userID)
+}
+
+// Checks that the file at filePath is an age file encrypted for the item's recipients, uploads it to the item's objKey and records the new recipients
+func replaceRotationItem(ctx context.Context, item RotationItem, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open the file. %w", err)
+	}
+	defer file.Close()
+
+	err = checkAgeRecipients(file, item.Recipients)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to seek the file. %w", err)
+	}
+
+	checksum, err := hashFile(file)
+	if err != nil {
+		return err
+	}
+
+	_, err = uploadFile(ctx, s3Client, serverConfig.S3BucketName, file, item.ObjKey)
+	if err != nil {
+		return fmt.Errorf("failed to upload the file. %w", err)
+	}
+
+	// Only files have a checksum, nothing is updated for thumbnails and folder keys
+	err = setCiphertextChecksum(ctx, item.ObjKey, checksum)
+	if err != nil {
+		return fmt.Errorf("setCiphertextChecksum error. %w", err)
+	}
+
+	return recordObjectRecipients(ctx, item.ObjKey, item.Recipients)
+}
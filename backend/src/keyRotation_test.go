@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+)
+
+// The answers for a key that is being rotated out, with remaining items still encrypted with it
+func keyRotationResponses(remaining int) []fakeResponse {
+	return []fakeResponse{
+		validTokenResponse,
+		{match: "SELECT COUNT(*) FROM (", columns: []string{"count"}, rows: [][]driver.Value{{remaining}}},
+		{match: "retiringDate IS NOT NULL", columns: []string{"count"}, rows: [][]driver.Value{{1}}},
+	}
+}
+
+func TestCompleteKeyRotation(t *testing.T) {
+	request := KeyRotationRequest{UserID: "testUser", AuthToken: "K1xS9ehuxeC5tw==", PublicKey: "age1old"}
+
+	fake := useFakeDB(t, keyRotationResponses(2)...)
+	status, response := postJSON(t, handleCompleteKeyRotation, request)
+	if status != 409 || response["remaining"] != float64(2) {
+		t.Errorf("handleCompleteKeyRotation() = %d %v, want 409 with 2 remaining", status, response)
+	}
+	if calls := fake.callsMatching("DELETE FROM encryptionKeys"); len(calls) != 0 || fake.commits != 0 {
+		t.Errorf("the key was deleted while items still use it")
+	}
+
+	fake = useFakeDB(t, keyRotationResponses(0)...)
+	status, response = postJSON(t, handleCompleteKeyRotation, request)
+	if status != 200 {
+		t.Fatalf("handleCompleteKeyRotation() = %d %v, want 200", status, response)
+	}
+	if calls := fake.callsMatching("DELETE FROM encryptionKeys"); len(calls) != 1 || calls[0].args[0] != "age1old" {
+		t.Errorf("got deletes %v, want the old key to be deleted", calls)
+	}
+	if fake.commits != 1 {
+		t.Errorf("got %d commits, want the count and the delete in 1 transaction", fake.commits)
+	}
+
+}
+
+func TestCompleteKeyRotationNotFound(t *testing.T) {
+	useFakeDB(t, fakeResponse{match: "retiringDate IS NOT NULL", columns: []string{"count"}, rows: [][]driver.Value{{0}}})
+
+	_, err := completeKeyRotation(context.Background(), "testUser", "age1old")
+	if !errors.Is(err, errKeyRotationNotFound) {
+		t.Errorf("completeKeyRotation() returned %v, want errKeyRotationNotFound", err)
+	}
+}
+
+func TestStartKeyRotation(t *testing.T) {
+	newPublicKey := newTestPublicKey(t)
+
+	// RowsAffected is always 1 in the fake DB, so the old key is found
+	fake := useFakeDB(t, noRegisteredKey)
+	err := startKeyRotation(context.Background(), "testUser", "age1old", newPublicKey, "X25519", "Laptop")
+	if err != nil {
+		t.Fatalf("startKeyRotation() returned %v", err)
+	}
+	if calls := fake.callsMatching("SET retiringDate = now()"); len(calls) != 1 || calls[0].args[0] != "age1old" {
+		t.Errorf("got %v, want the old key to be marked as retiring", calls)
+	}
+	if calls := fake.callsMatching("INSERT INTO encryptionKeys"); len(calls) != 1 || calls[0].args[0] != newPublicKey {
+		t.Errorf("got %v, want the new key to be added", calls)
+	}
+	if fake.commits != 1 {
+		t.Errorf("got %d commits, want 1", fake.commits)
+	}
+
+	fake = useFakeDB(t, fakeResponse{match: "SELECT COUNT(*) FROM encryptionKeys", columns: []string{"count"}, rows: [][]driver.Value{{1}}})
+	err = startKeyRotation(context.Background(), "testUser", "age1old", newPublicKey, "X25519", "Laptop")
+	if !errors.Is(err, errPublicKeyExists) || fake.commits != 0 {
+		t.Errorf("startKeyRotation(registered key) returned %v, want errPublicKeyExists without a commit", err)
+	}
+}
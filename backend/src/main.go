@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	_ "embed"
 	"flag"
@@ -67,6 +68,10 @@ func main() {
 		log.Fatal("[main] No ListenOn specified")
 	}
 
+	if err := validateSharingPolicy(serverSharingPolicy()); err != nil {
+		log.WithField("err", err).Fatal("[main] SharingPolicy has an invalid value")
+	}
+
 	log.WithField("LastCommitInfo", LastCommitInfo).Info("Starting server")
 
 	if serverConfig.GINRelease {
@@ -113,20 +118,31 @@ func main() {
 	})
 
 	router.POST("login", handleLogin)
+	router.POST("recoverAccount", handleRecoverAccount)
 	router.POST("logout", handleLogout)
 	router.POST("signup", handleSignup)
 	router.POST("changePassword", handleChangePassword)
+	router.POST("getSettings", handleGetSettings)
+	router.POST("updateSettings", handleUpdateSettings)
 
 	router.POST("uploadFile", handleFileUpload)
+	router.POST("getUploadRecipients", handleGetUploadRecipients)
 	router.POST("getFile", handleGetFile)
+	router.GET("files/:fileID", handleDownloadFile)
+	router.POST("getThumbnail", handleGetThumbnail)
 	router.POST("shareFile", handleShareFile)
 	router.POST("removeFile", handleRemoveFile)
 	router.POST("getSharedWith", handleGetSharedWith)
 	router.POST("getSharedFolders", handleGetSharedFolders)
 	router.POST("renameItem" , handleRenameItem)
+	router.POST("searchFiles", handleSearchFiles)
 
 	router.POST("createDir", handleCreateDirectory)
 	router.POST("getDir", handleGetDirectory)
+	router.POST("downloadFolder", handleDownloadFolder)
+	router.POST("copyItem", handleCopyItem)
+	router.POST("getCopyJob", handleGetCopyJob)
+	router.POST("batch", handleBatch)
 	router.POST("shareDir", handleShareDirectory)
 	router.POST("removeDir", handleRemoveDirectory)
 
@@ -137,12 +153,56 @@ func main() {
 	router.POST("getProfilePicture", handleGetProfilePicture)
 	router.POST("updateProfilePicture", handleUpdateProfilePicture)
 
+	router.POST("searchUsers", handleSearchUsers)
 	router.POST("getFriends", handleGetFriends)
 	router.POST("addFriends", handleAddFriends)
-	// router.POST("getPendingFriendRequests", handleGetPendingFriendRequests)
+	router.POST("getPendingFriendRequests", handleGetPendingFriendRequests)
 	router.POST("acceptFriendRequest", handleAcceptFriendRequest)
+	router.POST("declineFriendRequest", handleDeclineFriendRequest)
+	router.POST("cancelFriendRequest", handleCancelFriendRequest)
+	router.POST("removeFriend", handleRemoveFriend)
+	router.POST("blockUser", handleBlockUser)
+	router.POST("unblockUser", handleUnblockUser)
+	router.POST("getBlockedUsers", handleGetBlockedUsers)
+	router.POST("createGroup", handleCreateGroup)
+	router.POST("getGroups", handleGetGroups)
+	router.POST("addGroupMembers", handleAddGroupMembers)
+	router.POST("removeGroupMembers", handleRemoveGroupMembers)
+	router.POST("deleteGroup", handleDeleteGroup)
+	router.POST("getFolderKeyRecipients", handleGetFolderKeyRecipients)
+	router.POST("registerPublicKey", handleRegisterPublicKey)
+	router.POST("labelPublicKey", handleLabelPublicKey)
+	router.POST("getPublicKeys", handleGetPublicKeys)
+	router.POST("revokePublicKey", handleRevokePublicKey)
+	router.POST("uploadKeyBackup", handleUploadKeyBackup)
+	router.POST("getKeyBackup", handleGetKeyBackup)
+	router.POST("deleteKeyBackup", handleDeleteKeyBackup)
+	router.POST("generateRecoveryCodes", handleGenerateRecoveryCodes)
+	router.POST("startKeyRotation", handleStartKeyRotation)
+	router.POST("getKeyRotationItems", handleGetKeyRotationItems)
+	router.POST("uploadRewrappedItem", handleUploadRewrappedItem)
+	router.POST("completeKeyRotation", handleCompleteKeyRotation)
+	router.POST("getReencryptionTasks", handleGetReencryptionTasks)
+	router.POST("completeReencryptionTask", handleCompleteReencryptionTask)
+	router.POST("startScrub", handleStartScrub)
+	router.POST("getScrubStatus", handleGetScrubStatus)
+	router.POST("runGarbageCollector", handleRunGarbageCollector)
+	router.POST("setUserOrganization", handleSetUserOrganization)
+	router.POST("offerOwnership", handleOfferOwnership)
+	router.POST("acceptOwnershipTransfer", handleAcceptOwnershipTransfer)
+	router.POST("cancelOwnershipTransfer", handleCancelOwnershipTransfer)
 
 	router.POST("getEncryptedFolderKey", handleGetFolderKey)
+	router.POST("updateFolderKey", handleUpdateFolderKey)
+	router.POST("getFolderKeyVersions", handleGetFolderKeyVersions)
+	router.POST("rollbackFolderKey", handleRollbackFolderKey)
+
+	err = failStaleCopyJobs(context.Background())
+	if err != nil {
+		log.WithField("err", err).Error("[main] Failed to clean up the interrupted copy jobs")
+	}
+
+	startGarbageCollector()
 
 	router.Run(serverConfig.ListenOn)
 
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Ownership transfer not found, or not meant for the user, error
+	errTransferNotFound error = errors.New("ownership transfer not found")
+	// The item changed owner after the transfer was offered
+	errTransferOutdated error = errors.New("the item is no longer owned by the user that offered it")
+)
+
+// The owner offers a file or folder to another user. The other user gets an "ownershipTransfer" alert and has to accept it
+func handleOfferOwnership(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/offerOwnership" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","fileID": "0195f78c-2487-75e7-b611-127b303d1e9e", "toUserID": "anotherTestUser"}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request OfferOwnershipRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleOfferOwnership] Failed to decode JSON")
+		return
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleOfferOwnership] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	if request.FileID == "" || request.FileID == RootDirectoryID {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid fileID"})
+		return
+	}
+
+	owner, err := getItemOwner(c, request.FileID)
+	if err != nil {
+		if errors.Is(err, errFileNotFound) {
+			c.JSON(400, gin.H{"success": false, "error": "File not found"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleOfferOwnership] Failed to get item owner")
+		return
+	}
+
+	if owner != request.UserID {
+		c.JSON(403, gin.H{"success": false, "error": "Only the owner can transfer an item"})
+		return
+	}
+
+	// The item is moved to the new owner's root directory, where names can't be encrypted
+	nameEncrypted, err := isNameEncrypted(c, request.FileID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2b), Please try again later"})
+		log.WithField("error", err).Error("[handleOfferOwnership] Failed to check the name")
+		return
+	}
+
+	if nameEncrypted {
+		c.JSON(400, gin.H{"success": false, "error": "Items with encrypted names can't be transferred"})
+		return
+	}
+
+	// The new owner has to accept items from the user
+	refused, err := checkShareRecipients(c, request.UserID, []string{request.ToUserID})
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+		log.WithField("error", err).Error("[handleOfferOwnership] Failed to check the recipient")
+		return
+	}
+
+	if len(refused) > 0 {
+		c.JSON(403, gin.H{"success": false, "error": "The item can't be transferred to this user", "refused": refused})
+		return
+	}
+
+	transferID, err := getNewID()
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"})
+		log.WithField("error", err).Error("[handleOfferOwnership] Failed to get new ID")
+		return
+	}
+
+	// Only one pending transfer per item. A new offer replaces the old one
+	_, err = db.ExecContext(c, "DELETE FROM ownershipTransfers WHERE fileID = ?", request.FileID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (5), Please try again later"})
+		log.WithField("error", err).Error("[handleOfferOwnership] Failed to remove old offers")
+		return
+	}
+
+	_, err = db.ExecContext(c, "INSERT INTO ownershipTransfers (id, fileID, fromUserID, toUserID, createdDate) VALUES (?, ?, ?, ?, now())", transferID.String(), request.FileID, request.UserID, request.ToUserID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (6), Please try again later"})
+		log.WithField("error", err).Error("[handleOfferOwnership] Failed to insert transfer")
+		return
+	}
+
+	err = addAlert(c, request.ToUserID, "ownershipTransfer", request.UserID, transferID.String())
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "transferID": transferID}).Error("[handleOfferOwnership] Failed to add alert")
+	}
+
+	c.JSON(200, gin.H{"success": true, "transferID": transferID.String()})
+}
+
+// The recipient of an offer accepts it. The item and everything inside of it that the old owner owned changes owner.
+// The item is moved to the new owner's root directory and the old owner keeps write access to it.
+func handleAcceptOwnershipTransfer(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/acceptOwnershipTransfer" -H 'Content-Type: application/json' -d '{"userID":"anotherTestUser","authToken":"K1xS9ehuxeC5tw==","transferID": "0196a5d1-3c2f-7b8e-a0d4-5e6f7a8b9c0d"}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request OwnershipTransferRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleAcceptOwnershipTransfer] Failed to decode JSON")
+		return
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleAcceptOwnershipTransfer] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	transfer, err := getOwnershipTransfer(c, request.TransferID)
+	if err != nil {
+		if errors.Is(err, errTransferNotFound) {
+			c.JSON(404, gin.H{"success": false, "error": "Transfer not found"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleAcceptOwnershipTransfer] Failed to get transfer")
+		return
+	}
+
+	if transfer.ToUserID != request.UserID {
+		c.JSON(404, gin.H{"success": false, "error": "Transfer not found"})
+		return
+	}
+
+	err = transferOwnership(c, transfer)
+	if err != nil {
+		if errors.Is(err, errTransferOutdated) {
+			c.JSON(409, gin.H{"success": false, "error": "The item is no longer owned by the user that offered it"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+		log.WithFields(log.Fields{"error": err, "transferID": transfer.ID}).Error("[handleAcceptOwnershipTransfer] Failed to transfer ownership")
+		return
+	}
+
+	err = removeAlertsWithData(c, request.UserID, "ownershipTransfer", transfer.ID)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "transferID": transfer.ID}).Error("[handleAcceptOwnershipTransfer] Failed to remove alert")
+	}
+
+	err = addAlert(c, transfer.FromUserID, "ownershipTransferAccepted", request.UserID, transfer.FileID)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "transferID": transfer.ID}).Error("[handleAcceptOwnershipTransfer] Failed to add alert")
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// Used by the recipient to decline an offer and by the owner to cancel it
+func handleCancelOwnershipTransfer(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/cancelOwnershipTransfer" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","transferID": "0196a5d1-3c2f-7b8e-a0d4-5e6f7a8b9c0d"}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request OwnershipTransferRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleCancelOwnershipTransfer] Failed to decode JSON")
+		return
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleCancelOwnershipTransfer] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	transfer, err := getOwnershipTransfer(c, request.TransferID)
+	if err != nil {
+		if errors.Is(err, errTransferNotFound) {
+			c.JSON(404, gin.H{"success": false, "error": "Transfer not found"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleCancelOwnershipTransfer] Failed to get transfer")
+		return
+	}
+
+	if transfer.ToUserID != request.UserID && transfer.FromUserID != request.UserID {
+		c.JSON(404, gin.H{"success": false, "error": "Transfer not found"})
+		return
+	}
+
+	_, err = db.ExecContext(c, "DELETE FROM ownershipTransfers WHERE id = ?", transfer.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+		log.WithField("error", err).Error("[handleCancelOwnershipTransfer] Failed to delete transfer")
+		return
+	}
+
+	err = removeAlertsWithData(c, transfer.ToUserID, "ownershipTransfer", transfer.ID)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "transferID": transfer.ID}).Error("[handleCancelOwnershipTransfer] Failed to remove alert")
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// Returns the userID of the owner of a file or folder. If it doesn't exist, it returns errFileNotFound
+func getItemOwner(ctx context.Context, fileID string) (string, error) {
+	var owner string
+	err := db.QueryRowContext(ctx, "SELECT userID FROM files WHERE id = ?", fileID).Scan(&owner)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", errFileNotFound
+		}
+		return "", err
+	}
+	return owner, nil
+}
+
+func getOwnershipTransfer(ctx context.Context, transferID string) (OwnershipTransfer, error) {
+	var transfer OwnershipTransfer
+	err := db.QueryRowContext(ctx, "SELECT id, fileID, fromUserID, toUserID, createdDate FROM ownershipTransfers WHERE id = ?", transferID).Scan(&transfer.ID, &transfer.FileID, &transfer.FromUserID, &transfer.ToUserID, &transfer.CreatedDate)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return transfer, errTransferNotFound
+		}
+		return transfer, err
+	}
+	return transfer, nil
+}
+
+// Changes the owner of the item and of everything inside of it that the old owner owned, in a single transaction.
+// Items inside of the subtree that belong to other users are left alone.
+// Afterwards it schedules the re-encryption of the files and folder keys that the new owner can't decrypt yet.
+func transferOwnership(ctx context.Context, transfer OwnershipTransfer) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var owner string
+	err = tx.QueryRowContext(ctx, "SELECT userID FROM files WHERE id = ? FOR UPDATE", transfer.FileID).Scan(&owner)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return errTransferOutdated
+		}
+		return fmt.Errorf("failed to get item owner. %w", err)
+	}
+
+	if owner != transfer.FromUserID {
+		return errTransferOutdated
+	}
+
+	items, err := getOwnedSubtree(ctx, tx, transfer.FileID, transfer.FromUserID)
+	if err != nil {
+		return fmt.Errorf("getOwnedSubtree error. %w", err)
+	}
+
+	for _, item := range items {
+		_, err = tx.ExecContext(ctx, "UPDATE files SET userID = ?, lastModified = now() WHERE id = ?", transfer.ToUserID, item.ID)
+		if err != nil {
+			return fmt.Errorf("failed to update owner of %s. %w", item.ID, err)
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE sharedFiles SET fileOwner = ?, lastModified = now() WHERE fileID = ?", transfer.ToUserID, item.ID)
+		if err != nil {
+			return fmt.Errorf("failed to update sharedFiles of %s. %w", item.ID, err)
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE sharedFilesGroups SET fileOwner = ?, lastModified = now() WHERE fileID = ?", transfer.ToUserID, item.ID)
+		if err != nil {
+			return fmt.Errorf("failed to update sharedFilesGroups of %s. %w", item.ID, err)
+		}
+
+		// The new owner doesn't need a share for their own items
+		_, err = tx.ExecContext(ctx, "DELETE FROM sharedFiles WHERE fileID = ? AND userID = ?", item.ID, transfer.ToUserID)
+		if err != nil {
+			return fmt.Errorf("failed to remove share of %s. %w", item.ID, err)
+		}
+
+		// The deduplicated object belongs to the file's owner, so that it isn't deleted with the old owner's account
+		if item.Type != "folder" {
+			_, err = tx.ExecContext(ctx, "UPDATE dedupObjects d INNER JOIN files f ON f.objKey = d.objKey SET d.userID = ? WHERE f.id = ?", transfer.ToUserID, item.ID)
+			if err != nil {
+				return fmt.Errorf("failed to update dedup object of %s. %w", item.ID, err)
+			}
+		}
+
+		if item.HasFolderKey {
+			_, err = tx.ExecContext(ctx, "UPDATE encryptionKeys SET userID = ? WHERE folderID = ?", transfer.ToUserID, item.ID)
+			if err != nil {
+				return fmt.Errorf("failed to update folder key of %s. %w", item.ID, err)
+			}
+		}
+	}
+
+	// The old parentDir belongs to the old owner
+	_, err = tx.ExecContext(ctx, "UPDATE files SET parentDir = ? WHERE id = ?", RootDirectoryID, transfer.FileID)
+	if err != nil {
+		return fmt.Errorf("failed to move the item. %w", err)
+	}
+
+	// The old owner keeps write access. Their devices are also the only ones that can do the re-encryption.
+	// The share is processed since their keys can already decrypt everything
+	shareID, err := getNewID()
+	if err != nil {
+		return fmt.Errorf("failed to get new ID. %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO sharedFiles (id, fileID, userID, fileOwner, isReadOnly, processed, createdDate) VALUES (?, ?, ?, ?, false, true, now()) ON DUPLICATE KEY UPDATE isReadOnly = false, processed = true, lastModified = now()", shareID, transfer.FileID, transfer.FromUserID, transfer.ToUserID)
+	if err != nil {
+		return fmt.Errorf("failed to share the item with the old owner. %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM ownershipTransfers WHERE id = ?", transfer.ID)
+	if err != nil {
+		return fmt.Errorf("failed to delete transfer. %w", err)
+	}
+
+	err = scheduleOwnershipReencryption(ctx, tx, items, transfer.FromUserID)
+	if err != nil {
+		return fmt.Errorf("scheduleOwnershipReencryption error. %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// Returns the item and every item inside of it that is owned by ownerUserID.
+// UnderFolderKey is true for the items that are inside of a folder with its own folder key, since those are not encrypted with the owner's key.
+func getOwnedSubtree(ctx context.Context, tx *sql.Tx, fileID, ownerUserID string) ([]SubtreeItem, error) {
+	root := SubtreeItem{ID: fileID}
+	err := tx.QueryRowContext(ctx, "SELECT f.type, k.folderID IS NOT NULL FROM files f LEFT JOIN encryptionKeys k ON k.folderID = f.id WHERE f.id = ? LIMIT 1", fileID).Scan(&root.Type, &root.HasFolderKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get item %s. %w", fileID, err)
+	}
+
+	items := []SubtreeItem{root}
+	for i := 0; i < len(items); i++ {
+		parent := items[i]
+		if parent.Type != "folder" {
+			continue
+		}
+
+		rows, err := tx.QueryContext(ctx, "SELECT DISTINCT f.id, f.type, k.folderID IS NOT NULL FROM files f LEFT JOIN encryptionKeys k ON k.folderID = f.id WHERE f.parentDir = ? AND f.userID = ?", parent.ID, ownerUserID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get items in %s. %w", parent.ID, err)
+		}
+
+		for rows.Next() {
+			child := SubtreeItem{UnderFolderKey: parent.UnderFolderKey || parent.HasFolderKey}
+			err := rows.Scan(&child.ID, &child.Type, &child.HasFolderKey)
+			if err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("rows.Scan error. %w", err)
+			}
+			items = append(items, child)
+		}
+
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("rows error. %w", err)
+		}
+	}
+
+	return items, nil
+}
+
+// Creates the re-encryption tasks for an ownership transfer. They are assigned to the old owner since only their keys can decrypt the data.
+// Folder keys have to be wrapped again for the new owner, and the files that are not under a folder key were encrypted with the old owner's key.
+func scheduleOwnershipReencryption(ctx context.Context, tx *sql.Tx, items []SubtreeItem, oldOwnerUserID string) error {
+	return scheduleSubtreeReencryption(ctx, tx, items, oldOwnerUserID, "ownershipTransfer")
+}
+
+// Creates a task for every folder key in the items and for every file that is not under one of them. userID is the user whose devices do them
+func scheduleSubtreeReencryption(ctx context.Context, tx *sql.Tx, items []SubtreeItem, userID, reason string) error {
+	for _, item := range items {
+		taskType := ""
+		if item.HasFolderKey {
+			taskType = ReencryptionTaskFolderKey
+		} else if item.Type != "folder" && !item.UnderFolderKey {
+			taskType = ReencryptionTaskFile
+		}
+
+		if taskType == "" {
+			continue
+		}
+
+		err := insertReencryptionTask(ctx, tx, item.ID, userID, taskType, reason, sql.NullString{}, sql.NullString{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// An item returned by getOwnedSubtree
+type SubtreeItem struct {
+	ID   string
+	Type string
+	// The item is a folder with its own folder key
+	HasFolderKey bool
+	// One of the folders above the item, inside of the subtree, has a folder key
+	UnderFolderKey bool
+}
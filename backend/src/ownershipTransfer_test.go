@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestTransferOwnership(t *testing.T) {
+	transfer := OwnershipTransfer{ID: "0196a5d1-3c2f-7b8e-a0d4-5e6f7a8b9c0d", FileID: "0196a5d1-3c2f-7b8e-a0d4-5e6f7a8b9c01", FromUserID: "testUser", ToUserID: "anotherTestUser"}
+	fileID := "0196a5d1-3c2f-7b8e-a0d4-5e6f7a8b9c02"
+
+	// A folder without a folder key, with one file inside
+	fake := useFakeDB(t,
+		fakeResponse{match: "SELECT userID FROM files WHERE id = ? FOR UPDATE", columns: []string{"userID"}, rows: [][]driver.Value{{"testUser"}}},
+		fakeResponse{match: "SELECT f.type, k.folderID IS NOT NULL FROM files f", columns: []string{"type", "hasFolderKey"}, rows: [][]driver.Value{{"folder", false}}},
+		fakeResponse{match: "SELECT DISTINCT f.id, f.type", columns: []string{"id", "type", "hasFolderKey"}, rows: [][]driver.Value{{fileID, "file", false}}},
+	)
+
+	err := transferOwnership(context.Background(), transfer)
+	if err != nil {
+		t.Fatalf("transferOwnership() returned %v", err)
+	}
+
+	if calls := fake.callsMatching("UPDATE files SET userID"); len(calls) != 2 {
+		t.Errorf("got %d owner updates, want 2", len(calls))
+	}
+
+	calls := fake.callsMatching("UPDATE dedupObjects")
+	if len(calls) != 1 || calls[0].args[0] != "anotherTestUser" || calls[0].args[1] != fileID {
+		t.Errorf("got dedup updates %v, want the file's object to be moved to the new owner", calls)
+	}
+
+	calls = fake.callsMatching("INSERT INTO reencryptionTasks")
+	if len(calls) != 1 || calls[0].args[1] != fileID || calls[0].args[2] != "testUser" || calls[0].args[3] != ReencryptionTaskFile {
+		t.Errorf("got tasks %v, want a file task for the old owner", calls)
+	}
+
+	calls = fake.callsMatching("INSERT INTO sharedFiles")
+	if len(calls) != 1 || calls[0].args[2] != "testUser" {
+		t.Errorf("got shares %v, want the old owner to keep access", calls)
+	}
+
+	// The old owner can already decrypt everything, the share must not hide the items from searchFiles
+	if len(calls) == 1 && !strings.Contains(calls[0].query, "processed = true") {
+		t.Errorf("got share %q, want it processed", calls[0].query)
+	}
+
+	if fake.commits != 1 {
+		t.Errorf("got %d commits, want 1", fake.commits)
+	}
+}
+
+func TestTransferOwnershipOutdated(t *testing.T) {
+	transfer := OwnershipTransfer{ID: "0196a5d1-3c2f-7b8e-a0d4-5e6f7a8b9c0d", FileID: "0196a5d1-3c2f-7b8e-a0d4-5e6f7a8b9c01", FromUserID: "testUser", ToUserID: "anotherTestUser"}
+
+	// The item was already given to someone else
+	fake := useFakeDB(t, fakeResponse{match: "SELECT userID FROM files WHERE id = ? FOR UPDATE", columns: []string{"userID"}, rows: [][]driver.Value{{"thirdUser"}}})
+
+	err := transferOwnership(context.Background(), transfer)
+	if !errors.Is(err, errTransferOutdated) {
+		t.Fatalf("transferOwnership() returned %v, want errTransferOutdated", err)
+	}
+
+	if calls := fake.callsMatching("UPDATE files SET"); len(calls) != 0 || fake.commits != 0 {
+		t.Errorf("an outdated transfer changed the DB: %v", calls)
+	}
+
+	// The item was deleted
+	useFakeDB(t)
+	err = transferOwnership(context.Background(), transfer)
+	if !errors.Is(err, errTransferOutdated) {
+		t.Errorf("transferOwnership() of a deleted item returned %v, want errTransferOutdated", err)
+	}
+}
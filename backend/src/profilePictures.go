@@ -1,15 +1,37 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
 	"net/http"
 	"os"
 	"strings"
 
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/image/draw"
+)
+
+var (
+	// The sizes in pixels that the profile pictures are stored in. They have to be sorted from smallest to biggest
+	profilePictureSizes = []int{64, 256, 512}
+)
+
+const (
+	// The size sent when the client doesn't specify one
+	DefaultProfilePictureSize = 256
+	// The format that the profile pictures are stored in
+	ProfilePictureFormat = "jpeg"
+	// The JPEG quality used for profile pictures
+	ProfilePictureJPEGQuality = 85
 )
 
 func handleGetProfilePicture(c *gin.Context) {
@@ -42,6 +64,22 @@ func handleGetProfilePicture(c *gin.Context) {
 		return
 	}
 
+	size := closestProfilePictureSize(request.Size)
+
+	allowed, err := canSeeProfilePicture(c, request.UserID, request.ForUserID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (6), Please try again later"})
+		log.WithField("error", err).Error("[handleGetProfilePicture] Failed to check the profile picture visibility")
+		return
+	}
+
+	if !allowed {
+		// Send the same placeholder as users without a profile picture
+		log.WithFields(log.Fields{"userID": request.UserID, "ForUserID": request.ForUserID}).Trace("[handleGetProfilePicture] Profile picture not visible, using default")
+		sendDefaultAvatar(c, request.ForUserID, size)
+		return
+	}
+
 	profilePictureID, err := getProfilePictureIDFromDB(c, request.ForUserID)
 	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
@@ -53,8 +91,8 @@ func handleGetProfilePicture(c *gin.Context) {
 
 	// profilePictureID is "default" when a user is created
 	if profilePictureID == "" || profilePictureID == "default" {
-		c.JSON(200, gin.H{"success": true, "profilePictureID": "default"})
 		log.Trace("[handleGetProfilePicture] No custom profile picture, using default")
+		sendDefaultAvatar(c, request.ForUserID, size)
 		return
 	}
 
@@ -66,20 +104,45 @@ func handleGetProfilePicture(c *gin.Context) {
 		return
 	}
 
-	file, err := getFile(c, s3Client, serverConfig.S3BucketName, profilePictureID)
+	objKey := profilePictureObjKey(profilePictureID, size)
+	file, err := getFile(c, s3Client, serverConfig.S3BucketName, objKey)
+	if err != nil {
+		// Profile pictures uploaded before they were resized only have the original
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			objKey = profilePictureID
+			file, err = getFile(c, s3Client, serverConfig.S3BucketName, objKey)
+		}
+	}
+
 	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"})
-		log.WithFields(log.Fields{"error": err, "profilePictureID": profilePictureID}).Error("[handleGetProfilePicture] Failed to get file")
+		log.WithFields(log.Fields{"error": err, "profilePictureID": profilePictureID, "objKey": objKey}).Error("[handleGetProfilePicture] Failed to get file")
 		return
 	}
 
-	filename := fmt.Sprintf("attachment; filename=\"%s\"", profilePictureID)
+	filename := fmt.Sprintf("attachment; filename=\"%s\"", objKey)
 	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Reference/Headers/Content-Disposition
 	extraHeaders := map[string]string{"Content-Disposition": filename, "Cache-Control": "public, max-age=604800"}
 	contentType := fmt.Sprintf("image/%s", partsOfID[1])
 	c.DataFromReader(http.StatusOK, int64(*file.ContentLength), contentType, file.Body, extraHeaders)
 }
 
+// Sends the generated avatar for the userID
+func sendDefaultAvatar(c *gin.Context, userID string, size int) {
+	avatar, err := generateDefaultAvatar(userID, size)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (5), Please try again later"})
+		log.WithFields(log.Fields{"error": err, "userID": userID}).Error("[sendDefaultAvatar] Failed to generate avatar")
+		return
+	}
+
+	filename := fmt.Sprintf("attachment; filename=\"default_%d.png\"", size)
+	c.Header("Content-Disposition", filename)
+	c.Header("Cache-Control", "public, max-age=604800")
+	c.Data(http.StatusOK, "image/png", avatar)
+}
+
 func handleUpdateProfilePicture(c *gin.Context) {
 	/*
 		curl -F "userID=testUser" -F "authToken=K1xS9ehuxeC5tw==" -F "file=@profilePicture.jpeg" localhost:9090/updateProfilePicture
@@ -179,16 +242,38 @@ func handleUpdateProfilePicture(c *gin.Context) {
 	c.JSON(200, gin.H{"success": true, "fileName": file.Filename, "bytesUploaded": file.Size, "profilePictureID": profilePictureID})
 
 	// delete the old profilePicture from S3
-	if OLDProfilePictureID != "" {
-		res, err := deleteFile(context.Background(), s3Client, serverConfig.S3BucketName, OLDProfilePictureID)
-		if err != nil {
-			log.WithFields(log.Fields{"err": err, "OLDProfilePictureID": OLDProfilePictureID, "res": res}).Error("[handleUpdateProfilePicture] Error deleting old profile picture")
-		}
+	if OLDProfilePictureID != "" && OLDProfilePictureID != "default" {
+		deleteProfilePicture(context.Background(), OLDProfilePictureID)
 	}
 
 	deleteLocalFile(filePath)
 }
 
+// Checks the profilePictureVisibility setting of forUserID to know if userID can see their profile picture.
+func canSeeProfilePicture(ctx context.Context, userID, forUserID string) (bool, error) {
+	if userID == forUserID {
+		return true, nil
+	}
+
+	settings, err := getUserSettings(ctx, forUserID)
+	if err != nil {
+		if errors.Is(err, errUserNotFound) {
+			// There is no profile picture to hide, the default one is sent
+			return true, nil
+		}
+		return false, fmt.Errorf("getUserSettings error. %w", err)
+	}
+
+	switch settings.ProfilePictureVisibility {
+	case VisibilityEveryone:
+		return true, nil
+	case VisibilityFriends:
+		return areFriends(ctx, userID, forUserID)
+	default:
+		return false, nil
+	}
+}
+
 // gets a user's profilePictureID from the DB.
 // if the user doesn't have a profile picture, it returns an empty string.
 func getProfilePictureIDFromDB(ctx context.Context, userID string) (string, error) {
@@ -227,3 +312,177 @@ func deleteLocalFile(filePath string) {
 
 	log.WithFields(log.Fields{"filePath": filePath}).Trace("[deleteLocalFile] deleted tmp file")
 }
+
+// Returns the profile picture size that should be sent when the client asks for requestedSize.
+// It is the smallest standard size that is at least requestedSize, or the biggest size available.
+// When requestedSize is 0, DefaultProfilePictureSize is used.
+func closestProfilePictureSize(requestedSize int) int {
+	if requestedSize <= 0 {
+		return DefaultProfilePictureSize
+	}
+
+	for _, size := range profilePictureSizes {
+		if size >= requestedSize {
+			return size
+		}
+	}
+
+	return profilePictureSizes[len(profilePictureSizes)-1]
+}
+
+// Returns the S3 objKey for a size of the profile picture.
+// The profilePictureID is <ID>.<format> and the objKey is <ID>_<size>.<format>
+func profilePictureObjKey(profilePictureID string, size int) string {
+	id, format, _ := strings.Cut(profilePictureID, ".")
+	return fmt.Sprintf("%s_%d.%s", id, size, format)
+}
+
+// Deletes every size of the profile picture from S3.
+// Profile pictures uploaded before they were resized only have one object with the profilePictureID as the objKey, it is also deleted.
+func deleteProfilePicture(ctx context.Context, profilePictureID string) {
+	objKeys := []string{profilePictureID}
+	for _, size := range profilePictureSizes {
+		objKeys = append(objKeys, profilePictureObjKey(profilePictureID, size))
+	}
+
+	for _, objKey := range objKeys {
+		res, err := deleteFile(ctx, s3Client, serverConfig.S3BucketName, objKey)
+		if err != nil {
+			log.WithFields(log.Fields{"err": err, "objKey": objKey, "res": res}).Error("[deleteProfilePicture] Error deleting profile picture")
+		}
+	}
+}
+
+// Decodes the image, crops it to a square in the center and returns it encoded as ProfilePictureFormat in each of the profilePictureSizes.
+// The result is a map with the size as the key.
+func resizeProfilePicture(buf []byte, mimeType string) (map[int][]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(buf))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image config: %w", err)
+	}
+
+	if config.Width*config.Height > MaxThumbnailSourcePixels {
+		return nil, errImageTooLarge
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	src = applyOrientation(src, readImageOrientation(buf, mimeType))
+
+	// The biggest square in the center of the image
+	bounds := src.Bounds()
+	side := min(bounds.Dx(), bounds.Dy())
+	x := bounds.Min.X + (bounds.Dx()-side)/2
+	y := bounds.Min.Y + (bounds.Dy()-side)/2
+	square := image.Rect(x, y, x+side, y+side)
+
+	sizes := map[int][]byte{}
+	for _, size := range profilePictureSizes {
+		dst := image.NewRGBA(image.Rect(0, 0, size, size))
+		// JPEG doesn't support transparency, use a white background
+		draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+		draw.CatmullRom.Scale(dst, dst.Bounds(), src, square, draw.Over, nil)
+
+		out := &bytes.Buffer{}
+		err = jpeg.Encode(out, dst, &jpeg.Options{Quality: ProfilePictureJPEGQuality})
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode the %dpx image: %w", size, err)
+		}
+		sizes[size] = out.Bytes()
+	}
+
+	return sizes, nil
+}
+
+// Returns the image rotated and flipped so that it is displayed the right way with the EXIF orientation removed.
+// Orientations that are not between 2 and 8 return the same image.
+func applyOrientation(src image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	// Orientations 5 to 8 swap the width and height
+	dstWidth, dstHeight := w, h
+	if orientation >= 5 {
+		dstWidth, dstHeight = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			var srcX, srcY int
+			switch orientation {
+			case 2:
+				// flip horizontally
+				srcX, srcY = w-1-x, y
+			case 3:
+				// rotate 180
+				srcX, srcY = w-1-x, h-1-y
+			case 4:
+				// flip vertically
+				srcX, srcY = x, h-1-y
+			case 5:
+				// transpose
+				srcX, srcY = y, x
+			case 6:
+				// rotate 90 clockwise
+				srcX, srcY = y, h-1-x
+			case 7:
+				// transverse
+				srcX, srcY = w-1-y, h-1-x
+			case 8:
+				// rotate 90 counterclockwise
+				srcX, srcY = w-1-y, x
+			}
+			dst.Set(x, y, src.At(bounds.Min.X+srcX, bounds.Min.Y+srcY))
+		}
+	}
+
+	return dst
+}
+
+// Generates a PNG avatar for users without a profile picture.
+// It is a symmetric 5x5 pattern with a color that both come from the hash of the userID, so it is always the same for a user.
+func generateDefaultAvatar(userID string, size int) ([]byte, error) {
+	hash := sha256.Sum256([]byte(userID))
+
+	// Keep the color between 64 and 191 so that it is not too dark or too light
+	foreground := color.RGBA{64 + hash[0]/2, 64 + hash[1]/2, 64 + hash[2]/2, 255}
+	background := color.RGBA{240, 240, 240, 255}
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{background}, image.Point{}, draw.Src)
+
+	// 5 cells with half a cell of margin on each side
+	cell := size / 6
+	margin := (size - 5*cell) / 2
+
+	for row := 0; row < 5; row++ {
+		for col := 0; col < 3; col++ {
+			// one bit of the hash for each cell of the left half
+			if hash[3+row*3+col]&1 == 0 {
+				continue
+			}
+
+			// mirror the left half to the right
+			for _, c := range []int{col, 4 - col} {
+				rect := image.Rect(margin+c*cell, margin+row*cell, margin+(c+1)*cell, margin+(row+1)*cell)
+				draw.Draw(img, rect, &image.Uniform{foreground}, image.Point{}, draw.Src)
+			}
+		}
+	}
+
+	out := &bytes.Buffer{}
+	err := png.Encode(out, img)
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestClosestProfilePictureSize(t *testing.T) {
+	items := map[int]int{0: DefaultProfilePictureSize, -5: DefaultProfilePictureSize, 1: 64, 64: 64, 65: 256, 200: 256, 256: 256, 300: 512, 512: 512, 4096: 512}
+
+	for key, value := range items {
+		result := closestProfilePictureSize(key)
+		if result != value {
+			t.Errorf("closestProfilePictureSize failed for value %d. Expected: %d got: %d", key, value, result)
+		}
+	}
+}
+
+func TestProfilePictureObjKey(t *testing.T) {
+	result := profilePictureObjKey("0195f78c-2487-75e7-b611-127b303d1e9e.jpeg", 64)
+	expected := "0195f78c-2487-75e7-b611-127b303d1e9e_64.jpeg"
+	if result != expected {
+		t.Errorf("profilePictureObjKey failed. Expected: %s got: %s", expected, result)
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// 2x1 image, red on the left and blue on the right
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, red)
+	src.Set(1, 0, blue)
+
+	// rotating 90 degrees clockwise puts red on the top
+	result := applyOrientation(src, 6)
+	if result.Bounds().Dx() != 1 || result.Bounds().Dy() != 2 {
+		t.Fatalf("wrong size after rotating. got: %v", result.Bounds())
+	}
+
+	if result.At(0, 0) != red || result.At(0, 1) != blue {
+		t.Error("wrong pixels after rotating 90 degrees clockwise")
+	}
+
+	// rotating 90 degrees counterclockwise puts blue on the top
+	result = applyOrientation(src, 8)
+	if result.At(0, 0) != blue || result.At(0, 1) != red {
+		t.Error("wrong pixels after rotating 90 degrees counterclockwise")
+	}
+
+	result = applyOrientation(src, 2)
+	if result.At(0, 0) != blue || result.At(1, 0) != red {
+		t.Error("wrong pixels after flipping horizontally")
+	}
+
+	if applyOrientation(src, 1) != image.Image(src) {
+		t.Error("orientation 1 changed the image")
+	}
+}
+
+func TestResizeProfilePicture(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 300, 200)))
+	if err != nil {
+		t.Fatalf("failed to encode test image: %v", err)
+	}
+
+	sizes, err := resizeProfilePicture(buf.Bytes(), "image/png")
+	if err != nil {
+		t.Fatalf("resizeProfilePicture failed: %v", err)
+	}
+
+	for _, size := range profilePictureSizes {
+		config, err := jpeg.DecodeConfig(bytes.NewReader(sizes[size]))
+		if err != nil {
+			t.Errorf("the %dpx image is not a valid JPEG: %v", size, err)
+			continue
+		}
+
+		if config.Width != size || config.Height != size {
+			t.Errorf("wrong size. Expected: %dx%d got: %dx%d", size, size, config.Width, config.Height)
+		}
+	}
+}
+
+func TestGenerateDefaultAvatar(t *testing.T) {
+	first, err := generateDefaultAvatar("testUser", 64)
+	if err != nil {
+		t.Fatalf("generateDefaultAvatar failed: %v", err)
+	}
+
+	second, _ := generateDefaultAvatar("testUser", 64)
+	if !bytes.Equal(first, second) {
+		t.Error("the avatar is not the same for the same user")
+	}
+
+	other, _ := generateDefaultAvatar("anotherTestUser", 64)
+	if bytes.Equal(first, other) {
+		t.Error("the avatar is the same for different users")
+	}
+
+	config, err := png.DecodeConfig(bytes.NewReader(first))
+	if err != nil {
+		t.Fatalf("the avatar is not a valid PNG: %v", err)
+	}
+
+	if config.Width != 64 || config.Height != 64 {
+		t.Errorf("wrong size. Expected: 64x64 got: %dx%d", config.Width, config.Height)
+	}
+}
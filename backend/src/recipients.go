@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// The public key is not an age X25519 recipient or a supported SSH key
+	errUnsupportedKeyType error = errors.New("unsupported public key type")
+)
+
+const (
+	// age1... recipients generated by age
+	KeyTypeX25519 = "X25519"
+	// SSH keys, as in an authorized_keys file. age encrypts to them with the agessh package
+	KeyTypeSSHEd25519 = "ssh-ed25519"
+	KeyTypeSSHRSA     = "ssh-rsa"
+	// The size of the publicKey column in encryptionKeys. It fits RSA keys of up to 4096 bits
+	MaxPublicKeyLength = 750
+)
+
+// Validates a public key sent by a client and returns it in the form that is stored in encryptionKeys, with its key type.
+// SSH keys are stored without the comment and the options, so the same key is always stored the same way.
+func parsePublicKey(publicKey string) (string, string, error) {
+	publicKey = strings.TrimSpace(publicKey)
+
+	if strings.HasPrefix(publicKey, "age1") {
+		recipient, err := age.ParseX25519Recipient(publicKey)
+		if err != nil {
+			return "", "", err
+		}
+		return recipient.String(), KeyTypeX25519, nil
+	}
+
+	sshKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return "", "", errUnsupportedKeyType
+	}
+
+	// agessh checks the key, e.g. that RSA keys have at least 2048 bits
+	switch sshKey.Type() {
+	case KeyTypeSSHEd25519:
+		_, err = agessh.NewEd25519Recipient(sshKey)
+	case KeyTypeSSHRSA:
+		_, err = agessh.NewRSARecipient(sshKey)
+	default:
+		return "", "", fmt.Errorf("%w: %s", errUnsupportedKeyType, sshKey.Type())
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	publicKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshKey)))
+	if len(publicKey) > MaxPublicKeyLength {
+		return "", "", fmt.Errorf("the public key is longer than %d characters", MaxPublicKeyLength)
+	}
+	return publicKey, sshKey.Type(), nil
+}
+
+// Returns the type of a public key stored in encryptionKeys. It is also the type of the age stanzas for the key
+func publicKeyType(publicKey string) string {
+	if strings.HasPrefix(publicKey, "age1") {
+		return KeyTypeX25519
+	}
+
+	keyType, _, _ := strings.Cut(publicKey, " ")
+	return keyType
+}
+
+// Returns the age recipient for a public key of any supported type
+func parseRecipient(publicKey string) (age.Recipient, error) {
+	switch publicKeyType(publicKey) {
+	case KeyTypeX25519:
+		return age.ParseX25519Recipient(publicKey)
+	case KeyTypeSSHEd25519, KeyTypeSSHRSA:
+		return agessh.ParseRecipient(publicKey)
+	default:
+		return nil, errUnsupportedKeyType
+	}
+}
+
+// Returns the age recipients for the public keys. It fails if any of them is not valid
+func parseRecipients(publicKeys []string) ([]age.Recipient, error) {
+	recipients := []age.Recipient{}
+	for _, publicKey := range publicKeys {
+		recipient, err := parseRecipient(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key %s. %w", publicKey, err)
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"golang.org/x/crypto/ssh"
+)
+
+// Returns a new ssh-ed25519 public key in the authorized_keys format, without a comment
+func newTestSSHKey(t *testing.T) string {
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sshKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshKey)))
+}
+
+func TestParsePublicKey(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	x25519Key := identity.Recipient().String()
+	ed25519Key := newTestSSHKey(t)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPublicKey, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKeyStr := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(rsaPublicKey)))
+
+	// input: expected key and type
+	items := map[string][2]string{
+		x25519Key:                           {x25519Key, KeyTypeX25519},
+		" " + x25519Key + "\n":              {x25519Key, KeyTypeX25519},
+		ed25519Key:                          {ed25519Key, KeyTypeSSHEd25519},
+		ed25519Key + " user@laptop":         {ed25519Key, KeyTypeSSHEd25519},
+		`no-pty ` + ed25519Key + " comment": {ed25519Key, KeyTypeSSHEd25519},
+		rsaKeyStr:                           {rsaKeyStr, KeyTypeSSHRSA},
+	}
+
+	for input, expected := range items {
+		publicKey, keyType, err := parsePublicKey(input)
+		if err != nil {
+			t.Errorf("parsePublicKey failed for %q. %v", input, err)
+			continue
+		}
+
+		if publicKey != expected[0] || keyType != expected[1] {
+			t.Errorf("parsePublicKey failed for %q. Expected: %q %s got: %q %s", input, expected[0], expected[1], publicKey, keyType)
+		}
+
+		if publicKeyType(publicKey) != keyType {
+			t.Errorf("publicKeyType failed for %q. Expected: %s got: %s", publicKey, keyType, publicKeyType(publicKey))
+		}
+	}
+}
+
+func TestParsePublicKeyInvalid(t *testing.T) {
+	smallRSAKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smallRSAPublicKey, err := ssh.NewPublicKey(&smallRSAKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items := []string{
+		"",
+		"age1",
+		"age1pkl3nxgdqlfe35g6x96spkvqf0ru8me2nhp5vcqeg5p5wthmuerqss6agX",
+		"ssh-ed25519 AAAA",
+		"ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBEmKSENjQEezOmxkZMy7opKgwFB9nkt5YRrYMjNuG5N87uRgg6CLrbo5wAdT/y6v0mKV0U2w0WZ2YB/++Tpockg=",
+		string(ssh.MarshalAuthorizedKey(smallRSAPublicKey)),
+	}
+
+	for _, item := range items {
+		_, _, err := parsePublicKey(item)
+		if err == nil {
+			t.Errorf("parsePublicKey didn't fail for %q", item)
+		}
+	}
+
+	_, err = parseRecipient("ecdsa-sha2-nistp256 AAAA")
+	if !errors.Is(err, errUnsupportedKeyType) {
+		t.Errorf("parseRecipient should fail with errUnsupportedKeyType. Got: %v", err)
+	}
+}
+
+func TestParseRecipientsSSH(t *testing.T) {
+	publicKey, secretKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recipients, err := parseRecipients([]string{strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshKey)))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted := &bytes.Buffer{}
+	w, err := age.Encrypt(encrypted, recipients...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := agessh.NewEd25519Identity(secretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := age.Decrypt(encrypted, identity)
+	if err != nil {
+		t.Fatalf("Failed to decrypt with the SSH key. %v", err)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "hello" {
+		t.Errorf("Decrypted data doesn't match. Got: %q", data)
+	}
+}
@@ -0,0 +1,642 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// The task doesn't exist or is assigned to another user
+	errTaskNotFound error = errors.New("re-encryption task not found")
+	// The file has a thumbnail and it wasn't sent with the file
+	errThumbnailRequired error = errors.New("the thumbnail has to be encrypted again and sent with the file")
+)
+
+const (
+	// The file was encrypted with the old owner's key and has to be encrypted again
+	ReencryptionTaskFile = "file"
+	// The folder key has to be encrypted again with the current recipients
+	ReencryptionTaskFolderKey = "folderKey"
+	// The maximum number of tasks returned by getReencryptionTasks in one call
+	MaxReencryptionTasks = 100
+)
+
+// Returns the re-encryption tasks assigned to the user, with the public keys that each item has to be encrypted with.
+// The tasks are created when an item is shared or its owner changes, since only the clients can decrypt the files and folder keys.
+func handleGetReencryptionTasks(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/getReencryptionTasks" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","limit": 50}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request GetReencryptionTasksRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleGetReencryptionTasks] Failed to decode JSON")
+		return
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleGetReencryptionTasks] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	limit := request.Limit
+	if limit <= 0 || limit > MaxReencryptionTasks {
+		limit = MaxReencryptionTasks
+	}
+
+	tasks, err := getReencryptionTasks(c, request.UserID, limit)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleGetReencryptionTasks] Failed to get tasks")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "tasks": tasks})
+}
+
+// Receives the item of a task encrypted again by the client. For file tasks, the thumbnail has to be sent too if the file has one,
+// so that the new recipients can decrypt it. Once every task of a share is done, the share is marked as processed.
+func handleCompleteReencryptionTask(c *gin.Context) {
+	/*
+		curl -F "userID=testUser" -F "authToken=K1xS9ehuxeC5tw==" -F "taskID=0195ddc2-dba1-7b94-acbb-b360f88dd9d6" -F "file=@file.age" -F "thumbnail=@thumbnail.age" localhost:9090/completeReencryptionTask
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	userID := c.PostForm("userID")
+	authToken := c.PostForm("authToken")
+	taskID := c.PostForm("taskID")
+	if userID == "" || authToken == "" {
+		c.JSON(400, gin.H{"success": false, "error": "Authentication Missing"})
+		return
+	}
+
+	valid, err := isAuthTokenValid(c, userID, authToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleCompleteReencryptionTask] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	task, err := getReencryptionTask(c, taskID, userID)
+	if err != nil {
+		if errors.Is(err, errTaskNotFound) {
+			c.JSON(404, gin.H{"success": false, "error": "Task not found"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleCompleteReencryptionTask] Failed to get task")
+		return
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "No file received"})
+		return
+	}
+
+	filePath := fmt.Sprintf("%s%s_task", serverConfig.TMPStorageDir, task.ID)
+	err = c.SaveUploadedFile(file, filePath)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithFields(log.Fields{"error": err, "filePath": filePath}).Error("[handleCompleteReencryptionTask] Error saving uploaded file")
+		return
+	}
+	defer deleteLocalFile(filePath)
+
+	if task.TaskType == ReencryptionTaskFolderKey {
+		err = updateFolderKey(c, task.FileID, userID, filePath)
+	} else {
+		thumbnailPath := ""
+		thumbnail, thumbnailErr := c.FormFile("thumbnail")
+		if thumbnailErr == nil {
+			thumbnailPath = fmt.Sprintf("%s%s_taskThumbnail", serverConfig.TMPStorageDir, task.ID)
+			err = c.SaveUploadedFile(thumbnail, thumbnailPath)
+			if err != nil {
+				c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+				log.WithFields(log.Fields{"error": err, "filePath": thumbnailPath}).Error("[handleCompleteReencryptionTask] Error saving uploaded thumbnail")
+				return
+			}
+			defer deleteLocalFile(thumbnailPath)
+		}
+
+		err = replaceFileObjects(c, task.FileID, filePath, thumbnailPath)
+	}
+
+	if err != nil {
+		if errors.Is(err, errInvalidAgeHeader) || errors.Is(err, errWrongRecipients) || errors.Is(err, errThumbnailRequired) {
+			c.JSON(400, gin.H{"success": false, "error": err.Error()})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"})
+		log.WithFields(log.Fields{"error": err, "taskID": task.ID}).Error("[handleCompleteReencryptionTask] Failed to replace item")
+		return
+	}
+
+	err = finishReencryptionTasks(c, task.FileID, task.TaskType, userID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (5), Please try again later"})
+		log.WithFields(log.Fields{"error": err, "taskID": task.ID}).Error("[handleCompleteReencryptionTask] Failed to finish tasks")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// Inserts a re-encryption task. userID is the user whose devices have to do it.
+// sharedFileID or sharedFileGroupID is the share that is waiting for it, if it was created by a share.
+func insertReencryptionTask(ctx context.Context, tx *sql.Tx, fileID, userID, taskType, reason string, sharedFileID, sharedFileGroupID sql.NullString) error {
+	taskID, err := getNewID()
+	if err != nil {
+		return fmt.Errorf("failed to get new ID. %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO reencryptionTasks (id, fileID, userID, taskType, reason, sharedFileID, sharedFileGroupID, createdDate) VALUES (?, ?, ?, ?, ?, ?, ?, now())", taskID.String(), fileID, userID, taskType, reason, sharedFileID, sharedFileGroupID)
+	if err != nil {
+		return fmt.Errorf("failed to insert task for %s. %w", fileID, err)
+	}
+	return nil
+}
+
+// Creates the re-encryption tasks for new shares of an item. They are assigned to the owner since only their devices can decrypt everything.
+// If the item is inside of a folder with a folder key, only that folder key has to be wrapped again.
+// Otherwise every file owned by the owner inside of it is re-encrypted and every folder key inside of it is wrapped again.
+// The shares that don't need any work are marked as processed right away.
+// sharedFileIDs are the new shares with users and sharedFileGroupIDs the new shares with groups.
+// The tasks are added in tx, the same transaction as the shares.
+func scheduleShareReencryption(ctx context.Context, tx *sql.Tx, fileID, ownerUserID string, sharedFileIDs, sharedFileGroupIDs []string) error {
+	if len(sharedFileIDs) == 0 && len(sharedFileGroupIDs) == 0 {
+		return nil
+	}
+
+	keyFolderID, err := getFolderKeyFolder(ctx, tx, fileID)
+	if err != nil {
+		return fmt.Errorf("getFolderKeyFolder error. %w", err)
+	}
+
+	// The fileID and taskType of each task
+	tasks := [][2]string{}
+	if keyFolderID != "" {
+		tasks = append(tasks, [2]string{keyFolderID, ReencryptionTaskFolderKey})
+	} else {
+		items, err := getOwnedSubtree(ctx, tx, fileID, ownerUserID)
+		if err != nil {
+			return fmt.Errorf("getOwnedSubtree error. %w", err)
+		}
+
+		for _, item := range items {
+			if item.HasFolderKey {
+				tasks = append(tasks, [2]string{item.ID, ReencryptionTaskFolderKey})
+			} else if item.Type != "folder" && !item.UnderFolderKey {
+				tasks = append(tasks, [2]string{item.ID, ReencryptionTaskFile})
+			}
+		}
+	}
+
+	for _, sharedFileID := range sharedFileIDs {
+		if len(tasks) == 0 {
+			_, err = tx.ExecContext(ctx, "UPDATE sharedFiles SET processed = true WHERE id = ?", sharedFileID)
+			if err != nil {
+				return fmt.Errorf("failed to mark share as processed. %w", err)
+			}
+			continue
+		}
+
+		for _, task := range tasks {
+			err = insertReencryptionTask(ctx, tx, task[0], ownerUserID, task[1], "share", sql.NullString{String: sharedFileID, Valid: true}, sql.NullString{})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, sharedFileGroupID := range sharedFileGroupIDs {
+		if len(tasks) == 0 {
+			_, err = tx.ExecContext(ctx, "UPDATE sharedFilesGroups SET processed = true WHERE id = ?", sharedFileGroupID)
+			if err != nil {
+				return fmt.Errorf("failed to mark group share as processed. %w", err)
+			}
+			continue
+		}
+
+		for _, task := range tasks {
+			err = insertReencryptionTask(ctx, tx, task[0], ownerUserID, task[1], "share", sql.NullString{}, sql.NullString{String: sharedFileGroupID, Valid: true})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Marks the shares as processed, for shares where the recipient can already decrypt everything
+func markSharesProcessed(ctx context.Context, e execer, sharedFileIDs []string) error {
+	for _, sharedFileID := range sharedFileIDs {
+		_, err := e.ExecContext(ctx, "UPDATE sharedFiles SET processed = true WHERE id = ?", sharedFileID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Like markSharesProcessed, for shares with groups
+func markGroupSharesProcessed(ctx context.Context, e execer, sharedFileGroupIDs []string) error {
+	for _, sharedFileGroupID := range sharedFileGroupIDs {
+		_, err := e.ExecContext(ctx, "UPDATE sharedFilesGroups SET processed = true WHERE id = ?", sharedFileGroupID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Implemented by *sql.DB and *sql.Tx, for the queries that are used inside and outside of transactions
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Implemented by *sql.DB and *sql.Tx, for the statements that are used inside and outside of transactions
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// Returns the closest folder with a folder key, starting with the item itself, or an empty string if there is none.
+func getFolderKeyFolder(ctx context.Context, q rowQuerier, fileID string) (string, error) {
+	var folderID string
+	err := q.QueryRowContext(ctx, `
+		WITH RECURSIVE ancestors (id, parentDir, depth) AS (
+			SELECT id, parentDir, 0 FROM files WHERE id = ?
+			UNION ALL
+			SELECT f.id, f.parentDir, a.depth + 1 FROM files f INNER JOIN ancestors a ON f.id = a.parentDir
+		)
+		SELECT a.id FROM ancestors a INNER JOIN encryptionKeys k ON k.folderID = a.id ORDER BY a.depth LIMIT 1`, fileID).Scan(&folderID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return folderID, err
+}
+
+// Returns true if the item is shared with the user or one of their groups, directly or with a parentDir, by a share that still has re-encryption tasks.
+// The user can't decrypt the item until the owner's device finishes them.
+func hasPendingShare(ctx context.Context, fileID, userID string) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx, `
+		WITH RECURSIVE ancestors (id, parentDir) AS (
+			SELECT id, parentDir FROM files WHERE id = ?
+			UNION ALL
+			SELECT f.id, f.parentDir FROM files f INNER JOIN ancestors a ON f.id = a.parentDir
+		)
+		SELECT
+			(SELECT COUNT(*) FROM sharedFiles s INNER JOIN ancestors a ON s.fileID = a.id
+			WHERE s.userID = ? AND s.processed = false AND EXISTS (SELECT 1 FROM reencryptionTasks t WHERE t.sharedFileID = s.id))
+			+ (SELECT COUNT(*) FROM sharedFilesGroups s INNER JOIN ancestors a ON s.fileID = a.id INNER JOIN userGroupMembers m ON s.groupID = m.groupID
+			WHERE m.userID = ? AND s.processed = false AND EXISTS (SELECT 1 FROM reencryptionTasks t WHERE t.sharedFileGroupID = s.id))`, fileID, userID, userID).Scan(&count)
+	return count > 0, err
+}
+
+// Returns true if the user has to encrypt the file again
+func hasFileReencryptionTask(ctx context.Context, fileID, userID string) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM reencryptionTasks WHERE fileID = ? AND userID = ? AND taskType = ?", fileID, userID, ReencryptionTaskFile).Scan(&count)
+	return count > 0, err
+}
+
+// Returns the public keys that a file has to be encrypted with: the key of the closest folder key,
+// or every active key of the owners and of the users with access when it is not inside of a folder with a folder key.
+func getFileRecipients(ctx context.Context, fileID string) ([]string, error) {
+	var parentDir, owner string
+	err := db.QueryRowContext(ctx, "SELECT parentDir, userID FROM files WHERE id = ?", fileID).Scan(&parentDir, &owner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the file. %w", err)
+	}
+
+	keyFolderID, err := getFolderKeyFolder(ctx, db, parentDir)
+	if err != nil {
+		return nil, fmt.Errorf("getFolderKeyFolder error. %w", err)
+	}
+
+	if keyFolderID != "" {
+		return getPublicKeysForDirectory(ctx, keyFolderID, owner, 0)
+	}
+	return getUsersPublicKeys(ctx, fileID, owner)
+}
+
+// Returns the public keys that a new file of userID in dirID has to be encrypted with.
+// They are the same ones that getFileRecipients returns once the file is in the DB, so that clients can encrypt uploads for them.
+func getUploadRecipients(ctx context.Context, dirID, userID string) ([]string, error) {
+	if dirID == RootDirectoryID {
+		return getActivePublicKeysForUser(ctx, userID)
+	}
+
+	keyFolderID, err := getFolderKeyFolder(ctx, db, dirID)
+	if err != nil {
+		return nil, fmt.Errorf("getFolderKeyFolder error. %w", err)
+	}
+
+	if keyFolderID != "" {
+		return getPublicKeysForDirectory(ctx, keyFolderID, userID, 0)
+	}
+	return getUsersPublicKeys(ctx, dirID, userID)
+}
+
+// Returns every active key of userID, of the owners of the item and of the folders above it, and of the users that they are shared with
+func getUsersPublicKeys(ctx context.Context, fileID, userID string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		WITH RECURSIVE ancestors (id, parentDir, userID, depth) AS (
+			SELECT id, parentDir, userID, 0 FROM files WHERE id = ?
+			UNION ALL
+			SELECT f.id, f.parentDir, f.userID, a.depth + 1 FROM files f INNER JOIN ancestors a ON f.id = a.parentDir
+		)
+		SELECT userID FROM ancestors GROUP BY userID ORDER BY MIN(depth)`, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the owners. %w", err)
+	}
+	defer rows.Close()
+
+	userIDs := []string{userID}
+	for rows.Next() {
+		var owner string
+		if err := rows.Scan(&owner); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(userIDs, owner) {
+			userIDs = append(userIDs, owner)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	permissions, err := getUsersWithFileAccess(ctx, fileID, 0, nil)
+	if err != nil {
+		return nil, fmt.Errorf("getUsersWithFileAccess error. %w", err)
+	}
+
+	for _, perm := range permissions {
+		if !slices.Contains(userIDs, perm.UserID) {
+			userIDs = append(userIDs, perm.UserID)
+		}
+	}
+
+	publicKeys := []string{}
+	for _, user := range userIDs {
+		userKeys, err := getActivePublicKeysForUser(ctx, user)
+		if err != nil {
+			return nil, fmt.Errorf("getActivePublicKeysForUser error. %w", err)
+		}
+
+		for _, publicKey := range userKeys {
+			if !slices.Contains(publicKeys, publicKey) {
+				publicKeys = append(publicKeys, publicKey)
+			}
+		}
+	}
+	return publicKeys, nil
+}
+
+// Returns up to limit tasks of the user. Tasks for the same item are merged since one upload completes all of them.
+func getReencryptionTasks(ctx context.Context, userID string, limit int) ([]ReencryptionTask, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT MIN(t.id), t.fileID, t.taskType, MIN(t.reason), IFNULL(f.objKey, ''), IFNULL(f.thumbnailObjKey, '')
+		FROM reencryptionTasks t INNER JOIN files f ON f.id = t.fileID
+		WHERE t.userID = ?
+		GROUP BY t.fileID, t.taskType, f.objKey, f.thumbnailObjKey
+		ORDER BY MIN(t.createdDate)
+		LIMIT ?`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Initialize an empty array so that the json returns an empty array instead of null.
+	tasks := []ReencryptionTask{}
+	for rows.Next() {
+		var task ReencryptionTask
+		if err := rows.Scan(&task.ID, &task.FileID, &task.TaskType, &task.Reason, &task.ObjKey, &task.ThumbnailObjKey); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range tasks {
+		if tasks[i].TaskType == ReencryptionTaskFolderKey {
+			tasks[i].ObjKey = folderKeyObjKey(tasks[i].FileID)
+			tasks[i].ThumbnailObjKey = ""
+			tasks[i].Recipients, err = getFolderKeyPublicKeys(ctx, tasks[i].FileID)
+		} else {
+			tasks[i].Recipients, err = getFileRecipients(ctx, tasks[i].FileID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the recipients of %s. %w", tasks[i].FileID, err)
+		}
+	}
+	return tasks, nil
+}
+
+// Returns the task if it is assigned to the user, otherwise errTaskNotFound
+func getReencryptionTask(ctx context.Context, taskID, userID string) (ReencryptionTask, error) {
+	var task ReencryptionTask
+	err := db.QueryRowContext(ctx, "SELECT id, fileID, taskType, reason FROM reencryptionTasks WHERE id = ? AND userID = ?", taskID, userID).Scan(&task.ID, &task.FileID, &task.TaskType, &task.Reason)
+	if errors.Is(err, sql.ErrNoRows) {
+		return task, errTaskNotFound
+	}
+	return task, err
+}
+
+// Replaces the file and its thumbnail with the versions encrypted again by the client. They keep the same objKeys,
+// unless the object is shared with other files by dedup. Then the file gets a new object and the others keep the old one.
+// If the file has a thumbnail and thumbnailPath is empty, it returns errThumbnailRequired and nothing is replaced.
+func replaceFileObjects(ctx context.Context, fileID, filePath, thumbnailPath string) error {
+	var objKey, thumbnailObjKey string
+	err := db.QueryRowContext(ctx, "SELECT objKey, IFNULL(thumbnailObjKey, '') FROM files WHERE id = ?", fileID).Scan(&objKey, &thumbnailObjKey)
+	if err != nil {
+		return fmt.Errorf("failed to get the objKeys. %w", err)
+	}
+
+	if thumbnailObjKey != "" && thumbnailPath == "" {
+		return errThumbnailRequired
+	}
+
+	publicKeys, err := getFileRecipients(ctx, fileID)
+	if err != nil {
+		return err
+	}
+
+	if thumbnailObjKey != "" {
+		_, err = replaceObject(ctx, thumbnailObjKey, thumbnailPath, publicKeys)
+		if err != nil {
+			return fmt.Errorf("failed to replace the thumbnail. %w", err)
+		}
+	}
+
+	shared, err := detachDedupObject(ctx, objKey)
+	if err != nil {
+		return fmt.Errorf("detachDedupObject error. %w", err)
+	}
+
+	if !shared {
+		_, err = replaceObject(ctx, objKey, filePath, publicKeys)
+		return err
+	}
+
+	newObjKey, err := getNewID()
+	if err != nil {
+		return fmt.Errorf("failed to get a new objKey. %w", err)
+	}
+
+	checksum, err := replaceObject(ctx, newObjKey.String(), filePath, publicKeys)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE files SET objKey = ?, ciphertextSHA256 = ?, checksumVerifiedDate = NULL, checksumMismatch = false WHERE id = ?", newObjKey.String(), checksum, fileID)
+	if err != nil {
+		// Don't keep an object that no file uses
+		deleteFile(ctx, s3Client, serverConfig.S3BucketName, newObjKey.String())
+		return fmt.Errorf("failed to update the objKey. %w", err)
+	}
+
+	// The other files keep the old object, it is deleted if they were removed in the meantime
+	err = deleteFileObject(ctx, objKey)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "objKey": objKey}).Error("[replaceFileObjects] Failed to release the old object")
+	}
+	return nil
+}
+
+// Checks that the age file at filePath is encrypted for the public keys and uploads it to objKey. Returns the checksum of the file
+func replaceObject(ctx context.Context, objKey, filePath string, publicKeys []string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open the file. %w", err)
+	}
+	defer file.Close()
+
+	err = checkAgeRecipients(file, publicKeys)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to seek the file. %w", err)
+	}
+
+	checksum, err := hashFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = uploadFile(ctx, s3Client, serverConfig.S3BucketName, file, objKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload the file. %w", err)
+	}
+
+	// Only files have a checksum, nothing is updated for thumbnails and folder keys
+	err = setCiphertextChecksum(ctx, objKey, checksum)
+	if err != nil {
+		return "", fmt.Errorf("setCiphertextChecksum error. %w", err)
+	}
+
+	return checksum, recordObjectRecipients(ctx, objKey, publicKeys)
+}
+
+// Deletes every task of the user for the item and type, and marks the shares that were waiting only for them as processed.
+// A copy that was waiting for its file tasks is marked as processed too.
+func finishReencryptionTasks(ctx context.Context, fileID, taskType, userID string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, "SELECT DISTINCT sharedFileID, sharedFileGroupID FROM reencryptionTasks WHERE fileID = ? AND taskType = ? AND userID = ? AND (sharedFileID IS NOT NULL OR sharedFileGroupID IS NOT NULL)", fileID, taskType, userID)
+	if err != nil {
+		return fmt.Errorf("failed to get the shares. %w", err)
+	}
+
+	sharedFileIDs := []string{}
+	sharedFileGroupIDs := []string{}
+	for rows.Next() {
+		var sharedFileID, sharedFileGroupID sql.NullString
+		if err := rows.Scan(&sharedFileID, &sharedFileGroupID); err != nil {
+			rows.Close()
+			return err
+		}
+
+		if sharedFileID.Valid {
+			sharedFileIDs = append(sharedFileIDs, sharedFileID.String)
+		}
+		if sharedFileGroupID.Valid {
+			sharedFileGroupIDs = append(sharedFileGroupIDs, sharedFileGroupID.String)
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM reencryptionTasks WHERE fileID = ? AND taskType = ? AND userID = ?", fileID, taskType, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete the tasks. %w", err)
+	}
+
+	if taskType == ReencryptionTaskFile {
+		_, err = tx.ExecContext(ctx, "UPDATE files SET processed = true WHERE id = ? AND NOT EXISTS (SELECT 1 FROM reencryptionTasks WHERE fileID = ? AND taskType = ?)", fileID, fileID, ReencryptionTaskFile)
+		if err != nil {
+			return fmt.Errorf("failed to mark the file as processed. %w", err)
+		}
+	}
+
+	for _, sharedFileID := range sharedFileIDs {
+		_, err = tx.ExecContext(ctx, "UPDATE sharedFiles SET processed = true WHERE id = ? AND NOT EXISTS (SELECT 1 FROM reencryptionTasks WHERE sharedFileID = ?)", sharedFileID, sharedFileID)
+		if err != nil {
+			return fmt.Errorf("failed to mark share as processed. %w", err)
+		}
+	}
+
+	for _, sharedFileGroupID := range sharedFileGroupIDs {
+		_, err = tx.ExecContext(ctx, "UPDATE sharedFilesGroups SET processed = true WHERE id = ? AND NOT EXISTS (SELECT 1 FROM reencryptionTasks WHERE sharedFileGroupID = ?)", sharedFileGroupID, sharedFileGroupID)
+		if err != nil {
+			return fmt.Errorf("failed to mark group share as processed. %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// Answers every query for the public keys of a user with the next key
+func userKeyResponses(publicKeys ...string) []fakeResponse {
+	responses := []fakeResponse{}
+	for _, publicKey := range publicKeys {
+		responses = append(responses, fakeResponse{match: "SELECT publicKey FROM encryptionKeys WHERE userID", columns: []string{"publicKey"}, rows: [][]driver.Value{{publicKey}}, once: true})
+	}
+	return responses
+}
+
+func TestReplaceFileObjectsRequiresThumbnail(t *testing.T) {
+	useFakeDB(t, fakeResponse{match: "SELECT objKey, IFNULL(thumbnailObjKey", columns: []string{"objKey", "thumbnailObjKey"}, rows: [][]driver.Value{{"object", "thumbnail"}}})
+
+	err := replaceFileObjects(context.Background(), "file", "file.age", "")
+	if !errors.Is(err, errThumbnailRequired) {
+		t.Errorf("replaceFileObjects() without the thumbnail = %v, want errThumbnailRequired", err)
+	}
+}
+
+func TestGetFileRecipientsSharedFolder(t *testing.T) {
+	// anotherTestUser uploaded a file to a folder of testUser that is shared with thirdUser. There is no folder key
+	responses := []fakeResponse{
+		{match: "SELECT parentDir, userID FROM files", columns: []string{"parentDir", "userID"}, rows: [][]driver.Value{{"sharedFolder", "anotherTestUser"}}},
+		{match: "SELECT userID FROM ancestors", columns: []string{"userID"}, rows: [][]driver.Value{{"anotherTestUser"}, {"testUser"}}},
+		// The file itself is not shared, the folder is
+		{match: "select userID, isReadOnly from sharedFiles", columns: []string{"userID", "isReadOnly"}, once: true},
+		{match: "select userID, isReadOnly from sharedFiles", columns: []string{"userID", "isReadOnly"}, rows: [][]driver.Value{{"thirdUser", true}}},
+		{match: "select parentDir from files", columns: []string{"parentDir"}, rows: [][]driver.Value{{"sharedFolder"}}, once: true},
+		{match: "select parentDir from files", columns: []string{"parentDir"}, rows: [][]driver.Value{{RootDirectoryID}}},
+	}
+	useFakeDB(t, append(responses, userKeyResponses("age1uploader", "age1owner", "age1sharee")...)...)
+
+	publicKeys, err := getFileRecipients(context.Background(), "file")
+	if err != nil {
+		t.Fatalf("getFileRecipients() returned %v", err)
+	}
+
+	expected := []string{"age1uploader", "age1owner", "age1sharee"}
+	if !slices.Equal(publicKeys, expected) {
+		t.Errorf("getFileRecipients() = %v, want %v", publicKeys, expected)
+	}
+}
+
+func TestGetFileRecipientsFolderKey(t *testing.T) {
+	useFakeDB(t,
+		fakeResponse{match: "SELECT parentDir, userID FROM files", columns: []string{"parentDir", "userID"}, rows: [][]driver.Value{{"sharedFolder", "anotherTestUser"}}},
+		fakeResponse{match: "INNER JOIN encryptionKeys k ON k.folderID = a.id", columns: []string{"id"}, rows: [][]driver.Value{{"keyFolder"}}},
+		fakeResponse{match: "SELECT publicKey FROM encryptionKeys WHERE folderID", columns: []string{"publicKey"}, rows: [][]driver.Value{{"age1folder"}}},
+	)
+
+	publicKeys, err := getFileRecipients(context.Background(), "file")
+	if err != nil {
+		t.Fatalf("getFileRecipients() returned %v", err)
+	}
+
+	if !slices.Equal(publicKeys, []string{"age1folder"}) {
+		t.Errorf("getFileRecipients() = %v, want only the folder key", publicKeys)
+	}
+}
+
+func TestGetUploadRecipientsRoot(t *testing.T) {
+	fake := useFakeDB(t, userKeyResponses("age1first", "age1second")...)
+
+	publicKeys, err := getUploadRecipients(context.Background(), RootDirectoryID, "testUser")
+	if err != nil || !slices.Equal(publicKeys, []string{"age1first"}) {
+		t.Errorf("getUploadRecipients(root) = %v %v, want the user's keys", publicKeys, err)
+	}
+
+	if calls := fake.callsMatching("ancestors"); len(calls) != 0 {
+		t.Errorf("nobody else has access to the root directory, got %v", calls)
+	}
+}
+
+func TestScheduleShareReencryption(t *testing.T) {
+	ctx := context.Background()
+
+	// A file that is not under a folder key is encrypted again for the new share
+	fake := useFakeDB(t, fakeResponse{match: "SELECT f.type, k.folderID IS NOT NULL FROM files f", columns: []string{"type", "hasFolderKey"}, rows: [][]driver.Value{{"text/plain", false}}})
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = scheduleShareReencryption(ctx, tx, "file", "testUser", []string{"share"}, nil)
+	if err != nil {
+		t.Fatalf("scheduleShareReencryption() returned %v", err)
+	}
+	tx.Commit()
+
+	calls := fake.callsMatching("INSERT INTO reencryptionTasks")
+	if len(calls) != 1 || calls[0].args[1] != "file" || calls[0].args[3] != ReencryptionTaskFile || calls[0].args[5] != "share" {
+		t.Errorf("got tasks %v, want a file task for the share", calls)
+	}
+
+	// Inside of a folder with a folder key, only the folder key is wrapped again
+	fake = useFakeDB(t, fakeResponse{match: "INNER JOIN encryptionKeys k ON k.folderID = a.id", columns: []string{"id"}, rows: [][]driver.Value{{"keyFolder"}}})
+	tx, err = db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = scheduleShareReencryption(ctx, tx, "file", "testUser", []string{"share"}, []string{"groupShare"})
+	if err != nil {
+		t.Fatalf("scheduleShareReencryption() returned %v", err)
+	}
+	tx.Commit()
+
+	calls = fake.callsMatching("INSERT INTO reencryptionTasks")
+	if len(calls) != 2 {
+		t.Fatalf("got %d tasks, want one for the group share and one for the share", len(calls))
+	}
+	for _, call := range calls {
+		if call.args[1] != "keyFolder" || call.args[3] != ReencryptionTaskFolderKey {
+			t.Errorf("got task %v, want a folder key task for keyFolder", call.args)
+		}
+	}
+
+	// The group share waits for its own task like the share with a user
+	if calls[1].args[5] != nil || calls[1].args[6] != "groupShare" {
+		t.Errorf("got task %v, want it linked to the group share", calls[1].args)
+	}
+
+	// A folder without files to encrypt again, the group share can be used right away
+	fake = useFakeDB(t, fakeResponse{match: "SELECT f.type, k.folderID IS NOT NULL FROM files f", columns: []string{"type", "hasFolderKey"}, rows: [][]driver.Value{{"folder", false}}})
+	tx, err = db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = scheduleShareReencryption(ctx, tx, "folder", "testUser", nil, []string{"groupShare"})
+	if err != nil {
+		t.Fatalf("scheduleShareReencryption() returned %v", err)
+	}
+	tx.Commit()
+
+	if calls := fake.callsMatching("UPDATE sharedFilesGroups SET processed = true"); len(calls) != 1 || calls[0].args[0] != "groupShare" {
+		t.Errorf("got %v, want the group share marked as processed", calls)
+	}
+}
+
+func TestFinishReencryptionTasksProcessesGroupShare(t *testing.T) {
+	fake := useFakeDB(t, fakeResponse{match: "SELECT DISTINCT sharedFileID, sharedFileGroupID", columns: []string{"sharedFileID", "sharedFileGroupID"}, rows: [][]driver.Value{{nil, "groupShare"}}})
+
+	err := finishReencryptionTasks(context.Background(), "file", ReencryptionTaskFile, "testUser")
+	if err != nil {
+		t.Fatalf("finishReencryptionTasks() returned %v", err)
+	}
+
+	if calls := fake.callsMatching("UPDATE sharedFiles SET processed"); len(calls) != 0 {
+		t.Errorf("got %v, want no share with a user updated", calls)
+	}
+
+	calls := fake.callsMatching("UPDATE sharedFilesGroups SET processed = true")
+	if len(calls) != 1 || calls[0].args[0] != "groupShare" {
+		t.Errorf("got %v, want the group share marked as processed", calls)
+	}
+}
+
+func TestFinishReencryptionTasksProcessesCopy(t *testing.T) {
+	fake := useFakeDB(t)
+
+	err := finishReencryptionTasks(context.Background(), "copy", ReencryptionTaskFile, "testUser")
+	if err != nil {
+		t.Fatalf("finishReencryptionTasks() returned %v", err)
+	}
+
+	calls := fake.callsMatching("UPDATE files SET processed = true")
+	if len(calls) != 1 || calls[0].args[0] != "copy" {
+		t.Errorf("got %v, want the copy marked as processed", calls)
+	}
+
+	// Folder keys are not files
+	fake = useFakeDB(t)
+	err = finishReencryptionTasks(context.Background(), "folder", ReencryptionTaskFolderKey, "testUser")
+	if err != nil {
+		t.Fatalf("finishReencryptionTasks() returned %v", err)
+	}
+
+	if calls := fake.callsMatching("UPDATE files SET processed"); len(calls) != 0 {
+		t.Errorf("got %v, want no file updated for a folder key", calls)
+	}
+}
+
+func TestGetObjectKeyCopyWaitingForTask(t *testing.T) {
+	responses := []fakeResponse{{match: "select userID, IFNULL(objKey, ''), processed from files", columns: []string{"userID", "objKey", "processed"}, rows: [][]driver.Value{{"testUser", "object", false}}}}
+
+	// Only the devices that encrypt it again can download it
+	useFakeDB(t, append(responses, fakeResponse{match: "SELECT COUNT(*) FROM reencryptionTasks WHERE fileID", columns: []string{"count"}, rows: [][]driver.Value{{1}}})...)
+	objKey, err := getObjectKey(context.Background(), "copy", "testUser", true)
+	if err != nil || objKey != "object" {
+		t.Errorf("getObjectKey() with a task = %q %v, want the object", objKey, err)
+	}
+
+	useFakeDB(t, append(responses, fakeResponse{match: "SELECT COUNT(*) FROM reencryptionTasks WHERE fileID", columns: []string{"count"}, rows: [][]driver.Value{{0}}})...)
+	_, err = getObjectKey(context.Background(), "copy", "testUser", true)
+	if !errors.Is(err, errFileProcessing) {
+		t.Errorf("getObjectKey() without a task = %v, want errFileProcessing", err)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// User not found in the users table error
+	errUserNotFound error = errors.New("user not found")
+	// Error returned when a setting has a value that is not allowed
+	errInvalidSetting error = errors.New("invalid setting value")
+	// The values allowed for profilePictureVisibility
+	profilePictureVisibilityOptions = []string{VisibilityEveryone, VisibilityFriends, VisibilityNobody}
+)
+
+const (
+	// Everyone can see it
+	VisibilityEveryone = "everyone"
+	// Only the user's friends can see it
+	VisibilityFriends = "friends"
+	// Only the user can see it
+	VisibilityNobody = "nobody"
+	// The maximum length of a display name in characters
+	MaxDisplayNameLength = 50
+)
+
+func handleGetSettings(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/getSettings" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw=="}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request BasicRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0)"})
+		log.WithField("error", err).Error("[handleGetSettings] Failed to decode JSON")
+		return
+	}
+
+	// verify that the token is valid
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleGetSettings] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	settings, err := getUserSettings(c, request.UserID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleGetSettings] Failed to get settings")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "settings": settings})
+}
+
+func handleUpdateSettings(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/updateSettings" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","stripPhotoMetadata": true}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request UpdateSettingsRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0)"})
+		log.WithField("error", err).Error("[handleUpdateSettings] Failed to decode JSON")
+		return
+	}
+
+	// verify that the token is valid
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleUpdateSettings] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	err = updateUserSettings(c, request)
+	if err != nil {
+		if errors.Is(err, errInvalidSetting) {
+			c.JSON(400, gin.H{"success": false, "error": err.Error()})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleUpdateSettings] Failed to update settings")
+		return
+	}
+
+	settings, err := getUserSettings(c, request.UserID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+		log.WithField("error", err).Error("[handleUpdateSettings] Failed to get settings")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "settings": settings})
+}
+
+// Returns the settings for the userID.
+// If the user doesn't exist, it returns errUserNotFound.
+func getUserSettings(ctx context.Context, userID string) (UserSettings, error) {
+	var settings UserSettings
+	err := db.QueryRowContext(ctx, "SELECT stripPhotoMetadata, profilePictureVisibility, IFNULL(displayName, ''), discoverable, sharingPolicy FROM users WHERE userID = ?", userID).Scan(&settings.StripPhotoMetadata, &settings.ProfilePictureVisibility, &settings.DisplayName, &settings.Discoverable, &settings.SharingPolicy)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return settings, errUserNotFound
+		}
+		return settings, fmt.Errorf("db query error. %w", err)
+	}
+
+	return settings, nil
+}
+
+// Changes the settings that are set in the request. The rest are not modified.
+// If a value is not allowed, it returns an error that wraps errInvalidSetting.
+func updateUserSettings(ctx context.Context, request UpdateSettingsRequest) error {
+	columns := []string{}
+	args := []any{}
+
+	if request.StripPhotoMetadata != nil {
+		columns = append(columns, "stripPhotoMetadata=?")
+		args = append(args, *request.StripPhotoMetadata)
+	}
+
+	if request.ProfilePictureVisibility != "" {
+		if !slices.Contains(profilePictureVisibilityOptions, request.ProfilePictureVisibility) {
+			return fmt.Errorf("%w: profilePictureVisibility must be one of %v", errInvalidSetting, profilePictureVisibilityOptions)
+		}
+		columns = append(columns, "profilePictureVisibility=?")
+		args = append(args, request.ProfilePictureVisibility)
+	}
+
+	if request.DisplayName != nil {
+		displayName := strings.TrimSpace(*request.DisplayName)
+		if utf8.RuneCountInString(displayName) > MaxDisplayNameLength {
+			return fmt.Errorf("%w: displayName can't be longer than %d characters", errInvalidSetting, MaxDisplayNameLength)
+		}
+		columns = append(columns, "displayName=NULLIF(?, '')")
+		args = append(args, displayName)
+	}
+
+	if request.Discoverable != nil {
+		columns = append(columns, "discoverable=?")
+		args = append(args, *request.Discoverable)
+	}
+
+	if request.SharingPolicy != "" {
+		if err := validateSharingPolicy(request.SharingPolicy); err != nil {
+			return err
+		}
+		columns = append(columns, "sharingPolicy=?")
+		args = append(args, request.SharingPolicy)
+	}
+
+	if len(columns) == 0 {
+		// Nothing to change
+		return nil
+	}
+
+	args = append(args, request.UserID)
+	_, err := db.ExecContext(ctx, "UPDATE users SET "+strings.Join(columns, ", ")+", lastModified=now() WHERE userID=?", args...)
+	return err
+}
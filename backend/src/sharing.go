@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"os"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
@@ -45,39 +44,67 @@ func handleShareFile(c *gin.Context) {
 		return
 	}
 
+	c.JSON(shareFile(c, request))
+}
+
+// Shares the file with the users and groups of the request. Returns the status and the body of the response, so that it can also be used by batch
+func shareFile(ctx context.Context, request ShareFileRequest) (int, gin.H) {
 	// check that file exists and that the user is allowed to share it
 	// TODO: Test this. Specially with another user's file
-	_, err = getObjectKey(c, request.FileID, request.UserID, false)
+	_, err := getObjectKey(ctx, request.FileID, request.UserID, false)
 	if err != nil {
 		if errors.Is(err, errUserAccessNotAllowed) {
-			c.JSON(403, gin.H{"success": false, "error": "Operation not allowed"})
-			return
+			return 403, gin.H{"success": false, "error": "Operation not allowed"}
 		}
 
 		if errors.Is(err, errFileNotFound) {
-			c.JSON(400, gin.H{"success": false, "error": "File not found"})
 			log.WithFields(log.Fields{"error": err, "fileID": request.FileID}).Debug("[handleGetSharedWith] No file with that fileID found")
-			return
+			return 400, gin.H{"success": false, "error": "File not found"}
 		}
 
-		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
-		log.WithField("error", err).Error("[handleShareFile] Failed to if file exists")
-		return
+		log.WithField("error", err).Error("[shareFile] Failed to if file exists")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"}
+	}
+
+	// check that the sharing policies allow sharing with every recipient
+	refused, err := checkShareRecipients(ctx, request.UserID, request.WithUserID)
+	if err != nil {
+		log.WithField("error", err).Error("[shareFile] Failed to check the recipients")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (2b), Please try again later"}
+	}
+
+	if len(refused) > 0 {
+		return 403, gin.H{"success": false, "error": "Sharing is not allowed with some of the users", "refused": refused}
+	}
+
+	// check that the user can share with the groups and that the policies allow sharing with their members
+	refused, err = checkShareGroups(ctx, request.UserID, request.WithGroupID)
+	if err != nil {
+		log.WithField("error", err).Error("[shareFile] Failed to check the groups")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (2c), Please try again later"}
+	}
+
+	if len(refused) > 0 {
+		return 403, gin.H{"success": false, "error": "Sharing is not allowed with some of the users", "refused": refused}
 	}
 
 	// file exists, check if it is already shared. If it is, check if the permission needs to be changed
 
 	// TODO: Make sure this works
 	// sharedFileID is empty if the file is inside of a shared dir. I.E., the user has access to the file because it is inside of a directory/folder that is shared with the user.
-	sharedFileID, perm, err := checkFilePermission(c, request.FileID, request.WithUserID)
+	sharedFileID, perm, err := checkFilePermission(ctx, request.FileID, request.WithUserID)
 	if err != nil {
-		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
-		log.WithField("error", err).Error("[handleShareFile] Failed to check permission")
-		return
+		log.WithField("error", err).Error("[shareFile] Failed to check permission")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"}
 	}
 
-	log.WithFields(log.Fields{"sharedFileID": sharedFileID, "perm": perm}).Trace("[handleShareFile] got data from checkFilePermission")
+	log.WithFields(log.Fields{"sharedFileID": sharedFileID, "perm": perm}).Trace("[shareFile] got data from checkFilePermission")
 
+	// Everything is checked before anything is written, so that a refused request doesn't leave the file shared with the groups.
+	// newPermission is set when only the permission of the direct share changes
+	newPermission := ""
+	// True when the users can already decrypt the file through a shared parentDir
+	sharesProcessed := false
 	if perm != "" {
 		// file is already shared. Either directly or a parentDir is
 		if sharedFileID == "" {
@@ -85,113 +112,120 @@ func handleShareFile(c *gin.Context) {
 			if perm == WritePermission {
 				if !request.ReadOnly {
 					// do nothing
-					c.JSON(400, gin.H{"success": false, "error": "User already has write permission via a shared directory"})
-					log.Trace("[handleShareFile] File already has write permission from parentDir")
-					return
+					log.Trace("[shareFile] File already has write permission from parentDir")
+					return 400, gin.H{"success": false, "error": "User already has write permission via a shared directory"}
 				} else {
 					// the file is already fully accesible.
 					// Make the file read only
-					log.Trace("[handleShareFile] File shared via parentDir, setting file permission from write to read")
+					log.Trace("[shareFile] File shared via parentDir, setting file permission from write to read")
 				}
 			} else {
 				// perm is "read"
 				if request.ReadOnly {
 					// The file is already read-only and the user is sharing it with readOnly permission.
 					// Do nothing
-					c.JSON(400, gin.H{"success": false, "error": "User already has read-only permission via a shared directory"})
-					log.Trace("[handleShareFile] File already has read-only permission from parentDir")
-					return
+					log.Trace("[shareFile] File already has read-only permission from parentDir")
+					return 400, gin.H{"success": false, "error": "User already has read-only permission via a shared directory"}
 				} else {
 					// the file is already readable, owner wants user to be able to modify it
 					// Make the file writeable
-					log.Trace("[handleShareFile] File shared via parentDir, setting file permission from read to write")
+					log.Trace("[shareFile] File shared via parentDir, setting file permission from read to write")
 				}
 			}
 
-			// add the new file permission
-			err = addFilePermission(c, request.FileID, request.WithUserID, request.UserID, request.ReadOnly)
-			if err != nil {
-				c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4b), Please try again later"})
-				log.WithField("error", err).Error("[handleShareFile] Failed to add more specific permission")
-				return
-			}
-
-			c.JSON(200, gin.H{"success": true})
-			return
-
+			// The user can already decrypt it through the shared parentDir
+			sharesProcessed = true
 		} else {
 			// File is shared directly
 			switch perm {
 			case WritePermission:
 				// read and write perm
-				if request.ReadOnly {
-					// change permission to be read only
-					err := changeFilePermission(c, sharedFileID, request.FileID, ReadOnlyPermission)
-					if err != nil {
-						c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4c), Please try again later"})
-						log.WithField("error", err).Error("[handleShareFile] Failed to change permission")
-						return
-					}
-					c.JSON(200, gin.H{"success": true})
-					return
-				} else {
+				if !request.ReadOnly {
 					// do nothing
-					c.JSON(400, gin.H{"success": false, "error": "File already has write permission"})
-					log.Trace("[handleShareFile] File already has write permission")
-					return
+					log.Trace("[shareFile] File already has write permission")
+					return 400, gin.H{"success": false, "error": "File already has write permission"}
 				}
+				// change permission to be read only
+				newPermission = ReadOnlyPermission
 
 			case ReadOnlyPermission:
 				// read-only perm
-				if !request.ReadOnly {
-					// change permission to write
-					err := changeFilePermission(c, sharedFileID, request.FileID, WritePermission)
-					if err != nil {
-						c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4d), Please try again later"})
-						log.WithField("error", err).Error("[handleShareFile] Failed to change permission")
-						return
-					}
-					c.JSON(200, gin.H{"success": true})
-					return
-				} else {
+				if request.ReadOnly {
 					// do nothing
-					c.JSON(400, gin.H{"success": false, "error": "File already has read-only permission"})
-					log.Trace("[handleShareFile] File already has read-only permission")
-					return
+					log.Trace("[shareFile] File already has read-only permission")
+					return 400, gin.H{"success": false, "error": "File already has read-only permission"}
 				}
+				// change permission to write
+				newPermission = WritePermission
+
 			default:
 				// unkown permission value
-				c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (5), Please try again later"})
-				log.WithFields(log.Fields{"perm": perm}).Error("[handleShareFile] File has unkown permission")
-				return
+				log.WithFields(log.Fields{"perm": perm}).Error("[shareFile] File has unkown permission")
+				return 500, gin.H{"success": false, "error": "Internal Server Error (5), Please try again later"}
 			}
 		}
 	}
 
-	// File is not shared at all
-	err = addFilePermission(c, request.FileID, request.WithUserID, request.UserID, request.ReadOnly)
+	// The group and user shares are added together
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (7)"})
-		log.WithField("error", err).Error("[handleShareFile] Failed to add share to DB")
-		return
+		log.WithField("error", err).Error("[shareFile] Failed to start the transaction")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"}
 	}
+	defer tx.Rollback()
 
-	// TODO: reencrypt the fKey with the user's publicKey
+	sharedFileGroupIDs, err := addGroupFilePermission(ctx, tx, request.FileID, request.WithGroupID, request.UserID, request.ReadOnly)
+	if err != nil {
+		log.WithField("error", err).Error("[shareFile] Failed to share with the groups")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (4a), Please try again later"}
+	}
 
-	// return to the client, the list of publicKeys that have access to the file, get it to encrypt it, and send it back.
-	sharedWith := []string{}
-	// TODO; work on this
-	perms, err := getUsersWithFileAccess(c, request.FileID, 0, nil)
+	sharedFileIDs := []string{}
+	if newPermission != "" {
+		err = changeFilePermission(ctx, tx, sharedFileID, request.FileID, newPermission)
+		if err != nil {
+			log.WithField("error", err).Error("[shareFile] Failed to change permission")
+			return 500, gin.H{"success": false, "error": "Internal Server Error (4b), Please try again later"}
+		}
+	} else {
+		sharedFileIDs, err = addFilePermission(ctx, tx, request.FileID, request.WithUserID, request.UserID, request.ReadOnly)
+		if err != nil {
+			log.WithField("error", err).Error("[shareFile] Failed to add share to DB")
+			return 500, gin.H{"success": false, "error": "Internal Server Error (4c), Please try again later"}
+		}
+	}
 
-	publicKeys, err := getPublicKeysForUsers(c, sharedWith, request.UserID)
+	if sharesProcessed {
+		err = markSharesProcessed(ctx, tx, sharedFileIDs)
+		if err != nil {
+			log.WithField("error", err).Error("[shareFile] Failed to mark the share as processed")
+			return 500, gin.H{"success": false, "error": "Internal Server Error (4d), Please try again later"}
+		}
+		sharedFileIDs = nil
+	}
 
-	c.JSON(200, gin.H{"success": true})
+	// The owner's devices encrypt the file for the new recipients with getReencryptionTasks. The shares are processed once they are done
+	err = scheduleShareReencryption(ctx, tx, request.FileID, request.UserID, sharedFileIDs, sharedFileGroupIDs)
+	if err != nil {
+		log.WithField("error", err).Error("[shareFile] Failed to schedule re-encryption")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (8)"}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.WithField("error", err).Error("[shareFile] Failed to commit the transaction")
+		return 500, gin.H{"success": false, "error": "Internal Server Error (9)"}
+	}
+
+	return 200, gin.H{"success": true}
 }
 
+// Replaces the folder key of a folder with a new one encrypted by the client, e.g. after sharing the folder with more users.
+// The upload has to be an age file with one recipient stanza for each active key of the owner and of the users with access.
+// The previous folder key is kept as a version so that it can be restored with rollbackFolderKey.
 func handleUpdateFolderKey(c *gin.Context) {
 	/*
-		Upload file:
-			curl -F "userID=testUser" -F "authToken=K1xS9ehuxeC5tw==" -F "parentDir=root" -F "file=@testFile.txt" localhost:9090/uploadFile
+		curl -F "userID=testUser" -F "authToken=K1xS9ehuxeC5tw==" -F "sharedFolderID=0195ddc2-dba1-7b94-acbb-b360f88dd9d6" -F "file=@folderKey.age" localhost:9090/updateFolderKey
 	*/
 
 	if c.Request.Body == nil {
@@ -201,7 +235,7 @@ func handleUpdateFolderKey(c *gin.Context) {
 
 	userID := c.PostForm("userID")
 	authToken := c.PostForm("authToken")
-	// parentDir is a UUID for an actual folder. If it is the root/home folder, then it is 'root'
+	// The ID of the folder that the key is for
 	sharedFolderID := c.PostForm("sharedFolderID")
 
 	if userID == "" || authToken == "" {
@@ -214,7 +248,7 @@ func handleUpdateFolderKey(c *gin.Context) {
 	valid, err := isAuthTokenValid(c, userID, authToken)
 	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
-		log.WithField("error", err).Error("[handleFileUpload] Failed to verify token")
+		log.WithField("error", err).Error("[handleUpdateFolderKey] Failed to verify token")
 		return
 	}
 
@@ -223,15 +257,13 @@ func handleUpdateFolderKey(c *gin.Context) {
 		return
 	}
 
-	if sharedFolderID == "" {
+	if sharedFolderID == "" || sharedFolderID == RootDirectoryID {
 		c.JSON(400, gin.H{"success": false, "error": "sharedFolderID Missing"})
-		log.Error("[handleUpdateFolderKey] No parentDir in request")
+		log.Debug("[handleUpdateFolderKey] No sharedFolderID in request")
 		return
 	}
 
-	fmt.Printf("[handleUpdateFolderKey] WARNING: authToken not verified. userID: '%s' authToken: '%s'. parentDir: '%s'\n", userID, authToken, sharedFolderID)
-
-	// Check that parentDir is a valid folder and that the user can create a new directory in that location.
+	// Check that sharedFolderID is a valid folder and that the user can change it.
 	permission, err := getFolderPermission(c, sharedFolderID, userID, true)
 	if err != nil {
 		if errors.Is(err, errDirNotFound) {
@@ -239,7 +271,7 @@ func handleUpdateFolderKey(c *gin.Context) {
 			return
 		}
 
-		log.WithField("Error", err).Error("[handleUpdateFolderKey] Error getting parentDir permission")
+		log.WithField("Error", err).Error("[handleUpdateFolderKey] Error getting folder permission")
 		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
 		return
 	}
@@ -248,10 +280,21 @@ func handleUpdateFolderKey(c *gin.Context) {
 		return
 	}
 
+	hasKey, err := hasFolderKey(c, sharedFolderID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleUpdateFolderKey] Failed to check the folder key")
+		return
+	}
+
+	if !hasKey {
+		c.JSON(400, gin.H{"success": false, "error": "The folder doesn't have a folder key"})
+		return
+	}
+
 	file, err := c.FormFile("file")
 	if err != nil {
-		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
-		log.WithField("Error", err).Error("[handleUpdateFolderKey] Error getting uploaded file")
+		c.JSON(400, gin.H{"success": false, "error": "No file received"})
 		return
 	}
 
@@ -260,59 +303,61 @@ func handleUpdateFolderKey(c *gin.Context) {
 	filePath := fmt.Sprintf("%s%s_fKey", serverConfig.TMPStorageDir, sharedFolderID)
 	err = c.SaveUploadedFile(file, filePath)
 	if err != nil {
-		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
 		log.WithFields(log.Fields{"error": err, "filename": file.Filename, "size": file.Size, "header": file.Header, "filePath": filePath}).Error("[handleUpdateFolderKey] Error saving uploaded file")
 		return
 	}
+	defer deleteLocalFile(filePath)
 
-	// TODO: somehow validate the file, a user could upload random data and fuck the key up
-
-	objKey := fmt.Sprintf("folderkeys/%s", sharedFolderID)
-
-	file2, err := os.Open(filePath)
+	err = updateFolderKey(c, sharedFolderID, userID, filePath)
 	if err != nil {
-		c.JSON(400, gin.H{"success": false, "error": "File name is too long"})
-		log.Debug("[handleUpdateFolderKey] Filename too long")
-		err = os.Remove(filePath)
-		if err != nil {
-			log.WithError(err).Error("[handleUpdateFolderKey] Failed to delete file after error")
+		if errors.Is(err, errInvalidAgeHeader) || errors.Is(err, errWrongRecipients) {
+			c.JSON(400, gin.H{"success": false, "error": err.Error()})
+			return
 		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"})
+		log.WithFields(log.Fields{"error": err, "folderID": sharedFolderID}).Error("[handleUpdateFolderKey] Failed to update folder key")
 		return
 	}
-	defer file2.Close()
 
-	_, err = uploadFile(c, s3Client, serverConfig.S3BucketName, file2, objKey)
+	// The folder key is up to date, so the requests to re-wrap it are done. They are sent to the owner, who might not be the user that uploaded it
+	owner, err := getItemOwner(c, sharedFolderID)
+	if err == nil {
+		err = removeAlertsWithData(c, owner, "folderKeyRewrap", sharedFolderID)
+	}
 	if err != nil {
-		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
-		log.WithFields(log.Fields{"error": err, "filename": file.Filename, "size": file.Size, "header": file.Header, "filePath": filePath}).Error("[handleFihandleUpdateFolderKeyleUpload] Error uploading file")
-		return
+		log.WithFields(log.Fields{"error": err, "folderID": sharedFolderID}).Error("[handleUpdateFolderKey] Failed to remove folderKeyRewrap alerts")
 	}
 
 	c.JSON(200, gin.H{"success": true})
 }
 
 // Changes a files permission in the DB
-func changeFilePermission(ctx context.Context, sharedFileID, fileID, permission string) error {
+func changeFilePermission(ctx context.Context, e execer, sharedFileID, fileID, permission string) error {
 	var isReadOnly = (permission == ReadOnlyPermission && permission != WritePermission)
 	// fileID is not needed, but it could be a good check to make sure it is the right file
-	_, err := db.ExecContext(ctx, "UPDATE sharedFiles SET isReadOnly=? WHERE id=? AND fileID=?", isReadOnly, sharedFileID, fileID)
+	_, err := e.ExecContext(ctx, "UPDATE sharedFiles SET isReadOnly=? WHERE id=? AND fileID=?", isReadOnly, sharedFileID, fileID)
 	return err
 }
 
-func addFilePermission(ctx context.Context, fileID string, WithUserIDs []string, fileOwner string, isReadOnly bool) error {
+// Adds a share for each user. Returns the IDs of the new rows in sharedFiles
+func addFilePermission(ctx context.Context, e execer, fileID string, WithUserIDs []string, fileOwner string, isReadOnly bool) ([]string, error) {
+	sharedFileIDs := []string{}
 	for _, userID := range WithUserIDs {
 		newID, err := getNewID()
 		if err != nil {
-			return fmt.Errorf("failed to get new ID for shared file: %w", err)
+			return sharedFileIDs, fmt.Errorf("failed to get new ID for shared file: %w", err)
 		}
 
-		_, err = db.ExecContext(ctx, "INSERT INTO sharedFiles (id, fileID, userID, fileOwner, isReadOnly, createdDate) VALUES (?, ?, ?, ?, ?, now());", newID, fileID, userID, fileOwner, isReadOnly)
+		_, err = e.ExecContext(ctx, "INSERT INTO sharedFiles (id, fileID, userID, fileOwner, isReadOnly, createdDate) VALUES (?, ?, ?, ?, ?, now());", newID, fileID, userID, fileOwner, isReadOnly)
 
 		if err != nil {
-			return fmt.Errorf("failed to insert shared file permission for user %s: %w", userID, err)
+			return sharedFileIDs, fmt.Errorf("failed to insert shared file permission for user %s: %w", userID, err)
 		}
+		sharedFileIDs = append(sharedFileIDs, newID.String())
 	}
-	return nil
+	return sharedFileIDs, nil
 }
 
 // Used to check the permission when a request is sent to share it.
@@ -358,6 +403,16 @@ func hasSharedFilePermission(ctx context.Context, fileID, withUserID string) (st
 		return permission, nil
 	}
 
+	// Check if the file is shared with one of the user's groups
+	permission, err = queryGroupPermission(ctx, fileID, withUserID)
+	if err != nil {
+		return "", fmt.Errorf("error from queryGroupPermission. %w", err)
+	}
+
+	if permission != "" {
+		return permission, nil
+	}
+
 	// Check if a parentDir is shared
 	permission, err = checkIfParentDirIsShared(ctx, fileID, withUserID, 0)
 	if err != nil {
@@ -403,6 +458,16 @@ func checkIfParentDirIsShared(ctx context.Context, fileID, withUserID string, ca
 		return permission, nil
 	}
 
+	// A permission for the user itself takes precedence over their groups
+	permission, err = queryGroupPermission(ctx, parentDir, withUserID)
+	if err != nil {
+		return "", err
+	}
+
+	if permission != "" {
+		return permission, nil
+	}
+
 	// Call itself
 	callNumber++
 	return checkIfParentDirIsShared(ctx, parentDir, withUserID, callNumber)
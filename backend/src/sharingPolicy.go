@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// The values allowed for the sharing policies
+	sharingPolicyOptions = []string{SharingPolicyAnyone, SharingPolicyFriends, SharingPolicyOrganization}
+)
+
+const (
+	// Items can be shared with any user
+	SharingPolicyAnyone = "anyone"
+	// Items can only be shared with users that accepted a friend request
+	SharingPolicyFriends = "friends"
+	// Items can only be shared with users in the same organization
+	SharingPolicyOrganization = "organization"
+	// The length of users.organizationID in the DB
+	MaxOrganizationIDLength = 50
+)
+
+// A recipient that an item can't be shared with and the reason why
+type RefusedRecipient struct {
+	UserID string `json:"userID"`
+	Error  string `json:"error"`
+}
+
+// Returns the sharing policy for the whole server. Defaults to SharingPolicyAnyone if it is not set in the config
+func serverSharingPolicy() string {
+	if serverConfig.SharingPolicy == "" {
+		return SharingPolicyAnyone
+	}
+	return serverConfig.SharingPolicy
+}
+
+// Checks if userID is allowed to share items with each of the recipients.
+// A share is only allowed if the recipient exists, didn't block the user and both the server's policy and the recipient's own policy allow it.
+// It returns the recipients that were refused, an empty slice means that every recipient is allowed.
+func checkShareRecipients(ctx context.Context, userID string, recipients []string) ([]RefusedRecipient, error) {
+	refused := []RefusedRecipient{}
+
+	var userOrganization sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT organizationID FROM users WHERE userID = ?", userID).Scan(&userOrganization)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errUserNotFound
+		}
+		return nil, fmt.Errorf("failed to get the user's organization. %w", err)
+	}
+
+	for _, recipient := range recipients {
+		if recipient == userID {
+			refused = append(refused, RefusedRecipient{UserID: recipient, Error: "You can't share with yourself"})
+			continue
+		}
+
+		var recipientPolicy string
+		var recipientOrganization sql.NullString
+		err := db.QueryRowContext(ctx, "SELECT sharingPolicy, organizationID FROM users WHERE userID = ?", recipient).Scan(&recipientPolicy, &recipientOrganization)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				refused = append(refused, RefusedRecipient{UserID: recipient, Error: "User does not exist"})
+				continue
+			}
+			return nil, fmt.Errorf("failed to get the policy of user %s. %w", recipient, err)
+		}
+
+		blocked, err := isBlockedBy(ctx, userID, recipient)
+		if err != nil {
+			return nil, fmt.Errorf("isBlockedBy error for user %s. %w", recipient, err)
+		}
+
+		if blocked {
+			refused = append(refused, RefusedRecipient{UserID: recipient, Error: "This user doesn't accept items from you"})
+			continue
+		}
+
+		for _, policy := range []string{serverSharingPolicy(), recipientPolicy} {
+			reason, err := checkSharingPolicy(ctx, policy, userID, recipient, userOrganization, recipientOrganization)
+			if err != nil {
+				return nil, err
+			}
+
+			if reason != "" {
+				refused = append(refused, RefusedRecipient{UserID: recipient, Error: reason})
+				break
+			}
+		}
+	}
+
+	return refused, nil
+}
+
+// Returns why the policy doesn't allow userID to share with the recipient, or an empty string if it is allowed
+func checkSharingPolicy(ctx context.Context, policy, userID, recipient string, userOrganization, recipientOrganization sql.NullString) (string, error) {
+	switch policy {
+	case SharingPolicyAnyone:
+		return "", nil
+	case SharingPolicyFriends:
+		friends, err := areFriends(ctx, userID, recipient)
+		if err != nil {
+			return "", fmt.Errorf("areFriends error for user %s. %w", recipient, err)
+		}
+
+		if !friends {
+			return "You can only share with this user if you are friends", nil
+		}
+		return "", nil
+	case SharingPolicyOrganization:
+		if !userOrganization.Valid || userOrganization != recipientOrganization {
+			return "You can only share with this user if you are in the same organization", nil
+		}
+		return "", nil
+	default:
+		return "", fmt.Errorf("unknown sharing policy '%s'", policy)
+	}
+}
+
+// Returns an error if the policy is not one of sharingPolicyOptions
+func validateSharingPolicy(policy string) error {
+	if !slices.Contains(sharingPolicyOptions, policy) {
+		return fmt.Errorf("%w: sharingPolicy must be one of %v", errInvalidSetting, sharingPolicyOptions)
+	}
+	return nil
+}
+
+// Sets the organization of a user, which is used by the "organization" sharing policy. Only admins can do it.
+// An empty organizationID removes the user from their organization.
+func handleSetUserOrganization(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/setUserOrganization" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","targetUserID": "anotherTestUser", "organizationID": "hammerspace"}'
+	*/
+	request, ok := bindAdminRequest(c, "handleSetUserOrganization")
+	if !ok {
+		return
+	}
+
+	if len(request.OrganizationID) > MaxOrganizationIDLength {
+		c.JSON(400, gin.H{"success": false, "error": fmt.Sprintf("organizationID can't be longer than %d characters", MaxOrganizationIDLength)})
+		return
+	}
+
+	exists, err := doesUserExist(request.TargetUserID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+		log.WithField("error", err).Error("[handleSetUserOrganization] Failed to check the user")
+		return
+	}
+
+	if !exists {
+		c.JSON(400, gin.H{"success": false, "error": "User does not exist"})
+		return
+	}
+
+	err = setUserOrganization(c, request.TargetUserID, request.OrganizationID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"})
+		log.WithField("error", err).Error("[handleSetUserOrganization] Failed to set the organization")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// Sets the user's organizationID, or NULL if it is empty
+func setUserOrganization(ctx context.Context, userID, organizationID string) error {
+	_, err := db.ExecContext(ctx, "UPDATE users SET organizationID = ? WHERE userID = ?", sql.NullString{String: organizationID, Valid: organizationID != ""}, userID)
+	return err
+}
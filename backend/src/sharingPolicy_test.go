@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestCheckSharingPolicy(t *testing.T) {
+	orgA := sql.NullString{String: "orgA", Valid: true}
+	orgB := sql.NullString{String: "orgB", Valid: true}
+	noOrg := sql.NullString{}
+
+	items := []struct {
+		policy                string
+		userOrg, recipientOrg sql.NullString
+		allowed               bool
+	}{
+		{SharingPolicyAnyone, noOrg, noOrg, true},
+		{SharingPolicyOrganization, orgA, orgA, true},
+		{SharingPolicyOrganization, orgA, orgB, false},
+		{SharingPolicyOrganization, noOrg, noOrg, false},
+		{SharingPolicyOrganization, orgA, noOrg, false},
+	}
+
+	for _, item := range items {
+		reason, err := checkSharingPolicy(context.Background(), item.policy, "testUser", "anotherTestUser", item.userOrg, item.recipientOrg)
+		if err != nil {
+			t.Errorf("checkSharingPolicy failed for %+v. %v", item, err)
+			continue
+		}
+
+		if (reason == "") != item.allowed {
+			t.Errorf("checkSharingPolicy failed for %+v. Expected allowed: %v got reason: '%s'", item, item.allowed, reason)
+		}
+	}
+
+	_, err := checkSharingPolicy(context.Background(), "everyone", "testUser", "anotherTestUser", noOrg, noOrg)
+	if err == nil {
+		t.Error("checkSharingPolicy didn't fail for an unknown policy")
+	}
+}
+
+func TestValidateSharingPolicy(t *testing.T) {
+	for _, policy := range sharingPolicyOptions {
+		if err := validateSharingPolicy(policy); err != nil {
+			t.Errorf("validateSharingPolicy failed for '%s'. %v", policy, err)
+		}
+	}
+
+	if err := validateSharingPolicy("everyone"); !errors.Is(err, errInvalidSetting) {
+		t.Errorf("validateSharingPolicy didn't return errInvalidSetting. Got: %v", err)
+	}
+}
+
+func TestSetUserOrganization(t *testing.T) {
+	fake := useFakeDB(t)
+	ctx := context.Background()
+
+	if err := setUserOrganization(ctx, "testUser", "orgA"); err != nil {
+		t.Fatalf("setUserOrganization(orgA) returned %v", err)
+	}
+	if err := setUserOrganization(ctx, "testUser", ""); err != nil {
+		t.Fatalf("setUserOrganization(\"\") returned %v", err)
+	}
+
+	calls := fake.callsMatching("UPDATE users SET organizationID")
+	if len(calls) != 2 {
+		t.Fatalf("got %d updates, want 2", len(calls))
+	}
+	if calls[0].args[0] != "orgA" || calls[0].args[1] != "testUser" {
+		t.Errorf("first update args = %v, want [orgA testUser]", calls[0].args)
+	}
+	if calls[1].args[0] != nil {
+		t.Errorf("an empty organizationID should be stored as NULL, got %v", calls[1].args[0])
+	}
+}
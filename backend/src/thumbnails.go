@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+var (
+	// Error returned when a thumbnail can't be generated for the file type
+	errThumbnailNotSupported error = errors.New("thumbnails are not supported for this file type")
+	// Error for images with more pixels than MaxThumbnailSourcePixels
+	errImageTooLarge error = errors.New("the image is too large")
+	// Error returned when a file doesn't have a thumbnail
+	errNoThumbnail error = errors.New("file has no thumbnail")
+	// The MIME types that thumbnails are generated for.
+	// PDF previews are not generated since there is no pure-Go PDF renderer in the dependencies.
+	thumbnailImageTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+)
+
+const (
+	// The maximum width and height of a thumbnail in pixels. The aspect ratio is kept
+	ThumbnailMaxSize = 256
+	// The JPEG quality used for thumbnails
+	ThumbnailJPEGQuality = 80
+	// Images with more pixels than this are not decoded to avoid decompression bombs. 50 megapixels
+	MaxThumbnailSourcePixels = 50_000_000
+)
+
+func handleGetThumbnail(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/getThumbnail" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","dirID": "01955f82-7409-7cfc-a6ab-af5a70ca5897"}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request GetFileRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0)"})
+		log.WithField("error", err).Error("[handleGetThumbnail] Failed to decode JSON")
+		return
+	}
+
+	// verify that the token is valid
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleGetThumbnail] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	// check that file exists and that the user has access to it
+	_, err = getObjectKey(c, request.FileID, request.UserID, true)
+	if err != nil {
+		if errors.Is(err, errFileNotFound) {
+			c.JSON(400, gin.H{"success": false, "error": "File not found"})
+			return
+		}
+
+		if errors.Is(err, errUserAccessNotAllowed) {
+			c.JSON(403, gin.H{"success": false, "error": "Operation not allowed"})
+			return
+		}
+
+		if errors.Is(err, errFileProcessing) {
+			c.JSON(400, gin.H{"success": false, "error": "File is being processed, try again later"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleGetThumbnail] Failed to get object key")
+		return
+	}
+
+	thumbnailObjKey, err := getThumbnailObjKey(c, request.FileID)
+	if err != nil {
+		if errors.Is(err, errNoThumbnail) {
+			c.JSON(404, gin.H{"success": false, "error": "The file has no thumbnail"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+		log.WithField("error", err).Error("[handleGetThumbnail] Failed to get thumbnail object key")
+		return
+	}
+
+	file, err := getFile(c, s3Client, serverConfig.S3BucketName, thumbnailObjKey)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4)"})
+		log.WithFields(log.Fields{"error": err, "thumbnailObjKey": thumbnailObjKey}).Error("[handleGetThumbnail] Failed to get thumbnail")
+		return
+	}
+
+	// The thumbnail is encrypted with the same recipient as the file
+	extraHeaders := map[string]string{"Cache-Control": "private"}
+	c.DataFromReader(http.StatusOK, int64(*file.ContentLength), "application/vnd.age", file.Body, extraHeaders)
+}
+
+// Returns the S3 object key of the file's thumbnail.
+// If the file doesn't have one, it returns errNoThumbnail.
+func getThumbnailObjKey(ctx context.Context, fileID string) (string, error) {
+	var thumbnailObjKey string
+	err := db.QueryRowContext(ctx, "SELECT IFNULL(thumbnailObjKey, '') FROM files WHERE id = ?", fileID).Scan(&thumbnailObjKey)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", errFileNotFound
+		}
+		return "", err
+	}
+
+	if thumbnailObjKey == "" {
+		return "", errNoThumbnail
+	}
+
+	return thumbnailObjKey, nil
+}
+
+// Generates a thumbnail for the file if it is a supported type, encrypts it with the same key as the file and uploads it.
+// It returns the S3 object key of the thumbnail.
+// If the MIME type is not supported, it returns errThumbnailNotSupported.
+func createThumbnail(ctx context.Context, buf []byte, mimeType string, publicKeys []string) (string, error) {
+	if !slices.Contains(thumbnailImageTypes, mimeType) {
+		return "", errThumbnailNotSupported
+	}
+
+	thumbnail, err := generateThumbnail(buf)
+	if err != nil {
+		return "", fmt.Errorf("generateThumbnail failed: %w", err)
+	}
+
+	objKey, err := getNewID()
+	if err != nil {
+		return "", fmt.Errorf("getNewID failed: %w", err)
+	}
+
+	_, err = encryptAndUploadReader(ctx, bytes.NewReader(thumbnail), objKey.String(), publicKeys)
+	if err != nil {
+		return "", fmt.Errorf("encryptAndUploadReader failed: %w", err)
+	}
+
+	return objKey.String(), nil
+}
+
+// Decodes the image and returns a JPEG that fits in ThumbnailMaxSize x ThumbnailMaxSize.
+// Images that are already small enough are re-encoded without scaling them.
+func generateThumbnail(buf []byte) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(buf))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image config: %w", err)
+	}
+
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, fmt.Errorf("invalid image size %dx%d", config.Width, config.Height)
+	}
+
+	if config.Width*config.Height > MaxThumbnailSourcePixels {
+		return nil, errImageTooLarge
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	width, height := thumbnailSize(src.Bounds().Dx(), src.Bounds().Dy(), ThumbnailMaxSize)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+
+	out := &bytes.Buffer{}
+	err = jpeg.Encode(out, dst, &jpeg.Options{Quality: ThumbnailJPEGQuality})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+
+	return out.Bytes(), nil
+}
+
+// Returns the width and height that fit inside maxSize x maxSize while keeping the aspect ratio.
+// Images smaller than maxSize are not scaled up.
+func thumbnailSize(width, height, maxSize int) (int, int) {
+	if width <= maxSize && height <= maxSize {
+		return width, height
+	}
+
+	if width >= height {
+		return maxSize, max(1, height*maxSize/width)
+	}
+
+	return max(1, width*maxSize/height), maxSize
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestThumbnailSize(t *testing.T) {
+	type size struct{ width, height int }
+	items := map[size]size{{100, 50}: {100, 50}, {256, 256}: {256, 256}, {1024, 512}: {256, 128}, {512, 1024}: {128, 256}, {4000, 3000}: {256, 192}, {10000, 10}: {256, 1}}
+
+	for key, value := range items {
+		width, height := thumbnailSize(key.width, key.height, 256)
+		if width != value.width || height != value.height {
+			t.Errorf("thumbnailSize failed for %dx%d. Expected: %dx%d got: %dx%d", key.width, key.height, value.width, value.height, width, height)
+		}
+	}
+}
+
+func TestGenerateThumbnail(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 800, 400))
+	buf := &bytes.Buffer{}
+	err := png.Encode(buf, src)
+	if err != nil {
+		t.Fatalf("failed to encode test image: %v", err)
+	}
+
+	thumbnail, err := generateThumbnail(buf.Bytes())
+	if err != nil {
+		t.Fatalf("generateThumbnail failed: %v", err)
+	}
+
+	config, err := jpeg.DecodeConfig(bytes.NewReader(thumbnail))
+	if err != nil {
+		t.Fatalf("thumbnail is not a valid JPEG: %v", err)
+	}
+
+	if config.Width != ThumbnailMaxSize || config.Height != ThumbnailMaxSize/2 {
+		t.Errorf("thumbnail has the wrong size. Expected: %dx%d got: %dx%d", ThumbnailMaxSize, ThumbnailMaxSize/2, config.Width, config.Height)
+	}
+
+	_, err = generateThumbnail([]byte("not an image"))
+	if err == nil {
+		t.Error("generateThumbnail didn't return an error for invalid data")
+	}
+}
@@ -1,172 +1,364 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
 	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// No friend request or friendship between the users error
+	errFriendshipNotFound error = errors.New("friendship not found")
+)
+
+const (
+	FriendStatusPending  = "pending"
+	FriendStatusAccepted = "accepted"
+	// userID1 blocked userID2
+	FriendStatusBlocked = "blocked"
 )
 
-// This is the test function
-func testUserFriendRequest() {
-	var currentUser string
-	fmt.Print("Enter your userID: ")
-	fmt.Scanln(&currentUser)
-
-	fmt.Println("1. Send friend request")
-	fmt.Println("2. View friend list")
-	fmt.Println("3. Accept friend request")
-	fmt.Println("4. Decline friend request")
-	var choice int
-	fmt.Scanln(&choice)
-
-	switch choice {
-	case 1:
-		var targetUser string
-		fmt.Print("Enter the userID of the person you'd like to add: ")
-		fmt.Scanln(&targetUser)
-		err := sendFriendRequest(db, currentUser, targetUser)
+func handleGetPendingFriendRequests(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/getPendingFriendRequests" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw=="}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request BasicRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleGetPendingFriendRequests] Failed to decode JSON")
+		return
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleGetPendingFriendRequests] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	incoming, err := getPendingRequests(c, request.UserID, true)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleGetPendingFriendRequests] Failed to get incoming requests")
+		return
+	}
+
+	outgoing, err := getPendingRequests(c, request.UserID, false)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+		log.WithField("error", err).Error("[handleGetPendingFriendRequests] Failed to get outgoing requests")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "incoming": incoming, "outgoing": outgoing})
+}
+
+// Declines a friend request that forUserID sent to the user
+func handleDeclineFriendRequest(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/declineFriendRequest" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","forUserID":"anotherTestUser"}'
+	*/
+	handleFriendshipAction(c, "handleDeclineFriendRequest", func(ctx context.Context, request AddFriendRequest) error {
+		// The request is deleted so that it can be sent again in the future
+		return removeFriendship(ctx, request.ForUserID, request.UserID, FriendStatusPending, false)
+	})
+}
+
+// Cancels a friend request that the user sent to forUserID
+func handleCancelFriendRequest(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/cancelFriendRequest" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","forUserID":"anotherTestUser"}'
+	*/
+	handleFriendshipAction(c, "handleCancelFriendRequest", func(ctx context.Context, request AddFriendRequest) error {
+		friendshipID, err := getFriendshipID(ctx, request.UserID, request.ForUserID, FriendStatusPending)
+		if err != nil {
+			return err
+		}
+
+		err = removeFriendship(ctx, request.UserID, request.ForUserID, FriendStatusPending, false)
 		if err != nil {
-			log.Println("Error sending request:", err)
-		} else {
-			fmt.Println("Friend request sent.")
+			return err
 		}
-	case 2:
-		friends, err := getFriendList(db, currentUser)
+
+		// The recipient doesn't need the alert anymore
+		err = removeAlertsWithData(ctx, request.ForUserID, "friendRequest", friendshipID)
 		if err != nil {
-			log.Println("Error retrieving friend list:", err)
-			return
+			log.WithFields(log.Fields{"error": err, "friendshipID": friendshipID}).Error("[handleCancelFriendRequest] Failed to remove friend request alert")
+		}
+		return nil
+	})
+}
+
+// Removes forUserID from the user's friends
+func handleRemoveFriend(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/removeFriend" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","forUserID":"anotherTestUser"}'
+	*/
+	handleFriendshipAction(c, "handleRemoveFriend", func(ctx context.Context, request AddFriendRequest) error {
+		return removeFriendship(ctx, request.UserID, request.ForUserID, FriendStatusAccepted, true)
+	})
+}
+
+// Blocks forUserID. It removes any friendship or pending request between the users.
+// A blocked user can't send friend requests to the user or share items with them.
+func handleBlockUser(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/blockUser" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","forUserID":"anotherTestUser"}'
+	*/
+	handleFriendshipAction(c, "handleBlockUser", func(ctx context.Context, request AddFriendRequest) error {
+		exists, err := doesUserExist(request.ForUserID)
+		if err != nil {
+			return err
 		}
-		if len(friends) == 0 {
-			fmt.Println("You have no friends added yet.")
-		} else {
-			fmt.Println("Your friends:")
-			for _, f := range friends {
-				fmt.Println("- " + f)
-			}
+
+		if !exists {
+			return errUserNotFound
 		}
-	case 3:
-		handleFriendRequestAction(db, currentUser, true)
-	case 4:
-		handleFriendRequestAction(db, currentUser, false)
-	default:
-		fmt.Println("Invalid choice.")
-	}
+
+		return blockUser(ctx, request.UserID, request.ForUserID)
+	})
+}
+
+// Unblocks a user that the user blocked
+func handleUnblockUser(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/unblockUser" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","forUserID":"anotherTestUser"}'
+	*/
+	handleFriendshipAction(c, "handleUnblockUser", func(ctx context.Context, request AddFriendRequest) error {
+		return removeFriendship(ctx, request.UserID, request.ForUserID, FriendStatusBlocked, false)
+	})
 }
 
-// This is the function to send friend request
-func sendFriendRequest(dbConn *sql.DB, userID, friendID string) error {
-	id, err := getNewID()
+// Returns the users that the user blocked
+func handleGetBlockedUsers(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/getBlockedUsers" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw=="}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request BasicRequest
+	err := c.BindJSON(&request)
 	if err != nil {
-		return err
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleGetBlockedUsers] Failed to decode JSON")
+		return
 	}
-	_, err = dbConn.Exec("INSERT INTO user_friends (id, userID, friendID, status, createdDate) VALUES (?, ?, ?, 'pending', ?)",
-		id.String(), userID, friendID, time.Now().Format("2006-01-02 15:04:05"))
-	return err
-}
 
-// This is the function for user to view thier friends list
-func getFriendList(dbConn *sql.DB, userID string) ([]string, error) {
-	rows, err := dbConn.Query(`
-		SELECT friendID FROM user_friends 
-		WHERE userID = ? AND status = 'accepted'
-		UNION
-		SELECT userID FROM user_friends 
-		WHERE friendID = ? AND status = 'accepted'`, userID, userID)
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
 	if err != nil {
-		return nil, err
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleGetBlockedUsers] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	rows, err := db.QueryContext(c, "SELECT userID2 FROM user_friends WHERE userID1 = ? AND request_status = 'blocked'", request.UserID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleGetBlockedUsers] DB query failed")
+		return
 	}
 	defer rows.Close()
 
-	var friends []string
+	blocked := []string{}
 	for rows.Next() {
-		var f string
-		if err := rows.Scan(&f); err != nil {
-			return nil, err
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+			log.WithField("error", err).Error("[handleGetBlockedUsers] Failed to scan row")
+			return
 		}
-		friends = append(friends, f)
+		blocked = append(blocked, userID)
 	}
-	return friends, nil
+
+	c.JSON(200, gin.H{"success": true, "blocked": blocked})
+}
+
+// Does the authentication for the endpoints that take an AddFriendRequest and only change the friendship, then it runs the action.
+// name is the function name used in the logs.
+func handleFriendshipAction(c *gin.Context, name string, action func(ctx context.Context, request AddFriendRequest) error) {
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request AddFriendRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Errorf("[%s] Failed to decode JSON", name)
+		return
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Errorf("[%s] Failed to verify token", name)
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	if request.ForUserID == "" || request.ForUserID == request.UserID {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid forUserID"})
+		return
+	}
+
+	err = action(c, request)
+	if err != nil {
+		if errors.Is(err, errFriendshipNotFound) {
+			c.JSON(404, gin.H{"success": false, "error": "No friend request or friendship found"})
+			return
+		}
+
+		if errors.Is(err, errUserNotFound) {
+			c.JSON(404, gin.H{"success": false, "error": "User does not exist"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithFields(log.Fields{"error": err, "forUserID": request.ForUserID}).Errorf("[%s] Failed to update friendship", name)
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
 }
 
-// This is the function for pending request
-func getPendingRequests(dbConn *sql.DB, userID string) ([]string, error) {
-	rows, err := dbConn.Query(`
-		SELECT userID FROM user_friends 
-		WHERE friendID = ? AND status = 'pending'`, userID)
+// Returns the pending friend requests for the user.
+// When incoming is true, it returns the requests sent to the user, otherwise it returns the ones that the user sent.
+func getPendingRequests(ctx context.Context, userID string, incoming bool) ([]FriendRequestItem, error) {
+	query := "SELECT userID1, createdDate FROM user_friends WHERE userID2 = ? AND request_status = 'pending'"
+	if !incoming {
+		query = "SELECT userID2, createdDate FROM user_friends WHERE userID1 = ? AND request_status = 'pending'"
+	}
+
+	rows, err := db.QueryContext(ctx, query, userID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var requests []string
+	// Initialize an empty array so that the json returns an empty array instead of null.
+	requests := []FriendRequestItem{}
 	for rows.Next() {
-		var sender string
-		if err := rows.Scan(&sender); err != nil {
+		var item FriendRequestItem
+		if err := rows.Scan(&item.UserID, &item.CreatedDate); err != nil {
 			return nil, err
 		}
-		requests = append(requests, sender)
+		requests = append(requests, item)
 	}
-	return requests, nil
-}
 
-// This is the function for user to accept friend request
-func acceptFriendRequest(dbConn *sql.DB, fromUserID, currentUserID string) error {
-	_, err := dbConn.Exec(`
-		UPDATE user_friends 
-		SET status = 'accepted' 
-		WHERE userID = ? AND friendID = ? AND status = 'pending'`,
-		fromUserID, currentUserID)
-	return err
+	return requests, rows.Err()
 }
 
-// This is the function for user to decline friend request
-func declineFriendRequest(dbConn *sql.DB, fromUserID, currentUserID string) error {
-	_, err := dbConn.Exec(`
-		DELETE FROM user_friends 
-		WHERE userID = ? AND friendID = ? AND status = 'pending'`,
-		fromUserID, currentUserID)
-	return err
+// Returns the friendshipID of the row from fromUserID to toUserID with the status.
+// If there is none, it returns errFriendshipNotFound.
+func getFriendshipID(ctx context.Context, fromUserID, toUserID, status string) (string, error) {
+	var friendshipID string
+	err := db.QueryRowContext(ctx, "SELECT friendshipID FROM user_friends WHERE userID1 = ? AND userID2 = ? AND request_status = ?", fromUserID, toUserID, status).Scan(&friendshipID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", errFriendshipNotFound
+		}
+		return "", err
+	}
+	return friendshipID, nil
 }
 
-// This is the function that handles a suer's friend requests
-func handleFriendRequestAction(dbConn *sql.DB, currentUser string, accept bool) {
-	requests, err := getPendingRequests(dbConn, currentUser)
+// Removes the row with the status from fromUserID to toUserID.
+// When eitherDirection is true, the row from toUserID to fromUserID is also removed. Used for friendships since it doesn't matter who sent the request.
+// If nothing was removed, it returns errFriendshipNotFound.
+func removeFriendship(ctx context.Context, fromUserID, toUserID, status string, eitherDirection bool) error {
+	query := "DELETE FROM user_friends WHERE userID1 = ? AND userID2 = ? AND request_status = ?"
+	args := []any{fromUserID, toUserID, status}
+	if eitherDirection {
+		query = "DELETE FROM user_friends WHERE ((userID1 = ? AND userID2 = ?) OR (userID1 = ? AND userID2 = ?)) AND request_status = ?"
+		args = []any{fromUserID, toUserID, toUserID, fromUserID, status}
+	}
+
+	res, err := db.ExecContext(ctx, query, args...)
 	if err != nil {
-		log.Println("Error retrieving requests:", err)
-		return
+		return err
 	}
-	if len(requests) == 0 {
-		fmt.Println("No pending friend requests.")
-		return
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
 	}
 
-	fmt.Println("Pending friend requests:")
-	for i, r := range requests {
-		fmt.Printf("%d. %s\n", i+1, r)
+	if n == 0 {
+		return errFriendshipNotFound
 	}
-	var selection int
-	fmt.Print("Enter the number of the request to process: ")
-	fmt.Scanln(&selection)
 
-	if selection < 1 || selection > len(requests) {
-		fmt.Println("Invalid selection.")
-		return
+	return nil
+}
+
+// Replaces any friendship or request between the users with a block from userID to blockedUserID
+func blockUser(ctx context.Context, userID, blockedUserID string) error {
+	friendshipID, err := getNewID()
+	if err != nil {
+		return fmt.Errorf("failed to get a new ID. %w", err)
 	}
 
-	fromUser := requests[selection-1]
-	if accept {
-		err = acceptFriendRequest(dbConn, fromUser, currentUser)
-		if err == nil {
-			fmt.Println("Friend request accepted.")
-		}
-	} else {
-		err = declineFriendRequest(dbConn, fromUser, currentUser)
-		if err == nil {
-			fmt.Println("Friend request declined.")
-		}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
+
+	// If the other user already blocked the user, that block is kept
+	_, err = tx.ExecContext(ctx, "DELETE FROM user_friends WHERE ((userID1 = ? AND userID2 = ?) OR (userID1 = ? AND userID2 = ? AND request_status != 'blocked'))", userID, blockedUserID, blockedUserID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to remove the friendship. %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO user_friends (friendshipID, userID1, userID2, request_status, createdDate) VALUES (?, ?, ?, 'blocked', now())", friendshipID, userID, blockedUserID)
 	if err != nil {
-		log.Println("Error processing request:", err)
+		return fmt.Errorf("failed to insert the block. %w", err)
 	}
+
+	return tx.Commit()
+}
+
+// Returns true if blockerUserID blocked userID
+func isBlockedBy(ctx context.Context, userID, blockerUserID string) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM user_friends WHERE userID1 = ? AND userID2 = ? AND request_status = 'blocked'", blockerUserID, userID).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// A pending friend request
+type FriendRequestItem struct {
+	// The user that sent the request or that it was sent to
+	UserID      string    `json:"userID"`
+	CreatedDate time.Time `json:"createdDate"`
 }
@@ -0,0 +1,696 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Group not found in the userGroups table error
+	errGroupNotFound error = errors.New("group not found")
+)
+
+const (
+	// The maximum length of a group name in characters
+	MaxGroupNameLength = 50
+)
+
+func handleCreateGroup(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/createGroup" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","name": "Team", "members": ["anotherTestUser"]}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request CreateGroupRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleCreateGroup] Failed to decode JSON")
+		return
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleCreateGroup] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || utf8.RuneCountInString(request.Name) > MaxGroupNameLength {
+		c.JSON(400, gin.H{"success": false, "error": fmt.Sprintf("The group name must be between 1 and %d characters", MaxGroupNameLength)})
+		return
+	}
+
+	// The members have to accept items from the owner since the group is used to share with them
+	refused, err := checkShareRecipients(c, request.UserID, request.Members)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleCreateGroup] Failed to check the members")
+		return
+	}
+
+	if len(refused) > 0 {
+		c.JSON(403, gin.H{"success": false, "error": "Some of the users can't be added to the group", "refused": refused})
+		return
+	}
+
+	groupID, err := getNewID()
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+		log.WithField("error", err).Error("[handleCreateGroup] Failed to get new ID")
+		return
+	}
+
+	// The owner is also a member so that they get access to the items that other members share with the group
+	err = createGroup(c, groupID.String(), request.Name, request.UserID, append([]string{request.UserID}, request.Members...))
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"})
+		log.WithField("error", err).Error("[handleCreateGroup] Failed to create group")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "groupID": groupID.String()})
+}
+
+// Returns the groups that the user owns or is a member of
+func handleGetGroups(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/getGroups" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw=="}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request BasicRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleGetGroups] Failed to decode JSON")
+		return
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleGetGroups] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	groups, err := getGroupsForUser(c, request.UserID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleGetGroups] Failed to get groups")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "groups": groups})
+}
+
+func handleAddGroupMembers(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/addGroupMembers" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","groupID": "0196a4c2-1b7e-7d3a-9f55-3b2c9e0a1d42", "members": ["anotherTestUser"]}'
+	*/
+	handleGroupMembersChange(c, "handleAddGroupMembers", true)
+}
+
+func handleRemoveGroupMembers(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/removeGroupMembers" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","groupID": "0196a4c2-1b7e-7d3a-9f55-3b2c9e0a1d42", "members": ["anotherTestUser"]}'
+	*/
+	handleGroupMembersChange(c, "handleRemoveGroupMembers", false)
+}
+
+// Deletes a group. The items shared with the group stop being shared with its members
+func handleDeleteGroup(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/deleteGroup" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","groupID": "0196a4c2-1b7e-7d3a-9f55-3b2c9e0a1d42"}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request GroupMembersRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleDeleteGroup] Failed to decode JSON")
+		return
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleDeleteGroup] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	owner, err := getGroupOwner(c, request.GroupID)
+	if err != nil {
+		if errors.Is(err, errGroupNotFound) {
+			c.JSON(404, gin.H{"success": false, "error": "Group not found"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleDeleteGroup] Failed to get group owner")
+		return
+	}
+
+	if owner != request.UserID {
+		c.JSON(403, gin.H{"success": false, "error": "Only the owner of the group can delete it"})
+		return
+	}
+
+	// Get the folders before the shares are removed with the group so that their keys can be re-wrapped
+	folders, err := getSharedFoldersWithKeys(c, request.GroupID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+		log.WithField("error", err).Error("[handleDeleteGroup] Failed to get the group's folders")
+		return
+	}
+
+	// members and shares are deleted with ON DELETE CASCADE
+	_, err = db.ExecContext(c, "DELETE FROM userGroups WHERE id = ?", request.GroupID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"})
+		log.WithField("error", err).Error("[handleDeleteGroup] Failed to delete group")
+		return
+	}
+
+	requestFolderKeyRewrap(c, request.GroupID, folders)
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// Returns the public keys that a folder key has to be encrypted with. I.E., the folder owner and every user with access to the folder.
+// Used by the clients to re-wrap a folder key after a "folderKeyRewrap" alert.
+func handleGetFolderKeyRecipients(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/getFolderKeyRecipients" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","folderID": "0195f78c-2487-75e7-b611-127b303d1e9e"}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request GetFolderKeyRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleGetFolderKeyRecipients] Failed to decode JSON")
+		return
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleGetFolderKeyRecipients] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	perm, err := getFolderPermission(c, request.FolderID, request.UserID, true)
+	if err != nil {
+		if errors.Is(err, errDirNotFound) {
+			c.JSON(400, gin.H{"success": false, "error": "Directory doesn't exist"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleGetFolderKeyRecipients] Failed to get folder permission")
+		return
+	}
+
+	if perm == "" {
+		c.JSON(403, gin.H{"success": false, "error": "Operation not allowed"})
+		return
+	}
+
+	userIDs, err := getFolderKeyRecipients(c, request.FolderID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+		log.WithField("error", err).Error("[handleGetFolderKeyRecipients] Failed to get recipients")
+		return
+	}
+
+	recipients := []FolderKeyRecipient{}
+	for _, userID := range userIDs {
+		publicKeys, err := getActivePublicKeysForUser(c, userID)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "userID": userID}).Error("[handleGetFolderKeyRecipients] Failed to get public keys")
+			continue
+		}
+
+		// One entry for each of the user's devices
+		for _, publicKey := range publicKeys {
+			recipients = append(recipients, FolderKeyRecipient{UserID: userID, PublicKey: publicKey})
+		}
+	}
+
+	c.JSON(200, gin.H{"success": true, "recipients": recipients})
+}
+
+// Adds or removes group members. Only the owner can do it.
+// add is true to add the members and false to remove them.
+func handleGroupMembersChange(c *gin.Context, name string, add bool) {
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
+
+	var request GroupMembersRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Errorf("[%s] Failed to decode JSON", name)
+		return
+	}
+
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Errorf("[%s] Failed to verify token", name)
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	if len(request.Members) == 0 {
+		c.JSON(400, gin.H{"success": false, "error": "Members Missing"})
+		return
+	}
+
+	owner, err := getGroupOwner(c, request.GroupID)
+	if err != nil {
+		if errors.Is(err, errGroupNotFound) {
+			c.JSON(404, gin.H{"success": false, "error": "Group not found"})
+			return
+		}
+
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Errorf("[%s] Failed to get group owner", name)
+		return
+	}
+
+	if owner != request.UserID {
+		c.JSON(403, gin.H{"success": false, "error": "Only the owner of the group can change its members"})
+		return
+	}
+
+	if add {
+		refused, err := checkShareRecipients(c, request.UserID, request.Members)
+		if err != nil {
+			c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (3), Please try again later"})
+			log.WithField("error", err).Errorf("[%s] Failed to check the members", name)
+			return
+		}
+
+		if len(refused) > 0 {
+			c.JSON(403, gin.H{"success": false, "error": "Some of the users can't be added to the group", "refused": refused})
+			return
+		}
+
+		err = addGroupMembers(c, request.GroupID, request.Members)
+	} else {
+		if slices.Contains(request.Members, owner) {
+			c.JSON(400, gin.H{"success": false, "error": "The owner can't be removed from the group"})
+			return
+		}
+
+		err = removeGroupMembers(c, request.GroupID, request.Members)
+	}
+
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (4), Please try again later"})
+		log.WithFields(log.Fields{"error": err, "groupID": request.GroupID}).Errorf("[%s] Failed to change members", name)
+		return
+	}
+
+	folders, err := getSharedFoldersWithKeys(c, request.GroupID)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "groupID": request.GroupID}).Errorf("[%s] Failed to get the group's folders", name)
+	} else {
+		requestFolderKeyRewrap(c, request.GroupID, folders)
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// Creates a group with the members. The members should include the owner
+func createGroup(ctx context.Context, groupID, name, ownerUserID string, members []string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO userGroups (id, name, ownerUserID, createdDate) VALUES (?, ?, ?, now())", groupID, name, ownerUserID)
+	if err != nil {
+		return fmt.Errorf("failed to insert group. %w", err)
+	}
+
+	for _, member := range members {
+		_, err = tx.ExecContext(ctx, "INSERT IGNORE INTO userGroupMembers (groupID, userID, createdDate) VALUES (?, ?, now())", groupID, member)
+		if err != nil {
+			return fmt.Errorf("failed to insert member %s. %w", member, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func addGroupMembers(ctx context.Context, groupID string, members []string) error {
+	for _, member := range members {
+		_, err := db.ExecContext(ctx, "INSERT IGNORE INTO userGroupMembers (groupID, userID, createdDate) VALUES (?, ?, now())", groupID, member)
+		if err != nil {
+			return fmt.Errorf("failed to insert member %s. %w", member, err)
+		}
+	}
+	return nil
+}
+
+func removeGroupMembers(ctx context.Context, groupID string, members []string) error {
+	for _, member := range members {
+		_, err := db.ExecContext(ctx, "DELETE FROM userGroupMembers WHERE groupID = ? AND userID = ?", groupID, member)
+		if err != nil {
+			return fmt.Errorf("failed to remove member %s. %w", member, err)
+		}
+	}
+	return nil
+}
+
+// Returns the owner of the group. If it doesn't exist, it returns errGroupNotFound
+func getGroupOwner(ctx context.Context, groupID string) (string, error) {
+	var owner string
+	err := db.QueryRowContext(ctx, "SELECT ownerUserID FROM userGroups WHERE id = ?", groupID).Scan(&owner)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", errGroupNotFound
+		}
+		return "", err
+	}
+	return owner, nil
+}
+
+func getGroupMembers(ctx context.Context, groupID string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT userID FROM userGroupMembers WHERE groupID = ? ORDER BY userID", groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []string{}
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		members = append(members, userID)
+	}
+	return members, rows.Err()
+}
+
+// Returns the members of every group without duplicates
+func getMembersOfGroups(ctx context.Context, groupIDs []string) ([]string, error) {
+	members := []string{}
+	for _, groupID := range groupIDs {
+		groupMembers, err := getGroupMembers(ctx, groupID)
+		if err != nil {
+			return nil, fmt.Errorf("getGroupMembers error for group %s. %w", groupID, err)
+		}
+
+		for _, member := range groupMembers {
+			if !slices.Contains(members, member) {
+				members = append(members, member)
+			}
+		}
+	}
+	return members, nil
+}
+
+func isGroupMember(ctx context.Context, groupID, userID string) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM userGroupMembers WHERE groupID = ? AND userID = ?", groupID, userID).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// Returns the groups that the user is a member of, with their members
+func getGroupsForUser(ctx context.Context, userID string) ([]Group, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT g.id, g.name, g.ownerUserID
+		FROM userGroups g
+		INNER JOIN userGroupMembers m ON g.id = m.groupID
+		WHERE m.userID = ?
+		ORDER BY g.name, g.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Initialize an empty array so that the json returns an empty array instead of null.
+	groups := []Group{}
+	for rows.Next() {
+		var group Group
+		if err := rows.Scan(&group.ID, &group.Name, &group.OwnerUserID); err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range groups {
+		groups[i].Members, err = getGroupMembers(ctx, groups[i].ID)
+		if err != nil {
+			return nil, fmt.Errorf("getGroupMembers error for group %s. %w", groups[i].ID, err)
+		}
+	}
+
+	return groups, nil
+}
+
+// Checks that the user can share items with each group and returns the members that the sharing policies refused.
+// A user can share with the groups that they are a member of.
+func checkShareGroups(ctx context.Context, userID string, groupIDs []string) ([]RefusedRecipient, error) {
+	refused := []RefusedRecipient{}
+	for _, groupID := range groupIDs {
+		member, err := isGroupMember(ctx, groupID, userID)
+		if err != nil {
+			return nil, fmt.Errorf("isGroupMember error for group %s. %w", groupID, err)
+		}
+
+		if !member {
+			refused = append(refused, RefusedRecipient{UserID: groupID, Error: "You are not a member of this group"})
+			continue
+		}
+
+		members, err := getGroupMembers(ctx, groupID)
+		if err != nil {
+			return nil, fmt.Errorf("getGroupMembers error for group %s. %w", groupID, err)
+		}
+
+		members = slices.DeleteFunc(members, func(m string) bool { return m == userID })
+		groupRefused, err := checkShareRecipients(ctx, userID, members)
+		if err != nil {
+			return nil, err
+		}
+		refused = append(refused, groupRefused...)
+	}
+	return refused, nil
+}
+
+// Shares the item with the groups. If it is already shared with a group, the permission is changed.
+// It returns the IDs of the new shares, the groups that already had access are not included.
+func addGroupFilePermission(ctx context.Context, e execer, fileID string, groupIDs []string, fileOwner string, isReadOnly bool) ([]string, error) {
+	sharedFileGroupIDs := []string{}
+	for _, groupID := range groupIDs {
+		newID, err := getNewID()
+		if err != nil {
+			return sharedFileGroupIDs, fmt.Errorf("failed to get new ID for shared file: %w", err)
+		}
+
+		res, err := e.ExecContext(ctx, "INSERT INTO sharedFilesGroups (id, fileID, groupID, fileOwner, isReadOnly, createdDate) VALUES (?, ?, ?, ?, ?, now()) ON DUPLICATE KEY UPDATE isReadOnly = VALUES(isReadOnly), lastModified = now();", newID, fileID, groupID, fileOwner, isReadOnly)
+		if err != nil {
+			return sharedFileGroupIDs, fmt.Errorf("failed to insert shared file permission for group %s: %w", groupID, err)
+		}
+
+		// MySQL returns 1 for a new row, 2 when the existing row is updated and 0 when it doesn't change
+		n, err := res.RowsAffected()
+		if err != nil {
+			return sharedFileGroupIDs, err
+		}
+
+		if n == 1 {
+			sharedFileGroupIDs = append(sharedFileGroupIDs, newID.String())
+		}
+	}
+	return sharedFileGroupIDs, nil
+}
+
+// Checks if the fileID itself is shared with a group that the userID is a member of.
+// If more than one group has access, write permission wins.
+// It returns "read", "write", or "" for no permission.
+func queryGroupPermission(ctx context.Context, fileID, userID string) (string, error) {
+	var readOnly sql.NullBool
+	err := db.QueryRowContext(ctx, `
+		SELECT MIN(s.isReadOnly)
+		FROM sharedFilesGroups s
+		INNER JOIN userGroupMembers m ON s.groupID = m.groupID
+		WHERE s.fileID = ? AND m.userID = ?`, fileID, userID).Scan(&readOnly)
+	if err != nil {
+		return "", err
+	}
+
+	if !readOnly.Valid {
+		// No rows
+		return "", nil
+	}
+
+	if readOnly.Bool {
+		return ReadOnlyPermission, nil
+	}
+	return WritePermission, nil
+}
+
+// Returns the permissions that the groups give to their members on the fileID itself. Parent directories are not checked.
+func getGroupMembersWithFileAccess(ctx context.Context, fileID string) ([]UserFilePermission, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT m.userID, s.isReadOnly
+		FROM sharedFilesGroups s
+		INNER JOIN userGroupMembers m ON s.groupID = m.groupID
+		WHERE s.fileID = ?`, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := []UserFilePermission{}
+	for rows.Next() {
+		var userID string
+		var isReadOnly bool
+		if err := rows.Scan(&userID, &isReadOnly); err != nil {
+			return nil, err
+		}
+
+		if isReadOnly {
+			permissions = append(permissions, UserFilePermission{userID, ReadOnlyPermission})
+		} else {
+			permissions = append(permissions, UserFilePermission{userID, WritePermission})
+		}
+	}
+	return permissions, rows.Err()
+}
+
+// Returns the folders that have a folder key and are shared with the group, directly or by being inside of a shared folder.
+func getSharedFoldersWithKeys(ctx context.Context, groupID string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		WITH RECURSIVE sharedTree (id) AS (
+			SELECT fileID FROM sharedFilesGroups WHERE groupID = ?
+			UNION
+			SELECT f.id FROM files f INNER JOIN sharedTree t ON f.parentDir = t.id
+		)
+		SELECT DISTINCT k.folderID FROM encryptionKeys k INNER JOIN sharedTree t ON k.folderID = t.id`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	folders := []string{}
+	for rows.Next() {
+		var folderID string
+		if err := rows.Scan(&folderID); err != nil {
+			return nil, err
+		}
+		folders = append(folders, folderID)
+	}
+	return folders, rows.Err()
+}
+
+// Returns the owner of the folder and every user with access to it, without duplicates
+func getFolderKeyRecipients(ctx context.Context, folderID string) ([]string, error) {
+	var owner string
+	err := db.QueryRowContext(ctx, "SELECT userID FROM files WHERE id = ?", folderID).Scan(&owner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get folder owner. %w", err)
+	}
+
+	permissions, err := getUsersWithFileAccess(ctx, folderID, 0, nil)
+	if err != nil {
+		return nil, fmt.Errorf("getUsersWithFileAccess error. %w", err)
+	}
+
+	userIDs := []string{owner}
+	for _, perm := range permissions {
+		if !slices.Contains(userIDs, perm.UserID) {
+			userIDs = append(userIDs, perm.UserID)
+		}
+	}
+	return userIDs, nil
+}
+
+// The folder keys can only be decrypted by the clients, so the server can't re-wrap them itself.
+// It sends a "folderKeyRewrap" alert to the owner of each folder so that their client encrypts the folder key with the recipients from getFolderKeyRecipients and uploads it.
+// Errors are only logged since the membership change already happened.
+func requestFolderKeyRewrap(ctx context.Context, groupID string, folders []string) {
+	for _, folderID := range folders {
+		var owner string
+		err := db.QueryRowContext(ctx, "SELECT userID FROM files WHERE id = ?", folderID).Scan(&owner)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "folderID": folderID}).Error("[requestFolderKeyRewrap] Failed to get folder owner")
+			continue
+		}
+
+		// Only keep one alert per folder
+		err = removeAlertsWithData(ctx, owner, "folderKeyRewrap", folderID)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "folderID": folderID}).Error("[requestFolderKeyRewrap] Failed to remove old alert")
+		}
+
+		err = addAlert(ctx, owner, "folderKeyRewrap", groupID, folderID)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "folderID": folderID}).Error("[requestFolderKeyRewrap] Failed to add alert")
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+)
+
+const testGroupID = "0196a0b1-4f3e-7c55-9d1a-2b6c8e4f7a10"
+
+// The answers that let testUser share the folder with anotherTestUser and the group
+func shareDirectoryResponses(existingShare []driver.Value) []fakeResponse {
+	responses := []fakeResponse{
+		{match: "select userID from files where id=? AND type='folder'", columns: []string{"userID"}, rows: [][]driver.Value{{"testUser"}}},
+		{match: "SELECT organizationID FROM users", columns: []string{"organizationID"}, rows: [][]driver.Value{{nil}}},
+		{match: "SELECT sharingPolicy, organizationID FROM users", columns: []string{"sharingPolicy", "organizationID"}, rows: [][]driver.Value{{SharingPolicyAnyone, nil}}},
+		{match: "request_status = 'blocked'", columns: []string{"count"}, rows: [][]driver.Value{{0}}},
+		{match: "SELECT COUNT(*) FROM userGroupMembers", columns: []string{"count"}, rows: [][]driver.Value{{1}}},
+		{match: "SELECT userID FROM userGroupMembers", columns: []string{"userID"}, rows: [][]driver.Value{{"testUser"}, {"anotherTestUser"}}},
+	}
+	if existingShare != nil {
+		responses = append(responses, fakeResponse{match: "select id, isReadOnly from sharedFiles", columns: []string{"id", "isReadOnly"}, rows: [][]driver.Value{existingShare}})
+	}
+	return responses
+}
+
+func TestShareDirectoryWithGroup(t *testing.T) {
+	// An empty folder without a folder key, so there is nothing to re-encrypt
+	responses := append(shareDirectoryResponses(nil), fakeResponse{match: "SELECT f.type, k.folderID IS NOT NULL FROM files f", columns: []string{"type", "hasFolderKey"}, rows: [][]driver.Value{{"folder", false}}})
+	fake := useFakeDB(t, responses...)
+
+	request := ShareDirectoryRequest{UserID: "testUser", DirID: "0196a0b1-4f3e-7c55-9d1a-2b6c8e4f7a11", WithUserID: []string{"anotherTestUser"}, WithGroupID: []string{testGroupID}}
+	status, response := shareDirectory(context.Background(), request)
+	if status != 200 {
+		t.Fatalf("shareDirectory() = %d %v, want 200", status, response)
+	}
+
+	if calls := fake.callsMatching("INSERT INTO sharedFilesGroups"); len(calls) != 1 || calls[0].args[2] != testGroupID {
+		t.Errorf("got group shares %v, want one for %s", calls, testGroupID)
+	}
+	if calls := fake.callsMatching("INSERT INTO sharedFiles ("); len(calls) != 1 || calls[0].args[2] != "anotherTestUser" {
+		t.Errorf("got user shares %v, want one for anotherTestUser", calls)
+	}
+	if calls := fake.callsMatching("UPDATE sharedFiles SET processed = true"); len(calls) != 1 {
+		t.Errorf("got %d processed updates, want the share to be processed right away", len(calls))
+	}
+	if fake.commits != 1 {
+		t.Errorf("got %d commits, want the shares to be added in 1 transaction", fake.commits)
+	}
+}
+
+func TestShareDirectoryRefusedDoesNotShareWithGroup(t *testing.T) {
+	// anotherTestUser already has write permission, so the request is refused after the group was checked
+	fake := useFakeDB(t, shareDirectoryResponses([]driver.Value{"0196a0b1-4f3e-7c55-9d1a-2b6c8e4f7a12", false})...)
+
+	request := ShareDirectoryRequest{UserID: "testUser", DirID: "0196a0b1-4f3e-7c55-9d1a-2b6c8e4f7a11", WithUserID: []string{"anotherTestUser"}, WithGroupID: []string{testGroupID}}
+	status, response := shareDirectory(context.Background(), request)
+	if status != 400 {
+		t.Fatalf("shareDirectory() = %d %v, want 400", status, response)
+	}
+
+	if calls := fake.callsMatching("INSERT INTO sharedFilesGroups"); len(calls) != 0 {
+		t.Errorf("a refused request shared the folder with the group: %v", calls)
+	}
+	if fake.commits != 0 {
+		t.Errorf("got %d commits, want none", fake.commits)
+	}
+}
+
+func TestCheckShareGroupsNotMember(t *testing.T) {
+	useFakeDB(t, fakeResponse{match: "SELECT COUNT(*) FROM userGroupMembers", columns: []string{"count"}, rows: [][]driver.Value{{0}}})
+
+	refused, err := checkShareGroups(context.Background(), "testUser", []string{testGroupID})
+	if err != nil {
+		t.Fatalf("checkShareGroups() returned %v", err)
+	}
+	if len(refused) != 1 || refused[0].UserID != testGroupID {
+		t.Errorf("checkShareGroups() = %v, want the group to be refused", refused)
+	}
+}
@@ -1,48 +1,143 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 )
 
-/*
-// This is the main function to test the user search function
-func testUserSearch() {
-	db.InitDB()
-	defer db.DB.Close()
+const (
+	FriendshipNone    = "none"
+	FriendshipPending = "pending"
+	FriendshipFriends = "friends"
+	FriendshipBlocked = "blocked"
+)
 
-	var userID string
-	fmt.Print("Enter userID to search: ")
-	fmt.Scanln(&userID)
+func handleSearchUsers(c *gin.Context) {
+	/*
+		curl -X POST "localhost:9090/searchUsers" -H 'Content-Type: application/json' -d '{"userID":"testUser","authToken":"K1xS9ehuxeC5tw==","query": "another"}'
+	*/
+	if c.Request.Body == nil {
+		c.JSON(400, gin.H{"success": false, "error": "No data received"})
+		return
+	}
 
-	user, err := userSearch(db.DB, userID)
+	var request SearchUsersRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
+		log.WithField("error", err).Error("[handleSearchUsers] Failed to decode JSON")
+		return
+	}
+
+	// verify that the token is valid
+	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
 	if err != nil {
-		log.Println("User not found or error: ", err)
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
+		log.WithField("error", err).Error("[handleSearchUsers] Failed to verify token")
+		return
+	}
+
+	if !valid {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
+		return
+	}
+
+	if strings.TrimSpace(request.Query) == "" {
+		c.JSON(400, gin.H{"success": false, "error": "Query Missing"})
+		return
+	}
+
+	if request.Page < 0 || request.PageSize < 0 {
+		c.JSON(400, gin.H{"success": false, "error": "Invalid search parameters"})
 		return
 	}
 
-	fmt.Printf("\nUser Found:\n- userID: %s\n- Email: %s\n- Role: %s\n- Created: %s\n",
-		user.UserID, user.Email, user.RoleID, user.Created)
+	if request.PageSize == 0 {
+		request.PageSize = DefaultSearchPageSize
+	}
+
+	if request.PageSize > MaxSearchPageSize {
+		request.PageSize = MaxSearchPageSize
+	}
+
+	results, hasMore, err := searchUsers(c, request)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleSearchUsers] Failed to search users")
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "results": results, "page": request.Page, "pageSize": request.PageSize, "hasMore": hasMore})
 }
-*/
 
-// This function looks for the userID through queries
-func userSearch(conn *sql.DB, userID string) (*User, error) {
+// Searches the users whose userID, or a word of their display name, starts with the query.
+// Users that blocked the searcher are never returned, and users that are not discoverable are only returned if they have a friendship or request with the searcher.
+// It returns one page of results and true if there are more pages after it.
+func searchUsers(ctx context.Context, request SearchUsersRequest) ([]SearchUsersResult, bool, error) {
+	pattern := searchPattern(request.Query, true)
+
+	// There is at most one user_friends row per pair of users, except when both blocked each other, and those are skipped anyway
 	query := `
-		SELECT userID, email, roleID, createdDate
-		FROM users
-		WHERE userID = ?
-	`
+		SELECT u.userID, IFNULL(u.displayName, ''), IFNULL(f.request_status, '')
+		FROM users u
+		LEFT JOIN user_friends f ON (f.userID1 = ? AND f.userID2 = u.userID) OR (f.userID1 = u.userID AND f.userID2 = ?)
+		WHERE u.userID != ?
+			AND (LOWER(u.userID) LIKE ? ESCAPE '\\' OR LOWER(IFNULL(u.displayName, '')) LIKE ? ESCAPE '\\' OR LOWER(IFNULL(u.displayName, '')) LIKE ? ESCAPE '\\')
+			AND NOT EXISTS (SELECT 1 FROM user_friends b WHERE b.userID1 = u.userID AND b.userID2 = ? AND b.request_status = 'blocked')
+			AND (u.discoverable OR f.request_status IN ('pending', 'accepted', 'blocked'))
+		ORDER BY u.userID LIMIT ? OFFSET ?`
+
+	// Get one extra row to know if there is another page
+	rows, err := db.QueryContext(ctx, query, request.UserID, request.UserID, request.UserID, pattern, pattern, "% "+pattern, request.UserID, request.PageSize+1, request.Page*request.PageSize)
+	if err != nil {
+		return nil, false, fmt.Errorf("db query error. %w", err)
+	}
 
-	var u User
-	err := conn.QueryRow(query, userID).Scan(&u.UserID, &u.Email, &u.RoleID, &u.Created)
+	defer rows.Close()
+
+	// Initialize an empty array so that the json returns an empty array instead of null.
+	results := []SearchUsersResult{}
+	for rows.Next() {
+		var result SearchUsersResult
+		var status string
+		err := rows.Scan(&result.UserID, &result.DisplayName, &status)
+		if err != nil {
+			return nil, false, fmt.Errorf("rows.Scan error. %w", err)
+		}
+		result.Friendship = friendshipState(status)
+		results = append(results, result)
+	}
+
+	err = rows.Err()
 	if err != nil {
-		return nil, err
+		return nil, false, fmt.Errorf("rows error. %w", err)
 	}
 
-	return &u, nil
+	if len(results) > request.PageSize {
+		return results[:request.PageSize], true, nil
+	}
+
+	return results, false, nil
+}
+
+// Converts the request_status of the user_friends table into the friendship state returned to the client.
+// A declined request, or no row at all, is "none".
+func friendshipState(requestStatus string) string {
+	switch strings.ToLower(requestStatus) {
+	case FriendStatusPending:
+		return FriendshipPending
+	case FriendStatusAccepted:
+		return FriendshipFriends
+	case FriendStatusBlocked:
+		return FriendshipBlocked
+	default:
+		return FriendshipNone
+	}
 }
 
 func handleGetFriends(c *gin.Context) {
@@ -100,57 +195,6 @@ func handleGetFriends(c *gin.Context) {
 	c.JSON(200, gin.H{"success": true, "friends": friendIDs})
 }
 
-/*
-func handleGetPendingFriendRequests(c *gin.Context) {
-	if c.Request.Body == nil {
-		c.JSON(400, gin.H{"success": false, "error": "No data received"})
-		return
-	}
-
-	var request AddFriendRequest
-	err := c.BindJSON(&request)
-	if err != nil {
-		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (0), Please try again later"})
-		log.WithField("error", err).Error("[handleGetPendingFriendRequests] Failed to decode JSON")
-		return
-	}
-
-	valid, err := isAuthTokenValid(c, request.UserID, request.AuthToken)
-	if err != nil {
-		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (1), Please try again later"})
-		log.WithField("error", err).Error("[handleGetPendingFriendRequests] Failed to verify token")
-		return
-	}
-	if !valid {
-		c.JSON(400, gin.H{"success": false, "error": "Invalid Credentials"})
-		return
-	}
-
-	rows, err := db.Query(`
-		SELECT userID1
-		FROM user_friends
-		WHERE userID2 = ? AND request_status = 'pending'
-	`, request.UserID)
-	if err != nil {
-		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
-		log.WithField("error", err).Error("[handleGetPendingFriendRequests] Failed to query pending requests")
-		return
-	}
-	defer rows.Close()
-
-	var pendingUsers []string
-	for rows.Next() {
-		var userID1 string
-		if err := rows.Scan(&userID1); err != nil {
-			log.WithField("error", err).Error("[handleGetPendingFriendRequests] Failed to scan row")
-			continue
-		}
-		pendingUsers = append(pendingUsers, userID1)
-	}
-
-	c.JSON(200, gin.H{"success": true, "pendingRequests": pendingUsers})
-}*/
-
 func handleAddFriends(c *gin.Context) {
 	if c.Request.Body == nil {
 		c.JSON(400, gin.H{"success": false, "error": "No data received"})
@@ -195,6 +239,19 @@ func handleAddFriends(c *gin.Context) {
 		return
 	}
 
+	// A user that was blocked can't send friend requests to the user that blocked them
+	blocked, err := isBlockedBy(c, request.UserID, request.ForUserID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Internal Server Error (2), Please try again later"})
+		log.WithField("error", err).Error("[handleAddFriends] Failed to check if the user is blocked")
+		return
+	}
+
+	if blocked {
+		c.JSON(403, gin.H{"success": false, "error": "You can't send a friend request to this user"})
+		return
+	}
+
 	// Check if a friendship already exists
 	var count int
 	err = db.QueryRow("SELECT COUNT(*) FROM user_friends WHERE (userID1 = ? AND userID2 = ?) OR (userID1 = ? AND userID2 = ?)", request.UserID, request.ForUserID, request.ForUserID, request.UserID).Scan(&count)
@@ -248,6 +305,16 @@ func doesUserExist(userID string) (bool, error) {
 	return count > 0, nil
 }
 
+// Returns true if the users have an accepted friend request between them
+func areFriends(ctx context.Context, userID, otherUserID string) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM user_friends WHERE ((userID1 = ? AND userID2 = ?) OR (userID1 = ? AND userID2 = ?)) AND request_status = 'accepted'", userID, otherUserID, otherUserID, userID).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
 func handleAcceptFriendRequest(c *gin.Context) {
 	if c.Request.Body == nil {
 		c.JSON(400, gin.H{"success": false, "error": "No data received"})
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFriendshipState(t *testing.T) {
+	items := map[string]string{"": FriendshipNone, "pending": FriendshipPending, "Pending": FriendshipPending, "accepted": FriendshipFriends, "declined": FriendshipNone, "blocked": FriendshipBlocked}
+
+	for key, value := range items {
+		result := friendshipState(key)
+		if result != value {
+			t.Errorf("friendshipState failed for value '%s'. Expected: '%s' got: '%s'", key, value, result)
+		}
+	}
+}